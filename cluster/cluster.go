@@ -4,9 +4,15 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
+	"log"
+	"net"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
-	"net"
+
 	"github.com/costela/wesher/common"
 	"github.com/hashicorp/memberlist"
 	"github.com/mattn/go-isatty"
@@ -17,20 +23,79 @@ import (
 // KeyLen is the fixed length of cluster keys, must be checked by callers
 const KeyLen = 32
 
+var errUnresolved = errors.New("could not resolve")
+
+// maxCoalesceFactor bounds the time events are coalesced, relative to the update delay
+const maxCoalesceFactor = 10
+
 // Cluster represents a running cluster configuration
 type Cluster struct {
-	name      string
-	ml        *memberlist.Memberlist
-	mlConfig  *memberlist.Config
-	localNode *common.Node
-	LocalName string
-	state     *state
-	events    chan memberlist.NodeEvent
+	// accessed atomically; first for 64-bit alignment on 32-bit platforms
+	lastPushPull int64 // unix nanoseconds
+	joinAttempts uint64
+	joinFailures uint64
+
+	name       string
+	bindDevice string
+	shared     SharedSocket  // sending and receiving gossip packets, if shared with wireguard
+	overlay    *overlayAddrs // with gossip over the overlay network, see SetOverlayAddrs
+	mlLock     sync.RWMutex
+	ml         *memberlist.Memberlist
+	mlConfig   *memberlist.Config
+	localNode  *common.Node
+	nameLock   sync.RWMutex
+	localName  string
+	// UpdateDelay is the time to wait for further events after an event before pushing the node list, so bursts like
+	// rolling restarts result in a single update; 0 pushes an update for every event.
+	UpdateDelay time.Duration
+	// NoState disables keeping and persisting the known nodes, saving memory and writes on small devices; restarted
+	// nodes then have to be able to reach their join hosts. The cluster key is still persisted on leave.
+	NoState bool
+	// MaxStateNodes is the maximum number of nodes kept in the state, including nodes no longer members; the least
+	// recently seen nodes are evicted first. Defaults to DefaultMaxStateNodes if not positive.
+	MaxStateNodes int
+	state         *state
+	stateLock     sync.Mutex
+	events        chan memberlist.NodeEvent
+
+	overflowLock      sync.Mutex
+	overflowMeta      map[string][]byte
+	overflowRequested map[string]time.Time // complete metadata requests in flight, by node name
+
+	kv           kvStore
+	kvBroadcasts *memberlist.TransmitLimitedQueue
+
+	conflicts chan Conflict
+
+	rotateLock sync.Mutex // held during cluster key rotations
+	keyLock    sync.Mutex
+	keyAcks    chan keyAck // acknowledgements of the key being rotated to, if any
+
+	static []common.Node // members of a standalone cluster
+
+	mismatches *keyMismatches // decryption failures, see KeyMismatches
+}
+
+// Conflict describes another node claiming the name of the local node
+type Conflict struct {
+	Name      string
+	Addr      string // of the local node
+	OtherAddr string
+	// OtherStarted is the start time the other node announces, or the zero time if unknown (e.g. older versions)
+	OtherStarted time.Time
+	// OtherPubKey is the wireguard public key the other node announces, if known
+	OtherPubKey string
 }
 
 // New is used to create a new Cluster instance
 // The returned instance is ready to be updated with the local node settings then joined
-func New(name string, init bool, clusterKey []byte, bindAddr string, bindPort int, advertiseAddr string, advertisePort int, useIPAsName bool) (*Cluster, error) {
+// The local node is named nodeName, or the hostname if empty.
+// Gossip messages are compressed unless disabled; compression trades some CPU for smaller UDP packets, which cause fewer
+// fallbacks to TCP in clusters announcing many routes.
+// The push/pull interval and gossip fan-out of the memberlist WAN profile are kept unless set (see Cluster.RecommendedGossip).
+// With overlay, gossip is sent via the overlay addresses set with SetOverlayAddrs.
+// With a shared socket, gossip packets are sent and received via it instead of a socket of their own.
+func New(name string, init bool, clusterKey []byte, bindAddr string, bindPort int, bindDevice string, advertiseAddr string, advertisePort int, nodeName string, queueDepth int, compression bool, pushPullInterval time.Duration, gossipNodes int, overlay bool, shared SharedSocket) (*Cluster, error) {
 	state := &state{}
 	if !init {
 		loadState(state, name)
@@ -42,143 +107,449 @@ func New(name string, init bool, clusterKey []byte, bindAddr string, bindPort in
 	}
 
 	mlConfig := memberlist.DefaultWANConfig()
-	mlConfig.LogOutput = logrus.StandardLogger().WriterLevel(logrus.DebugLevel)
+	mismatches := newKeyMismatches(logrus.StandardLogger().WriterLevel(logrus.DebugLevel))
+	mlConfig.LogOutput = mismatches
 	mlConfig.SecretKey = clusterKey
 	mlConfig.BindAddr = bindAddr
 	mlConfig.BindPort = bindPort
 	mlConfig.AdvertiseAddr = advertiseAddr
 	mlConfig.AdvertisePort = advertisePort
-	
-	if useIPAsName && bindAddr != "0.0.0.0" {
-		mlConfig.Name = bindAddr
+	if queueDepth > 0 {
+		mlConfig.HandoffQueueDepth = queueDepth
+	}
+	mlConfig.EnableCompression = compression
+	if pushPullInterval > 0 {
+		mlConfig.PushPullInterval = pushPullInterval
+	}
+	if gossipNodes > 0 {
+		mlConfig.GossipNodes = gossipNodes
 	}
 
-	ml, err := memberlist.Create(mlConfig)
-	if err != nil {
-		return nil, fmt.Errorf("creating memberlist: %w", err)
+	if nodeName != "" {
+		mlConfig.Name = nodeName
 	}
 
 	cluster := Cluster{
-		name:      name,
-		ml:        ml,
-		mlConfig:  mlConfig,
-		LocalName: ml.LocalNode().Name,
+		name:       name,
+		bindDevice: bindDevice,
+		shared:     shared,
+		mlConfig:   mlConfig,
 		// The big channel buffer is a work-around for https://github.com/hashicorp/memberlist/issues/23
 		// More than this many simultaneous events will deadlock cluster.members()
-		events: make(chan memberlist.NodeEvent, 100),
-		state:  state,
+		events:            make(chan memberlist.NodeEvent, 100),
+		state:             state,
+		overflowMeta:      make(map[string][]byte),
+		overflowRequested: make(map[string]time.Time),
+		conflicts:         make(chan Conflict, 16),
+		mismatches:        mismatches,
+	}
+	if overlay {
+		cluster.overlay = &overlayAddrs{}
+	}
+	if err := cluster.setTransport(); err != nil {
+		return nil, fmt.Errorf("creating transport: %w", err)
+	}
+	ml, err := memberlist.Create(mlConfig)
+	if err != nil {
+		return nil, fmt.Errorf("creating memberlist: %w", err)
+	}
+	cluster.ml = ml
+	cluster.localName = ml.LocalNode().Name
+	mismatches.setNodeName(cluster.nodeNameByIP)
+	cluster.kvBroadcasts = &memberlist.TransmitLimitedQueue{
+		NumNodes:       cluster.numMembers,
+		RetransmitMult: kvRetransmitMult,
 	}
 	return &cluster, nil
 }
 
+// LocalName provides the name of the local node
+func (c *Cluster) LocalName() string {
+	c.nameLock.RLock()
+	defer c.nameLock.RUnlock()
+	return c.localName
+}
+
 // Name provides the current cluster name
 func (c *Cluster) Name() string {
 	return c.localNode.Name
 }
 
-// Join tries to join the cluster by contacting provided ips.
-// If no ip is provided, ips of known nodes are used instead.
+// Join tries to join the cluster by contacting provided hosts.
+// If no host is provided, addresses of known nodes are used instead.
+// All hosts are resolved and joined concurrently and the join is considered
+// successful as soon as any of them responds, so offline seeds at the start
+// of the list do not delay joining.
 // Only addresses that are not already members are joined.
 func (c *Cluster) Join(hosts []string) error {
-	addrs := make([]net.IP, 0, len(hosts))
+	if c.standalone() {
+		return nil
+	}
+	atomic.AddUint64(&c.joinAttempts, 1)
+	err := c.join(hosts)
+	if err != nil {
+		atomic.AddUint64(&c.joinFailures, 1)
+	}
+	return err
+}
 
-	// resolve hostnames so we are able to proerly filter out
-	// cluster members later
+// JoinStats provides the number of join attempts and failed ones
+func (c *Cluster) JoinStats() (uint64, uint64) {
+	return atomic.LoadUint64(&c.joinAttempts), atomic.LoadUint64(&c.joinFailures)
+}
+
+func (c *Cluster) join(hosts []string) error {
+	if len(hosts) == 0 {
+		hosts = c.knownHosts()
+	}
+	if len(hosts) == 0 {
+		return nil
+	}
+
+	results := make(chan error, len(hosts))
 	for _, host := range hosts {
-		if addr := net.ParseIP(host); addr != nil {
-			addrs = append(addrs, addr)
-		} else if ips, err := net.LookupIP(host); err == nil {
-			addrs = append(addrs, ips...)
+		go func(host string) {
+			results <- c.joinHost(host)
+		}(host)
+	}
+
+	var lastErr error
+	unresolved := 0
+	for range hosts {
+		err := <-results
+		if err == nil {
+			return nil
 		}
+		if errors.Is(err, errUnresolved) {
+			unresolved++
+		}
+		lastErr = err
 	}
 
-	// add known hosts if necessary
-	if len(addrs) == 0 {
-		for _, n := range c.state.Nodes {
-			addrs = append(addrs, n.Addr)
-				}
-			}
-		
-			// filter out addresses that are already members
-			targets := make([]string, 0, len(addrs))
-			members := c.ml.Members()
-		AddrLoop:
-			for _, addr := range addrs {
-				for _, member := range members {
-					if member.Addr.Equal(addr) {
-						continue AddrLoop
-					}
-				}
-				targets = append(targets, addr.String())
+	// none of the provided hosts could be resolved; try known nodes instead
+	if unresolved == len(hosts) && len(c.knownHosts()) > 0 {
+		return c.join(nil)
+	}
+	return lastErr
+}
+
+// joinHost resolves a single host and joins any of its addresses that is not
+// already a cluster member.
+// The host may carry an explicit gossip port (host:port); otherwise the local
+// cluster port is assumed.
+func (c *Cluster) joinHost(host string) error {
+	hostname, port, err := splitHostPort(host, c.mlConfig.BindPort)
+	if err != nil {
+		return err
+	}
+
+	// resolve hostnames so we are able to properly filter out
+	// cluster members later
+	addrs := []net.IP{}
+	if addr := net.ParseIP(hostname); addr != nil {
+		addrs = append(addrs, addr)
+	} else {
+		ips, err := net.LookupIP(hostname)
+		if err != nil {
+			return fmt.Errorf("%w %s: %s", errUnresolved, hostname, err)
+		}
+		addrs = append(addrs, ips...)
+	}
+
+	// filter out addresses that are already members
+	targets := make([]string, 0, len(addrs))
+	members := c.memberlist().Members()
+AddrLoop:
+	for _, addr := range addrs {
+		for _, member := range members {
+			if member.Addr.Equal(addr) && int(member.Port) == port {
+				continue AddrLoop
 			}
-		
-			// finally try and join any remaining address
-			if _, err := c.ml.Join(targets); err != nil {
-				return fmt.Errorf("joining cluster: %w", err)
-			} else if len(targets) > 0 && c.ml.NumMembers() < 2 {
+		}
+		targets = append(targets, net.JoinHostPort(addr.String(), strconv.Itoa(port)))
+	}
+	if len(targets) == 0 {
+		return nil // nothing to do, already joined
+	}
+
+	// finally try and join any remaining address
+	if _, err := c.memberlist().Join(targets); err != nil {
+		return fmt.Errorf("joining cluster via %s: %w", host, err)
+	} else if c.memberlist().NumMembers() < 2 {
 		return errors.New("could not join to any of the provided addresses")
 	}
 	return nil
 }
 
+// splitHostPort splits a join target into its host and port parts, using the
+// provided default port if none is given.
+// Bare IPv6 addresses are accepted with or without brackets.
+func splitHostPort(target string, defaultPort int) (string, int, error) {
+	if ip := net.ParseIP(strings.Trim(target, "[]")); ip != nil {
+		return ip.String(), defaultPort, nil
+	}
+	host, sport, err := net.SplitHostPort(target)
+	if err != nil {
+		// no port provided
+		return target, defaultPort, nil
+	}
+	port, err := strconv.ParseUint(sport, 10, 16)
+	if err != nil || port == 0 {
+		return "", 0, fmt.Errorf("invalid port in join address %s", target)
+	}
+	return host, int(port), nil
+}
+
+// knownHosts provides the addresses of nodes known from previous runs
+func (c *Cluster) knownHosts() []string {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	hosts := make([]string, 0, len(c.state.Nodes))
+	for _, n := range c.state.Nodes {
+		if n.Port != 0 {
+			hosts = append(hosts, net.JoinHostPort(n.Addr.String(), strconv.Itoa(int(n.Port))))
+		} else {
+			hosts = append(hosts, n.Addr.String())
+		}
+	}
+	return hosts
+}
+
+// SetAdvertiseAddr changes the address advertised to other nodes.
+// Since memberlist does not support changing the address of a running node,
+// the local memberlist instance is recreated and the current members are
+// joined again, waiting at most leaveTimeout for the previous instance to leave.
+func (c *Cluster) SetAdvertiseAddr(addr string, leaveTimeout time.Duration) error {
+	c.mlLock.RLock()
+	unchanged := c.mlConfig.AdvertiseAddr == addr
+	c.mlLock.RUnlock()
+	if unchanged {
+		return nil
+	}
+	return c.recreate(func() { c.mlConfig.AdvertiseAddr = addr }, leaveTimeout)
+}
+
+// Rename changes the name of the local node
+// Like SetAdvertiseAddr, the local memberlist instance is recreated and the current members are joined again.
+func (c *Cluster) Rename(name string, leaveTimeout time.Duration) error {
+	c.mlLock.RLock()
+	unchanged := c.mlConfig.Name == name
+	c.mlLock.RUnlock()
+	if unchanged {
+		return nil
+	}
+	c.nameLock.Lock()
+	c.localName = name
+	c.nameLock.Unlock()
+	return c.recreate(func() { c.mlConfig.Name = name }, leaveTimeout)
+}
+
+// recreate leaves and recreates the memberlist instance with the configuration changed by change, then joins the
+// current members again
+// The previous instance leaves without holding mlLock, since the leave waits up to leaveTimeout for its broadcast; it
+// stays in use until replaced.
+func (c *Cluster) recreate(change func(), leaveTimeout time.Duration) error {
+	c.mlLock.Lock()
+	if c.ml == nil {
+		change() // standalone; nothing is advertised
+		c.mlLock.Unlock()
+		return nil
+	}
+	previous := c.ml
+	hosts := make([]string, 0)
+	for _, n := range previous.Members() {
+		if n.Name == previous.LocalNode().Name {
+			continue
+		}
+		hosts = append(hosts, net.JoinHostPort(n.Addr.String(), strconv.Itoa(int(n.Port))))
+	}
+	c.mlLock.Unlock()
+
+	previous.Leave(leaveTimeout)
+	previous.Shutdown() //nolint: errcheck
+
+	c.mlLock.Lock()
+	change()
+	if err := c.setTransport(); err != nil {
+		c.mlLock.Unlock()
+		return fmt.Errorf("recreating transport: %w", err)
+	}
+	ml, err := memberlist.Create(c.mlConfig)
+	if err != nil {
+		c.mlLock.Unlock()
+		return fmt.Errorf("recreating memberlist: %w", err)
+	}
+	c.ml = ml
+	c.mlLock.Unlock()
+
+	return c.Join(hosts)
+}
+
+// setTransport sets the memberlist transport needed for the bind device or gossip over the overlay network, replacing
+// any previous one, which must have been shut down along with its memberlist
+func (c *Cluster) setTransport() error {
+	c.mlConfig.Transport = nil
+	switch {
+	case c.bindDevice != "" || c.shared != nil:
+		transport, err := newDeviceTransport(c.bindDevice, c.mlConfig.BindAddr, c.mlConfig.BindPort, c.shared)
+		if err != nil {
+			return err
+		}
+		c.mlConfig.Transport = transport
+	case c.overlay != nil:
+		transport, err := newOverlayTransport(c.overlay, c.mlConfig.BindAddr, c.mlConfig.BindPort, log.New(c.mlConfig.LogOutput, "", log.LstdFlags))
+		if err != nil {
+			return err
+		}
+		// like memberlist does for its own transport
+		if c.mlConfig.AdvertisePort == c.mlConfig.BindPort {
+			c.mlConfig.AdvertisePort = transport.GetAutoBindPort()
+		}
+		c.mlConfig.BindPort = transport.GetAutoBindPort()
+		c.mlConfig.Transport = transport
+	}
+	return nil
+}
+
+// LocalAddr provides the address the local node is currently advertised with
+func (c *Cluster) LocalAddr() net.IP {
+	if c.standalone() {
+		return c.localAddr()
+	}
+	return c.memberlist().LocalNode().Addr
+}
+
+// Conflicts provides a channel notifying of other nodes claiming the name of the local node
+func (c *Cluster) Conflicts() <-chan Conflict {
+	return c.conflicts
+}
+
+// memberlist provides the current memberlist instance
+func (c *Cluster) memberlist() *memberlist.Memberlist {
+	c.mlLock.RLock()
+	defer c.mlLock.RUnlock()
+	return c.ml
+}
+
 // Leave saves the current state before leaving, then leaves the cluster
-func (c *Cluster) Leave() {
-	c.state.save(c.name)
-	c.ml.Leave(10 * time.Second)
-	c.ml.Shutdown() //nolint: errcheck
+// The timeout bounds the time spent waiting for the leave message to be broadcast
+func (c *Cluster) Leave(timeout time.Duration) {
+	if c.standalone() {
+		return
+	}
+	c.stateLock.Lock()
+	c.state.save(c.name) // nolint: errcheck // opportunistic; also persists the cluster key with NoState
+	c.stateLock.Unlock()
+	c.memberlist().Leave(timeout)
+	c.memberlist().Shutdown() //nolint: errcheck
 }
 
 // Update gossips the local node configuration, propagating any change
 func (c *Cluster) Update(localNode *common.Node) {
 	c.localNode = localNode
 	// wrap in a delegateNode instance for memberlist.Delegate implementation
-	delegate := &delegateNode{c.localNode}
+	delegate := &delegateNode{c.localNode, c}
 	c.mlConfig.Conflict = delegate
 	c.mlConfig.Delegate = delegate
 	c.mlConfig.Events = &memberlist.ChannelEventDelegate{Ch: c.events}
-	c.ml.UpdateNode(1 * time.Second) // we currently do not update after creation
+	if !c.standalone() {
+		c.memberlist().UpdateNode(1 * time.Second) // we currently do not update after creation
+	}
 }
 
 // Members provides a channel notifying of cluster changes
 // Everytime a change happens inside the cluster (except for local changes),
-// the updated list of cluster nodes is pushed to the channel.
+// the updated list of cluster nodes is pushed to the channel. Events happening within UpdateDelay of each other are
+// coalesced into a single update.
 func (c *Cluster) Members() <-chan []common.Node {
 	changes := make(chan []common.Node)
+	if c.standalone() {
+		go c.staticMembers(changes)
+		return changes
+	}
 	go func() {
 		for {
-			event := <-c.events
-			if event.Node.Name == c.LocalName {
-				// ignore events about ourselves
+			if !c.waitEvents(c.events, c.UpdateDelay) {
 				continue
 			}
-			switch event.Event {
-			case memberlist.NodeJoin:
-				logrus.Infof("node %s joined", event.Node)
-			case memberlist.NodeUpdate:
-				logrus.Infof("node %s updated", event.Node)
-			case memberlist.NodeLeave:
-				logrus.Infof("node %s left", event.Node)
-			}
 
-			nodes := make([]common.Node, 0)
-			for _, n := range c.ml.Members() {
-				if n.Name == c.LocalName {
+			members := c.memberlist().Members()
+			c.pruneOverflow(members)
+			nodes := make([]common.Node, 0, len(members))
+			for _, n := range members {
+				if n.Name == c.LocalName() {
 					continue
 				}
-				nodes = append(nodes, common.Node{
+				node := common.Node{
 					Name: n.Name,
 					Addr: n.Addr,
+					Port: n.Port,
 					Meta: n.Meta,
-				})
+				}
+				c.resolveOverflow(&node)
+				nodes = append(nodes, node)
 			}
-			c.state.Nodes = nodes
 			changes <- nodes
-			c.state.save(c.name) // nolint: errcheck // opportunistic
+			if !c.NoState {
+				max := c.MaxStateNodes
+				if max <= 0 {
+					max = DefaultMaxStateNodes
+				}
+				c.stateLock.Lock()
+				c.state.update(nodes, time.Now(), max)
+				c.state.save(c.name) // nolint: errcheck // opportunistic
+				c.stateLock.Unlock()
+			}
 		}
 	}()
 	return changes
 }
 
+// waitEvents blocks until at least one event arrives, then keeps consuming events until none arrived for the
+// provided delay, or for at most maxCoalesceFactor times the delay, so constant churn still produces updates.
+// It reports whether any of the events concerned another node.
+func (c *Cluster) waitEvents(events <-chan memberlist.NodeEvent, delay time.Duration) bool {
+	relevant := c.logEvent(<-events)
+	if delay <= 0 {
+		return relevant
+	}
+	deadline := time.After(maxCoalesceFactor * delay)
+	for {
+		select {
+		case event := <-events:
+			relevant = c.logEvent(event) || relevant
+		case <-time.After(delay):
+			return relevant
+		case <-deadline:
+			return relevant
+		}
+	}
+}
+
+var eventNames = map[memberlist.NodeEventType]string{
+	memberlist.NodeJoin:   "join",
+	memberlist.NodeLeave:  "leave",
+	memberlist.NodeUpdate: "update",
+}
+
+// logEvent logs the provided event, reporting whether it concerns another node
+func (c *Cluster) logEvent(event memberlist.NodeEvent) bool {
+	logrus.Tracef("gossip %s event for node %s at %s:%d, %d bytes of metadata", eventNames[event.Event], event.Node.Name, event.Node.Addr, event.Node.Port, len(event.Node.Meta))
+	if event.Node.Name == c.LocalName() {
+		// ignore events about ourselves
+		return false
+	}
+	switch event.Event {
+	case memberlist.NodeJoin:
+		logrus.Infof("node %s joined", event.Node)
+	case memberlist.NodeUpdate:
+		logrus.Infof("node %s updated", event.Node)
+	case memberlist.NodeLeave:
+		logrus.Infof("node %s left", event.Node)
+	}
+	return true
+}
+
 func computeClusterKey(state *state, clusterKey []byte) ([]byte, error) {
 	if len(clusterKey) == 0 {
 		clusterKey = state.ClusterKey
@@ -0,0 +1,168 @@
+package cluster
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/costela/wesher/common"
+	"github.com/hashicorp/memberlist"
+)
+
+func Test_splitHostPort(t *testing.T) {
+	tests := []struct {
+		name     string
+		target   string
+		wantHost string
+		wantPort int
+		wantErr  bool
+	}{
+		{"hostname without port", "seed1.example.com", "seed1.example.com", 7946, false},
+		{"hostname with port", "seed1.example.com:7847", "seed1.example.com", 7847, false},
+		{"ipv4 without port", "10.0.0.1", "10.0.0.1", 7946, false},
+		{"ipv4 with port", "10.0.0.1:7847", "10.0.0.1", 7847, false},
+		{"bare ipv6", "2001:db8::1", "2001:db8::1", 7946, false},
+		{"bracketed ipv6", "[2001:db8::1]", "2001:db8::1", 7946, false},
+		{"ipv6 with port", "[2001:db8::1]:7847", "2001:db8::1", 7847, false},
+		{"invalid port", "seed1.example.com:foo", "", 0, true},
+		{"zero port", "seed1.example.com:0", "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, port, err := splitHostPort(tt.target, 7946)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("splitHostPort() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if host != tt.wantHost || port != tt.wantPort {
+				t.Errorf("splitHostPort() = %s, %d, want %s, %d", host, port, tt.wantHost, tt.wantPort)
+			}
+		})
+	}
+}
+
+func Test_Cluster_waitEvents(t *testing.T) {
+	c := &Cluster{localName: "local"}
+	event := func(name string) memberlist.NodeEvent {
+		return memberlist.NodeEvent{Event: memberlist.NodeJoin, Node: &memberlist.Node{Name: name}}
+	}
+
+	events := make(chan memberlist.NodeEvent, 10)
+	for _, name := range []string{"a", "b", "local", "c"} {
+		events <- event(name)
+	}
+	if !c.waitEvents(events, 10*time.Millisecond) {
+		t.Error("waitEvents() = false, want true for events about other nodes")
+	}
+	if len(events) != 0 {
+		t.Errorf("waitEvents() left %d events, want all coalesced", len(events))
+	}
+
+	events <- event("local")
+	if c.waitEvents(events, 0) {
+		t.Error("waitEvents() = true, want false for events about the local node only")
+	}
+}
+
+func Test_delegateNode_NotifyConflict(t *testing.T) {
+	c := &Cluster{localName: "local", conflicts: make(chan Conflict, 1)}
+	d := &delegateNode{Node: &common.Node{}, cluster: c}
+	claimant := &common.Node{}
+	claimant.OverlayAddr = net.IPNet{IP: net.ParseIP("10.10.0.1").To4(), Mask: net.CIDRMask(32, 32)}
+	claimant.Started = 1588327200
+	meta, err := claimant.EncodeMeta(memberlist.MetaMaxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := &memberlist.Node{Name: "local", Addr: net.ParseIP("10.0.0.1"), Port: 7946}
+
+	d.NotifyConflict(node, &memberlist.Node{Name: "other", Addr: net.ParseIP("10.0.0.2"), Port: 7946})
+	if len(c.conflicts) != 0 {
+		t.Error("NotifyConflict() forwarded a conflict about another node")
+	}
+
+	d.NotifyConflict(node, &memberlist.Node{Name: "local", Addr: net.ParseIP("10.0.0.3"), Port: 7946, Meta: meta})
+	d.NotifyConflict(node, &memberlist.Node{Name: "local", Addr: net.ParseIP("10.0.0.3"), Port: 7946, Meta: meta}) // must not block
+	conflict := <-c.Conflicts()
+	want := Conflict{Name: "local", Addr: "10.0.0.1:7946", OtherAddr: "10.0.0.3:7946", OtherStarted: time.Unix(1588327200, 0)}
+	if conflict != want {
+		t.Errorf("NotifyConflict() forwarded %+v, want %+v", conflict, want)
+	}
+}
+
+func Test_NewStandalone(t *testing.T) {
+	peer := common.Node{Name: "peer", Addr: net.ParseIP("192.0.2.1")}
+	peer.OverlayAddr = net.IPNet{IP: net.ParseIP("10.0.0.2").To4(), Mask: net.CIDRMask(32, 32)}
+	peer.Meta, _ = peer.FullMeta()
+	c, err := NewStandalone("local", "192.0.2.2", []common.Node{peer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Update(&common.Node{Name: "local"})
+	if err := c.Join([]string{"192.0.2.3"}); err != nil {
+		t.Errorf("Join() error = %v, want none", err)
+	}
+	select {
+	case nodes := <-c.Members():
+		if len(nodes) != 1 || nodes[0].Name != "peer" {
+			t.Errorf("Members() = %v, want the static peer", nodes)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Members() provided no static peers")
+	}
+	if err := c.SetAdvertiseAddr("192.0.2.4", time.Second); err != nil || c.LocalAddr().String() != "192.0.2.4" {
+		t.Errorf("SetAdvertiseAddr() error = %v, LocalAddr() = %s, want 192.0.2.4", err, c.LocalAddr())
+	}
+	if conv := c.Convergence(); conv.Members != 2 {
+		t.Errorf("Convergence().Members = %d, want 2", conv.Members)
+	}
+	c.Leave(time.Second)
+}
+
+// Test_Cluster_SetAdvertiseAddr changes the address of a node, which other nodes must learn after it rejoined
+func Test_Cluster_SetAdvertiseAddr(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wesher-advertise")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(template string) { statePathTemplate = template }(statePathTemplate)
+	statePathTemplate = path.Join(dir, "%s.json")
+
+	key := bytes.Repeat([]byte{1}, KeyLen)
+	start := func(name string) *Cluster {
+		c, err := New(name, true, key, "0.0.0.0", 0, "", "127.0.0.1", 0, name, 0, true, 0, 0, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Update(&common.Node{Name: name})
+		return c
+	}
+	node1 := start("node1")
+	defer node1.Leave(time.Second)
+	node2 := start("node2")
+	defer node2.Leave(time.Second)
+	if err := node2.Join([]string{net.JoinHostPort("127.0.0.1", strconv.Itoa(node1.mlConfig.BindPort))}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := node2.SetAdvertiseAddr("127.0.0.2", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got := node2.LocalAddr(); !got.Equal(net.ParseIP("127.0.0.2")) {
+		t.Errorf("LocalAddr() = %s, want 127.0.0.2", got)
+	}
+	for i := 0; i < 100; i++ {
+		for _, n := range node1.memberlist().Members() {
+			if n.Name == "node2" && n.Addr.Equal(net.ParseIP("127.0.0.2")) {
+				return
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Errorf("node1 did not learn the new address of node2, members: %v", node1.memberlist().Members())
+}
@@ -0,0 +1,43 @@
+package cluster
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// Convergence describes the state of the gossip protocol, telling network trouble apart from a converged cluster
+type Convergence struct {
+	// HealthScore is the memberlist awareness score; 0 is healthy, higher values mean the local node has trouble
+	// reaching others in time, e.g. due to network congestion or CPU starvation
+	HealthScore int
+	Members     int // including the local node
+	Suspects    int // members suspected to have failed, but not declared dead yet
+	// LastPushPull is the time of the last complete state exchange with another node, or the zero time if none yet
+	LastPushPull time.Time
+}
+
+// Convergence provides the current state of the gossip protocol
+func (c *Cluster) Convergence() Convergence {
+	if c.standalone() {
+		return Convergence{Members: c.numMembers()}
+	}
+	ml := c.memberlist()
+	conv := Convergence{HealthScore: ml.GetHealthScore()}
+	for _, n := range ml.Members() {
+		conv.Members++
+		if n.State == memberlist.StateSuspect {
+			conv.Suspects++
+		}
+	}
+	if last := atomic.LoadInt64(&c.lastPushPull); last != 0 {
+		conv.LastPushPull = time.Unix(0, last)
+	}
+	return conv
+}
+
+// pushedPulled records a complete state exchange
+func (c *Cluster) pushedPulled(now time.Time) {
+	atomic.StoreInt64(&c.lastPushPull, now.UnixNano())
+}
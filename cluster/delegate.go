@@ -1,6 +1,10 @@
 package cluster
 
 import (
+	"net"
+	"strconv"
+	"time"
+
 	"github.com/costela/wesher/common"
 	"github.com/hashicorp/memberlist"
 	"github.com/sirupsen/logrus"
@@ -9,11 +13,30 @@ import (
 // DelegateNode implements the memberlist delegation interface
 type delegateNode struct {
 	*common.Node
+	cluster *Cluster
 }
 
 // NotifyConflict implements the memberlist.Delegate interface
+// Conflicts about the local node are forwarded to Conflicts.
 func (n *delegateNode) NotifyConflict(node, other *memberlist.Node) {
-	logrus.Errorf("node name conflict detected: %s", other.Name)
+	addr := net.JoinHostPort(node.Addr.String(), strconv.Itoa(int(node.Port)))
+	otherAddr := net.JoinHostPort(other.Addr.String(), strconv.Itoa(int(other.Port)))
+	logrus.Errorf("node name conflict detected: %s is claimed by both %s and %s; nodes must have distinct names, e.g. set via --node-name", other.Name, addr, otherAddr)
+	if other.Name != n.cluster.LocalName() {
+		return
+	}
+	conflict := Conflict{Name: other.Name, Addr: addr, OtherAddr: otherAddr}
+	claimant := common.Node{Meta: other.Meta}
+	if err := claimant.DecodeMeta(); err == nil {
+		if claimant.Started > 0 {
+			conflict.OtherStarted = time.Unix(claimant.Started, 0)
+		}
+		conflict.OtherPubKey = claimant.PubKey
+	}
+	select {
+	case n.cluster.conflicts <- conflict:
+	default: // already plenty of conflicts pending
+	}
 }
 
 // NodeMeta implements the memberlist.Delegate interface
@@ -29,13 +52,27 @@ func (n *delegateNode) NodeMeta(limit int) []byte {
 }
 
 // NotifyMsg implements the memberlist.Delegate interface
-func (n *delegateNode) NotifyMsg([]byte) {}
+// Messages are handled asynchronously, to avoid blocking memberlist
+func (n *delegateNode) NotifyMsg(msg []byte) {
+	go n.cluster.handleUserMsg(append([]byte{}, msg...)) // the buffer is not ours to keep
+}
 
 // GetBroadcasts implements the memberlist.Delegate interface
-func (n *delegateNode) GetBroadcasts(overhead, limit int) [][]byte { return nil }
+func (n *delegateNode) GetBroadcasts(overhead, limit int) [][]byte {
+	return n.cluster.kvBroadcasts.GetBroadcasts(overhead, limit)
+}
 
 // LocalState implements the memberlist.Delegate interface
-func (n *delegateNode) LocalState(join bool) []byte { return nil }
+// The key/value store is exchanged completely, so nodes converge even if they missed broadcasts.
+func (n *delegateNode) LocalState(join bool) []byte {
+	return n.cluster.kv.encode()
+}
 
 // MergeRemoteState implements the memberlist.Delegate interface
-func (n *delegateNode) MergeRemoteState(buf []byte, join bool) {}
+// It is called for every complete state exchange, which is recorded for Convergence.
+func (n *delegateNode) MergeRemoteState(buf []byte, join bool) {
+	n.cluster.pushedPulled(time.Now())
+	if len(buf) > 0 {
+		n.cluster.mergeKV(buf)
+	}
+}
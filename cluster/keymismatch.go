@@ -0,0 +1,177 @@
+package cluster
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Memberlist silently drops gossip it cannot decrypt, only logging it at debug level, so a node using a different
+// cluster key just looks unreachable. The decryption failures are picked from the memberlist log instead, and reported
+// once they repeat, since a single failure may just be a corrupted packet.
+const (
+	keyMismatchThreshold = 3                // failures within keyMismatchWindow before reporting the address
+	keyMismatchWindow    = time.Minute      // see keyMismatchThreshold
+	keyMismatchRepeat    = 10 * time.Minute // minimum time between two warnings about the same address
+	keyMismatchMaxAddrs  = 1024             // addresses tracked at once, so spoofed sources cannot exhaust memory
+)
+
+// keyMismatchPatterns match the memberlist log messages of gossip which could not be decrypted
+var keyMismatchPatterns = [][]byte{
+	[]byte("No installed keys could decrypt"),
+	[]byte("Decrypt packet failed"),
+	[]byte("Encryption is configured but remote state is not encrypted"),
+	[]byte("Remote state is encrypted and encryption is not configured"),
+}
+
+var logAddressPattern = regexp.MustCompile(`from=(\S+)`)
+
+// KeyMismatch describes an address gossip repeatedly could not be decrypted from
+type KeyMismatch struct {
+	Addr     string
+	Node     string // name of the node last known at the address, if any
+	Failures int    // within the last minute
+	Last     time.Time
+}
+
+// keyMismatches tracks decryption failures by address, as an io.Writer wrapping the memberlist log output
+type keyMismatches struct {
+	next io.Writer
+
+	lock     sync.Mutex
+	failures map[string][]time.Time // by IP address
+	warned   map[string]time.Time
+	total    uint64
+	nodeName func(ip string) string
+}
+
+func newKeyMismatches(next io.Writer) *keyMismatches {
+	return &keyMismatches{next: next, failures: make(map[string][]time.Time), warned: make(map[string]time.Time)}
+}
+
+// Write passes the log line on, recording it if it reports a decryption failure
+func (km *keyMismatches) Write(line []byte) (int, error) {
+	for _, pattern := range keyMismatchPatterns {
+		if bytes.Contains(line, pattern) {
+			if match := logAddressPattern.FindSubmatch(line); match != nil {
+				km.record(string(match[1]), time.Now())
+			}
+			break
+		}
+	}
+	return km.next.Write(line)
+}
+
+func (km *keyMismatches) record(addr string, now time.Time) {
+	ip := addr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		ip = host
+	}
+	km.lock.Lock()
+	defer km.lock.Unlock()
+	km.total++
+	km.prune(now)
+	if _, ok := km.failures[ip]; !ok && len(km.failures) >= keyMismatchMaxAddrs {
+		return // only counted in the total
+	}
+	km.failures[ip] = append(km.failures[ip], now)
+	if len(km.failures[ip]) < keyMismatchThreshold || now.Sub(km.warned[ip]) < keyMismatchRepeat {
+		return
+	}
+	km.warned[ip] = now
+	if name := km.name(ip); name != "" {
+		logrus.Warnf("node %s (%s) appears to use a different cluster key; gossip from it cannot be decrypted", name, ip)
+	} else {
+		logrus.Warnf("node at %s appears to use a different cluster key; gossip from it cannot be decrypted", ip)
+	}
+}
+
+// prune forgets the failures outside of keyMismatchWindow and the warnings older than keyMismatchRepeat
+func (km *keyMismatches) prune(now time.Time) {
+	for ip, failures := range km.failures {
+		if failures = recentFailures(failures, now); len(failures) > 0 {
+			km.failures[ip] = failures
+		} else {
+			delete(km.failures, ip)
+		}
+	}
+	for ip, warned := range km.warned {
+		if now.Sub(warned) >= keyMismatchRepeat {
+			delete(km.warned, ip)
+		}
+	}
+}
+
+func (km *keyMismatches) name(ip string) string {
+	if km.nodeName == nil {
+		return ""
+	}
+	return km.nodeName(ip)
+}
+
+// setNodeName sets the function naming the node at an address, once the cluster exists
+func (km *keyMismatches) setNodeName(nodeName func(ip string) string) {
+	km.lock.Lock()
+	defer km.lock.Unlock()
+	km.nodeName = nodeName
+}
+
+// current provides the addresses currently exceeding the threshold, sorted by address
+func (km *keyMismatches) current(now time.Time) []KeyMismatch {
+	km.lock.Lock()
+	defer km.lock.Unlock()
+	km.prune(now)
+	mismatches := []KeyMismatch{}
+	for ip, failures := range km.failures {
+		if len(failures) >= keyMismatchThreshold {
+			mismatches = append(mismatches, KeyMismatch{Addr: ip, Node: km.name(ip), Failures: len(failures), Last: failures[len(failures)-1]})
+		}
+	}
+	sort.Slice(mismatches, func(i, j int) bool { return mismatches[i].Addr < mismatches[j].Addr })
+	return mismatches
+}
+
+func recentFailures(failures []time.Time, now time.Time) []time.Time {
+	for len(failures) > 0 && now.Sub(failures[0]) > keyMismatchWindow {
+		failures = failures[1:]
+	}
+	return failures
+}
+
+// KeyMismatches provides the addresses gossip repeatedly could not be decrypted from within the last minute, which most
+// likely belong to nodes using a different cluster key
+func (c *Cluster) KeyMismatches() []KeyMismatch {
+	if c.mismatches == nil {
+		return []KeyMismatch{}
+	}
+	return c.mismatches.current(time.Now())
+}
+
+// DecryptFailures provides the total number of gossip messages which could not be decrypted
+func (c *Cluster) DecryptFailures() uint64 {
+	if c.mismatches == nil {
+		return 0
+	}
+	c.mismatches.lock.Lock()
+	defer c.mismatches.lock.Unlock()
+	return c.mismatches.total
+}
+
+// nodeNameByIP provides the name of the node last known at the address, according to the cluster state
+func (c *Cluster) nodeNameByIP(ip string) string {
+	parsed := net.ParseIP(ip)
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	for _, node := range c.state.Nodes {
+		if node.Addr.Equal(parsed) {
+			return node.Name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,78 @@
+package cluster
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/costela/wesher/common"
+)
+
+func Test_keyMismatches_Write(t *testing.T) {
+	km := newKeyMismatches(ioutil.Discard)
+	km.setNodeName(func(ip string) string {
+		if ip == "10.0.0.2" {
+			return "node2"
+		}
+		return ""
+	})
+	lines := []string{
+		"2020/05/01 10:00:00 [ERR] memberlist: Decrypt packet failed: No installed keys could decrypt the message from=10.0.0.2:7946\n",
+		"2020/05/01 10:00:01 [ERR] memberlist: failed to receive: No installed keys could decrypt the message from=10.0.0.2:41234\n",
+		"2020/05/01 10:00:02 [ERR] memberlist: Decrypt packet failed: No installed keys could decrypt the message from=10.0.0.2:7946\n",
+		"2020/05/01 10:00:03 [ERR] memberlist: Decrypt packet failed: No installed keys could decrypt the message from=[2001:db8::3]:7946\n",
+		"2020/05/01 10:00:04 [DEBUG] memberlist: Stream connection from=10.0.0.4:41234\n",
+	}
+	for _, line := range lines {
+		if n, err := km.Write([]byte(line)); err != nil || n != len(line) {
+			t.Fatalf("Write() = %d, %v; want %d, nil", n, err, len(line))
+		}
+	}
+
+	mismatches := km.current(time.Now())
+	if len(mismatches) != 1 {
+		t.Fatalf("current() = %v, want only the address failing repeatedly", mismatches)
+	}
+	if m := mismatches[0]; m.Addr != "10.0.0.2" || m.Node != "node2" || m.Failures != 3 {
+		t.Errorf("current() = %+v, want 3 failures of node2 at 10.0.0.2", m)
+	}
+	if km.total != 4 {
+		t.Errorf("total failures = %d, want 4", km.total)
+	}
+	if mismatches := km.current(time.Now().Add(2 * keyMismatchWindow)); len(mismatches) != 0 {
+		t.Errorf("current() = %v, want failures to expire", mismatches)
+	}
+}
+
+func Test_Cluster_nodeNameByIP(t *testing.T) {
+	c := &Cluster{state: &state{Nodes: []common.Node{{Name: "node2", Addr: net.ParseIP("10.0.0.2")}}}}
+	if got := c.nodeNameByIP("10.0.0.2"); got != "node2" {
+		t.Errorf("nodeNameByIP() = %q, want node2", got)
+	}
+	if got := c.nodeNameByIP("10.0.0.3"); got != "" {
+		t.Errorf("nodeNameByIP() = %q, want none", got)
+	}
+}
+
+func Test_keyMismatches_bounded(t *testing.T) {
+	km := newKeyMismatches(ioutil.Discard)
+	now := time.Now()
+	for i := 0; i < keyMismatchThreshold; i++ {
+		km.record("10.0.0.2:7946", now)
+	}
+	for i := 0; i < keyMismatchMaxAddrs+10; i++ {
+		km.record(net.IPv4(10, 1, byte(i>>8), byte(i)).String(), now)
+	}
+	if len(km.failures) != keyMismatchMaxAddrs {
+		t.Errorf("tracked %d addresses, want at most %d", len(km.failures), keyMismatchMaxAddrs)
+	}
+	if km.total != uint64(keyMismatchThreshold+keyMismatchMaxAddrs+10) {
+		t.Errorf("total failures = %d, want all of them counted", km.total)
+	}
+
+	km.record("10.0.0.3:7946", now.Add(keyMismatchRepeat))
+	if len(km.failures) != 1 || len(km.warned) != 0 {
+		t.Errorf("tracked %d addresses and %d warnings after they expired, want only the latest address", len(km.failures), len(km.warned))
+	}
+}
@@ -0,0 +1,175 @@
+package cluster
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// The cluster key is rotated without interrupting gossip: the coordinating node installs the new key on every member
+// as an additional key, so it can be decrypted everywhere, and only switches the primary key once every member
+// acknowledged it. The old key stays installed until restart, so members switching late can still be understood.
+// All messages are reliable user messages, encrypted with the current key.
+
+// keyAck is the acknowledgement of an installed key by a member
+type keyAck struct {
+	name   string
+	digest []byte
+}
+
+// RotateKey generates a new cluster key, installs it on all live members, then switches every member to it
+// The rotation is aborted if any member does not acknowledge the new key within timeout, removing the key from the
+// members which installed it. The new key is persisted like the initial one, and provided along with the names of the
+// switched members.
+func (c *Cluster) RotateKey(timeout time.Duration) ([]byte, []string, error) {
+	if c.standalone() {
+		return nil, nil, errors.New("a standalone node has no cluster key")
+	}
+	c.rotateLock.Lock()
+	defer c.rotateLock.Unlock()
+
+	key := make([]byte, KeyLen)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, fmt.Errorf("reading random source: %w", err)
+	}
+	digest := keyDigest(key)
+
+	acks := make(chan keyAck, 16)
+	c.keyLock.Lock()
+	c.keyAcks = acks
+	c.keyLock.Unlock()
+	defer func() {
+		c.keyLock.Lock()
+		c.keyAcks = nil
+		c.keyLock.Unlock()
+	}()
+
+	if err := c.keyring().AddKey(key); err != nil {
+		return nil, nil, fmt.Errorf("installing key: %w", err)
+	}
+	pending := make(map[string]bool)
+	for _, member := range c.memberlist().Members() {
+		if member.Name == c.LocalName() {
+			continue
+		}
+		pending[member.Name] = true
+		go c.sendUserMsg(member.Name, msgKeyInstall, append([]byte(c.LocalName()+"\x00"), key...))
+	}
+	installed := make([]string, 0, len(pending))
+	deadline := time.After(timeout)
+	for len(pending) > 0 {
+		select {
+		case ack := <-acks:
+			if pending[ack.name] && bytes.Equal(ack.digest, digest) {
+				delete(pending, ack.name)
+				installed = append(installed, ack.name)
+			}
+		case <-deadline:
+			logrus.Warnf("aborting cluster key rotation, members did not acknowledge the new key: %s", sortedNames(pending))
+			c.keyring().RemoveKey(key) // nolint: errcheck // not the primary key
+			for _, name := range installed {
+				go c.sendUserMsg(name, msgKeyRemove, key)
+			}
+			return nil, nil, fmt.Errorf("members did not acknowledge the new key within %s: %s", timeout, strings.Join(sortedNames(pending), ", "))
+		}
+	}
+
+	for _, name := range installed {
+		go c.sendUserMsg(name, msgKeyUse, key)
+	}
+	if err := c.useKey(key); err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(installed)
+	logrus.Infof("rotated cluster key on %d members", len(installed))
+	return key, installed, nil
+}
+
+// handleKeyMsg handles the user messages of key rotations
+func (c *Cluster) handleKeyMsg(msgType byte, payload []byte) {
+	switch msgType {
+	case msgKeyInstall:
+		sep := bytes.IndexByte(payload, 0)
+		if sep < 0 {
+			return
+		}
+		coordinator, key := string(payload[:sep]), payload[sep+1:]
+		if err := c.keyring().AddKey(key); err != nil {
+			logrus.WithError(err).Errorf("could not install cluster key from %s", coordinator)
+			return
+		}
+		logrus.Infof("installed new cluster key from %s", coordinator)
+		c.sendUserMsg(coordinator, msgKeyInstalled, append([]byte(c.LocalName()+"\x00"), keyDigest(key)...))
+	case msgKeyInstalled:
+		sep := bytes.IndexByte(payload, 0)
+		if sep < 0 {
+			return
+		}
+		c.keyLock.Lock()
+		defer c.keyLock.Unlock()
+		if c.keyAcks == nil {
+			return // no rotation in progress
+		}
+		select {
+		case c.keyAcks <- keyAck{name: string(payload[:sep]), digest: payload[sep+1:]}:
+		default:
+		}
+	case msgKeyUse:
+		if err := c.useKey(payload); err != nil {
+			logrus.WithError(err).Error("could not switch to new cluster key")
+			return
+		}
+		logrus.Info("switched to new cluster key")
+	case msgKeyRemove:
+		if err := c.keyring().RemoveKey(payload); err != nil {
+			logrus.WithError(err).Warn("could not remove aborted cluster key")
+		}
+	}
+}
+
+// useKey makes the installed key the primary one, keeping it across memberlist recreations and restarts
+func (c *Cluster) useKey(key []byte) error {
+	c.mlLock.Lock()
+	defer c.mlLock.Unlock()
+	if err := c.mlConfig.Keyring.UseKey(key); err != nil {
+		return fmt.Errorf("switching key: %w", err)
+	}
+	c.mlConfig.SecretKey = key
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	c.state.ClusterKey = key
+	if err := c.state.save(c.name); err != nil {
+		logrus.WithError(err).Error("could not persist new cluster key")
+	}
+	return nil
+}
+
+// keyring provides the keyring shared by all memberlist instances
+func (c *Cluster) keyring() *memberlist.Keyring {
+	c.mlLock.RLock()
+	defer c.mlLock.RUnlock()
+	return c.mlConfig.Keyring
+}
+
+// keyDigest provides a digest identifying the key without revealing it
+func keyDigest(key []byte) []byte {
+	digest := sha256.Sum256(key)
+	return digest[:8]
+}
+
+func sortedNames(names map[string]bool) []string {
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
@@ -0,0 +1,64 @@
+package cluster
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/costela/wesher/common"
+)
+
+func Test_Cluster_RotateKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wesher-keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(template string) { statePathTemplate = template }(statePathTemplate)
+	statePathTemplate = path.Join(dir, "%s.json")
+
+	key := bytes.Repeat([]byte{1}, KeyLen)
+	clusters := make([]*Cluster, 0, 2)
+	for i, name := range []string{"node1", "node2"} {
+		c, err := New("test"+strconv.Itoa(i), true, key, "127.0.0.1", 0, "", "127.0.0.1", 0, name, 0, true, 0, 0, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Leave(time.Second)
+		node := &common.Node{Name: name}
+		node.OverlayAddr = net.IPNet{IP: net.IPv4(10, 0, 0, byte(i+1)).To4(), Mask: net.CIDRMask(32, 32)}
+		c.Update(node)
+		clusters = append(clusters, c)
+	}
+	target := net.JoinHostPort("127.0.0.1", strconv.Itoa(clusters[0].mlConfig.BindPort))
+	if err := clusters[1].Join([]string{target}); err != nil {
+		t.Fatal(err)
+	}
+
+	newKey, switched, err := clusters[0].RotateKey(5 * time.Second)
+	if err != nil {
+		t.Fatalf("RotateKey() error = %v", err)
+	}
+	if len(switched) != 1 || switched[0] != "node2" {
+		t.Errorf("RotateKey() switched = %v, want [node2]", switched)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !bytes.Equal(clusters[1].keyring().GetPrimaryKey(), newKey) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, c := range clusters {
+		if !bytes.Equal(c.keyring().GetPrimaryKey(), newKey) {
+			t.Errorf("%s primary key was not switched", c.LocalName())
+		}
+		loaded := &state{}
+		loadState(loaded, c.name)
+		if !bytes.Equal(loaded.ClusterKey, newKey) {
+			t.Errorf("%s did not persist the new key", c.LocalName())
+		}
+	}
+}
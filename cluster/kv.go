@@ -0,0 +1,214 @@
+package cluster
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// The key/value store is a tiny last-writer-wins map replicated to all nodes, meant for small bits of shared
+// configuration (e.g. the current exit node or maintenance flags). Changes are broadcast via gossip and the complete
+// store is exchanged on memberlist's periodic push/pull, so nodes joining later or missing a broadcast converge too.
+
+// MaxKVSize bounds the total size of all keys and values in the store
+const MaxKVSize = 4096
+
+// maxKVKeyLen bounds the length of a single key
+const maxKVKeyLen = 64
+
+// kvRetransmitMult is the multiplier for the number of retransmissions of broadcast changes
+const kvRetransmitMult = 3
+
+// kvTombstoneTTL is the time deleted keys are remembered, so the deletion reaches all nodes before it is forgotten
+const kvTombstoneTTL = 24 * time.Hour
+
+type kvEntry struct {
+	Value   string `json:"v,omitempty"`
+	Version uint64 `json:"t"` // lamport timestamp of the change
+	Node    string `json:"n"` // node which made the change, breaking ties between concurrent changes
+	Deleted bool   `json:"d,omitempty"`
+	// DeletedAt is the unix time of the deletion on the node making it, so all nodes expire it at about the same time
+	// instead of passing it back and forth
+	DeletedAt int64 `json:"e,omitempty"`
+}
+
+// newer reports whether the entry supersedes the other one
+func (e kvEntry) newer(other kvEntry) bool {
+	return e.Version > other.Version || (e.Version == other.Version && e.Node > other.Node)
+}
+
+// expired reports whether the entry is a deletion older than kvTombstoneTTL
+func (e kvEntry) expired(now time.Time) bool {
+	return e.Deleted && now.Sub(time.Unix(e.DeletedAt, 0)) > kvTombstoneTTL
+}
+
+// size is the size the entry takes up in the store; deleted keys are not counted
+func (e kvEntry) size(key string) int {
+	if e.Deleted {
+		return 0
+	}
+	return len(key) + len(e.Value)
+}
+
+type kvStore struct {
+	lock    sync.Mutex
+	entries map[string]kvEntry
+	clock   uint64 // highest version seen, kept when expiring deleted keys so later changes still supersede them
+}
+
+// set records a change made by the local node, checking the store bounds
+func (s *kvStore) set(node, key, value string, deleted bool) (kvEntry, error) {
+	if key == "" || len(key) > maxKVKeyLen {
+		return kvEntry{}, errors.Errorf("key must be between 1 and %d bytes long", maxKVKeyLen)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.expire(time.Now())
+
+	entry := kvEntry{Value: value, Version: s.clock + 1, Node: node, Deleted: deleted}
+	if deleted {
+		entry.Value, entry.DeletedAt = "", time.Now().Unix()
+	}
+	if s.sizeWith(key, entry) > MaxKVSize {
+		return kvEntry{}, errors.Errorf("store would exceed its maximum size of %d bytes", MaxKVSize)
+	}
+	s.put(key, entry)
+	return entry, nil
+}
+
+// merge applies the provided entries when they supersede known ones, providing the changed keys
+// Entries which would make the store exceed its maximum size are dropped.
+func (s *kvStore) merge(entries map[string]kvEntry) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	s.expire(now)
+	changed := make([]string, 0)
+	for key, entry := range entries {
+		if entry.Deleted && entry.DeletedAt == 0 { // made by older versions
+			entry.DeletedAt = now.Unix()
+		}
+		if key == "" || len(key) > maxKVKeyLen || entry.expired(now) {
+			continue
+		}
+		if current, ok := s.entries[key]; ok && !entry.newer(current) {
+			continue
+		}
+		if s.sizeWith(key, entry) > MaxKVSize {
+			logrus.Warnf("dropping key %q of the key/value store, it would exceed the maximum size of %d bytes", key, MaxKVSize)
+			continue
+		}
+		s.put(key, entry)
+		changed = append(changed, key)
+	}
+	return changed
+}
+
+// sizeWith provides the size of the store if the entry was stored for the key
+func (s *kvStore) sizeWith(key string, entry kvEntry) int {
+	size := entry.size(key)
+	for k, e := range s.entries {
+		if k != key {
+			size += e.size(k)
+		}
+	}
+	return size
+}
+
+// put stores the entry, advancing the clock
+func (s *kvStore) put(key string, entry kvEntry) {
+	if entry.Version > s.clock {
+		s.clock = entry.Version
+	}
+	if s.entries == nil {
+		s.entries = make(map[string]kvEntry)
+	}
+	s.entries[key] = entry
+}
+
+// expire forgets deleted keys older than kvTombstoneTTL
+func (s *kvStore) expire(now time.Time) {
+	for key, entry := range s.entries {
+		if entry.expired(now) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+// values provides the current values, leaving out deleted keys
+func (s *kvStore) values() map[string]string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	values := make(map[string]string, len(s.entries))
+	for key, entry := range s.entries {
+		if !entry.Deleted {
+			values[key] = entry.Value
+		}
+	}
+	return values
+}
+
+// encode provides the complete store, including deletions, for push/pull synchronization
+func (s *kvStore) encode() []byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.expire(time.Now())
+	encoded, _ := json.Marshal(s.entries) // plain strings and numbers, cannot fail
+	return encoded
+}
+
+// kvBroadcast is a change to a single key, superseding previous broadcasts for the same key
+type kvBroadcast struct {
+	key string
+	msg []byte
+}
+
+func (b *kvBroadcast) Invalidates(other memberlist.Broadcast) bool {
+	o, ok := other.(*kvBroadcast)
+	return ok && o.key == b.key
+}
+
+func (b *kvBroadcast) Message() []byte { return b.msg }
+
+func (b *kvBroadcast) Finished() {}
+
+// KV provides the current content of the replicated key/value store
+func (c *Cluster) KV() map[string]string {
+	return c.kv.values()
+}
+
+// SetKV sets a key of the replicated key/value store, broadcasting the change to all nodes
+func (c *Cluster) SetKV(key, value string) error {
+	return c.changeKV(key, value, false)
+}
+
+// DeleteKV deletes a key of the replicated key/value store, broadcasting the change to all nodes
+func (c *Cluster) DeleteKV(key string) error {
+	return c.changeKV(key, "", true)
+}
+
+func (c *Cluster) changeKV(key, value string, deleted bool) error {
+	entry, err := c.kv.set(c.LocalName(), key, value, deleted)
+	if err != nil {
+		return err
+	}
+	encoded, _ := json.Marshal(map[string]kvEntry{key: entry}) // plain strings and numbers, cannot fail
+	c.kvBroadcasts.QueueBroadcast(&kvBroadcast{key: key, msg: append([]byte{msgKVUpdate}, encoded...)})
+	return nil
+}
+
+// mergeKV merges entries received from other nodes
+func (c *Cluster) mergeKV(encoded []byte) {
+	entries := map[string]kvEntry{}
+	if err := json.Unmarshal(encoded, &entries); err != nil {
+		logrus.Warnf("could not decode key/value store update: %s", err)
+		return
+	}
+	for _, key := range c.kv.merge(entries) {
+		logrus.Debugf("key %q of the key/value store changed", key)
+	}
+}
@@ -0,0 +1,120 @@
+package cluster
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_kvStore_set_merge(t *testing.T) {
+	a, b := &kvStore{}, &kvStore{}
+	if _, err := a.set("node-a", "exit-node", "node-a", false); err != nil {
+		t.Fatal(err)
+	}
+	b.merge(a.entries)
+	if want := map[string]string{"exit-node": "node-a"}; !reflect.DeepEqual(b.values(), want) {
+		t.Errorf("values() after merge = %v, want %v", b.values(), want)
+	}
+
+	// later changes win, regardless of the node making them
+	if _, err := b.set("node-b", "exit-node", "node-b", false); err != nil {
+		t.Fatal(err)
+	}
+	if changed := a.merge(b.entries); !reflect.DeepEqual(changed, []string{"exit-node"}) {
+		t.Errorf("merge() changed = %v, want [exit-node]", changed)
+	}
+	if changed := a.merge(b.entries); len(changed) != 0 {
+		t.Errorf("merge() of known entries changed = %v, want none", changed)
+	}
+
+	// deletions are replicated as well
+	if _, err := a.set("node-a", "exit-node", "", true); err != nil {
+		t.Fatal(err)
+	}
+	b.merge(a.entries)
+	if values := b.values(); len(values) != 0 {
+		t.Errorf("values() after deletion = %v, want none", values)
+	}
+}
+
+func Test_kvEntry_newer(t *testing.T) {
+	if !(kvEntry{Version: 2, Node: "a"}).newer(kvEntry{Version: 1, Node: "b"}) {
+		t.Error("newer() should prefer higher versions")
+	}
+	if !(kvEntry{Version: 1, Node: "b"}).newer(kvEntry{Version: 1, Node: "a"}) {
+		t.Error("newer() should break ties by node name")
+	}
+}
+
+func Test_kvStore_set_bounds(t *testing.T) {
+	s := &kvStore{}
+	if _, err := s.set("node", "", "value", false); err == nil {
+		t.Error("set() with empty key should fail")
+	}
+	if _, err := s.set("node", strings.Repeat("k", maxKVKeyLen+1), "value", false); err == nil {
+		t.Error("set() with too long key should fail")
+	}
+	if _, err := s.set("node", "big", strings.Repeat("v", MaxKVSize-3), false); err != nil {
+		t.Errorf("set() within bounds error = %v", err)
+	}
+	if _, err := s.set("node", "more", "v", false); err == nil {
+		t.Error("set() exceeding the store size should fail")
+	}
+	if _, err := s.set("node", "big", "small", false); err != nil {
+		t.Errorf("set() replacing a value error = %v", err)
+	}
+}
+
+func Test_kvStore_deleted(t *testing.T) {
+	s := &kvStore{}
+	if _, err := s.set("node", "big", strings.Repeat("v", MaxKVSize-3), false); err != nil {
+		t.Fatal(err)
+	}
+	deletion, err := s.set("node", "big", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.set("node", "other", strings.Repeat("v", MaxKVSize-5), false); err != nil {
+		t.Errorf("set() with a deleted key error = %v, want deleted keys not to count", err)
+	}
+
+	deletion.DeletedAt -= int64((kvTombstoneTTL + time.Minute) / time.Second)
+	s.entries["big"] = deletion
+	s.expire(time.Now())
+	if _, ok := s.entries["big"]; ok {
+		t.Error("expire() kept a deleted key past its TTL")
+	}
+	if _, ok := s.entries["other"]; !ok {
+		t.Error("expire() dropped a key which is not deleted")
+	}
+	if changed := s.merge(map[string]kvEntry{"big": deletion}); len(changed) != 0 {
+		t.Errorf("merge() of an expired deletion changed = %v, want none", changed)
+	}
+	entry, err := s.set("node", "big", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !entry.newer(deletion) {
+		t.Errorf("set() after expiry = version %d, want above the expired version %d", entry.Version, deletion.Version)
+	}
+}
+
+func Test_kvStore_merge_bounds(t *testing.T) {
+	a, b := &kvStore{}, &kvStore{}
+	if _, err := a.set("node-a", "a", strings.Repeat("v", MaxKVSize-1), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.set("node-b", "b", strings.Repeat("v", MaxKVSize/2), false); err != nil {
+		t.Fatal(err)
+	}
+	if changed := b.merge(a.entries); len(changed) != 0 {
+		t.Errorf("merge() changed = %v, want entries exceeding the size to be dropped", changed)
+	}
+	if _, err := a.set("node-a", "a", "", true); err != nil {
+		t.Fatal(err)
+	}
+	if changed := b.merge(a.entries); !reflect.DeepEqual(changed, []string{"a"}) {
+		t.Errorf("merge() of a deletion changed = %v, want [a]", changed)
+	}
+}
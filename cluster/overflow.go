@@ -0,0 +1,127 @@
+package cluster
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/costela/wesher/common"
+	"github.com/hashicorp/memberlist"
+	"github.com/sirupsen/logrus"
+)
+
+// Node metadata not fitting into memberlist's meta size limit is gossiped as a placeholder carrying a digest of the
+// complete metadata (see common.Node.EncodeMeta). Complete metadata is then requested directly from the node using
+// reliable (TCP) user messages, which are not subject to the limit; like all gossip, they are sent via the overlay
+// network with gossip over the overlay (see SetOverlayAddrs).
+
+// user message types
+const (
+	msgMetaRequest  byte = iota // payload: name of the requesting node
+	msgMetaResponse             // payload: complete metadata of the sending node
+	msgKVUpdate                 // payload: changed key/value store entries, see kv.go
+	msgKeyInstall               // payload: name of the coordinating node, then the new cluster key; see keyring.go
+	msgKeyInstalled             // payload: name of the acknowledging node, then the digest of the installed key
+	msgKeyUse                   // payload: the cluster key to switch to
+	msgKeyRemove                // payload: the cluster key of an aborted rotation
+)
+
+// metaRequestTimeout is the time after which complete metadata is requested again if no response arrived
+const metaRequestTimeout = 10 * time.Second
+
+// resolveOverflow replaces the node metadata with the previously received complete metadata.
+// If the node metadata is a placeholder for which no matching complete metadata is known, it is requested from the
+// node and the node will be updated once it arrives. Only one request per node is in flight at a time.
+func (c *Cluster) resolveOverflow(node *common.Node) {
+	digest, ok := node.OverflowDigest()
+	if !ok {
+		return
+	}
+
+	c.overflowLock.Lock()
+	defer c.overflowLock.Unlock()
+	full, known := c.overflowMeta[node.Name]
+	if known && bytes.Equal(common.MetaDigest(full), digest) {
+		node.Meta = full
+		return
+	}
+	if requested, ok := c.overflowRequested[node.Name]; ok && time.Since(requested) < metaRequestTimeout {
+		return
+	}
+	c.overflowRequested[node.Name] = time.Now()
+
+	logrus.Debugf("requesting complete metadata from %s", node.Name)
+	go c.sendUserMsg(node.Name, msgMetaRequest, []byte(c.LocalName()))
+}
+
+// pruneOverflow forgets the complete metadata and pending requests of nodes no longer members
+func (c *Cluster) pruneOverflow(members []*memberlist.Node) {
+	names := make(map[string]bool, len(members))
+	for _, member := range members {
+		names[member.Name] = true
+	}
+	c.overflowLock.Lock()
+	defer c.overflowLock.Unlock()
+	for name := range c.overflowMeta {
+		if !names[name] {
+			delete(c.overflowMeta, name)
+		}
+	}
+	for name := range c.overflowRequested {
+		if !names[name] {
+			delete(c.overflowRequested, name)
+		}
+	}
+}
+
+// handleUserMsg handles messages received by the memberlist delegate
+func (c *Cluster) handleUserMsg(msg []byte) {
+	if len(msg) < 1 {
+		return
+	}
+	payload := msg[1:]
+	switch msg[0] {
+	case msgMetaRequest:
+		full, err := c.localNode.FullMeta()
+		if err != nil {
+			logrus.Errorf("failed to encode local node: %s", err)
+			return
+		}
+		go c.sendUserMsg(string(payload), msgMetaResponse, append([]byte(c.LocalName()+"\x00"), full...))
+	case msgKVUpdate:
+		c.mergeKV(payload)
+	case msgKeyInstall, msgKeyInstalled, msgKeyUse, msgKeyRemove:
+		c.handleKeyMsg(msg[0], payload)
+	case msgMetaResponse:
+		sep := bytes.IndexByte(payload, 0)
+		if sep < 0 {
+			return
+		}
+		name := string(payload[:sep])
+		c.overflowLock.Lock()
+		c.overflowMeta[name] = payload[sep+1:]
+		delete(c.overflowRequested, name)
+		c.overflowLock.Unlock()
+		// let the members pick up the complete metadata; if the events are full, they are rebuilt soon anyway
+		for _, member := range c.memberlist().Members() {
+			if member.Name != name {
+				continue
+			}
+			select {
+			case c.events <- memberlist.NodeEvent{Event: memberlist.NodeUpdate, Node: member}:
+			default:
+			}
+		}
+	}
+}
+
+func (c *Cluster) sendUserMsg(name string, msgType byte, payload []byte) {
+	for _, member := range c.memberlist().Members() {
+		if member.Name != name {
+			continue
+		}
+		if err := c.memberlist().SendReliable(member, append([]byte{msgType}, payload...)); err != nil {
+			logrus.Warnf("could not send message to %s: %s", name, err)
+		}
+		return
+	}
+}
@@ -0,0 +1,55 @@
+package cluster
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/costela/wesher/common"
+	"github.com/hashicorp/memberlist"
+)
+
+func Test_Cluster_resolveOverflow(t *testing.T) {
+	defer func(template string) { statePathTemplate = template }(statePathTemplate)
+	statePathTemplate = "/tmp/wesher-overflow-%s.json"
+	c, err := New("overflow", true, bytes.Repeat([]byte{1}, KeyLen), "127.0.0.1", 0, "", "127.0.0.1", 0, "local", 0, true, 0, 0, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Leave(time.Second)
+
+	big := common.Node{Name: "big"}
+	big.OverlayAddr = net.IPNet{IP: net.ParseIP("10.0.0.2").To4(), Mask: net.CIDRMask(32, 32)}
+	for i := 0; i < 100; i++ {
+		big.Routes = append(big.Routes, net.IPNet{IP: net.IPv4(10, 1, byte(i), 0).To4(), Mask: net.CIDRMask(24, 32)})
+	}
+	full, err := big.FullMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	placeholder, err := big.EncodeMeta(128)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		node := common.Node{Name: "big", Meta: placeholder}
+		c.resolveOverflow(&node)
+	}
+	if len(c.overflowRequested) != 1 {
+		t.Errorf("resolveOverflow() has %d requests in flight, want a single one", len(c.overflowRequested))
+	}
+
+	c.handleUserMsg(append([]byte{msgMetaResponse}, append([]byte("big\x00"), full...)...))
+	node := common.Node{Name: "big", Meta: placeholder}
+	c.resolveOverflow(&node)
+	if !bytes.Equal(node.Meta, full) || len(c.overflowRequested) != 0 {
+		t.Errorf("resolveOverflow() = %x with %d requests in flight, want the complete metadata", node.Meta, len(c.overflowRequested))
+	}
+
+	c.pruneOverflow([]*memberlist.Node{{Name: "local"}})
+	if len(c.overflowMeta) != 0 {
+		t.Errorf("pruneOverflow() kept %d entries of nodes no longer members", len(c.overflowMeta))
+	}
+}
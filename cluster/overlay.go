@@ -0,0 +1,83 @@
+package cluster
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// overlayAddrs maps the underlay addresses nodes advertise to their overlay addresses
+type overlayAddrs struct {
+	lock  sync.RWMutex
+	addrs map[string]net.IP
+}
+
+func (o *overlayAddrs) set(addrs map[string]net.IP) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.addrs = addrs
+}
+
+// route provides the address to send to instead of the provided host:port, i.e. the overlay address of the node
+// advertising it if known, or the provided address otherwise
+func (o *overlayAddrs) route(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	if overlay, ok := o.addrs[net.ParseIP(host).String()]; ok {
+		return net.JoinHostPort(overlay.String(), port)
+	}
+	return addr
+}
+
+// overlayTransport is a memberlist.NetTransport sending to nodes via their overlay address once known, so gossip is
+// carried by wireguard while all nodes keep advertising, persisting and joining via their underlay address.
+// Since it binds to all addresses, gossip sent by other nodes via the overlay is received too.
+type overlayTransport struct {
+	*memberlist.NetTransport
+	overlay *overlayAddrs
+}
+
+func newOverlayTransport(overlay *overlayAddrs, bindAddr string, bindPort int, logger *log.Logger) (*overlayTransport, error) {
+	nt, err := memberlist.NewNetTransport(&memberlist.NetTransportConfig{
+		BindAddrs: []string{bindAddr},
+		BindPort:  bindPort,
+		Logger:    logger,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("starting transport on %s: %w", net.JoinHostPort(bindAddr, strconv.Itoa(bindPort)), err)
+	}
+	return &overlayTransport{NetTransport: nt, overlay: overlay}, nil
+}
+
+// WriteTo implements the memberlist.Transport interface
+func (t *overlayTransport) WriteTo(b []byte, addr string) (time.Time, error) {
+	return t.NetTransport.WriteTo(b, t.overlay.route(addr))
+}
+
+// DialTimeout implements the memberlist.Transport interface
+func (t *overlayTransport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	return t.NetTransport.DialTimeout(t.overlay.route(addr), timeout)
+}
+
+// SetOverlayAddrs sets the overlay addresses of the nodes reachable over the overlay network, by the underlay address
+// they advertise; with gossip over the overlay, they are sent gossip via their overlay address from now on, while
+// nodes missing from addrs, e.g. ones not configured as wireguard peers yet, are still sent gossip via the underlay.
+func (c *Cluster) SetOverlayAddrs(addrs map[string]net.IP) {
+	if c.overlay == nil {
+		return
+	}
+	normalized := make(map[string]net.IP, len(addrs))
+	for underlay, overlay := range addrs {
+		normalized[net.ParseIP(underlay).String()] = overlay
+	}
+	c.overlay.set(normalized)
+}
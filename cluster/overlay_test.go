@@ -0,0 +1,108 @@
+package cluster
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/costela/wesher/common"
+)
+
+func Test_overlayAddrs_route(t *testing.T) {
+	o := &overlayAddrs{}
+	if got := o.route("192.0.2.1:7946"); got != "192.0.2.1:7946" {
+		t.Errorf("route() = %s without overlay addresses, want the underlay address", got)
+	}
+	o.set(map[string]net.IP{"192.0.2.1": net.ParseIP("10.0.0.1"), "2001:db8::1": net.ParseIP("fd00::1")})
+	tests := map[string]string{
+		"192.0.2.1:7946":     "10.0.0.1:7946",
+		"[2001:db8::1]:7946": "[fd00::1]:7946",
+		"192.0.2.2:7946":     "192.0.2.2:7946",
+		"invalid":            "invalid",
+	}
+	for addr, want := range tests {
+		if got := o.route(addr); got != want {
+			t.Errorf("route(%s) = %s, want %s", addr, got, want)
+		}
+	}
+}
+
+// Test_Cluster_overlay moves gossip of two nodes onto another address, then restarts one of them, which must rejoin
+// via the underlay address it persisted
+func Test_Cluster_overlay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wesher-overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(template string) { statePathTemplate = template }(statePathTemplate)
+	statePathTemplate = path.Join(dir, "%s.json")
+
+	key := bytes.Repeat([]byte{1}, KeyLen)
+	start := func(name string, init bool) (*Cluster, <-chan []common.Node) {
+		c, err := New(name, init, key, "0.0.0.0", 0, "", "127.0.0.1", 0, name, 0, true, 0, 0, true, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Update(&common.Node{Name: name})
+		return c, c.Members()
+	}
+	waitMembers := func(membersc <-chan []common.Node) []common.Node {
+		select {
+		case nodes := <-membersc:
+			return nodes
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for members")
+			return nil
+		}
+	}
+
+	node1, members1 := start("node1", true)
+	defer node1.Leave(time.Second)
+	node2, members2 := start("node2", true)
+	if err := node2.Join([]string{net.JoinHostPort("127.0.0.1", strconv.Itoa(node1.mlConfig.BindPort))}); err != nil {
+		t.Fatal(err)
+	}
+	waitMembers(members1)
+	waitMembers(members2)
+
+	// the "overlay" is another loopback address, both nodes listen on all addresses
+	overlay := map[string]net.IP{"127.0.0.1": net.ParseIP("127.0.0.2")}
+	node1.SetOverlayAddrs(overlay)
+	node2.SetOverlayAddrs(overlay)
+	if err := node1.SetKV("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for node2.KV()["key"] != "value" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if node2.KV()["key"] != "value" {
+		t.Error("gossip did not reach node2 via the overlay address")
+	}
+	for _, member := range node1.memberlist().Members() {
+		if !member.Addr.Equal(net.ParseIP("127.0.0.1")) {
+			t.Errorf("member %s advertises %s, want the underlay address", member.Name, member.Addr)
+		}
+	}
+
+	node2.Leave(time.Second)
+	persisted := node2.PersistedNodes()
+	if len(persisted) != 1 || !persisted[0].Addr.Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("PersistedNodes() = %v, want node1 with its underlay address", persisted)
+	}
+
+	restarted, membersRestarted := start("node2", false)
+	defer restarted.Leave(time.Second)
+	if err := restarted.Join(nil); err != nil {
+		t.Fatalf("Join() error = %v rejoining the persisted nodes", err)
+	}
+	if nodes := waitMembers(membersRestarted); len(nodes) != 1 || nodes[0].Name != "node1" {
+		t.Errorf("Members() = %v after restarting, want node1", nodes)
+	}
+}
@@ -0,0 +1,71 @@
+package cluster
+
+import (
+	"net"
+	"os"
+	"time"
+
+	"github.com/costela/wesher/common"
+	"github.com/hashicorp/memberlist"
+)
+
+// NewStandalone creates a Cluster without membership gossip, for running a single node, e.g. for development, CI and
+// air-gapped testing of scripts
+// Its members are only the provided static peers, whose metadata must be encoded already; joining, advertising and
+// leaving do nothing, and no state is loaded or persisted.
+// The local node is named nodeName, or the hostname if empty.
+func NewStandalone(nodeName string, advertiseAddr string, peers []common.Node) (*Cluster, error) {
+	if nodeName == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		nodeName = hostname
+	}
+	mlConfig := memberlist.DefaultWANConfig()
+	mlConfig.Name = nodeName
+	mlConfig.AdvertiseAddr = advertiseAddr
+	cluster := Cluster{
+		mlConfig:          mlConfig,
+		localName:         nodeName,
+		NoState:           true,
+		state:             &state{},
+		events:            make(chan memberlist.NodeEvent, 100),
+		overflowMeta:      make(map[string][]byte),
+		overflowRequested: make(map[string]time.Time),
+		conflicts:         make(chan Conflict, 16),
+		static:            peers,
+	}
+	cluster.kvBroadcasts = &memberlist.TransmitLimitedQueue{
+		NumNodes:       cluster.numMembers,
+		RetransmitMult: kvRetransmitMult,
+	}
+	return &cluster, nil
+}
+
+// standalone reports whether the cluster runs without membership gossip (see NewStandalone)
+func (c *Cluster) standalone() bool {
+	return c.memberlist() == nil
+}
+
+// numMembers provides the number of members, including the local node
+func (c *Cluster) numMembers() int {
+	if c.standalone() {
+		return len(c.static) + 1
+	}
+	return c.memberlist().NumMembers()
+}
+
+// staticMembers pushes the static peers once, as the only change a standalone cluster ever has
+func (c *Cluster) staticMembers(changes chan<- []common.Node) {
+	nodes := make([]common.Node, len(c.static))
+	copy(nodes, c.static)
+	changes <- nodes
+}
+
+// localAddr provides the advertised address of a standalone cluster
+func (c *Cluster) localAddr() net.IP {
+	c.mlLock.RLock()
+	defer c.mlLock.RUnlock()
+	return net.ParseIP(c.mlConfig.AdvertiseAddr)
+}
@@ -6,6 +6,8 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"sort"
+	"time"
 
 	"github.com/costela/wesher/common"
 	"github.com/sirupsen/logrus"
@@ -15,6 +17,39 @@ import (
 type state struct {
 	ClusterKey []byte
 	Nodes      []common.Node
+	// LastSeen records when each node in Nodes was last a member, by name
+	LastSeen map[string]time.Time `json:",omitempty"`
+}
+
+// DefaultMaxStateNodes is the default number of nodes kept in the state
+const DefaultMaxStateNodes = 128
+
+// update merges the current members into the known nodes, keeping nodes seen previously so they can be joined on
+// restart, up to max nodes (unlimited if not positive); the least recently seen nodes are evicted first.
+func (s *state) update(members []common.Node, now time.Time, max int) {
+	lastSeen := make(map[string]time.Time, len(members)+len(s.Nodes))
+	nodes := make([]common.Node, 0, len(members)+len(s.Nodes))
+	for _, node := range members {
+		lastSeen[node.Name] = now
+		nodes = append(nodes, node)
+	}
+	for _, node := range s.Nodes {
+		if _, ok := lastSeen[node.Name]; ok {
+			continue // still a member, already updated
+		}
+		lastSeen[node.Name] = s.LastSeen[node.Name] // zero for nodes persisted before LastSeen was recorded
+		nodes = append(nodes, node)
+	}
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return lastSeen[nodes[i].Name].After(lastSeen[nodes[j].Name])
+	})
+	if max > 0 && len(nodes) > max {
+		for _, node := range nodes[max:] {
+			delete(lastSeen, node.Name)
+		}
+		nodes = nodes[:max]
+	}
+	s.Nodes, s.LastSeen = nodes, lastSeen
 }
 
 var statePathTemplate = "/var/lib/wesher/%s.json"
@@ -61,3 +96,24 @@ func loadState(cs *state, clusterName string) {
 		*cs = *csTmp
 	}
 }
+
+// PersistedNodes provides the nodes currently persisted in the cluster state
+func (c *Cluster) PersistedNodes() []common.Node {
+	s := &state{}
+	loadState(s, c.name)
+	return s.Nodes
+}
+
+// RecentNodes provides the number of other nodes which were members within the provided window, according to the
+// cluster state; it is only kept up-to-date unless NoState is set.
+func (c *Cluster) RecentNodes(window time.Duration, now time.Time) int {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	recent := 0
+	for _, node := range c.state.Nodes {
+		if node.Name != c.LocalName() && now.Sub(c.state.LastSeen[node.Name]) <= window {
+			recent++
+		}
+	}
+	return recent
+}
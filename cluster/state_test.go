@@ -4,6 +4,7 @@ import (
 	"net"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/costela/wesher/common"
 )
@@ -30,6 +31,49 @@ func Test_state_save_soad(t *testing.T) {
 	loadState(loaded, "test")
 
 	if !reflect.DeepEqual(cluster.state, loaded) {
-		t.Errorf("cluster state save then reload mistmatch: %s / %s", cluster.state, loaded)
+		t.Errorf("cluster state save then reload mistmatch: %+v / %+v", cluster.state, loaded)
+	}
+}
+
+func Test_state_update(t *testing.T) {
+	now := time.Now()
+	s := &state{
+		Nodes: []common.Node{{Name: "old"}, {Name: "older"}, {Name: "member"}},
+		LastSeen: map[string]time.Time{
+			"old":    now.Add(-time.Hour),
+			"older":  now.Add(-2 * time.Hour),
+			"member": now.Add(-3 * time.Hour),
+		},
+	}
+	s.update([]common.Node{{Name: "member"}, {Name: "new"}}, now, 3)
+
+	names := make([]string, len(s.Nodes))
+	for i, node := range s.Nodes {
+		names[i] = node.Name
+	}
+	if want := []string{"member", "new", "old"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("state.update() nodes = %v, want %v", names, want)
+	}
+	if _, ok := s.LastSeen["older"]; ok || !s.LastSeen["member"].Equal(now) || len(s.LastSeen) != 3 {
+		t.Errorf("state.update() last seen = %v, want evicted node removed and members seen now", s.LastSeen)
+	}
+}
+
+func Test_Cluster_RecentNodes(t *testing.T) {
+	now := time.Now()
+	c := &Cluster{
+		localName: "local",
+		state: &state{
+			Nodes: []common.Node{{Name: "local"}, {Name: "member"}, {Name: "lost"}, {Name: "gone"}},
+			LastSeen: map[string]time.Time{
+				"local":  now,
+				"member": now,
+				"lost":   now.Add(-time.Hour),
+				"gone":   now.Add(-48 * time.Hour),
+			},
+		},
+	}
+	if got := c.RecentNodes(24*time.Hour, now); got != 2 {
+		t.Errorf("RecentNodes() = %d, want 2", got)
 	}
 }
@@ -0,0 +1,194 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/go-sockaddr"
+	"github.com/hashicorp/memberlist"
+	"github.com/sirupsen/logrus"
+)
+
+// udpPacketBufSize is used to buffer incoming packets during read operations, same as memberlist.NetTransport
+const udpPacketBufSize = 65536
+
+// SharedSocket is a UDP socket gossip shares with other traffic, e.g. wireguard with a single port
+type SharedSocket interface {
+	// Gossip provides a view of the socket only receiving gossip, which is closed along with the transport; the socket
+	// itself outlives it, since memberlist and its transport are recreated e.g. when the advertise address changes.
+	Gossip() net.PacketConn
+}
+
+// deviceTransport implements the memberlist.Transport interface with all sockets bound to a specific network
+// device (SO_BINDTODEVICE), so multi-homed hosts can force gossip traffic through a given uplink, or with packets
+// sent and received via a shared socket.
+// It otherwise mimics memberlist.NetTransport: UDP for packets, ad-hoc TCP connections for streams.
+type deviceTransport struct {
+	device      string
+	bindAddr    string
+	packetCh    chan *memberlist.Packet
+	streamCh    chan net.Conn
+	tcpListener net.Listener
+	udpListener net.PacketConn
+	wg          sync.WaitGroup
+	shutdown    int32
+}
+
+func newDeviceTransport(device, bindAddr string, bindPort int, shared SharedSocket) (*deviceTransport, error) {
+	t := &deviceTransport{
+		device:   device,
+		bindAddr: bindAddr,
+		packetCh: make(chan *memberlist.Packet),
+		streamCh: make(chan net.Conn),
+	}
+
+	var udpListener net.PacketConn
+	if shared != nil {
+		udpListener = shared.Gossip()
+		bindPort = udpListener.LocalAddr().(*net.UDPAddr).Port
+	}
+	lc := net.ListenConfig{Control: t.control}
+	addr := net.JoinHostPort(bindAddr, fmt.Sprint(bindPort))
+	tcpListener, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		if udpListener != nil {
+			udpListener.Close()
+		}
+		return nil, fmt.Errorf("starting TCP listener on %s (%s): %w", addr, device, err)
+	}
+	if udpListener == nil {
+		// with port 0, listen for packets on the port picked for streams, like memberlist.NetTransport
+		addr = net.JoinHostPort(bindAddr, fmt.Sprint(tcpListener.Addr().(*net.TCPAddr).Port))
+		if udpListener, err = lc.ListenPacket(context.Background(), "udp", addr); err != nil {
+			tcpListener.Close()
+			return nil, fmt.Errorf("starting UDP listener on %s (%s): %w", addr, device, err)
+		}
+	}
+	t.tcpListener = tcpListener
+	t.udpListener = udpListener
+
+	t.wg.Add(2)
+	go t.tcpListen()
+	go t.udpListen()
+	return t, nil
+}
+
+// control binds the raw socket to the transport's device, if any
+func (t *deviceTransport) control(network, address string, c syscall.RawConn) error {
+	if t.device == "" {
+		return nil
+	}
+	var sockErr error
+	if err := c.Control(func(fd uintptr) {
+		sockErr = syscall.BindToDevice(int(fd), t.device)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// FinalAdvertiseAddr implements the memberlist.Transport interface
+func (t *deviceTransport) FinalAdvertiseAddr(ip string, port int) (net.IP, int, error) {
+	if ip == "" {
+		ip = t.bindAddr
+	}
+	if ip == "" || ip == "0.0.0.0" {
+		privateIP, err := sockaddr.GetPrivateIP()
+		if err != nil {
+			return nil, 0, fmt.Errorf("getting private IP: %w", err)
+		}
+		ip = privateIP
+	}
+	advertiseAddr := net.ParseIP(ip)
+	if advertiseAddr == nil {
+		return nil, 0, fmt.Errorf("failed to parse advertise address %q", ip)
+	}
+	if port == 0 {
+		port = t.tcpListener.Addr().(*net.TCPAddr).Port
+	}
+	return advertiseAddr, port, nil
+}
+
+// WriteTo implements the memberlist.Transport interface
+func (t *deviceTransport) WriteTo(b []byte, addr string) (time.Time, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return time.Time{}, err
+	}
+	_, err = t.udpListener.WriteTo(b, udpAddr)
+	return time.Now(), err
+}
+
+// PacketCh implements the memberlist.Transport interface
+func (t *deviceTransport) PacketCh() <-chan *memberlist.Packet {
+	return t.packetCh
+}
+
+// DialTimeout implements the memberlist.Transport interface
+func (t *deviceTransport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: timeout, Control: t.control}
+	return dialer.Dial("tcp", addr)
+}
+
+// StreamCh implements the memberlist.Transport interface
+func (t *deviceTransport) StreamCh() <-chan net.Conn {
+	return t.streamCh
+}
+
+// Shutdown implements the memberlist.Transport interface
+func (t *deviceTransport) Shutdown() error {
+	atomic.StoreInt32(&t.shutdown, 1)
+	t.tcpListener.Close()
+	t.udpListener.Close()
+	t.wg.Wait()
+	return nil
+}
+
+func (t *deviceTransport) isShutdown() bool {
+	return atomic.LoadInt32(&t.shutdown) == 1
+}
+
+func (t *deviceTransport) tcpListen() {
+	defer t.wg.Done()
+	for {
+		conn, err := t.tcpListener.Accept()
+		if err != nil {
+			if t.isShutdown() {
+				return
+			}
+			logrus.Debugf("error accepting TCP connection on %s: %s", t.device, err)
+			time.Sleep(time.Second)
+			continue
+		}
+		t.streamCh <- conn
+	}
+}
+
+func (t *deviceTransport) udpListen() {
+	defer t.wg.Done()
+	for {
+		buf := make([]byte, udpPacketBufSize)
+		n, addr, err := t.udpListener.ReadFrom(buf)
+		ts := time.Now()
+		if err != nil {
+			if t.isShutdown() {
+				return
+			}
+			logrus.Debugf("error reading UDP packet on %s: %s", t.device, err)
+			continue
+		}
+		if n < 1 {
+			continue
+		}
+		t.packetCh <- &memberlist.Packet{
+			Buf:       buf[:n],
+			From:      addr,
+			Timestamp: ts,
+		}
+	}
+}
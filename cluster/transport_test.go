@@ -0,0 +1,99 @@
+package cluster
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/costela/wesher/wg"
+)
+
+func Test_deviceTransport(t *testing.T) {
+	listen := func() *deviceTransport {
+		transport, err := newDeviceTransport("lo", "127.0.0.1", 0, nil)
+		if errors.Is(err, syscall.EPERM) || errors.Is(err, os.ErrPermission) {
+			t.Skip("binding to a device is not permitted")
+		}
+		if err != nil {
+			t.Fatalf("newDeviceTransport() error = %v", err)
+		}
+		return transport
+	}
+	sender, receiver := listen(), listen()
+	defer sender.Shutdown()
+	defer receiver.Shutdown()
+
+	ip, port, err := receiver.FinalAdvertiseAddr("", 0)
+	if err != nil || !ip.Equal(net.ParseIP("127.0.0.1")) || port != receiver.tcpListener.Addr().(*net.TCPAddr).Port {
+		t.Fatalf("FinalAdvertiseAddr() = %s, %d, %v; want the bind address and listening port", ip, port, err)
+	}
+	addr := (&net.TCPAddr{IP: ip, Port: port}).String()
+
+	if _, err := sender.WriteTo([]byte("ping"), addr); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+	select {
+	case packet := <-receiver.PacketCh():
+		if !bytes.Equal(packet.Buf, []byte("ping")) {
+			t.Errorf("received packet %q, want ping", packet.Buf)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("packet was not received")
+	}
+
+	conn, err := sender.DialTimeout(addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("DialTimeout() error = %v", err)
+	}
+	defer conn.Close()
+	select {
+	case accepted := <-receiver.StreamCh():
+		accepted.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream was not accepted")
+	}
+}
+
+func Test_deviceTransport_shared(t *testing.T) {
+	relay, err := wg.NewRelay("127.0.0.1:0", 51820)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	sender, err := newDeviceTransport("", "127.0.0.1", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Shutdown()
+
+	// the transport is recreated along with memberlist, e.g. when the advertise address changes
+	for i := 0; i < 2; i++ {
+		receiver, err := newDeviceTransport("", "127.0.0.1", 0, relay)
+		if err != nil {
+			t.Fatalf("newDeviceTransport() error = %v", err)
+		}
+		ip, port, err := receiver.FinalAdvertiseAddr("", 0)
+		shared := receiver.udpListener.LocalAddr().(*net.UDPAddr).Port
+		if err != nil || port != shared {
+			t.Fatalf("FinalAdvertiseAddr() = %s, %d, %v; want the port of the shared socket %d", ip, port, err, shared)
+		}
+		addr := (&net.TCPAddr{IP: ip, Port: port}).String()
+
+		if _, err := sender.WriteTo([]byte("ping"), addr); err != nil {
+			t.Fatalf("WriteTo() error = %v", err)
+		}
+		select {
+		case packet := <-receiver.PacketCh():
+			if !bytes.Equal(packet.Buf, []byte("ping")) {
+				t.Errorf("received packet %q, want ping", packet.Buf)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("packet was not received via the shared socket")
+		}
+		receiver.Shutdown()
+	}
+}
@@ -0,0 +1,33 @@
+package cluster
+
+import "time"
+
+// gossipTier is the recommended gossip tuning for clusters of up to members nodes
+type gossipTier struct {
+	members          int
+	pushPullInterval time.Duration
+	gossipNodes      int
+}
+
+// gossipTiers grow the push/pull interval with the cluster size, since every push/pull exchanges the metadata of all
+// nodes, and the fan-out roughly logarithmically, keeping the number of gossip rounds needed to reach every node low.
+// Memberlist additionally scales the push/pull interval itself for clusters above 32 nodes.
+var gossipTiers = []gossipTier{
+	{8, 30 * time.Second, 3},
+	{64, 60 * time.Second, 4},
+	{256, 120 * time.Second, 5},
+}
+
+// RecommendedGossip provides the recommended push/pull interval and gossip fan-out for the current cluster size
+func (c *Cluster) RecommendedGossip() (time.Duration, int) {
+	return recommendedGossip(c.numMembers())
+}
+
+func recommendedGossip(members int) (time.Duration, int) {
+	for _, tier := range gossipTiers {
+		if members <= tier.members {
+			return tier.pushPullInterval, tier.gossipNodes
+		}
+	}
+	return 300 * time.Second, 6
+}
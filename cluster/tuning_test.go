@@ -0,0 +1,26 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_recommendedGossip(t *testing.T) {
+	tests := []struct {
+		members      int
+		wantPushPull time.Duration
+		wantNodes    int
+	}{
+		{1, 30 * time.Second, 3},
+		{8, 30 * time.Second, 3},
+		{9, 60 * time.Second, 4},
+		{200, 120 * time.Second, 5},
+		{1000, 300 * time.Second, 6},
+	}
+	for _, tt := range tests {
+		pushPull, nodes := recommendedGossip(tt.members)
+		if pushPull != tt.wantPushPull || nodes != tt.wantNodes {
+			t.Errorf("recommendedGossip(%d) = %s, %d, want %s, %d", tt.members, pushPull, nodes, tt.wantPushPull, tt.wantNodes)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// InterfaceAddr provides the first global unicast address of the provided interface
+func InterfaceAddr(iface string) (string, error) {
+	link, err := net.InterfaceByName(iface)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not get interface by name %s", iface)
+	}
+	addrs, err := link.Addrs()
+	if err != nil {
+		return "", errors.Wrapf(err, "could not get addresses for interface %s", iface)
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.IsGlobalUnicast() {
+			return ipnet.IP.String(), nil
+		}
+	}
+	return "", errors.Errorf("no global address found on interface %s", iface)
+}
+
+// interfaceAddrsRetryDelay is the time waited before subscribing to address changes again after the subscription
+// failed or was closed
+var interfaceAddrsRetryDelay = 5 * time.Second
+
+// replaced in tests
+var (
+	addrSubscribe = netlink.AddrSubscribe
+	interfaceAddr = InterfaceAddr
+)
+
+// InterfaceAddrs pushes the address of the provided interface to a channel
+// The address is pushed after every address change on the interface, if it differs from the previous one. Failed
+// subscriptions to address changes are logged and retried, checking the address on every attempt, so no change is
+// missed in between.
+func InterfaceAddrs(iface string, current string) <-chan string {
+	addrc := make(chan string)
+	go func() {
+		for {
+			updatec := make(chan netlink.AddrUpdate)
+			done := make(chan struct{})
+			if err := addrSubscribe(updatec, done); err != nil {
+				logrus.WithError(err).Warnf("could not watch addresses of interface %s, retrying in %s", iface, interfaceAddrsRetryDelay)
+				time.Sleep(interfaceAddrsRetryDelay)
+				continue
+			}
+			for ok := true; ok; _, ok = <-updatec {
+				addr, err := interfaceAddr(iface)
+				if err != nil || addr == current {
+					continue
+				}
+				current = addr
+				addrc <- addr
+			}
+			close(done)
+			logrus.Warnf("watching addresses of interface %s stopped, retrying in %s", iface, interfaceAddrsRetryDelay)
+			time.Sleep(interfaceAddrsRetryDelay)
+		}
+	}()
+	return addrc
+}
+
+// commandAddrTimeout is the time after which the advertise address command is killed and considered failed
+var commandAddrTimeout = 10 * time.Second
+
+// CommandAddr provides the address printed by the provided shell command
+// The command is killed along with the processes it started if it does not finish within commandAddrTimeout, since
+// these would otherwise keep its output open.
+func CommandAddr(cmd string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), commandAddrTimeout)
+	defer cancel()
+	c := exec.CommandContext(ctx, "/bin/sh", "-c", cmd)
+	out := &bytes.Buffer{}
+	c.Stdout = out
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := c.Start(); err != nil {
+		return "", errors.Wrapf(err, "could not run advertise address command %q", cmd)
+	}
+	done := make(chan error, 1)
+	go func() { done <- c.Wait() }()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		unix.Kill(-c.Process.Pid, unix.SIGKILL) //nolint: errcheck // the group may have exited meanwhile
+		<-done
+		return "", errors.Errorf("advertise address command %q killed after timeout of %s", cmd, commandAddrTimeout)
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "could not run advertise address command %q", cmd)
+	}
+	addr := strings.TrimSpace(out.String())
+	if net.ParseIP(addr) == nil {
+		return "", errors.Errorf("advertise address command %q returned invalid address %q", cmd, addr)
+	}
+	return addr, nil
+}
+
+// CommandAddrs pushes the address printed by the provided shell command to a channel
+// The command is run at every interval and its result pushed if it differs from the previous one
+func CommandAddrs(cmd string, current string, interval time.Duration) <-chan string {
+	addrc := make(chan string)
+	go func() {
+		for range time.Tick(interval) {
+			addr, err := CommandAddr(cmd)
+			if err != nil || addr == current {
+				continue
+			}
+			current = addr
+			addrc <- addr
+		}
+	}()
+	return addrc
+}
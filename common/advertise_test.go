@@ -0,0 +1,121 @@
+package common
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+func Test_InterfaceAddrs(t *testing.T) {
+	defer func(subscribe func(chan<- netlink.AddrUpdate, <-chan struct{}) error, addr func(string) (string, error), delay time.Duration) {
+		addrSubscribe, interfaceAddr, interfaceAddrsRetryDelay = subscribe, addr, delay
+	}(addrSubscribe, interfaceAddr, interfaceAddrsRetryDelay)
+	interfaceAddrsRetryDelay = time.Millisecond
+
+	subscriptions := make(chan chan<- netlink.AddrUpdate, 2)
+	attempts := 0
+	addrSubscribe = func(updatec chan<- netlink.AddrUpdate, done <-chan struct{}) error {
+		attempts++
+		if attempts == 1 {
+			return errors.New("netlink unavailable")
+		}
+		subscriptions <- updatec
+		return nil
+	}
+	current := "192.0.2.1"
+	addrLock := sync.Mutex{}
+	interfaceAddr = func(iface string) (string, error) {
+		addrLock.Lock()
+		defer addrLock.Unlock()
+		return current, nil
+	}
+	setAddr := func(addr string) {
+		addrLock.Lock()
+		defer addrLock.Unlock()
+		current = addr
+	}
+	expect := func(addrc <-chan string, want string) {
+		select {
+		case addr := <-addrc:
+			if addr != want {
+				t.Errorf("InterfaceAddrs() pushed %s, want %s", addr, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("InterfaceAddrs() did not push %s", want)
+		}
+	}
+
+	addrc := InterfaceAddrs("eth0", "192.0.2.1")
+	updatec := <-subscriptions // after the failed attempt
+	setAddr("192.0.2.2")
+	updatec <- netlink.AddrUpdate{}
+	expect(addrc, "192.0.2.2")
+
+	// closed subscriptions are renewed, checking the address right away
+	setAddr("192.0.2.3")
+	close(updatec)
+	<-subscriptions
+	expect(addrc, "192.0.2.3")
+}
+
+func Test_CommandAddr(t *testing.T) {
+	defer func(timeout time.Duration) { commandAddrTimeout = timeout }(commandAddrTimeout)
+	commandAddrTimeout = 500 * time.Millisecond
+	tests := []struct {
+		name    string
+		cmd     string
+		want    string
+		wantErr string
+	}{
+		{"ipv4", "echo 192.0.2.1", "192.0.2.1", ""},
+		{"ipv6 with whitespace", "printf '  2001:db8::1\\n\\n'", "2001:db8::1", ""},
+		{"invalid address", "echo nowhere", "", "invalid address"},
+		{"empty output", "true", "", "invalid address"},
+		{"failure", "echo 192.0.2.1; exit 1", "", "could not run"},
+		{"timeout", "sleep 5", "", "timeout"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := CommandAddr(tt.cmd)
+			if (err != nil) != (tt.wantErr != "") || (err != nil && !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("CommandAddr() error = %v, want %q", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("CommandAddr() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_CommandAddrs(t *testing.T) {
+	f, err := ioutil.TempFile("", "wesher-addr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+	write := func(addr string) {
+		if err := ioutil.WriteFile(f.Name(), []byte(addr+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("192.0.2.1")
+
+	addrc := CommandAddrs("cat "+f.Name(), "192.0.2.1", 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond) // unchanged addresses are not pushed
+	write("192.0.2.2")
+	select {
+	case addr := <-addrc:
+		if addr != "192.0.2.2" {
+			t.Errorf("CommandAddrs() pushed %s, want 192.0.2.2", addr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("CommandAddrs() did not push the changed address")
+	}
+}
@@ -0,0 +1,28 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// WriteFileAtomic replaces the file with the content at once, so readers never see partial content
+func WriteFileAtomic(filePath string, content []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(path.Dir(filePath), path.Base(filePath)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filePath)
+}
@@ -0,0 +1,127 @@
+package common
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Blackholes installs short-lived unreachable routes for networks of departed nodes, so traffic to them fails fast with
+// ICMP unreachable instead of leaking out the default route or hanging.
+type Blackholes struct {
+	// Duration is the time an unreachable route is kept, unless the network is announced again earlier
+	Duration time.Duration
+
+	expiries map[string]time.Time
+	networks map[string]net.IPNet
+	// routeReplace and routeDel manipulate the routing table; they are only overridden in tests
+	routeReplace, routeDel func(*netlink.Route) error
+}
+
+// Update installs unreachable routes for the networks no longer announced by any node, and removes the ones for
+// networks announced again, so they can be routed over the mesh
+func (b *Blackholes) Update(previous, current []Node, now time.Time) error {
+	if b.expiries == nil {
+		b.expiries = make(map[string]time.Time)
+		b.networks = make(map[string]net.IPNet)
+	}
+	if b.routeReplace == nil {
+		b.routeReplace, b.routeDel = netlink.RouteReplace, netlink.RouteDel
+	}
+	announced := make(map[string]bool)
+	for _, node := range current {
+		announced[node.OverlayAddr.String()] = true
+		for _, route := range node.Routes {
+			announced[route.String()] = true
+		}
+	}
+
+	var errs []string
+	for key := range announced {
+		if _, ok := b.expiries[key]; ok {
+			if err := b.remove(key); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+	for _, network := range WithdrawnNetworks(previous, current) {
+		key := network.String()
+		if announced[key] {
+			continue // moved to another node
+		}
+		network := network
+		if err := b.routeReplace(unreachableRoute(&network)); err != nil {
+			errs = append(errs, errors.Wrapf(err, "could not add unreachable route for %s", key).Error())
+			continue
+		}
+		b.expiries[key] = now.Add(b.Duration)
+		b.networks[key] = network
+	}
+	return joinErrors(errs)
+}
+
+// Expire removes the unreachable routes kept for longer than Duration
+func (b *Blackholes) Expire(now time.Time) error {
+	var errs []string
+	for key, expiry := range b.expiries {
+		if !now.Before(expiry) {
+			if err := b.remove(key); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+	return joinErrors(errs)
+}
+
+// Clear removes all unreachable routes, e.g. on shutdown
+func (b *Blackholes) Clear() error {
+	return b.Expire(time.Unix(1<<62, 0))
+}
+
+// Next provides the earliest expiry of the unreachable routes, or the zero time if there are none
+func (b *Blackholes) Next() time.Time {
+	next := time.Time{}
+	for _, expiry := range b.expiries {
+		if next.IsZero() || expiry.Before(next) {
+			next = expiry
+		}
+	}
+	return next
+}
+
+// Networks provides the networks currently routed as unreachable, sorted
+func (b *Blackholes) Networks() []string {
+	networks := make([]string, 0, len(b.networks))
+	for key := range b.networks {
+		networks = append(networks, key)
+	}
+	sort.Strings(networks)
+	return networks
+}
+
+func (b *Blackholes) remove(key string) error {
+	network := b.networks[key]
+	delete(b.expiries, key)
+	delete(b.networks, key)
+	if err := b.routeDel(unreachableRoute(&network)); err != nil && !errors.Is(err, unix.ESRCH) {
+		return errors.Wrapf(err, "could not remove unreachable route for %s", key)
+	}
+	return nil
+}
+
+func unreachableRoute(dst *net.IPNet) *netlink.Route {
+	return &netlink.Route{Dst: dst, Type: unix.RTN_UNREACHABLE, Table: unix.RT_TABLE_MAIN}
+}
+
+func joinErrors(errs []string) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.Strings(errs)
+	return errors.New(strings.Join(errs, "; "))
+}
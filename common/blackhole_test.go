@@ -0,0 +1,62 @@
+package common
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+func Test_Blackholes(t *testing.T) {
+	routes := map[string]bool{}
+	b := &Blackholes{
+		Duration:     time.Minute,
+		routeReplace: func(r *netlink.Route) error { routes[r.Dst.String()] = true; return nil },
+		routeDel:     func(r *netlink.Route) error { delete(routes, r.Dst.String()); return nil },
+	}
+	node := func(name, overlay string, routes ...string) Node {
+		n := Node{Name: name}
+		_, addr, _ := net.ParseCIDR(overlay)
+		n.OverlayAddr = *addr
+		for _, route := range routes {
+			_, network, _ := net.ParseCIDR(route)
+			n.Routes = append(n.Routes, *network)
+		}
+		return n
+	}
+	now := time.Unix(1000, 0)
+	before := []Node{node("node1", "10.0.0.1/32", "192.168.1.0/24"), node("node2", "10.0.0.2/32", "192.168.2.0/24")}
+
+	// node2 leaves, its routed network moves to node1
+	after := []Node{node("node1", "10.0.0.1/32", "192.168.1.0/24", "192.168.2.0/24")}
+	if err := b.Update(before, after, now); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.Networks(); !reflect.DeepEqual(got, []string{"10.0.0.2/32"}) || !routes["10.0.0.2/32"] {
+		t.Errorf("Update() unreachable = %v, routes %v; want only 10.0.0.2/32", got, routes)
+	}
+	if next := b.Next(); !next.Equal(now.Add(time.Minute)) {
+		t.Errorf("Next() = %s, want in a minute", next)
+	}
+
+	// node2 rejoins before expiry
+	if err := b.Update(after, before, now.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Networks()) != 0 || len(routes) != 0 {
+		t.Errorf("Update() after rejoin = %v, routes %v; want none", b.Networks(), routes)
+	}
+
+	// node1 leaves, until expiry
+	if err := b.Update(before, before[1:], now); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Expire(now.Add(30 * time.Second)); err != nil || len(routes) != 2 {
+		t.Errorf("Expire() before expiry = %v, routes %v; want both kept", err, routes)
+	}
+	if err := b.Expire(now.Add(time.Minute)); err != nil || len(routes) != 0 || !b.Next().IsZero() {
+		t.Errorf("Expire() = %v, routes %v; want all removed", err, routes)
+	}
+}
@@ -0,0 +1,66 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// RouteConflict describes two nodes announcing overlapping routed networks
+type RouteConflict struct {
+	Node       string
+	Route      net.IPNet
+	OtherNode  string
+	OtherRoute net.IPNet
+}
+
+func (rc RouteConflict) String() string {
+	return fmt.Sprintf("%s (%s) overlaps %s (%s)", &rc.Route, rc.Node, &rc.OtherRoute, rc.OtherNode)
+}
+
+// ResolveRouteConflicts detects routed networks announced by more than one node and deterministically resolves them.
+// Overlapping networks of different sizes are kept, since both wireguard and the kernel route by longest prefix,
+// making the most specific announcement win. Identical networks are only kept for the node with the lowest name,
+// instead of whichever node happened to be configured last.
+// The nodes' routes are replaced, without touching the slices they shared, and all detected conflicts are returned.
+func ResolveRouteConflicts(nodes []Node) []RouteConflict {
+	sorted := make([]*Node, len(nodes))
+	for i := range nodes {
+		sorted[i] = &nodes[i]
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	conflicts := make([]RouteConflict, 0)
+	for i, node := range sorted {
+		for _, other := range sorted[i+1:] {
+			kept := make([]net.IPNet, 0, len(other.Routes)) // the routes may be shared, e.g. with the cluster state
+			for _, otherRoute := range other.Routes {
+				identical := false
+				for _, route := range node.Routes {
+					if !Overlaps(&route, &otherRoute) {
+						continue
+					}
+					conflicts = append(conflicts, RouteConflict{
+						Node:       node.Name,
+						Route:      route,
+						OtherNode:  other.Name,
+						OtherRoute: otherRoute,
+					})
+					if sameNetwork(route, otherRoute) {
+						identical = true
+					}
+				}
+				if !identical {
+					kept = append(kept, otherRoute)
+				}
+			}
+			other.Routes = kept
+		}
+	}
+	return conflicts
+}
+
+func sameNetwork(a, b net.IPNet) bool {
+	return a.IP.Equal(b.IP) && bytes.Equal(a.Mask, b.Mask)
+}
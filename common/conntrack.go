@@ -0,0 +1,65 @@
+package common
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// networksFilter matches conntrack flows from or to any of its networks, in either direction
+type networksFilter []net.IPNet
+
+// MatchConntrackFlow implements the netlink.CustomConntrackFilter interface
+func (f networksFilter) MatchConntrackFlow(flow *netlink.ConntrackFlow) bool {
+	for _, network := range f {
+		for _, ip := range []net.IP{flow.Forward.SrcIP, flow.Forward.DstIP, flow.Reverse.SrcIP, flow.Reverse.DstIP} {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// FlushConntrack deletes all conntrack entries from or to the provided networks, so their flows are re-established
+// over the current path instead of hanging until they time out
+func FlushConntrack(networks []net.IPNet) (uint, error) {
+	if len(networks) == 0 {
+		return 0, nil
+	}
+	var flushed uint
+	for _, family := range []netlink.InetFamily{unix.AF_INET, unix.AF_INET6} {
+		n, err := netlink.ConntrackDeleteFilter(netlink.ConntrackTable, family, networksFilter(networks))
+		if err != nil {
+			return flushed, errors.Wrap(err, "could not flush conntrack entries")
+		}
+		flushed += n
+	}
+	return flushed, nil
+}
+
+// WithdrawnNetworks provides the overlay addresses of nodes which left and the routes no longer announced by the
+// node previously announcing them, even if another node took them over
+func WithdrawnNetworks(previous, current []Node) []net.IPNet {
+	announced := make(map[string]bool)
+	for _, node := range current {
+		announced[node.Name+" "+node.OverlayAddr.String()] = true
+		for _, route := range node.Routes {
+			announced[node.Name+" "+route.String()] = true
+		}
+	}
+	withdrawn := make([]net.IPNet, 0)
+	for _, node := range previous {
+		if !announced[node.Name+" "+node.OverlayAddr.String()] {
+			withdrawn = append(withdrawn, node.OverlayAddr)
+		}
+		for _, route := range node.Routes {
+			if !announced[node.Name+" "+route.String()] {
+				withdrawn = append(withdrawn, route)
+			}
+		}
+	}
+	return withdrawn
+}
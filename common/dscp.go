@@ -0,0 +1,84 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// dscpClass matches the symbolic DSCP class names (e.g. cs1, af41)
+var dscpClass = regexp.MustCompile(`^(cs[0-7]|af[1-4][1-3])$`)
+
+// nftInvalid matches characters not allowed in nftables identifiers
+var nftInvalid = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// ParseDSCP parses a DSCP value, either as a number between 0 and 63 or as a class name (ef, le, csN or afXY)
+func ParseDSCP(value string) (uint8, error) {
+	value = strings.ToLower(value)
+	switch {
+	case value == "ef":
+		return 46, nil
+	case value == "le":
+		return 1, nil
+	case dscpClass.MatchString(value) && value[:2] == "cs":
+		return (value[2] - '0') << 3, nil
+	case dscpClass.MatchString(value):
+		return (value[2]-'0')<<3 | (value[3]-'0')<<1, nil
+	}
+	dscp, err := strconv.ParseUint(value, 0, 8)
+	if err != nil || dscp > 63 {
+		return 0, errors.Errorf("invalid DSCP value %q; expected 0-63, ef, le, csN or afXY", value)
+	}
+	return uint8(dscp), nil
+}
+
+// DSCPMarking sets the DSCP field of the packets sent by the wireguard interface, so network operators can prioritize
+// mesh traffic on their links.
+// The kernel wireguard socket cannot be configured directly, so its packets are recognized by their firewall mark and
+// rewritten by an nftables table owned by wesher.
+type DSCPMarking struct {
+	Iface string
+	Mark  int
+	DSCP  uint8
+}
+
+// Apply creates or replaces the nftables table marking the packets
+func (d *DSCPMarking) Apply() error {
+	return d.run(d.script(), "could not set up DSCP marking")
+}
+
+// Remove deletes the nftables table marking the packets
+func (d *DSCPMarking) Remove() error {
+	return d.run(fmt.Sprintf("delete table inet %s\n", d.table()), "could not remove DSCP marking")
+}
+
+func (d *DSCPMarking) run(script, msg string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "%s: %s", msg, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// table provides the name of the nftables table, which is unique per wireguard interface
+func (d *DSCPMarking) table() string {
+	return "wesher_dscp_" + nftInvalid.ReplaceAllString(d.Iface, "_")
+}
+
+// script provides the nft script (re)creating the table in a single transaction
+func (d *DSCPMarking) script() string {
+	table := d.table()
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "add table inet %s\n", table)
+	fmt.Fprintf(b, "flush table inet %s\n", table)
+	fmt.Fprintf(b, "add chain inet %s output { type filter hook output priority -150; }\n", table)
+	fmt.Fprintf(b, "add rule inet %s output meta mark %#x ip dscp set %d\n", table, d.Mark, d.DSCP)
+	fmt.Fprintf(b, "add rule inet %s output meta mark %#x ip6 dscp set %d\n", table, d.Mark, d.DSCP)
+	return b.String()
+}
@@ -0,0 +1,80 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// EventLog appends events as JSON lines to a file, separate from the human readable logs, so external collectors can
+// tail it. The file is rotated once it exceeds MaxSize, keeping MaxFiles rotated files (path.1 being the most recent).
+type EventLog struct {
+	Path     string
+	MaxSize  int64 // bytes; 0 disables rotation
+	MaxFiles int
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+// Write appends the JSON encoding of the provided event, rotating the file if needed
+func (l *EventLog) Write(event interface{}) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "could not encode event")
+	}
+	line = append(line, '\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.file != nil && l.MaxSize > 0 && l.size+int64(len(line)) > l.MaxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	if l.file == nil {
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return errors.Wrapf(err, "could not write event to %s", l.Path)
+}
+
+func (l *EventLog) open() error {
+	file, err := os.OpenFile(l.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return errors.Wrapf(err, "could not open event log %s", l.Path)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.Wrapf(err, "could not stat event log %s", l.Path)
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+// rotate shifts the rotated files, dropping the oldest one, and moves the current file to path.1
+func (l *EventLog) rotate() error {
+	l.file.Close()
+	l.file = nil
+	if l.MaxFiles < 1 {
+		return errors.Wrapf(os.Remove(l.Path), "could not truncate event log %s", l.Path)
+	}
+	for i := l.MaxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(l.rotated(i), l.rotated(i+1)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "could not rotate event log")
+		}
+	}
+	return errors.Wrap(os.Rename(l.Path, l.rotated(1)), "could not rotate event log")
+}
+
+func (l *EventLog) rotated(i int) string {
+	return fmt.Sprintf("%s.%d", l.Path, i)
+}
@@ -0,0 +1,40 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func Test_EventLog_Write(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wesher-events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l := &EventLog{Path: path.Join(dir, "events.jsonl"), MaxSize: 20, MaxFiles: 2}
+	for _, n := range []int{1, 2, 3, 4} {
+		if err := l.Write(map[string]int{"event": n}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// every event is 12 bytes long, so each file holds a single one
+	for file, want := range map[string]string{
+		"events.jsonl":   "{\"event\":4}\n",
+		"events.jsonl.1": "{\"event\":3}\n",
+		"events.jsonl.2": "{\"event\":2}\n",
+	} {
+		got, err := ioutil.ReadFile(path.Join(dir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s = %q, want %q", file, got, want)
+		}
+	}
+	if _, err := os.Stat(path.Join(dir, "events.jsonl.3")); !os.IsNotExist(err) {
+		t.Error("Write() kept more rotated files than MaxFiles")
+	}
+}
@@ -0,0 +1,23 @@
+package common
+
+import (
+	"bytes"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// LocalFacts sets the facts describing the local host on the node: its operating system, architecture and kernel
+// release, if it can be determined
+func LocalFacts(node *Node) {
+	node.OS = runtime.GOOS
+	node.Arch = runtime.GOARCH
+	uname := unix.Utsname{}
+	if err := unix.Uname(&uname); err == nil {
+		release := uname.Release[:]
+		if end := bytes.IndexByte(release, 0); end >= 0 {
+			release = release[:end]
+		}
+		node.Kernel = string(release)
+	}
+}
@@ -0,0 +1,113 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Federation is what a gateway node shares of its mesh with the instance of a peer mesh running on the same host,
+// which announces it to its own mesh as routes and routed hosts; forwarding between both interfaces is left to the
+// kernel of the gateway.
+type Federation struct {
+	Networks []string            `json:"networks"` // CIDR format
+	Hosts    map[string][]string `json:"hosts"`    // host names by address
+}
+
+// NewFederation describes the overlay network and routes of the mesh, along with the host names matching any of the
+// shell patterns
+// The routes imported from the peer mesh must be excluded, so they are not echoed back.
+func NewFederation(overlayNet *net.IPNet, routes []net.IPNet, hosts map[string][]string, patterns []string) Federation {
+	networks := AggregateNetworks(append([]net.IPNet{*overlayNet}, routes...))
+	f := Federation{Networks: make([]string, len(networks)), Hosts: make(map[string][]string)}
+	for i := range networks {
+		f.Networks[i] = networks[i].String()
+	}
+	for ip, names := range hosts {
+		for _, name := range names {
+			for _, pattern := range patterns {
+				if ok, _ := path.Match(pattern, name); ok {
+					f.Hosts[ip] = append(f.Hosts[ip], name)
+					break
+				}
+			}
+		}
+		sort.Strings(f.Hosts[ip])
+	}
+	return f
+}
+
+// Routes provides the shared networks, except the ones overlapping the overlay network of the importing mesh, which
+// cannot be routed
+func (f Federation) Routes(overlayNet *net.IPNet) []net.IPNet {
+	routes := make([]net.IPNet, 0, len(f.Networks))
+	for _, network := range f.Networks {
+		_, parsed, err := net.ParseCIDR(network)
+		if err != nil {
+			logrus.Warnf("ignoring invalid federated network %q", network)
+			continue
+		}
+		if Overlaps(overlayNet, parsed) {
+			logrus.Warnf("ignoring federated network %s overlapping overlay network %s", parsed, overlayNet)
+			continue
+		}
+		routes = append(routes, *parsed)
+	}
+	return routes
+}
+
+// WriteFederationFile atomically replaces the federation file, so the importing instance never reads partial content
+func WriteFederationFile(filePath string, f Federation) error {
+	content, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(WriteFileAtomic(filePath, content, 0600), "could not write federation file")
+}
+
+// ReadFederationFile reads a federation file written by WriteFederationFile
+func ReadFederationFile(filePath string) (Federation, error) {
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return Federation{}, errors.Wrapf(err, "could not read federation file %s", filePath)
+	}
+	return decodeFederation(content)
+}
+
+func decodeFederation(content []byte) (Federation, error) {
+	f := Federation{}
+	if err := json.Unmarshal(content, &f); err != nil {
+		return Federation{}, errors.Wrap(err, "could not decode federation file")
+	}
+	return f, nil
+}
+
+// WatchFederationFile pushes the content of the federation file to a channel, every time it changes
+// Files which cannot be read or decoded are logged and skipped until they are fixed.
+func WatchFederationFile(filePath string) <-chan Federation {
+	federationc := make(chan Federation)
+	current, _ := ioutil.ReadFile(filePath)
+	go func() {
+		for range time.Tick(networksFilePollInterval) {
+			content, err := ioutil.ReadFile(filePath)
+			if err != nil || bytes.Equal(content, current) {
+				continue
+			}
+			current = content
+			f, err := decodeFederation(content)
+			if err != nil {
+				logrus.WithError(err).Warnf("ignoring invalid federation file %s", filePath)
+				continue
+			}
+			federationc <- f
+		}
+	}()
+	return federationc
+}
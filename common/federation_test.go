@@ -0,0 +1,49 @@
+package common
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func Test_Federation(t *testing.T) {
+	_, overlayNet, _ := net.ParseCIDR("10.0.0.0/16")
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+	_, lanPart, _ := net.ParseCIDR("192.168.1.128/25")
+	hosts := map[string][]string{
+		"10.0.0.1":    {"db1", "web1"},
+		"10.0.0.2":    {"web2"},
+		"192.168.1.5": {"db-lan"},
+	}
+	f := NewFederation(overlayNet, []net.IPNet{*lan, *lanPart}, hosts, []string{"db*"})
+	if want := []string{"10.0.0.0/16", "192.168.1.0/24"}; !reflect.DeepEqual(f.Networks, want) {
+		t.Errorf("NewFederation() networks = %v, want %v", f.Networks, want)
+	}
+	if want := map[string][]string{"10.0.0.1": {"db1"}, "192.168.1.5": {"db-lan"}}; !reflect.DeepEqual(f.Hosts, want) {
+		t.Errorf("NewFederation() hosts = %v, want %v", f.Hosts, want)
+	}
+
+	dir, err := ioutil.TempDir("", "wesher-federation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "federation.json")
+	if err := WriteFederationFile(file, f); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadFederationFile(file)
+	if err != nil || !reflect.DeepEqual(read, f) {
+		t.Errorf("ReadFederationFile() = %v, %v, want %v", read, err, f)
+	}
+
+	// the importing mesh uses an overlapping LAN as overlay network
+	_, importingNet, _ := net.ParseCIDR("192.168.0.0/16")
+	routes := read.Routes(importingNet)
+	if len(routes) != 1 || routes[0].String() != "10.0.0.0/16" {
+		t.Errorf("Federation.Routes() = %v, want only the non-overlapping network", routes)
+	}
+}
@@ -0,0 +1,73 @@
+package common
+
+import (
+	"context"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/pkg/errors"
+)
+
+// firewalld D-Bus API
+const (
+	firewalldName = "org.fedoraproject.FirewallD1"
+	firewalldPath = "/org/fedoraproject/FirewallD1"
+	firewalldZone = "org.fedoraproject.FirewallD1.zone"
+)
+
+// firewalldTimeout bounds each call to firewalld, so a wedged firewalld cannot block startup or shutdown
+const firewalldTimeout = 10 * time.Second
+
+// FirewalldZone places an interface into a firewalld zone, at runtime only; the permanent configuration is left
+// untouched, since the interface only exists while wesher runs.
+// firewalld is called directly over D-Bus.
+type FirewalldZone struct {
+	Zone  string
+	Iface string
+	// Address is the address of the bus firewalld is on; the system bus is used if not set.
+	Address string
+}
+
+// Add adds the interface to the zone, moving it from any zone it was previously in
+func (z *FirewalldZone) Add() error {
+	return z.call("changeZoneOfInterface")
+}
+
+// Remove removes the interface from the zone
+func (z *FirewalldZone) Remove() error {
+	return z.call("removeInterface")
+}
+
+func (z *FirewalldZone) call(method string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), firewalldTimeout)
+	defer cancel()
+	conn, err := z.connect(ctx)
+	if err != nil {
+		return errors.Wrap(err, "could not connect to firewalld")
+	}
+	defer conn.Close()
+	call := conn.Object(firewalldName, firewalldPath).CallWithContext(ctx, firewalldZone+"."+method, 0, z.Zone, z.Iface)
+	return errors.Wrapf(call.Err, "could not call firewalld %s for zone %s and interface %s", method, z.Zone, z.Iface)
+}
+
+func (z *FirewalldZone) connect(ctx context.Context) (*dbus.Conn, error) {
+	var conn *dbus.Conn
+	var err error
+	if z.Address != "" {
+		conn, err = dbus.Dial(z.Address, dbus.WithContext(ctx))
+	} else {
+		conn, err = dbus.SystemBusPrivate(dbus.WithContext(ctx))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Auth(nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := conn.Hello(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,118 @@
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const testBusConfig = `<!DOCTYPE busconfig PUBLIC "-//freedesktop//DTD D-Bus Bus Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/busconfig.dtd">
+<busconfig>
+  <type>session</type>
+  <listen>%s</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>
+`
+
+// fakeFirewalld records the zones of interfaces, like the firewalld zone interface
+type fakeFirewalld struct {
+	lock  sync.Mutex
+	zones map[string]string
+}
+
+func (f *fakeFirewalld) ChangeZoneOfInterface(zone, iface string) (string, *dbus.Error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.zones[iface] = zone
+	return zone, nil
+}
+
+func (f *fakeFirewalld) RemoveInterface(zone, iface string) (string, *dbus.Error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.zones[iface] != zone {
+		return "", dbus.NewError("org.fedoraproject.FirewallD1.Exception", []interface{}{"UNKNOWN_INTERFACE"})
+	}
+	delete(f.zones, iface)
+	return zone, nil
+}
+
+func (f *fakeFirewalld) zone(iface string) string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.zones[iface]
+}
+
+func Test_FirewalldZone(t *testing.T) {
+	if _, err := exec.LookPath("dbus-daemon"); err != nil {
+		t.Skip("dbus-daemon not available")
+	}
+	dir, err := ioutil.TempDir("", "wesher-firewalld")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	address := "unix:path=" + path.Join(dir, "bus")
+	configPath := path.Join(dir, "bus.conf")
+	if err := ioutil.WriteFile(configPath, []byte(fmt.Sprintf(testBusConfig, address)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	daemon := exec.Command("dbus-daemon", "--config-file="+configPath, "--nofork")
+	if err := daemon.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer daemon.Process.Kill() // nolint: errcheck
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(path.Join(dir, "bus")); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	z := &FirewalldZone{Zone: "trusted", Iface: "wgtest", Address: address}
+	if err := z.Add(); err == nil {
+		t.Error("Add() without firewalld succeeded, want an error")
+	}
+
+	conn, err := dbus.Dial(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.Auth(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Hello(); err != nil {
+		t.Fatal(err)
+	}
+	firewalld := &fakeFirewalld{zones: map[string]string{}}
+	if err := conn.ExportWithMap(firewalld, map[string]string{"ChangeZoneOfInterface": "changeZoneOfInterface", "RemoveInterface": "removeInterface"}, firewalldPath, firewalldZone); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.RequestName(firewalldName, dbus.NameFlagDoNotQueue); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := z.Add(); err != nil || firewalld.zone("wgtest") != "trusted" {
+		t.Errorf("Add() error = %v, zone %q; want wgtest in trusted", err, firewalld.zone("wgtest"))
+	}
+	if err := z.Remove(); err != nil || firewalld.zone("wgtest") != "" {
+		t.Errorf("Remove() error = %v, zone %q; want none", err, firewalld.zone("wgtest"))
+	}
+	if err := z.Remove(); err == nil {
+		t.Error("Remove() of a removed interface succeeded, want the firewalld error")
+	}
+}
@@ -0,0 +1,22 @@
+package common
+
+import "strings"
+
+// ValidHostname reports whether the provided name can be safely used as a hostname (RFC 1123)
+// Since names are gossiped by other nodes and written to the hosts file, anything else must be rejected.
+func ValidHostname(name string) bool {
+	if len(name) == 0 || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,31 @@
+package common
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ParseLabels parses KEY=VALUE labels; later occurrences of a key override earlier ones
+func ParseLabels(entries []string) (map[string]string, error) {
+	labels := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.Errorf("invalid label %q, expected KEY=VALUE", entry)
+		}
+		labels[parts[0]] = parts[1]
+	}
+	return labels, nil
+}
+
+// MatchLabels checks whether the labels have all the key/value pairs of the selector; an empty selector matches any
+// labels
+func MatchLabels(labels, selector map[string]string) bool {
+	for key, value := range selector {
+		if actual, ok := labels[key]; !ok || actual != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,59 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_ParseLabels(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"none", nil, map[string]string{}, false},
+		{"simple", []string{"env=prod", "zone=a"}, map[string]string{"env": "prod", "zone": "a"}, false},
+		{"empty value", []string{"canary="}, map[string]string{"canary": ""}, false},
+		{"value with separator", []string{"rule=a=b"}, map[string]string{"rule": "a=b"}, false},
+		{"override", []string{"env=dev", "env=prod"}, map[string]string{"env": "prod"}, false},
+		{"no separator", []string{"env"}, nil, true},
+		{"empty key", []string{"=prod"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseLabels(tt.entries)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseLabels() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseLabels() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_MatchLabels(t *testing.T) {
+	labels := map[string]string{"env": "prod", "zone": "a"}
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		selector map[string]string
+		want     bool
+	}{
+		{"empty selector", nil, nil, true},
+		{"single match", labels, map[string]string{"env": "prod"}, true},
+		{"all match", labels, map[string]string{"env": "prod", "zone": "a"}, true},
+		{"value mismatch", labels, map[string]string{"env": "dev"}, false},
+		{"partial match", labels, map[string]string{"env": "prod", "zone": "b"}, false},
+		{"missing key", labels, map[string]string{"team": "db"}, false},
+		{"unlabeled node", nil, map[string]string{"env": "prod"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MatchLabels(tt.labels, tt.selector); got != tt.want {
+				t.Errorf("MatchLabels() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,14 @@
+package common
+
+// Leader provides the name of the current mesh leader: the lowest name among the local node and the provided members
+// Every node computes the same leader from the same membership, without any extra coordination, so it can be used to
+// run singleton jobs. During membership changes, nodes may briefly disagree.
+func Leader(localName string, nodes []Node) string {
+	leader := localName
+	for _, node := range nodes {
+		if node.Name < leader {
+			leader = node.Name
+		}
+	}
+	return leader
+}
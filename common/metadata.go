@@ -0,0 +1,56 @@
+package common
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// metadata limits, keeping it small enough for gossip and within a single DNS TXT string per entry
+const (
+	MaxMetadataEntries  = 16
+	MaxMetadataKeyLen   = 63
+	MaxMetadataValueLen = 191 // leaves room for the key in a 255 byte TXT string
+)
+
+// ValidMetadata checks a single metadata entry
+// Keys are limited to lower case letters, digits, dots, dashes and underscores, values to printable ASCII, since both are
+// gossiped by other nodes and passed on to DNS, scripts and templates.
+func ValidMetadata(key, value string) error {
+	if key == "" || len(key) > MaxMetadataKeyLen {
+		return errors.Errorf("invalid metadata key %q, expected 1 to %d characters", key, MaxMetadataKeyLen)
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_') {
+			return errors.Errorf("invalid metadata key %q, expected lower case letters, digits, dots, dashes or underscores", key)
+		}
+	}
+	if len(value) > MaxMetadataValueLen {
+		return errors.Errorf("metadata value of %s exceeds %d bytes", key, MaxMetadataValueLen)
+	}
+	for _, c := range value {
+		if c < ' ' || c > '~' {
+			return errors.Errorf("invalid metadata value of %s, expected printable ASCII", key)
+		}
+	}
+	return nil
+}
+
+// ParseMetadata parses and checks KEY=VALUE metadata entries; later occurrences of a key override earlier ones
+func ParseMetadata(entries []string) (map[string]string, error) {
+	metadata := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid metadata %q, expected KEY=VALUE", entry)
+		}
+		if err := ValidMetadata(parts[0], parts[1]); err != nil {
+			return nil, err
+		}
+		metadata[parts[0]] = parts[1]
+	}
+	if len(metadata) > MaxMetadataEntries {
+		return nil, errors.Errorf("%d metadata entries exceed the maximum of %d", len(metadata), MaxMetadataEntries)
+	}
+	return metadata, nil
+}
@@ -0,0 +1,40 @@
+package common
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMetadata(t *testing.T) {
+	tooMany := []string{}
+	for i := 0; i <= MaxMetadataEntries; i++ {
+		tooMany = append(tooMany, fmt.Sprintf("key%d=value", i))
+	}
+	tests := []struct {
+		name    string
+		entries []string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"valid", []string{"rack=r12", "maintenance=", "dc=fra 1", "rack=r13"}, map[string]string{"rack": "r13", "maintenance": "", "dc": "fra 1"}, false},
+		{"missing value", []string{"rack"}, nil, true},
+		{"empty key", []string{"=r12"}, nil, true},
+		{"upper case key", []string{"Rack=r12"}, nil, true},
+		{"control character", []string{"rack=r12\nevil"}, nil, true},
+		{"too long", []string{"rack=" + strings.Repeat("r", MaxMetadataValueLen+1)}, nil, true},
+		{"too many", tooMany, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseMetadata(tt.entries)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseMetadata() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseMetadata() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package common
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Metrics is a minimal registry of metrics, exposed in the Prometheus text format
+// Values are collected when scraped, so they are never stale and need no updating from the main loop.
+type Metrics struct {
+	lock    sync.Mutex
+	metrics []metric // in registration order
+}
+
+type metric struct {
+	name, help, kind string
+	value            func() float64
+}
+
+// GaugeFunc registers a gauge whose value is provided by the function when scraped; it must be safe for concurrent
+// use
+func (m *Metrics) GaugeFunc(name, help string, value func() float64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.metrics = append(m.metrics, metric{name: name, help: help, kind: "gauge", value: value})
+}
+
+// CounterFunc registers a counter whose value is provided by the function when scraped; it must be safe for
+// concurrent use
+func (m *Metrics) CounterFunc(name, help string, value func() float64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.metrics = append(m.metrics, metric{name: name, help: help, kind: "counter", value: value})
+}
+
+// Counter registers a counter incremented by the caller
+func (m *Metrics) Counter(name, help string) *Counter {
+	c := &Counter{}
+	m.CounterFunc(name, help, func() float64 { return float64(c.Value()) })
+	return c
+}
+
+// Counter is a monotonically increasing count, safe for concurrent use
+type Counter struct {
+	value uint64
+}
+
+// Inc increments the counter
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+// Value provides the current count
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// ServeHTTP implements http.Handler, writing all metrics
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.lock.Lock()
+	metrics := append([]metric{}, m.metrics...)
+	m.lock.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	for _, metric := range metrics {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", metric.name, metric.help, metric.name, metric.kind, metric.name, metric.value())
+	}
+	bw.Flush()
+}
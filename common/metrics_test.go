@@ -0,0 +1,40 @@
+package common
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_Metrics_ServeHTTP(t *testing.T) {
+	m := &Metrics{}
+	value := 1.0
+	m.GaugeFunc("wesher_test", "a test gauge", func() float64 { return value })
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	want := "# HELP wesher_test a test gauge\n# TYPE wesher_test gauge\nwesher_test 1\n"
+	if got := rec.Body.String(); got != want {
+		t.Errorf("ServeHTTP() = %q, want %q", got, want)
+	}
+
+	value = 2.5
+	rec = httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if got := rec.Body.String(); got != "# HELP wesher_test a test gauge\n# TYPE wesher_test gauge\nwesher_test 2.5\n" {
+		t.Errorf("ServeHTTP() = %q, want the updated value", got)
+	}
+}
+
+func Test_Metrics_Counter(t *testing.T) {
+	m := &Metrics{}
+	c := m.Counter("wesher_test_total", "a test counter")
+	c.Inc()
+	c.Inc()
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	want := "# HELP wesher_test_total a test counter\n# TYPE wesher_test_total counter\nwesher_test_total 2\n"
+	if got := rec.Body.String(); got != want {
+		t.Errorf("ServeHTTP() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,121 @@
+package common
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+)
+
+// maxNDPProxyHostBits is the size of the largest routed IPv6 network proxied address by address; the kernel only
+// supports proxying single addresses, so larger networks are only proxied for their routed hosts
+const maxNDPProxyHostBits = 8 // i.e. at most 256 addresses per network
+
+// NDPProxy answers IPv6 neighbor solicitations on a LAN interface for addresses reachable over the mesh, the IPv6
+// counterpart of proxy-ARP.
+// Unlike proxy-ARP, the kernel needs an explicit proxy entry for every address, which are kept in sync using SetNodes.
+type NDPProxy struct {
+	Iface string
+
+	current map[string]net.IP
+}
+
+// Enable enables NDP proxying on the interface, returning the previous setting so it can be restored
+func (p *NDPProxy) Enable() (string, error) {
+	return SetSysctl(fmt.Sprintf("net/ipv6/conf/%s/proxy_ndp", p.Iface), "1")
+}
+
+// Restore removes all proxy entries and restores the provided NDP proxying setting
+func (p *NDPProxy) Restore(previous string) error {
+	if err := p.setAddrs(nil); err != nil {
+		return err
+	}
+	_, err := SetSysctl(fmt.Sprintf("net/ipv6/conf/%s/proxy_ndp", p.Iface), previous)
+	return err
+}
+
+// SetNodes replaces the proxy entries with the IPv6 addresses reachable via the provided nodes
+func (p *NDPProxy) SetNodes(nodes []Node) error {
+	return p.setAddrs(NDPProxyAddrs(nodes))
+}
+
+func (p *NDPProxy) setAddrs(addrs []net.IP) error {
+	link, err := netlink.LinkByName(p.Iface)
+	if err != nil {
+		return errors.Wrapf(err, "could not get link information for %s", p.Iface)
+	}
+	desired := make(map[string]net.IP, len(addrs))
+	for _, addr := range addrs {
+		desired[addr.String()] = addr
+	}
+	for key, addr := range p.current {
+		if _, ok := desired[key]; ok {
+			continue
+		}
+		if err := netlink.NeighDel(p.neigh(link, addr)); err != nil {
+			return errors.Wrapf(err, "could not remove NDP proxy entry for %s", addr)
+		}
+		delete(p.current, key)
+	}
+	if p.current == nil {
+		p.current = make(map[string]net.IP)
+	}
+	for key, addr := range desired {
+		if _, ok := p.current[key]; ok {
+			continue
+		}
+		if err := netlink.NeighSet(p.neigh(link, addr)); err != nil {
+			return errors.Wrapf(err, "could not add NDP proxy entry for %s", addr)
+		}
+		p.current[key] = addr
+	}
+	return nil
+}
+
+func (p *NDPProxy) neigh(link netlink.Link, addr net.IP) *netlink.Neigh {
+	return &netlink.Neigh{
+		LinkIndex: link.Attrs().Index,
+		Family:    netlink.FAMILY_V6,
+		Flags:     netlink.NTF_PROXY,
+		IP:        addr,
+	}
+}
+
+// NDPProxyAddrs provides the IPv6 addresses reachable via the provided nodes: their overlay addresses, the addresses
+// of small routed networks and their routed hosts
+func NDPProxyAddrs(nodes []Node) []net.IP {
+	addrs := make([]net.IP, 0)
+	for _, node := range nodes {
+		if node.OverlayAddr.IP.To4() == nil && node.OverlayAddr.IP != nil {
+			addrs = append(addrs, node.OverlayAddr.IP)
+		}
+		for _, route := range node.Routes {
+			ones, bits := route.Mask.Size()
+			if route.IP.To4() != nil || bits-ones > maxNDPProxyHostBits {
+				continue
+			}
+			for ip := route.IP.Mask(route.Mask); route.Contains(ip); ip = nextIP(ip) {
+				addrs = append(addrs, ip)
+			}
+		}
+		for ipStr := range node.RoutedHosts {
+			if ip := net.ParseIP(ipStr); ip != nil && ip.To4() == nil {
+				addrs = append(addrs, ip)
+			}
+		}
+	}
+	return addrs
+}
+
+// nextIP provides the address following the provided one
+func nextIP(ip net.IP) net.IP {
+	next := append(net.IP{}, ip...)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
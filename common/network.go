@@ -0,0 +1,101 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// Overlaps reports whether the two provided networks share any address
+func Overlaps(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// LocalOverlaps provides the local routes overlapping the provided network
+// Routes via the excluded interface (e.g. the one managed by wesher), as well as default routes, are ignored.
+func LocalOverlaps(network *net.IPNet, excludeIface string) ([]net.IPNet, error) {
+	excludeIndex := -1
+	if link, err := netlink.LinkByName(excludeIface); err == nil {
+		excludeIndex = link.Attrs().Index
+	}
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list local routes")
+	}
+	overlaps := make([]net.IPNet, 0)
+	for _, route := range routes {
+		if route.Dst == nil || route.LinkIndex == excludeIndex {
+			continue
+		}
+		if Overlaps(network, route.Dst) {
+			overlaps = append(overlaps, *route.Dst)
+		}
+	}
+	return overlaps, nil
+}
+
+// networksFilePollInterval is the interval at which networks files are checked for changes
+const networksFilePollInterval = 5 * time.Second
+
+// ReadNetworks parses a list of networks in CIDR format, one per line; empty lines and comments starting with # are
+// ignored
+func ReadNetworks(r io.Reader) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(line)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not parse network %q", line)
+		}
+		networks = append(networks, network)
+	}
+	return networks, scanner.Err()
+}
+
+// NetworksFile provides the networks listed in the provided file (see ReadNetworks)
+func NetworksFile(path string) ([]*net.IPNet, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read networks file %s", path)
+	}
+	return ReadNetworks(bytes.NewReader(content))
+}
+
+// WatchNetworksFile pushes the networks listed in the provided file to a channel, every time its content changes
+// Files which cannot be read or parsed are logged and skipped until they are fixed.
+func WatchNetworksFile(path string) <-chan []*net.IPNet {
+	networksc := make(chan []*net.IPNet)
+	current, _ := ioutil.ReadFile(path)
+	go func() {
+		for range time.Tick(networksFilePollInterval) {
+			content, err := ioutil.ReadFile(path)
+			if err != nil || bytes.Equal(content, current) {
+				continue
+			}
+			current = content
+			networks, err := ReadNetworks(bytes.NewReader(content))
+			if err != nil {
+				logrus.WithError(err).Warnf("ignoring invalid networks file %s", path)
+				continue
+			}
+			networksc <- networks
+		}
+	}()
+	return networksc
+}
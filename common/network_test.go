@@ -0,0 +1,165 @@
+package common
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func Test_Overlaps(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"10.0.0.0/8", "10.1.0.0/16", true},
+		{"10.1.0.0/16", "10.0.0.0/8", true},
+		{"10.0.0.0/8", "10.0.0.0/8", true},
+		{"10.0.0.0/8", "192.168.0.0/16", false},
+		{"10.0.0.0/24", "10.0.1.0/24", false},
+		{"2001:db8::/32", "2001:db8:1::/48", true},
+		{"2001:db8::/32", "10.0.0.0/8", false},
+	}
+	for _, tt := range tests {
+		_, a, _ := net.ParseCIDR(tt.a)
+		_, b, _ := net.ParseCIDR(tt.b)
+		if got := Overlaps(a, b); got != tt.want {
+			t.Errorf("Overlaps(%s, %s) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func Test_ResolveRouteConflicts(t *testing.T) {
+	parse := func(cidrs ...string) []net.IPNet {
+		nets := make([]net.IPNet, 0, len(cidrs))
+		for _, cidr := range cidrs {
+			_, n, _ := net.ParseCIDR(cidr)
+			nets = append(nets, *n)
+		}
+		return nets
+	}
+	newNode := func(name string, routes ...string) Node {
+		node := Node{Name: name}
+		node.Routes = parse(routes...)
+		return node
+	}
+
+	nodes := []Node{
+		newNode("c", "10.1.0.0/16"),
+		newNode("b", "10.1.2.0/24", "192.168.0.0/24"),
+		newNode("a", "10.1.0.0/16"),
+	}
+	shared := nodes[0].Routes
+	conflicts := ResolveRouteConflicts(nodes)
+	if len(shared) != 1 || shared[0].String() != "10.1.0.0/16" {
+		t.Errorf("ResolveRouteConflicts() modified the routes slice of node c to %v", shared)
+	}
+
+	if len(conflicts) != 2 {
+		t.Errorf("ResolveRouteConflicts() found %d conflicts, want 2: %v", len(conflicts), conflicts)
+	}
+	// identical network is kept for the lowest name only
+	if len(nodes[0].Routes) != 0 {
+		t.Errorf("ResolveRouteConflicts() kept %v for node c, want none", nodes[0].Routes)
+	}
+	if len(nodes[2].Routes) != 1 {
+		t.Errorf("ResolveRouteConflicts() kept %v for node a, want 10.1.0.0/16", nodes[2].Routes)
+	}
+	// more specific network is kept
+	if len(nodes[1].Routes) != 2 {
+		t.Errorf("ResolveRouteConflicts() kept %v for node b, want all routes", nodes[1].Routes)
+	}
+}
+
+func Test_ValidHostname(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"db1", true},
+		{"primary-db", true},
+		{"db1.example.com", true},
+		{"db1.example.com.", true},
+		{"", false},
+		{"-db", false},
+		{"db-", false},
+		{"db..example", false},
+		{"db 1", false},
+		{"db#1", false},
+		{strings.Repeat("a", 64), false},
+	}
+	for _, tt := range tests {
+		if got := ValidHostname(tt.name); got != tt.want {
+			t.Errorf("ValidHostname(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func Test_ReadNetworks(t *testing.T) {
+	networks, err := ReadNetworks(strings.NewReader("# sites\n10.1.0.0/16\n\n 192.168.0.0/24 # office\nfd00::/64\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.1.0.0/16", "192.168.0.0/24", "fd00::/64"}
+	if len(networks) != len(want) {
+		t.Fatalf("ReadNetworks() = %v, want %v", networks, want)
+	}
+	for i := range want {
+		if networks[i].String() != want[i] {
+			t.Errorf("ReadNetworks()[%d] = %s, want %s", i, networks[i], want[i])
+		}
+	}
+
+	if _, err := ReadNetworks(strings.NewReader("10.1.0.0\n")); err == nil {
+		t.Error("ReadNetworks() should fail on networks without prefix length")
+	}
+}
+
+func Test_NDPProxyAddrs(t *testing.T) {
+	_, overlay, _ := net.ParseCIDR("fd00::1/128")
+	_, small, _ := net.ParseCIDR("2001:db8:1::/126")
+	_, large, _ := net.ParseCIDR("2001:db8:2::/64")
+	_, ipv4, _ := net.ParseCIDR("192.168.0.0/30")
+	node := Node{Name: "test"}
+	node.OverlayAddr = *overlay
+	node.Routes = []net.IPNet{*small, *large, *ipv4}
+	node.RoutedHosts = map[string][]string{"2001:db8:2::10": {"host"}, "192.168.0.1": {"v4host"}}
+
+	got := make([]string, 0)
+	for _, ip := range NDPProxyAddrs([]Node{node}) {
+		got = append(got, ip.String())
+	}
+	want := []string{"fd00::1", "2001:db8:1::", "2001:db8:1::1", "2001:db8:1::2", "2001:db8:1::3", "2001:db8:2::10"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("NDPProxyAddrs() = %v, want %v", got, want)
+	}
+}
+
+func Test_WithdrawnNetworks(t *testing.T) {
+	node := func(name, overlay string, routes ...string) Node {
+		n := Node{Name: name}
+		_, overlayNet, _ := net.ParseCIDR(overlay)
+		n.OverlayAddr = *overlayNet
+		for _, route := range routes {
+			_, routeNet, _ := net.ParseCIDR(route)
+			n.Routes = append(n.Routes, *routeNet)
+		}
+		return n
+	}
+	previous := []Node{
+		node("a", "10.0.0.1/32", "192.168.1.0/24"),
+		node("b", "10.0.0.2/32", "192.168.2.0/24"),
+		node("c", "10.0.0.3/32"),
+	}
+	current := []Node{
+		node("a", "10.0.0.1/32"),
+		node("b", "10.0.0.2/32", "192.168.2.0/24", "192.168.1.0/24"), // took over a's route
+	}
+	got := make([]string, 0)
+	for _, network := range WithdrawnNetworks(previous, current) {
+		got = append(got, network.String())
+	}
+	want := []string{"192.168.1.0/24", "10.0.0.3/32"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("WithdrawnNetworks() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,63 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// NftSet is an nftables named set kept in sync with the overlay addresses of the cluster members, so firewall rules
+// like "ip saddr @wesher_peers accept" automatically track membership.
+// The set and its table are created if missing; it is updated atomically using the nft command.
+type NftSet struct {
+	Family string // table family, e.g. inet
+	Table  string
+	Name   string
+}
+
+// ParseNftSet parses a set reference in the FAMILY/TABLE/SET format
+func ParseNftSet(ref string) (*NftSet, error) {
+	parts := strings.Split(ref, "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return nil, errors.Errorf("invalid nftables set %q; expected FAMILY/TABLE/SET", ref)
+	}
+	return &NftSet{Family: parts[0], Table: parts[1], Name: parts[2]}, nil
+}
+
+// Update replaces the elements of the set with the provided addresses, which must all be of the same family
+func (s *NftSet) Update(ips []net.IP, ipv6 bool) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(s.script(ips, ipv6))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "could not update nftables set %s: %s", s, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func (s *NftSet) String() string {
+	return fmt.Sprintf("%s/%s/%s", s.Family, s.Table, s.Name)
+}
+
+// script provides the nft script replacing the set elements in a single transaction
+func (s *NftSet) script(ips []net.IP, ipv6 bool) string {
+	addrType := "ipv4_addr"
+	if ipv6 {
+		addrType = "ipv6_addr"
+	}
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "add table %s %s\n", s.Family, s.Table)
+	fmt.Fprintf(b, "add set %s %s %s { type %s; }\n", s.Family, s.Table, s.Name, addrType)
+	fmt.Fprintf(b, "flush set %s %s %s\n", s.Family, s.Table, s.Name)
+	if len(ips) > 0 {
+		elements := make([]string, len(ips))
+		for i, ip := range ips {
+			elements[i] = ip.String()
+		}
+		fmt.Fprintf(b, "add element %s %s %s { %s }\n", s.Family, s.Table, s.Name, strings.Join(elements, ", "))
+	}
+	return b.String()
+}
@@ -0,0 +1,87 @@
+package common
+
+import (
+	"net"
+	"testing"
+)
+
+func Test_ParseNftSet(t *testing.T) {
+	set, err := ParseNftSet("inet/filter/wesher_peers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.Family != "inet" || set.Table != "filter" || set.Name != "wesher_peers" {
+		t.Errorf("ParseNftSet() = %+v", set)
+	}
+	for _, invalid := range []string{"", "filter/wesher_peers", "inet//wesher_peers", "inet/filter/wesher/peers"} {
+		if _, err := ParseNftSet(invalid); err == nil {
+			t.Errorf("ParseNftSet(%q) should fail", invalid)
+		}
+	}
+}
+
+func Test_NftSet_script(t *testing.T) {
+	set := &NftSet{Family: "inet", Table: "filter", Name: "wesher_peers"}
+	got := set.script([]net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")}, false)
+	want := `add table inet filter
+add set inet filter wesher_peers { type ipv4_addr; }
+flush set inet filter wesher_peers
+add element inet filter wesher_peers { 10.0.0.1, 10.0.0.2 }
+`
+	if got != want {
+		t.Errorf("NftSet.script() = %q, want %q", got, want)
+	}
+
+	got = set.script(nil, true)
+	want = `add table inet filter
+add set inet filter wesher_peers { type ipv6_addr; }
+flush set inet filter wesher_peers
+`
+	if got != want {
+		t.Errorf("NftSet.script() without elements = %q, want %q", got, want)
+	}
+}
+
+func Test_ParseDSCP(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    uint8
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"46", 46, false},
+		{"0x0a", 10, false},
+		{"EF", 46, false},
+		{"le", 1, false},
+		{"cs1", 8, false},
+		{"af41", 34, false},
+		{"af13", 14, false},
+		{"64", 0, true},
+		{"af51", 0, true},
+		{"best", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseDSCP(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseDSCP() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseDSCP() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_DSCPMarking_script(t *testing.T) {
+	d := &DSCPMarking{Iface: "wg-overlay", Mark: 7946, DSCP: 46}
+	want := `add table inet wesher_dscp_wg_overlay
+flush table inet wesher_dscp_wg_overlay
+add chain inet wesher_dscp_wg_overlay output { type filter hook output priority -150; }
+add rule inet wesher_dscp_wg_overlay output meta mark 0x1f0a ip dscp set 46
+add rule inet wesher_dscp_wg_overlay output meta mark 0x1f0a ip6 dscp set 46
+`
+	if got := d.script(); got != want {
+		t.Errorf("DSCPMarking.script() = %q, want %q", got, want)
+	}
+}
@@ -2,25 +2,129 @@ package common
 
 import (
 	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/gob"
+	"fmt"
+	"io/ioutil"
 	"net"
+	"sort"
+	"sync"
 
+	"github.com/hashicorp/go-msgpack/codec"
 	"github.com/pkg/errors"
 )
 
+// metaMagic marks the versioned metadata encoding; it can never start a legacy gob stream, since gob messages are
+// prefixed by their non-zero length
+const metaMagic = 0x00
+
+// MetaVersion is the version of the metadata schema.
+// Fields may be added to the schema without changing its version, since unknown fields are ignored when decoding;
+// the version must only be increased for incompatible changes, which older nodes will then refuse to decode.
+const MetaVersion = 1
+
+// flateWriters pools compressors, which allocate about a megabyte each at the best compression level
+var flateWriters = sync.Pool{New: func() interface{} {
+	w, _ := flate.NewWriter(nil, flate.BestCompression) // only errors on invalid level
+	return w
+}}
+
+// ErrUnsupportedMetaVersion is returned when decoding metadata of an incompatible newer schema version
+var ErrUnsupportedMetaVersion = errors.New("unsupported metadata version")
+
+// metadata flags
+const (
+	metaCompressed = 1 << iota // payload is flate compressed
+	metaOverflow               // payload is a placeholder; full metadata must be exchanged separately
+)
+
+// metaHeaderLen is the length of the magic byte, version and flags preceding the payload
+const metaHeaderLen = 3
+
+// DigestLen is the length of the digest identifying overflowed metadata
+const DigestLen = 8
+
 // nodeMeta holds metadata sent over the cluster
 type nodeMeta struct {
 	OverlayAddr net.IPNet
+	// Prefixes are the prefixes of the secondary overlay networks assigned to the node, e.g. for local workloads
+	Prefixes    []net.IPNet
 	Routes      []net.IPNet
 	PubKey      string
+	Version     string
+	Aliases     []string
+	RoutedHosts map[string][]string
+	// IngressLimit is the rate in bits per second other nodes should limit their traffic to this node to; 0 if unlimited
+	IngressLimit uint64
+	// Started is the unix time the node started at, used to tell the older of two nodes claiming the same name
+	Started int64
+	// Endpoint is the underlay address for wireguard traffic, if it differs from the cluster address, i.e. when
+	// gossiping over the overlay network
+	Endpoint net.IP
+	// EndpointPort is the port other nodes should send wireguard traffic to, if it differs from the local listen port,
+	// e.g. behind a NAT port forward; 0 if the same
+	EndpointPort uint16
+	// BehindNAT is set for nodes not owning the address they advertise, which need keepalives to keep their NAT
+	// mapping open
+	BehindNAT bool
+	// Roamed holds the endpoints other nodes were observed roaming to, by public key, so nodes not having heard from
+	// them yet can reach them quickly
+	Roamed map[string]*net.UDPAddr
+	// Labels are arbitrary key/value pairs describing the node, e.g. its environment, which other nodes can select on
+	Labels map[string]string
+	// OS, Arch and Kernel describe the host the node runs on, see LocalFacts
+	OS     string
+	Arch   string
+	Kernel string
+	// VIPCandidates are the virtual IPs the node may own, see VIPOwners
+	VIPCandidates []net.IP
+	// Services are the named services the node offers on its overlay address
+	Services []Service
+	// Metadata holds small free-form values describing the node, e.g. its rack, which can be changed at runtime
+	Metadata map[string]string
+	// SSHHostKeys are the public SSH host keys of the node, as TYPE BASE64, for the known_hosts files of other nodes
+	SSHHostKeys []string
+}
+
+// wireMeta is the compact representation of nodeMeta sent over the cluster
+// It is encoded as a msgpack map with short keys, so fields can be added without breaking older nodes.
+// Networks are encoded as their address bytes followed by the prefix length and the public key in its raw form.
+type wireMeta struct {
+	OverlayAddr  []byte     `codec:"o"`
+	Prefixes     [][]byte   `codec:"x,omitempty"`
+	Routes       [][]byte   `codec:"r,omitempty"`
+	PubKey       []byte     `codec:"k"`
+	Digest       []byte     `codec:"d,omitempty"`
+	Version      string     `codec:"v,omitempty"`
+	Aliases      []string   `codec:"a,omitempty"`
+	RoutedHosts  [][]string `codec:"h,omitempty"` // IP followed by its names, sorted by IP for deterministic encoding
+	IngressLimit uint64     `codec:"b,omitempty"`
+	Started      int64      `codec:"s,omitempty"`
+	Endpoint     []byte     `codec:"e,omitempty"` // 4 or 16 address bytes
+	EndpointPort uint16     `codec:"p,omitempty"`
+	BehindNAT    bool       `codec:"n,omitempty"`
+	Roamed       [][]byte   `codec:"m,omitempty"` // raw public key, address bytes and port, sorted for deterministic encoding
+	Labels       []string   `codec:"l,omitempty"` // KEY=VALUE, sorted for deterministic encoding
+	OS           string     `codec:"g,omitempty"` // GOOS
+	Arch         string     `codec:"c,omitempty"` // GOARCH
+	Kernel       string     `codec:"u,omitempty"` // uname release
+	VIPs         [][]byte   `codec:"f,omitempty"` // 4 or 16 address bytes of each virtual IP candidacy
+	Services     []string   `codec:"y,omitempty"` // NAME=PORT/PROTO, sorted for deterministic encoding
+	Metadata     []string   `codec:"t,omitempty"` // KEY=VALUE, sorted for deterministic encoding
+	SSHHostKeys  []string   `codec:"z,omitempty"` // TYPE BASE64, sorted for deterministic encoding
 }
 
 // Node holds the memberlist node structure
 type Node struct {
 	Name string
 	Addr net.IP
+	Port uint16 `json:",omitempty"`
 	Meta []byte
 	nodeMeta
+	// VIPs are the virtual IPs currently owned by the node, as decided locally by VIPOwners
+	VIPs []net.IPNet `json:",omitempty"`
 }
 
 func (n *Node) String() string {
@@ -28,25 +132,366 @@ func (n *Node) String() string {
 }
 
 // EncodeMeta the node metadata to bytes, in a deterministic reversible way
+// If the complete metadata does not fit into limit, a placeholder only carrying the fields needed to connect to the node
+// is returned instead, along with a digest of the complete metadata, which must then be exchanged by other means (see
+// FullMeta). Routes, hosts entries, SSH host keys and the other optional fields are only part of the complete one.
 func (n *Node) EncodeMeta(limit int) ([]byte, error) {
-	buf := &bytes.Buffer{}
-	if err := gob.NewEncoder(buf).Encode(n.nodeMeta); err != nil {
-		return nil, errors.Wrap(err, "could not encode local state")
+	full, err := n.FullMeta()
+	if err != nil {
+		return nil, err
 	}
-	if buf.Len() > limit {
+	if len(full) <= limit {
+		return full, nil
+	}
+
+	wm, err := n.toWire()
+	if err != nil {
+		return nil, err
+	}
+	placeholder := &wireMeta{
+		OverlayAddr:  wm.OverlayAddr,
+		Prefixes:     wm.Prefixes,
+		PubKey:       wm.PubKey,
+		Digest:       MetaDigest(full),
+		Version:      wm.Version,
+		IngressLimit: wm.IngressLimit,
+		Started:      wm.Started,
+		Endpoint:     wm.Endpoint,
+		EndpointPort: wm.EndpointPort,
+		BehindNAT:    wm.BehindNAT,
+		VIPs:         wm.VIPs,
+	}
+	encoded, err := encodeWire(placeholder, false)
+	if err != nil {
+		return nil, err
+	}
+	encoded[2] |= metaOverflow
+	if len(encoded) > limit {
 		return nil, errors.Errorf("could not fit node metadata into %d bytes", limit)
 	}
-	return buf.Bytes(), nil
+	return encoded, nil
+}
+
+// FullMeta encodes the complete node metadata to bytes, without any size limit
+func (n *Node) FullMeta() ([]byte, error) {
+	wm, err := n.toWire()
+	if err != nil {
+		return nil, err
+	}
+	return encodeWire(wm, true)
 }
 
 // DecodeMeta the node Meta field into its metadata
 func (n *Node) DecodeMeta() error {
 	// TODO: we blindly trust the info we get from the peers; We should be more defensive to limit the damage a leaked
 	// PSK can cause.
+	if len(n.Meta) > 0 && n.Meta[0] != metaMagic {
+		return n.decodeLegacyMeta()
+	}
+	wm, err := decodeWire(n.Meta)
+	if err != nil {
+		return errors.Wrap(err, "could not decode node meta")
+	}
+	nm, err := wm.toNodeMeta()
+	if err != nil {
+		return errors.Wrap(err, "could not decode node meta")
+	}
+	n.nodeMeta = nm
+	return nil
+}
+
+// OverflowDigest provides the digest of the complete metadata, if the node Meta field only contains a placeholder
+func (n *Node) OverflowDigest() ([]byte, bool) {
+	if len(n.Meta) < metaHeaderLen || n.Meta[0] != metaMagic || n.Meta[2]&metaOverflow == 0 {
+		return nil, false
+	}
+	wm, err := decodeWire(n.Meta)
+	if err != nil {
+		return nil, false
+	}
+	return wm.Digest, true
+}
+
+// MetaVersion provides the schema version of the node Meta field; legacy gob encoded metadata has version 0
+func (n *Node) MetaVersion() int {
+	if len(n.Meta) < metaHeaderLen || n.Meta[0] != metaMagic {
+		return 0
+	}
+	return int(n.Meta[1])
+}
+
+// MetaDigest provides the digest used to identify complete metadata
+func MetaDigest(meta []byte) []byte {
+	sum := sha256.Sum256(meta)
+	return sum[:DigestLen]
+}
+
+// decodeLegacyMeta decodes metadata sent by wesher versions using gob encoding
+func (n *Node) decodeLegacyMeta() error {
 	nm := nodeMeta{}
 	if err := gob.NewDecoder(bytes.NewReader(n.Meta)).Decode(&nm); err != nil {
 		return errors.Wrap(err, "could not decode node meta")
 	}
 	n.nodeMeta = nm
 	return nil
-}
\ No newline at end of file
+}
+
+func (n *Node) toWire() (*wireMeta, error) {
+	pubKey, err := base64.StdEncoding.DecodeString(n.PubKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decode public key")
+	}
+	wm := &wireMeta{
+		OverlayAddr:  encodeNetwork(n.OverlayAddr),
+		PubKey:       pubKey,
+		Version:      n.Version,
+		Aliases:      n.Aliases,
+		IngressLimit: n.IngressLimit,
+		Started:      n.Started,
+		EndpointPort: n.EndpointPort,
+		BehindNAT:    n.BehindNAT,
+		OS:           n.OS,
+		Arch:         n.Arch,
+		Kernel:       n.Kernel,
+	}
+	if ip4 := n.Endpoint.To4(); ip4 != nil {
+		wm.Endpoint = ip4
+	} else if n.Endpoint != nil {
+		wm.Endpoint = n.Endpoint.To16()
+	}
+	for _, prefix := range n.Prefixes {
+		wm.Prefixes = append(wm.Prefixes, encodeNetwork(prefix))
+	}
+	for _, route := range n.Routes {
+		wm.Routes = append(wm.Routes, encodeNetwork(route))
+	}
+	for _, vip := range n.VIPCandidates {
+		if ip4 := vip.To4(); ip4 != nil {
+			wm.VIPs = append(wm.VIPs, ip4)
+		} else {
+			wm.VIPs = append(wm.VIPs, vip.To16())
+		}
+	}
+	for key, endpoint := range n.Roamed {
+		rawKey, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not decode public key of roamed endpoint")
+		}
+		wm.Roamed = append(wm.Roamed, encodeEndpoint(rawKey, endpoint))
+	}
+	sort.Slice(wm.Roamed, func(i, j int) bool { return bytes.Compare(wm.Roamed[i], wm.Roamed[j]) < 0 })
+	for key, value := range n.Labels {
+		wm.Labels = append(wm.Labels, key+"="+value)
+	}
+	sort.Strings(wm.Labels)
+	for _, service := range n.Services {
+		wm.Services = append(wm.Services, service.String())
+	}
+	sort.Strings(wm.Services)
+	for key, value := range n.Metadata {
+		wm.Metadata = append(wm.Metadata, key+"="+value)
+	}
+	sort.Strings(wm.Metadata)
+	wm.SSHHostKeys = append(wm.SSHHostKeys, n.SSHHostKeys...)
+	sort.Strings(wm.SSHHostKeys)
+	ips := make([]string, 0, len(n.RoutedHosts))
+	for ip := range n.RoutedHosts {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	for _, ip := range ips {
+		wm.RoutedHosts = append(wm.RoutedHosts, append([]string{ip}, n.RoutedHosts[ip]...))
+	}
+	return wm, nil
+}
+
+func (wm *wireMeta) toNodeMeta() (nodeMeta, error) {
+	nm := nodeMeta{
+		PubKey:       base64.StdEncoding.EncodeToString(wm.PubKey),
+		Version:      wm.Version,
+		Aliases:      wm.Aliases,
+		IngressLimit: wm.IngressLimit,
+		Started:      wm.Started,
+		EndpointPort: wm.EndpointPort,
+		BehindNAT:    wm.BehindNAT,
+		OS:           wm.OS,
+		Arch:         wm.Arch,
+		Kernel:       wm.Kernel,
+	}
+	overlayAddr, err := decodeNetwork(wm.OverlayAddr)
+	if err != nil {
+		return nm, err
+	}
+	nm.OverlayAddr = overlayAddr
+	switch len(wm.Endpoint) {
+	case 0:
+	case net.IPv4len, net.IPv6len:
+		nm.Endpoint = net.IP(wm.Endpoint)
+	default:
+		return nm, errors.Errorf("invalid endpoint length %d", len(wm.Endpoint))
+	}
+	for _, encoded := range wm.Prefixes {
+		prefix, err := decodeNetwork(encoded)
+		if err != nil {
+			return nm, err
+		}
+		nm.Prefixes = append(nm.Prefixes, prefix)
+	}
+	for _, encoded := range wm.Routes {
+		route, err := decodeNetwork(encoded)
+		if err != nil {
+			return nm, err
+		}
+		nm.Routes = append(nm.Routes, route)
+	}
+	for _, encoded := range wm.VIPs {
+		if len(encoded) != net.IPv4len && len(encoded) != net.IPv6len {
+			return nm, errors.Errorf("invalid virtual IP length %d", len(encoded))
+		}
+		nm.VIPCandidates = append(nm.VIPCandidates, net.IP(encoded))
+	}
+	for _, encoded := range wm.Roamed {
+		key, endpoint, err := decodeEndpoint(encoded)
+		if err != nil {
+			return nm, err
+		}
+		if nm.Roamed == nil {
+			nm.Roamed = make(map[string]*net.UDPAddr)
+		}
+		nm.Roamed[key] = endpoint
+	}
+	if len(wm.Labels) > 0 {
+		labels, err := ParseLabels(wm.Labels)
+		if err != nil {
+			return nm, err
+		}
+		nm.Labels = labels
+	}
+	if len(wm.Services) > 0 {
+		services, err := ParseServices(wm.Services)
+		if err != nil {
+			return nm, err
+		}
+		nm.Services = services
+	}
+	if len(wm.Metadata) > 0 {
+		metadata, err := ParseMetadata(wm.Metadata)
+		if err != nil {
+			return nm, err
+		}
+		nm.Metadata = metadata
+	}
+	for _, key := range wm.SSHHostKeys {
+		parsed, err := ParseSSHHostKey(key)
+		if err != nil {
+			return nm, err
+		}
+		nm.SSHHostKeys = append(nm.SSHHostKeys, parsed)
+	}
+	for _, entry := range wm.RoutedHosts {
+		if len(entry) < 2 {
+			continue
+		}
+		if nm.RoutedHosts == nil {
+			nm.RoutedHosts = make(map[string][]string)
+		}
+		nm.RoutedHosts[entry[0]] = entry[1:]
+	}
+	return nm, nil
+}
+
+func encodeWire(wm *wireMeta, compress bool) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := codec.NewEncoder(buf, &codec.MsgpackHandle{}).Encode(wm); err != nil {
+		return nil, errors.Wrap(err, "could not encode local state")
+	}
+	payload := buf.Bytes()
+	flags := byte(0)
+
+	if compress {
+		compressed := &bytes.Buffer{}
+		w := flateWriters.Get().(*flate.Writer)
+		defer flateWriters.Put(w)
+		w.Reset(compressed)
+		if _, err := w.Write(payload); err != nil {
+			return nil, errors.Wrap(err, "could not compress local state")
+		}
+		if err := w.Close(); err != nil {
+			return nil, errors.Wrap(err, "could not compress local state")
+		}
+		if compressed.Len() < len(payload) {
+			payload = compressed.Bytes()
+			flags |= metaCompressed
+		}
+	}
+
+	return append([]byte{metaMagic, MetaVersion, flags}, payload...), nil
+}
+
+func decodeWire(meta []byte) (*wireMeta, error) {
+	if len(meta) < metaHeaderLen || meta[0] != metaMagic {
+		return nil, errors.New("unknown metadata encoding")
+	}
+	if meta[1] > MetaVersion {
+		return nil, fmt.Errorf("%w %d (supported up to %d)", ErrUnsupportedMetaVersion, meta[1], MetaVersion)
+	}
+	flags := meta[2]
+	payload := meta[metaHeaderLen:]
+	if flags&metaCompressed != 0 {
+		decompressed, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(payload)))
+		if err != nil {
+			return nil, errors.Wrap(err, "could not decompress")
+		}
+		payload = decompressed
+	}
+	wm := &wireMeta{}
+	if err := codec.NewDecoderBytes(payload, &codec.MsgpackHandle{}).Decode(wm); err != nil {
+		return nil, err
+	}
+	return wm, nil
+}
+
+// encodeNetwork encodes a network as its address bytes (4 for IPv4, 16 for IPv6) followed by its prefix length
+func encodeNetwork(network net.IPNet) []byte {
+	ip := network.IP.To4()
+	if ip == nil {
+		ip = network.IP.To16()
+	}
+	ones, _ := network.Mask.Size()
+	return append(append([]byte{}, ip...), byte(ones))
+}
+
+func decodeNetwork(encoded []byte) (net.IPNet, error) {
+	if len(encoded) != net.IPv4len+1 && len(encoded) != net.IPv6len+1 {
+		return net.IPNet{}, errors.Errorf("invalid network length %d", len(encoded))
+	}
+	ip := net.IP(append([]byte{}, encoded[:len(encoded)-1]...))
+	ones := int(encoded[len(encoded)-1])
+	if ones > len(ip)*8 {
+		return net.IPNet{}, errors.Errorf("invalid prefix length %d", ones)
+	}
+	return net.IPNet{IP: ip, Mask: net.CIDRMask(ones, len(ip)*8)}, nil
+}
+
+// pubKeyLen is the length of raw wireguard public keys
+const pubKeyLen = 32
+
+// encodeEndpoint encodes the public key of a node followed by its endpoint address bytes (4 for IPv4, 16 for IPv6) and
+// port
+func encodeEndpoint(pubKey []byte, endpoint *net.UDPAddr) []byte {
+	ip := endpoint.IP.To4()
+	if ip == nil {
+		ip = endpoint.IP.To16()
+	}
+	encoded := append(append([]byte{}, pubKey...), ip...)
+	return append(encoded, byte(endpoint.Port>>8), byte(endpoint.Port))
+}
+
+func decodeEndpoint(encoded []byte) (string, *net.UDPAddr, error) {
+	if len(encoded) != pubKeyLen+net.IPv4len+2 && len(encoded) != pubKeyLen+net.IPv6len+2 {
+		return "", nil, errors.Errorf("invalid endpoint length %d", len(encoded))
+	}
+	ip := net.IP(append([]byte{}, encoded[pubKeyLen:len(encoded)-2]...))
+	port := int(encoded[len(encoded)-2])<<8 | int(encoded[len(encoded)-1])
+	return base64.StdEncoding.EncodeToString(encoded[:pubKeyLen]), &net.UDPAddr{IP: ip, Port: port}, nil
+}
@@ -1,28 +1,228 @@
 package common
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"math/rand"
 	"net"
 	"reflect"
 	"testing"
+
+	"github.com/hashicorp/go-msgpack/codec"
 )
 
 func Test_Node_Encode_Decode(t *testing.T) {
 	pubKey := "abcdefghijklmnopkqstuvwxyzABCDEF"
 	_, ipv4, _ := net.ParseCIDR("10.0.0.1/32")
 	_, ipv6, _ := net.ParseCIDR("2001:db8::1/128")
+	_, prefix, _ := net.ParseCIDR("fd00:10:0:2a::/64")
 
 	for _, ip := range []*net.IPNet{ipv4, ipv6} {
 		node := Node{
 			nodeMeta: nodeMeta{
-				OverlayAddr: *ip,
-				PubKey:      pubKey,
+				OverlayAddr:  *ip,
+				Prefixes:     []net.IPNet{*prefix},
+				PubKey:       pubKey,
+				IngressLimit: 1000000,
+				Started:      1588327200,
+				Endpoint:     ip.IP,
+				EndpointPort: 31820,
+				BehindNAT:    true,
+				Roamed: map[string]*net.UDPAddr{
+					"YWJjZGVmZ2hpamtsbW5vcGtxc3R1dnd4eXpBQkNERUY=": {IP: ip.IP, Port: 51820},
+				},
+				Labels:        map[string]string{"env": "prod", "zone": "a"},
+				OS:            "linux",
+				Arch:          "arm64",
+				Kernel:        "5.10.0-21-arm64",
+				VIPCandidates: []net.IP{ip.IP},
+				Services:      []Service{{"dns", 53, ProtoUDP}, {"web", 8080, ProtoTCP}},
+				Metadata:      map[string]string{"rack": "r12"},
+				SSHHostKeys:   []string{"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIA=="},
 			},
 		}
 		encoded, _ := node.EncodeMeta(1024)
 		new := Node{Meta: encoded}
 		new.DecodeMeta()
 		if !reflect.DeepEqual(node.nodeMeta, new.nodeMeta) {
-			t.Errorf("node encoding then decoding mismatch: %s / %s", node.nodeMeta, new.nodeMeta)
+			t.Errorf("node encoding then decoding mismatch: %v / %v", node.nodeMeta, new.nodeMeta)
+		}
+	}
+}
+
+func Test_Node_Encode_Overflow(t *testing.T) {
+	node := Node{
+		nodeMeta: nodeMeta{
+			PubKey: "abcdefghijklmnopkqstuvwxyzABCDEF",
+		},
+	}
+	_, overlay, _ := net.ParseCIDR("10.0.0.1/32")
+	node.OverlayAddr = *overlay
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		ip := net.IPv4(byte(rnd.Intn(256)), byte(rnd.Intn(256)), byte(rnd.Intn(256)), 0).To4()
+		node.Routes = append(node.Routes, net.IPNet{IP: ip, Mask: net.CIDRMask(24, 32)})
+	}
+
+	encoded, err := node.EncodeMeta(512)
+	if err != nil {
+		t.Fatalf("could not encode overflowing node meta: %s", err)
+	}
+	if len(encoded) > 512 {
+		t.Errorf("encoded node meta exceeds limit: %d", len(encoded))
+	}
+	placeholder := Node{Meta: encoded}
+	digest, ok := placeholder.OverflowDigest()
+	if !ok {
+		t.Fatalf("overflowing node meta not marked as such")
+	}
+	full, _ := node.FullMeta()
+	if !reflect.DeepEqual(digest, MetaDigest(full)) {
+		t.Errorf("overflow digest mismatch: %x / %x", digest, MetaDigest(full))
+	}
+	if err := placeholder.DecodeMeta(); err != nil || placeholder.PubKey != node.PubKey || len(placeholder.Routes) != 0 {
+		t.Errorf("placeholder decoding mismatch: %s / %+v", err, placeholder.nodeMeta)
+	}
+
+	complete := Node{Meta: full}
+	complete.DecodeMeta()
+	if !reflect.DeepEqual(node.nodeMeta, complete.nodeMeta) {
+		t.Errorf("full node encoding then decoding mismatch")
+	}
+	if _, ok := complete.OverflowDigest(); ok {
+		t.Errorf("full node meta marked as overflowing")
+	}
+}
+
+func Test_Node_Encode_Overflow_optional(t *testing.T) {
+	key := make([]byte, 407) // the size of an RSA-3072 public key
+	rand.New(rand.NewSource(1)).Read(key)
+	hostKey, err := ParseSSHHostKey("ssh-rsa " + base64.StdEncoding.EncodeToString(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := Node{
+		nodeMeta: nodeMeta{
+			PubKey:      "abcdefghijklmnopkqstuvwxyzABCDEF",
+			Aliases:     []string{"alias.example.com"},
+			Labels:      map[string]string{"env": "prod"},
+			Services:    []Service{{"web", 8080, ProtoTCP}},
+			Metadata:    map[string]string{"rack": "r12"},
+			SSHHostKeys: []string{hostKey},
+		},
+	}
+	_, overlay, _ := net.ParseCIDR("10.0.0.1/32")
+	node.OverlayAddr = *overlay
+
+	encoded, err := node.EncodeMeta(512)
+	if err != nil {
+		t.Fatalf("could not encode node meta with an RSA host key: %s", err)
+	}
+	placeholder := Node{Meta: encoded}
+	if _, ok := placeholder.OverflowDigest(); !ok {
+		t.Fatalf("overflowing node meta not marked as such")
+	}
+	if err := placeholder.DecodeMeta(); err != nil || placeholder.PubKey != node.PubKey || !placeholder.OverlayAddr.IP.Equal(overlay.IP) {
+		t.Errorf("placeholder decoding mismatch: %s / %+v", err, placeholder.nodeMeta)
+	}
+	if len(placeholder.SSHHostKeys) != 0 || len(placeholder.Aliases) != 0 || len(placeholder.Services) != 0 || len(placeholder.Metadata) != 0 {
+		t.Errorf("placeholder carries optional fields: %+v", placeholder.nodeMeta)
+	}
+}
+
+func Test_Node_Decode_Legacy(t *testing.T) {
+	_, overlay, _ := net.ParseCIDR("10.0.0.1/32")
+	nm := nodeMeta{
+		OverlayAddr: *overlay,
+		PubKey:      "abcdefghijklmnopkqstuvwxyzABCDEF",
+	}
+	buf := &bytes.Buffer{}
+	gob.NewEncoder(buf).Encode(nm)
+
+	node := Node{Meta: buf.Bytes()}
+	if err := node.DecodeMeta(); err != nil {
+		t.Fatalf("could not decode legacy node meta: %s", err)
+	}
+	if !reflect.DeepEqual(nm, node.nodeMeta) {
+		t.Errorf("legacy node decoding mismatch: %+v / %+v", nm, node.nodeMeta)
+	}
+}
+
+func Test_Node_Decode_Versions(t *testing.T) {
+	_, overlay, _ := net.ParseCIDR("10.0.0.1/32")
+	node := Node{}
+	node.OverlayAddr = *overlay
+	node.PubKey = "abcdefghijklmnopkqstuvwxyzABCDEF"
+	encoded, _ := node.EncodeMeta(512)
+
+	// unknown fields added by future versions are ignored
+	withExtra := map[string]interface{}{"o": encodeNetwork(*overlay), "k": []byte{1, 2, 3}, "future": "field"}
+	buf := &bytes.Buffer{}
+	codec.NewEncoder(buf, &codec.MsgpackHandle{}).Encode(withExtra)
+	extended := Node{Meta: append([]byte{metaMagic, MetaVersion, 0}, buf.Bytes()...)}
+	if err := extended.DecodeMeta(); err != nil {
+		t.Errorf("could not decode node meta with unknown fields: %s", err)
+	}
+
+	// incompatible future versions are refused
+	future := Node{Meta: append([]byte{}, encoded...)}
+	future.Meta[1] = MetaVersion + 1
+	if err := future.DecodeMeta(); !errors.Is(err, ErrUnsupportedMetaVersion) {
+		t.Errorf("decoding unsupported node meta version did not fail: %v", err)
+	}
+	if future.MetaVersion() != MetaVersion+1 {
+		t.Errorf("MetaVersion() = %d, want %d", future.MetaVersion(), MetaVersion+1)
+	}
+}
+
+func benchmarkNode() Node {
+	_, overlay, _ := net.ParseCIDR("10.0.0.1/32")
+	_, route, _ := net.ParseCIDR("192.168.0.0/24")
+	return Node{nodeMeta: nodeMeta{
+		OverlayAddr: *overlay,
+		PubKey:      "abcdefghijklmnopkqstuvwxyzABCDEF",
+		Routes:      []net.IPNet{*route},
+		Version:     "v0.0.0",
+	}}
+}
+
+func Benchmark_Node_EncodeMeta(b *testing.B) {
+	node := benchmarkNode()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := node.EncodeMeta(1024); err != nil {
+			b.Fatal(err)
 		}
 	}
 }
+
+func Benchmark_Node_DecodeMeta(b *testing.B) {
+	node := benchmarkNode()
+	encoded, err := node.EncodeMeta(1024)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		decoded := Node{Meta: encoded}
+		if err := decoded.DecodeMeta(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Test_Leader(t *testing.T) {
+	nodes := []Node{{Name: "node3"}, {Name: "node1"}, {Name: "node4"}}
+	if got := Leader("node2", nodes); got != "node1" {
+		t.Errorf("Leader() = %s, want node1", got)
+	}
+	if got := Leader("node0", nodes); got != "node0" {
+		t.Errorf("Leader() = %s, want local node0", got)
+	}
+	if got := Leader("node2", nil); got != "node2" {
+		t.Errorf("Leader() without members = %s, want local node2", got)
+	}
+}
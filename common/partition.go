@@ -0,0 +1,40 @@
+package common
+
+import "sync"
+
+// Partition detects the local node losing sight of a large part of the cluster, as happens on network partitions,
+// which are otherwise silent: the memberlist just declares the unreachable nodes dead.
+// The node is considered partitioned while fewer than Threshold percent of the expected members are visible.
+// It is safe for concurrent use.
+type Partition struct {
+	Threshold int
+
+	lock        sync.Mutex
+	partitioned bool
+	visible     int
+	expected    int
+}
+
+// Observe records the number of visible and expected members, both including the local node, and reports whether the
+// partitioned state changed
+// The expectation is raised to the visible members, so a growing cluster is never reported as partitioned.
+func (p *Partition) Observe(visible, expected int) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if expected < visible {
+		expected = visible
+	}
+	p.visible, p.expected = visible, expected
+	partitioned := expected > 1 && visible*100 < expected*p.Threshold
+	changed := partitioned != p.partitioned
+	p.partitioned = partitioned
+	return changed
+}
+
+// Partitioned reports whether the node was partitioned when last observed, along with the numbers of visible and
+// expected members
+func (p *Partition) Partitioned() (bool, int, int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.partitioned, p.visible, p.expected
+}
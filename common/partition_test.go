@@ -0,0 +1,39 @@
+package common
+
+import "testing"
+
+func Test_Partition_Observe(t *testing.T) {
+	p := &Partition{Threshold: 50}
+	steps := []struct {
+		name              string
+		visible, expected int
+		wantChanged       bool
+		wantPartitioned   bool
+	}{
+		{"complete", 5, 5, false, false},
+		{"at threshold", 3, 6, false, false},
+		{"sharp drop", 2, 6, true, true},
+		{"still partitioned", 1, 6, false, true},
+		{"healed", 6, 6, true, false},
+		{"grown beyond expectation", 8, 6, false, false},
+		{"single node", 1, 1, false, false},
+	}
+	for _, step := range steps {
+		if changed := p.Observe(step.visible, step.expected); changed != step.wantChanged {
+			t.Errorf("%s: Observe() = %t, want %t", step.name, changed, step.wantChanged)
+		}
+		if partitioned, _, _ := p.Partitioned(); partitioned != step.wantPartitioned {
+			t.Errorf("%s: Partitioned() = %t, want %t", step.name, partitioned, step.wantPartitioned)
+		}
+	}
+	if _, visible, expected := p.Partitioned(); visible != 1 || expected != 1 {
+		t.Errorf("Partitioned() members = %d/%d, want 1/1", visible, expected)
+	}
+}
+
+func Test_Partition_disabled(t *testing.T) {
+	p := &Partition{}
+	if p.Observe(1, 10) {
+		t.Errorf("Observe() reported a partition with a zero threshold")
+	}
+}
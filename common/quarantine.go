@@ -0,0 +1,121 @@
+package common
+
+import (
+	"sort"
+	"time"
+)
+
+// maxHoldDownFactor bounds the exponential growth of the hold-down of repeatedly quarantined nodes
+const maxHoldDownFactor = 32
+
+// Quarantine tracks nodes repeatedly joining and leaving the cluster or failing wireguard handshakes, and temporarily
+// excludes them, so a single misconfigured node cannot cause constant reconfiguration across the whole cluster.
+// Nodes flapping Threshold times within Window are excluded for HoldDown, doubled for every repeated quarantine up to
+// 32 times HoldDown; the hold-down is reset once a node stays calm for that long.
+type Quarantine struct {
+	Threshold int
+	Window    time.Duration
+	HoldDown  time.Duration
+
+	nodes map[string]*flapState
+}
+
+type flapState struct {
+	flaps    []time.Time
+	until    time.Time
+	holdDown time.Duration
+}
+
+// Observe records the joins and leaves between the previous and current members as flaps
+func (q *Quarantine) Observe(before, after []Node, now time.Time) {
+	if q.nodes == nil {
+		q.nodes = make(map[string]*flapState)
+	}
+	previous := make(map[string]bool, len(before))
+	for _, node := range before {
+		previous[node.Name] = true
+	}
+	for _, node := range after {
+		if !previous[node.Name] {
+			q.flap(node.Name, now)
+		}
+		delete(previous, node.Name)
+	}
+	for name := range previous {
+		q.flap(name, now)
+	}
+}
+
+// ObserveHandshakes records the nodes whose wireguard handshakes failed as flaps
+func (q *Quarantine) ObserveHandshakes(failed []string, now time.Time) {
+	if q.nodes == nil {
+		q.nodes = make(map[string]*flapState)
+	}
+	for _, name := range failed {
+		q.flap(name, now)
+	}
+}
+
+func (q *Quarantine) flap(name string, now time.Time) {
+	fs, ok := q.nodes[name]
+	if !ok {
+		fs = &flapState{}
+		q.nodes[name] = fs
+	}
+	if fs.holdDown > 0 && now.Sub(fs.until) > q.HoldDown*maxHoldDownFactor {
+		fs.holdDown = 0 // calm for long enough
+	}
+	fs.flaps = append(recentFlaps(fs.flaps, now.Add(-q.Window)), now)
+	if len(fs.flaps) < q.Threshold || now.Before(fs.until) {
+		return
+	}
+	switch {
+	case fs.holdDown == 0:
+		fs.holdDown = q.HoldDown
+	case fs.holdDown < q.HoldDown*maxHoldDownFactor:
+		fs.holdDown *= 2
+	}
+	fs.until = now.Add(fs.holdDown)
+	fs.flaps = nil
+}
+
+func recentFlaps(flaps []time.Time, since time.Time) []time.Time {
+	recent := flaps[:0]
+	for _, flap := range flaps {
+		if flap.After(since) {
+			recent = append(recent, flap)
+		}
+	}
+	return recent
+}
+
+// Filter provides the nodes not currently quarantined, and the sorted names of the excluded ones
+func (q *Quarantine) Filter(nodes []Node, now time.Time) ([]Node, []string) {
+	kept := make([]Node, 0, len(nodes))
+	excluded := []string{}
+	for _, node := range nodes {
+		if fs, ok := q.nodes[node.Name]; ok && now.Before(fs.until) {
+			excluded = append(excluded, node.Name)
+			continue
+		}
+		kept = append(kept, node)
+	}
+	sort.Strings(excluded)
+	return kept, excluded
+}
+
+// Next provides the end of the earliest quarantine still in effect, or the zero time if there is none
+func (q *Quarantine) Next(now time.Time) time.Time {
+	next := time.Time{}
+	for name, fs := range q.nodes {
+		switch {
+		case now.Before(fs.until):
+			if next.IsZero() || fs.until.Before(next) {
+				next = fs.until
+			}
+		case len(recentFlaps(fs.flaps, now.Add(-q.Window))) == 0 && now.Sub(fs.until) > q.HoldDown*maxHoldDownFactor:
+			delete(q.nodes, name) // forget calm nodes
+		}
+	}
+	return next
+}
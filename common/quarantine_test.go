@@ -0,0 +1,64 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_Quarantine(t *testing.T) {
+	q := &Quarantine{Threshold: 4, Window: time.Minute, HoldDown: 10 * time.Second}
+	stable, flapping := Node{Name: "stable"}, Node{Name: "flapping"}
+	with, without := []Node{stable, flapping}, []Node{stable}
+	now := time.Unix(1000, 0)
+
+	q.Observe(nil, with, now) // initial join
+	for i := 0; i < 3; i++ {
+		now = now.Add(time.Second)
+		if i%2 == 0 {
+			q.Observe(with, without, now)
+		} else {
+			q.Observe(without, with, now)
+		}
+	}
+	kept, excluded := q.Filter(with, now)
+	if !reflect.DeepEqual(kept, without) || !reflect.DeepEqual(excluded, []string{"flapping"}) {
+		t.Fatalf("Filter() = %v, %v; want only the stable node kept", kept, excluded)
+	}
+	if next := q.Next(now); !next.Equal(now.Add(10 * time.Second)) {
+		t.Errorf("Next() = %s, want end of the first hold-down", next)
+	}
+
+	now = now.Add(11 * time.Second)
+	if kept, _ := q.Filter(with, now); len(kept) != 2 {
+		t.Errorf("Filter() after hold-down = %v, want both nodes", kept)
+	}
+
+	// flapping again doubles the hold-down
+	for i := 0; i < 4; i++ {
+		now = now.Add(time.Second)
+		q.Observe(with, without, now)
+	}
+	if next := q.Next(now); !next.Equal(now.Add(20 * time.Second)) {
+		t.Errorf("Next() = %s, want end of the doubled hold-down", next)
+	}
+
+	// calm nodes are forgotten
+	now = now.Add(time.Hour)
+	if next := q.Next(now); !next.IsZero() || len(q.nodes) != 0 {
+		t.Errorf("Next() = %s with %d nodes tracked, want none", next, len(q.nodes))
+	}
+}
+
+func Test_Quarantine_ObserveHandshakes(t *testing.T) {
+	q := &Quarantine{Threshold: 3, Window: time.Minute, HoldDown: 10 * time.Second}
+	nodes := []Node{{Name: "reachable"}, {Name: "unreachable"}}
+	now := time.Unix(1000, 0)
+	for i := 0; i < 3; i++ {
+		now = now.Add(time.Second)
+		q.ObserveHandshakes([]string{"unreachable"}, now)
+	}
+	if _, excluded := q.Filter(nodes, now); !reflect.DeepEqual(excluded, []string{"unreachable"}) {
+		t.Errorf("Filter() excluded %v, want the node failing handshakes", excluded)
+	}
+}
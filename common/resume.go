@@ -0,0 +1,33 @@
+package common
+
+import "time"
+
+// minSuspendTime is the minimum time the wall clock must have advanced beyond the monotonic clock to consider the
+// system suspended, so small wall clock adjustments (e.g. by NTP) are not mistaken for a suspend
+const minSuspendTime = 30 * time.Second
+
+// Resumes pushes the time the system was suspended to a channel, every time it resumes
+// Suspends are detected by comparing the clocks every interval: the monotonic clock stops while suspended, but the
+// wall clock keeps going, so no support of the init system (e.g. logind) is needed.
+func Resumes(interval time.Duration) <-chan time.Duration {
+	resumec := make(chan time.Duration)
+	go func() {
+		last := time.Now()
+		for range time.Tick(interval) {
+			now := time.Now()
+			if suspended := suspendedFor(now.Round(0).Sub(last.Round(0)), now.Sub(last)); suspended > 0 {
+				resumec <- suspended
+			}
+			last = now
+		}
+	}()
+	return resumec
+}
+
+// suspendedFor provides how long the system was suspended, given the time elapsed on the wall and monotonic clocks
+func suspendedFor(wall, monotonic time.Duration) time.Duration {
+	if wall-monotonic < minSuspendTime {
+		return 0
+	}
+	return wall - monotonic
+}
@@ -0,0 +1,27 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_suspendedFor(t *testing.T) {
+	tests := []struct {
+		name      string
+		wall      time.Duration
+		monotonic time.Duration
+		want      time.Duration
+	}{
+		{"running", 5 * time.Second, 5 * time.Second, 0},
+		{"clock adjusted forward", 7 * time.Second, 5 * time.Second, 0},
+		{"clock adjusted backward", -time.Hour, 5 * time.Second, 0},
+		{"suspended", 2*time.Hour + 5*time.Second, 5 * time.Second, 2 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := suspendedFor(tt.wall, tt.monotonic); got != tt.want {
+				t.Errorf("suspendedFor() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
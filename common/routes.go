@@ -1,34 +1,262 @@
 package common
 
 import (
+	"bytes"
+	"fmt"
 	"net"
+	"path"
+	"sort"
+	"time"
 
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
+// routeSettleTime is the time waited for further route updates before pushing, so bursts (e.g. an interface going
+// down) are pushed as a single change
+const routeSettleTime = 50 * time.Millisecond
+
+// resubscribeDelay is the time waited before resubscribing to route updates after the subscription failed
+const resubscribeDelay = 5 * time.Second
+
 // Routes pushes list of local routes to a channel, after filtering using the provided network
-// The full list is pushed after every routing change
-func Routes(filter []*net.IPNet) <-chan []net.IPNet {
+// The routes are aggregated into the smallest equivalent list of networks, to keep node metadata small
+// Only routes via interfaces matching ifaces are considered.
+// Routes are tracked via netlink route updates, without ever polling the routing table. The full list is pushed once
+// initially and then after every change, including filter changes received on filterc.
+func Routes(filter []*net.IPNet, ifaces InterfaceFilter, filterc <-chan []*net.IPNet) <-chan []net.IPNet {
 	routesc := make(chan []net.IPNet)
-	updatec := make(chan netlink.RouteUpdate)
-	netlink.RouteSubscribe(updatec, make(chan struct{}))
-	go func() {
-		for {
-			<-updatec
-			routes, err := netlink.RouteList(nil, netlink.FAMILY_ALL)
-			if err != nil {
+	w := &routeWatcher{filter: filter, ifaces: ifaces}
+	go w.run(routesc, filterc)
+	return routesc
+}
+
+// routeWatcher keeps track of the local routes matching its filters
+type routeWatcher struct {
+	filter    []*net.IPNet
+	ifaces    InterfaceFilter
+	routes    map[string]net.IPNet // matching routes by table, link and destination
+	linkNames map[int]string
+}
+
+func (w *routeWatcher) run(routesc chan<- []net.IPNet, filterc <-chan []*net.IPNet) {
+	var updatec chan netlink.RouteUpdate
+	var done chan struct{}
+	var settle, retry <-chan time.Time
+	var last, pending []net.IPNet
+	var out chan<- []net.IPNet // only set while a result is pending
+
+	subscribe := func() {
+		if done != nil {
+			close(done)
+			if updatec != nil {
+				go func(c chan netlink.RouteUpdate) {
+					for range c { // drain until the old subscription is closed
+					}
+				}(updatec)
+			}
+		}
+		w.routes = make(map[string]net.IPNet)
+		w.linkNames = make(map[int]string)
+		updatec = make(chan netlink.RouteUpdate)
+		done = make(chan struct{})
+		// the existing routes are listed as updates, so the routing table is read from the same subscription
+		if err := netlink.RouteSubscribeWithOptions(updatec, done, netlink.RouteSubscribeOptions{ListExisting: true}); err != nil {
+			close(updatec) // retried below
+		}
+		settle = time.After(routeSettleTime)
+	}
+
+	subscribe()
+	for {
+		select {
+		case update, ok := <-updatec:
+			if !ok {
+				updatec = nil
+				retry = time.After(resubscribeDelay)
 				continue
 			}
-			result := make([]net.IPNet, 0)
-			for _, route := range routes {
-				for _, filterItem := range filter {
-					if route.Dst != nil && filterItem.Contains(route.Dst.IP) {
-						result = append(result, *route.Dst)
-					}
-				}
+			if w.apply(update) && settle == nil {
+				settle = time.After(routeSettleTime)
+			}
+		case filter := <-filterc:
+			w.filter = filter
+			subscribe()
+		case <-retry:
+			retry = nil
+			subscribe()
+		case <-settle:
+			settle = nil
+			if result := w.result(); !equalNetworks(result, last) || last == nil {
+				pending, out = result, routesc
 			}
-			routesc <- result
+		case out <- pending:
+			last, out = pending, nil
 		}
-	}()
-	return routesc
+	}
+}
+
+// apply applies the route update, reporting whether the matching routes changed
+func (w *routeWatcher) apply(update netlink.RouteUpdate) bool {
+	route := update.Route
+	// like the default RouteList, only consider unicast routes from the main table; the local table in particular
+	// contains host routes for all local addresses (and multicast routes for IPv6)
+	if route.Dst == nil || route.Table != unix.RT_TABLE_MAIN || route.Type != unix.RTN_UNICAST || !w.matches(route) {
+		return false
+	}
+	key := fmt.Sprintf("%d/%d/%s", route.Table, route.LinkIndex, route.Dst)
+	_, known := w.routes[key]
+	switch update.Type {
+	case unix.RTM_NEWROUTE:
+		w.routes[key] = *route.Dst
+		return !known
+	case unix.RTM_DELROUTE:
+		delete(w.routes, key)
+		return known
+	}
+	return false
+}
+
+func (w *routeWatcher) matches(route netlink.Route) bool {
+	if len(w.ifaces.Include) > 0 || len(w.ifaces.Exclude) > 0 {
+		if !w.ifaces.Match(w.linkName(route.LinkIndex)) {
+			return false
+		}
+	}
+	for _, filterItem := range w.filter {
+		if filterItem.Contains(route.Dst.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *routeWatcher) linkName(index int) string {
+	if name, ok := w.linkNames[index]; ok {
+		return name
+	}
+	name := ""
+	if link, err := netlink.LinkByIndex(index); err == nil {
+		name = link.Attrs().Name
+	}
+	w.linkNames[index] = name
+	return name
+}
+
+// result provides the aggregated matching routes
+func (w *routeWatcher) result() []net.IPNet {
+	result := make([]net.IPNet, 0, len(w.routes))
+	for _, route := range w.routes {
+		result = append(result, route)
+	}
+	return AggregateNetworks(result)
+}
+
+func equalNetworks(a, b []net.IPNet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !sameNetwork(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// InterfaceFilter selects interfaces by name, using shell patterns (e.g. "br-*")
+// Interfaces are matched if they match any include pattern, or if there are none, and no exclude pattern.
+type InterfaceFilter struct {
+	Include []string
+	Exclude []string
+}
+
+// Match reports whether the interface with the provided name is selected by the filter
+func (f InterfaceFilter) Match(name string) bool {
+	for _, pattern := range f.Exclude {
+		if matched, _ := path.Match(pattern, name); matched {
+			return false
+		}
+	}
+	if len(f.Include) == 0 {
+		return true
+	}
+	for _, pattern := range f.Include {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// AggregateNetworks merges the provided networks into the smallest equivalent list of networks: networks contained in
+// others are dropped and adjacent networks of the same size are merged into their supernet, recursively.
+// No address outside of the provided networks is ever added.
+func AggregateNetworks(networks []net.IPNet) []net.IPNet {
+	result := make([]net.IPNet, 0, len(networks))
+	for _, network := range networks {
+		result = append(result, normalizeNetwork(network))
+	}
+
+	for changed := true; changed; {
+		changed = false
+		sort.Slice(result, func(i, j int) bool {
+			if len(result[i].IP) != len(result[j].IP) {
+				return len(result[i].IP) < len(result[j].IP)
+			}
+			if c := bytes.Compare(result[i].IP, result[j].IP); c != 0 {
+				return c < 0
+			}
+			onesi, _ := result[i].Mask.Size()
+			onesj, _ := result[j].Mask.Size()
+			return onesi < onesj
+		})
+
+		merged := result[:0]
+		for _, network := range result {
+			if len(merged) == 0 {
+				merged = append(merged, network)
+				continue
+			}
+			last := &merged[len(merged)-1]
+			if len(last.IP) == len(network.IP) && last.Contains(network.IP) {
+				changed = changed || !sameNetwork(*last, network)
+				continue // contained in previous network
+			}
+			if supernet, ok := siblingSupernet(*last, network); ok {
+				*last = supernet
+				changed = true
+				continue
+			}
+			merged = append(merged, network)
+		}
+		result = merged
+	}
+	return result
+}
+
+// normalizeNetwork returns a copy of the network with its host bits cleared, using 4 byte representation for IPv4
+func normalizeNetwork(network net.IPNet) net.IPNet {
+	ip := network.IP.To4()
+	mask := network.Mask
+	if ip != nil && len(mask) == net.IPv6len {
+		mask = mask[12:]
+	} else if ip == nil {
+		ip = network.IP.To16()
+	}
+	return net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+// siblingSupernet returns the network containing exactly both provided networks, if they are adjacent halves of it
+func siblingSupernet(a, b net.IPNet) (net.IPNet, bool) {
+	onesa, bits := a.Mask.Size()
+	onesb, _ := b.Mask.Size()
+	if len(a.IP) != len(b.IP) || onesa != onesb || onesa == 0 {
+		return net.IPNet{}, false
+	}
+	mask := net.CIDRMask(onesa-1, bits)
+	if !a.IP.Mask(mask).Equal(b.IP.Mask(mask)) || a.IP.Equal(b.IP) {
+		return net.IPNet{}, false
+	}
+	return net.IPNet{IP: a.IP.Mask(mask), Mask: mask}, true
 }
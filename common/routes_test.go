@@ -0,0 +1,106 @@
+package common
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func Test_AggregateNetworks(t *testing.T) {
+	parse := func(cidrs ...string) []net.IPNet {
+		nets := make([]net.IPNet, 0, len(cidrs))
+		for _, cidr := range cidrs {
+			_, n, _ := net.ParseCIDR(cidr)
+			nets = append(nets, *n)
+		}
+		return nets
+	}
+	tests := []struct {
+		name string
+		in   []string
+		want []string
+	}{
+		{"empty", []string{}, []string{}},
+		{"single", []string{"10.1.0.0/24"}, []string{"10.1.0.0/24"}},
+		{"siblings", []string{"10.1.1.0/24", "10.1.0.0/24"}, []string{"10.1.0.0/23"}},
+		{"recursive siblings", []string{"10.1.0.0/24", "10.1.1.0/24", "10.1.2.0/24", "10.1.3.0/24"}, []string{"10.1.0.0/22"}},
+		{"non-siblings", []string{"10.1.1.0/24", "10.1.2.0/24"}, []string{"10.1.1.0/24", "10.1.2.0/24"}},
+		{"contained", []string{"10.1.2.0/24", "10.1.0.0/16", "10.1.0.0/24"}, []string{"10.1.0.0/16"}},
+		{"duplicates", []string{"10.1.0.0/24", "10.1.0.0/24"}, []string{"10.1.0.0/24"}},
+		{"different sizes", []string{"10.1.0.0/24", "10.1.1.0/25"}, []string{"10.1.0.0/24", "10.1.1.0/25"}},
+		{"ipv6", []string{"2001:db8::/64", "2001:db8:0:1::/64", "10.1.0.0/24"}, []string{"10.1.0.0/24", "2001:db8::/63"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := AggregateNetworks(parse(tt.in...))
+			gotStr := make([]string, 0, len(got))
+			for _, n := range got {
+				gotStr = append(gotStr, n.String())
+			}
+			if !reflect.DeepEqual(gotStr, tt.want) {
+				t.Errorf("AggregateNetworks() = %v, want %v", gotStr, tt.want)
+			}
+		})
+	}
+}
+
+func Test_InterfaceFilter_Match(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter InterfaceFilter
+		iface  string
+		want   bool
+	}{
+		{"empty filter", InterfaceFilter{}, "eth0", true},
+		{"included", InterfaceFilter{Include: []string{"br-*"}}, "br-lan", true},
+		{"not included", InterfaceFilter{Include: []string{"br-*"}}, "eth0", false},
+		{"excluded", InterfaceFilter{Exclude: []string{"docker*"}}, "docker0", false},
+		{"not excluded", InterfaceFilter{Exclude: []string{"docker*"}}, "eth0", true},
+		{"exclude wins", InterfaceFilter{Include: []string{"*"}, Exclude: []string{"veth*"}}, "veth1234", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.Match(tt.iface); got != tt.want {
+				t.Errorf("InterfaceFilter.Match(%q) = %v, want %v", tt.iface, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_routeWatcher_apply(t *testing.T) {
+	_, filter, _ := net.ParseCIDR("192.168.0.0/16")
+	w := &routeWatcher{filter: []*net.IPNet{filter}, routes: make(map[string]net.IPNet), linkNames: make(map[int]string)}
+	route := func(cidr string, link int) netlink.Route {
+		_, dst, _ := net.ParseCIDR(cidr)
+		return netlink.Route{Dst: dst, LinkIndex: link, Table: unix.RT_TABLE_MAIN, Type: unix.RTN_UNICAST}
+	}
+
+	if !w.apply(netlink.RouteUpdate{Type: unix.RTM_NEWROUTE, Route: route("192.168.1.0/24", 2)}) {
+		t.Error("routeWatcher.apply() should report new matching route")
+	}
+	if w.apply(netlink.RouteUpdate{Type: unix.RTM_NEWROUTE, Route: route("192.168.1.0/24", 2)}) {
+		t.Error("routeWatcher.apply() should not report known route")
+	}
+	if w.apply(netlink.RouteUpdate{Type: unix.RTM_NEWROUTE, Route: route("10.0.0.0/24", 2)}) {
+		t.Error("routeWatcher.apply() should not report route outside of filter")
+	}
+	local := route("192.168.2.1/32", 2)
+	local.Table, local.Type = unix.RT_TABLE_LOCAL, unix.RTN_LOCAL
+	if w.apply(netlink.RouteUpdate{Type: unix.RTM_NEWROUTE, Route: local}) {
+		t.Error("routeWatcher.apply() should not report local table routes")
+	}
+	w.apply(netlink.RouteUpdate{Type: unix.RTM_NEWROUTE, Route: route("192.168.0.0/24", 3)})
+	if got := w.result(); len(got) != 1 || got[0].String() != "192.168.0.0/23" {
+		t.Errorf("routeWatcher.result() = %v, want [192.168.0.0/23]", got)
+	}
+
+	if !w.apply(netlink.RouteUpdate{Type: unix.RTM_DELROUTE, Route: route("192.168.1.0/24", 2)}) {
+		t.Error("routeWatcher.apply() should report removed route")
+	}
+	if got := w.result(); len(got) != 1 || got[0].String() != "192.168.0.0/24" {
+		t.Errorf("routeWatcher.result() = %v, want [192.168.0.0/24]", got)
+	}
+}
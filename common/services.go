@@ -0,0 +1,55 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// service protocols
+const (
+	ProtoTCP = "tcp"
+	ProtoUDP = "udp"
+)
+
+// Service is a named service offered by a node on a port of its overlay address
+type Service struct {
+	Name  string
+	Port  uint16
+	Proto string
+}
+
+func (s Service) String() string {
+	return fmt.Sprintf("%s=%d/%s", s.Name, s.Port, s.Proto)
+}
+
+// ParseServices parses NAME=PORT services, optionally followed by /tcp or /udp; the protocol defaults to TCP
+// The services are sorted, so they are encoded deterministically.
+func ParseServices(entries []string) ([]Service, error) {
+	services := make([]Service, 0, len(entries))
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.Contains(parts[0], ".") || !ValidHostname(parts[0]) {
+			return nil, errors.Errorf("invalid service %q, expected NAME=PORT", entry)
+		}
+		service := Service{Name: strings.ToLower(parts[0]), Proto: ProtoTCP}
+		portProto := strings.SplitN(parts[1], "/", 2)
+		if len(portProto) == 2 {
+			service.Proto = strings.ToLower(portProto[1])
+		}
+		port, err := strconv.ParseUint(portProto[0], 10, 16)
+		if err != nil || port == 0 {
+			return nil, errors.Errorf("invalid port of service %q", entry)
+		}
+		service.Port = uint16(port)
+		if service.Proto != ProtoTCP && service.Proto != ProtoUDP {
+			return nil, errors.Errorf("invalid protocol of service %q, expected %s or %s", entry, ProtoTCP, ProtoUDP)
+		}
+		services = append(services, service)
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].String() < services[j].String() })
+	return services, nil
+}
@@ -0,0 +1,36 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_ParseServices(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		want    []Service
+		wantErr bool
+	}{
+		{"none", nil, []Service{}, false},
+		{"default protocol", []string{"web=8080"}, []Service{{"web", 8080, ProtoTCP}}, false},
+		{"sorted", []string{"dns=53/UDP", "Api=443/tcp"}, []Service{{"api", 443, ProtoTCP}, {"dns", 53, ProtoUDP}}, false},
+		{"no port", []string{"web"}, nil, true},
+		{"invalid port", []string{"web=http"}, nil, true},
+		{"port out of range", []string{"web=65536"}, nil, true},
+		{"invalid protocol", []string{"web=80/sctp"}, nil, true},
+		{"invalid name", []string{"_web=80"}, nil, true},
+		{"dotted name", []string{"web.internal=80"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseServices(tt.entries)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseServices() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseServices() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package common
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ParseSSHHostKey parses a public SSH host key in authorized_keys format (TYPE BASE64 [COMMENT]), providing it as TYPE
+// BASE64 without comment
+// Since keys are gossiped by other nodes and written to known_hosts files, anything else must be rejected.
+func ParseSSHHostKey(line string) (string, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return "", errors.Errorf("invalid SSH host key %q, expected TYPE BASE64", line)
+	}
+	for _, c := range fields[0] {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '@' || c == '.') {
+			return "", errors.Errorf("invalid SSH host key type %q", fields[0])
+		}
+	}
+	if _, err := base64.StdEncoding.DecodeString(fields[1]); err != nil {
+		return "", errors.Wrapf(err, "invalid SSH host key of type %s", fields[0])
+	}
+	return fields[0] + " " + fields[1], nil
+}
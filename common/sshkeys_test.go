@@ -0,0 +1,23 @@
+package common
+
+import "testing"
+
+func TestParseSSHHostKey(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    string
+		wantErr bool
+	}{
+		{"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIA== root@node1\n", "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIA==", false},
+		{"ecdsa-sha2-nistp256 AAAAE2VjZHNh", "ecdsa-sha2-nistp256 AAAAE2VjZHNh", false},
+		{"ssh-ed25519", "", true},
+		{"ssh-ed25519 not-base64!", "", true},
+		{"node1,10.0.0.1 ssh-ed25519 AAAA", "", true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSSHHostKey(tt.line)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseSSHHostKey(%q) = %q, %v, want %q (error %v)", tt.line, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
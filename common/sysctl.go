@@ -0,0 +1,36 @@
+package common
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// sysctlRoot is the root of the sysctl tree, as exposed by procfs
+const sysctlRoot = "/proc/sys"
+
+// Sysctl provides the value of the provided kernel parameter, using slashes as separator (e.g. net/ipv4/ip_forward)
+func Sysctl(name string) (string, error) {
+	value, err := ioutil.ReadFile(path.Join(sysctlRoot, name))
+	if err != nil {
+		return "", errors.Wrapf(err, "could not read sysctl %s", name)
+	}
+	return strings.TrimSpace(string(value)), nil
+}
+
+// SetSysctl sets the provided kernel parameter, returning its previous value so it can be restored
+func SetSysctl(name, value string) (string, error) {
+	previous, err := Sysctl(name)
+	if err != nil {
+		return "", err
+	}
+	if previous == value {
+		return previous, nil
+	}
+	if err := ioutil.WriteFile(path.Join(sysctlRoot, name), []byte(value), 0644); err != nil {
+		return "", errors.Wrapf(err, "could not set sysctl %s", name)
+	}
+	return previous, nil
+}
@@ -0,0 +1,41 @@
+package common
+
+import (
+	"net"
+)
+
+// VIPOwners decides which node owns each virtual IP: the candidate with the lowest name among the local node and the
+// provided members, like the mesh leader. Candidates are the nodes configured with the virtual IP, so it moves to a
+// surviving candidate when its owner leaves. Every node computes the same owners from the same membership.
+func VIPOwners(localName string, localVIPs []net.IP, nodes []Node) map[string]string {
+	owners := make(map[string]string)
+	claim := func(name string, vips []net.IP) {
+		for _, vip := range vips {
+			if owner, ok := owners[vip.String()]; !ok || name < owner {
+				owners[vip.String()] = name
+			}
+		}
+	}
+	claim(localName, localVIPs)
+	for _, node := range nodes {
+		claim(node.Name, node.VIPCandidates)
+	}
+	return owners
+}
+
+// OwnedVIPs provides the virtual IPs owned by the named node, as single address networks
+func OwnedVIPs(name string, owners map[string]string) []net.IPNet {
+	owned := make([]net.IPNet, 0)
+	for vip, owner := range owners {
+		if owner != name {
+			continue
+		}
+		ip := net.ParseIP(vip)
+		if ip4 := ip.To4(); ip4 != nil {
+			owned = append(owned, net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)})
+		} else {
+			owned = append(owned, net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+		}
+	}
+	return owned
+}
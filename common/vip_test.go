@@ -0,0 +1,43 @@
+package common
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func Test_VIPOwners(t *testing.T) {
+	vip, other := net.ParseIP("10.0.0.100"), net.ParseIP("10.0.0.101")
+	nodes := []Node{
+		{Name: "node3", nodeMeta: nodeMeta{VIPCandidates: []net.IP{vip, other}}},
+		{Name: "node2", nodeMeta: nodeMeta{VIPCandidates: []net.IP{vip}}},
+		{Name: "node0"}, // not a candidate
+	}
+
+	want := map[string]string{"10.0.0.100": "node2", "10.0.0.101": "node3"}
+	if got := VIPOwners("node4", []net.IP{vip}, nodes); !reflect.DeepEqual(got, want) {
+		t.Errorf("VIPOwners() = %v, want %v", got, want)
+	}
+	want = map[string]string{"10.0.0.100": "node1", "10.0.0.101": "node3"}
+	if got := VIPOwners("node1", []net.IP{vip}, nodes); !reflect.DeepEqual(got, want) {
+		t.Errorf("VIPOwners() = %v, want %v", got, want)
+	}
+	// the owner left, the surviving candidates take over
+	want = map[string]string{"10.0.0.100": "node3", "10.0.0.101": "node3"}
+	if got := VIPOwners("node4", []net.IP{vip}, nodes[:1]); !reflect.DeepEqual(got, want) {
+		t.Errorf("VIPOwners() = %v after node2 left, want %v", got, want)
+	}
+}
+
+func Test_OwnedVIPs(t *testing.T) {
+	owners := map[string]string{"10.0.0.100": "node1", "10.0.0.101": "node2", "2001:db8::100": "node1"}
+	got := OwnedVIPs("node1", owners)
+	if len(got) != 2 {
+		t.Fatalf("OwnedVIPs() = %v, want 2 addresses", got)
+	}
+	for _, vip := range got {
+		if ones, bits := vip.Mask.Size(); ones != bits || owners[vip.IP.String()] != "node1" {
+			t.Errorf("OwnedVIPs() contains %s, want only single addresses owned by node1", &vip)
+		}
+	}
+}
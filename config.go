@@ -2,35 +2,148 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/costela/wesher/cluster"
+	"github.com/costela/wesher/common"
+	"github.com/costela/wesher/control"
+	"github.com/costela/wesher/etchosts"
+	"github.com/costela/wesher/wg"
 	"github.com/hashicorp/go-sockaddr"
 	"github.com/mikioh/ipaddr"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"github.com/stevenroose/gonfig"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 type config struct {
-	ConfigFile       string     `id:"config" desc:"config file YAML" default:"wesher.conf"`
-	ClusterKey       []byte     `id:"cluster-key" desc:"shared key for cluster membership; must be 32 bytes base64 encoded; will be generated if not provided"`
-	Join             []string   `desc:"comma separated list of hostnames or IP addresses to existing cluster members; if not provided, will attempt resuming any known state or otherwise wait for further members."`
-	Rejoin           int      `desc:"interval at which join nodes are joined again if away, 0 disables rejoining altogether" default:"0"`
-	Init             bool       `desc:"whether to explicitly (re)initialize the cluster; any known state from previous runs will be forgotten"`
-	BindAddr         string     `id:"bind-addr" desc:"IP address to bind to for cluster membership traffic (cannot be used with --bind-iface)"`
-	BindIface        string     `id:"bind-iface" desc:"Interface to bind to for cluster membership traffic (cannot be used with --bind-addr)"`
-	AdvertiseAddr    string     `id:"advertise-addr" desc:"IP address to advertise to other nodes for NAT traversal"`
-	ClusterPort      int        `id:"cluster-port" desc:"port used for membership gossip traffic (both TCP and UDP); must be the same across cluster" default:"7946"`
-	WireguardPort    int        `id:"wireguard-port" desc:"port used for wireguard traffic (UDP); must be the same across cluster" default:"51820"`
-	MTU              int        `id:"mtu" desc:"mtu for wireguard interface" default:"1420"`
-	OverlayNet       *network   `id:"overlay-net" desc:"the network in which to allocate addresses for the overlay mesh network (CIDR format); smaller networks increase the chance of IP collision" default:"10.0.0.0/8"`
-	RoutedNet        []*network `id:"routed-net" desc:"network used to filter routes that nodes are allowed to announce (CIDR format)" default:"0.0.0.0/32"`
-	Interface        string     `desc:"name of the wireguard interface to create and manage" default:"wgoverlay"`
-	NoEtcHosts       bool       `id:"no-etc-hosts" desc:"disable writing of entries to /etc/hosts"`
-	LogLevel         string     `id:"log-level" desc:"set the verbosity (debug/info/warn/error)" default:"warn"`
-	Version          bool       `desc:"display current version and exit"`
-	NodeUpdateScript string     `id:"node-update-script" desc:"path to script which is executed everytime the service receives an update for a node"`
-	KeepaliveInterval string   `id:"keepalive-interval" desc:"interval for which to send keepalive packets" default:"30s"`
+	ConfigFile               string     `id:"config" desc:"config file YAML" default:"wesher.conf"`
+	ClusterKey               []byte     `id:"cluster-key" desc:"shared key for cluster membership; must be 32 bytes base64 encoded; will be generated if not provided"`
+	NodeName                 string     `id:"node-name" desc:"name of this node in the cluster; defaults to the hostname"`
+	PersistIdentity          bool       `id:"persist-identity" desc:"keep the wireguard key and overlay address across restarts in /var/lib/wesher, even if the node name changes"`
+	NameConflict             string     `id:"name-conflict" desc:"what to do if another node claims the name of this node (log/suffix/abort/evict)" default:"log"`
+	Join                     []string   `desc:"comma separated list of hostnames or IP addresses to existing cluster members, optionally with a port (host:port); if not provided, will attempt resuming any known state or otherwise wait for further members."`
+	JoinFile                 string     `id:"join-file" desc:"file with additional hosts to join, one per line; re-read on every rejoin"`
+	Rejoin                   *duration  `desc:"interval at which join nodes are joined again if away (e.g. 30s or 5m; bare numbers are seconds), 0 disables rejoining altogether" default:"0"`
+	ResumeCheckInterval      *duration  `id:"resume-check-interval" desc:"interval at which the clocks are compared to detect resuming from suspend, upon which join nodes are rejoined, external peer endpoints resolved again and handshakes initiated; 0 disables it" default:"5s"`
+	Init                     bool       `desc:"whether to explicitly (re)initialize the cluster; any known state from previous runs will be forgotten"`
+	BindAddr                 string     `id:"bind-addr" desc:"IP address to bind to for cluster membership traffic (cannot be used with --bind-iface)"`
+	BindIface                string     `id:"bind-iface" desc:"Interface to bind to for cluster membership traffic (cannot be used with --bind-addr)"`
+	BindDevice               string     `id:"bind-device" desc:"network device to bind cluster membership and wireguard sockets to, forcing mesh traffic through it (SO_BINDTODEVICE and fwmark routing)"`
+	AdvertiseAddr            string     `id:"advertise-addr" desc:"IP address to advertise to other nodes for NAT traversal"`
+	AdvertiseIface           string     `id:"advertise-interface" desc:"interface whose first global address is advertised to other nodes; re-evaluated when the address changes (cannot be used with --advertise-addr or --advertise-addr-cmd)"`
+	AdvertiseAddrCmd         string     `id:"advertise-addr-cmd" desc:"shell command whose output is advertised to other nodes as IP address; periodically re-evaluated, and killed if it takes longer than 10s (cannot be used with --advertise-addr or --advertise-interface)"`
+	AdvertiseAddrCmdInterval *duration  `id:"advertise-addr-cmd-interval" desc:"interval at which the advertise address command is re-evaluated" default:"5m"`
+	ClusterPort              int        `id:"cluster-port" desc:"port used for membership gossip traffic (both TCP and UDP); must be the same across cluster" default:"7946"`
+	WireguardPort            int        `id:"wireguard-port" desc:"port used for wireguard traffic (UDP); must be the same across cluster, unless nodes announce --wireguard-endpoint-port" default:"51820"`
+	WireguardEndpointPort    int        `id:"wireguard-endpoint-port" desc:"port other nodes send wireguard traffic to, if it differs from --wireguard-port, e.g. behind a NAT port forward; 0 uses --wireguard-port"`
+	SinglePort               bool       `id:"single-port" desc:"multiplex wireguard traffic with cluster membership traffic on the cluster port, so only it must be reachable by other nodes; wireguard still listens on --wireguard-port for external peers"`
+	MTU                      int        `id:"mtu" desc:"mtu for wireguard interface" default:"1420"`
+	OverlayNet               *network   `id:"overlay-net" desc:"the network in which to allocate addresses for the overlay mesh network (CIDR format); smaller networks increase the chance of IP collision" default:"10.0.0.0/8"`
+	OverlayAddrStrategy      string     `id:"overlay-addr-strategy" desc:"how to assign the overlay address of this node: by hash of the node name or wireguard public key, the lowest address unused by known nodes, or from --overlay-addr-file (name/pubkey/sequential/static)" default:"name"`
+	OverlayAddrFile          string     `id:"overlay-addr-file" desc:"file listing the overlay address of each node as lines of node name and address, used by the static strategy"`
+	SecondaryNets            []*subnet  `id:"secondary-net" desc:"additional overlay network from which every node is assigned a prefix, as NETWORK=LENGTH (e.g. fd00:10::/48=64) or NETWORK for single addresses; the prefixes are added to the allowed IPs, e.g. for local workloads; can be passed multiple times"`
+	OverlayReserved          []*network `id:"overlay-reserved" desc:"range of the overlay network never assigned automatically, e.g. for static assignments or VIPs (CIDR format); can be passed multiple times"`
+	RoutedNet                []*network `id:"routed-net" desc:"network used to filter routes that nodes are allowed to announce (CIDR format)" default:"0.0.0.0/32"`
+	RoutedNetFile            string     `id:"routed-net-file" desc:"file with additional routed networks, one per line (CIDR format); watched for changes and re-announced"`
+	RoutedNetIfaces          []string   `id:"routed-net-iface" desc:"only announce routes via interfaces matching this shell pattern (e.g. br-lan or eth*); can be passed multiple times"`
+	RoutedNetExcludeIfaces   []string   `id:"routed-net-exclude-iface" desc:"never announce routes via interfaces matching this shell pattern (e.g. docker*); can be passed multiple times"`
+	VIPs                     []string   `id:"vip" desc:"virtual IP of the overlay network this node is a candidate for; exactly one candidate owns it and it moves to another one when the owner leaves; can be passed multiple times"`
+	StrictAllowedIPs         bool       `id:"strict-allowed-ips" desc:"only allow the exact overlay address of each node on its wireguard peer, ignoring the networks and hosts announced by other nodes, so no node can attract traffic for anything else"`
+	ProxyARPIface            string     `id:"proxy-arp-iface" desc:"LAN interface on which to enable proxy-ARP for remote addresses routed via the mesh"`
+	NDPProxyIface            string     `id:"ndp-proxy-iface" desc:"LAN interface on which to proxy IPv6 neighbor discovery for remote addresses reachable via the mesh"`
+	FlushConntrack           bool       `id:"flush-conntrack" desc:"flush conntrack entries of nodes leaving and routes withdrawn, so long-lived flows fail over immediately"`
+	UnreachableDeparted      *duration  `id:"unreachable-departed" desc:"time to route the overlay addresses and withdrawn networks of departed nodes as unreachable, so traffic fails fast; 0 disables it" default:"0"`
+	NftSet                   string     `id:"nft-set" desc:"nftables set (FAMILY/TABLE/SET) kept in sync with the overlay addresses of all members"`
+	FirewalldZone            string     `id:"firewalld-zone" desc:"firewalld zone to place the wireguard interface in while running"`
+	DSCP                     string     `id:"dscp" desc:"DSCP value (0-63, or a class name like ef or af41) to set on wireguard packets sent to other nodes"`
+	EgressLimit              *bandwidth `id:"egress-limit" desc:"limit the total traffic sent over the mesh, in bits per second (e.g. 100mbit), 0 disables the limit" default:"0"`
+	PeerEgressLimit          *bandwidth `id:"peer-egress-limit" desc:"limit the traffic sent to each node, in bits per second (e.g. 20mbit), 0 disables the limit" default:"0"`
+	IngressLimit             *bandwidth `id:"ingress-limit" desc:"ask other nodes to limit the traffic they send to this node, in bits per second (e.g. 50mbit), 0 disables the limit" default:"0"`
+	RoutedHosts              []string   `id:"routed-host" desc:"NAME=IP of a host behind a routed network, announced to other nodes for their hosts entries and DNS; can be passed multiple times"`
+	RoutedHostsFile          string     `id:"routed-hosts-file" desc:"file in /etc/hosts format with hosts behind routed networks, announced like --routed-host"`
+	ExternalPeersFile        string     `id:"external-peers-file" desc:"file listing plain wireguard peers not running wesher to configure on the interface, as lines of name, public key, comma separated allowed IPs and optional endpoint (address:port)"`
+	AnnounceExternalPeers    bool       `id:"announce-external-peers" desc:"announce the allowed IPs of external peers as routes of this node, so other nodes reach them via this node"`
+	FederationExport         string     `id:"federation-export" desc:"file to share the networks and selected host names of this mesh in, for the instance of a federated mesh on the same gateway host to import"`
+	FederationImport         string     `id:"federation-import" desc:"file written by the instance of a federated mesh on the same gateway host with --federation-export, whose networks and host names are announced to this mesh"`
+	FederationHosts          []string   `id:"federation-host" desc:"shell pattern of host names shared with --federation-export (e.g. db*); can be passed multiple times; no names are shared by default"`
+	Interface                string     `desc:"name of the wireguard interface to create and manage" default:"wgoverlay"`
+	NoEtcHosts               bool       `id:"no-etc-hosts" desc:"disable writing of entries to /etc/hosts"`
+	NoEtcHostsWatch          bool       `id:"no-etc-hosts-watch" desc:"disable re-applying entries to /etc/hosts when it is modified by other tools"`
+	EtcHostsInterval         *duration  `id:"etc-hosts-interval" desc:"minimum time between two writes of /etc/hosts; changes in between are written at once" default:"1s"`
+	HostsLabels              []string   `id:"hosts-label" desc:"KEY=VALUE label nodes must have to be added to the hosts entries and DNS (e.g. env=prod); can be passed multiple times, all must match; the mesh itself still includes every node"`
+	NoStateCache             bool       `id:"no-state-cache" desc:"disable keeping and persisting the known nodes in /var/lib/wesher, e.g. on flash storage"`
+	StateMaxNodes            int        `id:"state-max-nodes" desc:"maximum number of nodes kept in the state for rejoining, including nodes no longer members; the least recently seen are evicted first" default:"128"`
+	MinMembers               int        `id:"min-members" desc:"only configure the interface, routes and hosts entries once at least this many members, including this node, are known; 0 disables waiting" default:"0"`
+	LeaveIntact              bool       `id:"leave-intact" desc:"keep the wireguard interface and hosts entries in place on shutdown, only leaving the cluster"`
+	ErrorPolicy              string     `id:"error-policy" desc:"what to do when configuring the interface, hosts entries or running the node update script fails (degrade/fail-fast); fail-fast exits so the service manager restarts the node" default:"degrade"`
+	ReconcileInterval        *duration  `id:"reconcile-interval" desc:"interval at which the wireguard peers, interface address and routes are compared against the desired state, repairing any drift (e.g. caused by manual changes); 0 disables it" default:"5m"`
+	ExistingInterface        string     `id:"existing-interface" desc:"what to do if the interface already exists but does not match the overlay network or has foreign peers (adopt/recreate/abort)" default:"abort"`
+	Backend                  string     `desc:"wireguard backend (kernel/fake); fake keeps the configuration in memory only, for development and tests without root" default:"kernel"`
+	DownOnCrash              bool       `id:"down-on-crash" desc:"also remove the wireguard interface on crashes, not only the hosts entries"`
+	LeaveTimeout             *duration  `id:"leave-timeout" desc:"maximum time to wait for the cluster leave to be broadcast on shutdown, or when rejoining after the advertise address or node name changed" default:"10s"`
+	ShutdownTimeout          *duration  `id:"shutdown-timeout" desc:"maximum time for the whole shutdown sequence" default:"30s"`
+	DumpFile                 string     `id:"dump-file" desc:"file to write the internal state to on SIGUSR1; logged if empty"`
+	MetricsAddr              string     `id:"metrics-addr" desc:"address to serve Prometheus metrics on at /metrics, e.g. 127.0.0.1:9746; disabled if empty"`
+	PprofAddr                string     `id:"pprof-addr" desc:"loopback address to serve runtime profiles on at /debug/pprof/, e.g. 127.0.0.1:6060; disabled if empty"`
+	PrometheusSDFile         string     `id:"prometheus-sd-file" desc:"file to keep up to date with the overlay addresses and labels of all members, as Prometheus file_sd targets"`
+	PrometheusSDPort         int        `id:"prometheus-sd-port" desc:"port of the targets in --prometheus-sd-file, e.g. of an exporter running on every node" default:"9100"`
+	InventoryFile            string     `id:"inventory-file" desc:"file to keep up to date with the names, overlay addresses and labels of all members, as Ansible dynamic inventory"`
+	MembersFile              string     `id:"members-file" desc:"file to keep up to date with the names, addresses, routes, labels and services of all members, as JSON, e.g. for templating tools"`
+	SSHConfigFile            string     `id:"ssh-config-file" desc:"file to keep up to date with a Host block per member connecting to its overlay address, for inclusion in ssh_config"`
+	SSHKnownHostsFile        string     `id:"ssh-known-hosts-file" desc:"file to keep up to date with the SSH host keys announced by all members, in known_hosts format"`
+	SSHHostKeys              []string   `id:"ssh-host-key" desc:"public SSH host key file of this node to announce for --ssh-known-hosts-file of other nodes (e.g. /etc/ssh/ssh_host_ed25519_key.pub); can be passed multiple times"`
+	EventLog                 string     `id:"event-log" desc:"file to append membership and reconfiguration events to, as JSON lines"`
+	EventLogMaxSize          int        `id:"event-log-max-size" desc:"size in MB after which the event log is rotated, keeping 3 rotated files; 0 disables rotation" default:"10"`
+	ControlSocket            string     `id:"control-socket" desc:"path of the unix socket accepting runtime commands (e.g. wesher route); defaults to one per interface in /var/run/wesher"`
+	DBus                     bool       `id:"dbus" desc:"export the status, peers and connect/disconnect methods on the D-Bus system bus, e.g. for desktop indicators"`
+	DBusName                 string     `id:"dbus-name" desc:"well-known D-Bus name to own with --dbus; must be changed to run several instances" default:"io.github.costela.wesher"`
+	DNSAddr                  string     `id:"dns-addr" desc:"address (host:port) on which to serve DNS queries for node names and reverse queries for overlay addresses; disabled if empty"`
+	DNSDomain                string     `id:"dns-domain" desc:"domain under which node names are served via DNS" default:"wesher"`
+	Aliases                  []string   `id:"alias" desc:"additional hostname for this node, added to the hosts entries of other nodes; can be passed multiple times"`
+	Services                 []string   `id:"service" desc:"NAME=PORT of a service this node offers on its overlay address, optionally followed by /tcp or /udp (e.g. web=8080), served as SRV records by the DNS server of every node; can be passed multiple times"`
+	Metadata                 []string   `id:"metadata" desc:"KEY=VALUE free-form metadata of this node announced on startup (e.g. rack=r12), changeable at runtime with wesher metadata; can be passed multiple times"`
+	Labels                   []string   `id:"label" desc:"KEY=VALUE label of this node (e.g. env=prod), which other nodes can select with --hosts-label; can be passed multiple times"`
+	LogLevel                 string     `id:"log-level" desc:"set the verbosity (trace/debug/info/warn/error)" default:"warn"`
+	Version                  bool       `desc:"display current version and exit"`
+	Output                   string     `id:"output" desc:"output format of subcommands and --version (text/json)" default:"text"`
+	NodeUpdateScript         string     `id:"node-update-script" desc:"path to script which is executed everytime the service receives an update for a node"`
+	NodeUpdateScriptInterval *duration  `id:"node-update-script-interval" desc:"minimum time between two runs of the node update script; changes in between are coalesced into one run with the latest state" default:"1s"`
+	NodeUpdateScriptTimeout  *duration  `id:"node-update-script-timeout" desc:"time after which a running node update script, hook script or partition script is killed and considered failed" default:"1m"`
+	ScriptFailureLimit       int        `id:"script-failure-limit" desc:"consecutive failures of the node update script or a hook script after which --error-policy fail-fast shuts down" default:"1"`
+	OnNodeJoin               string     `id:"on-node-join" desc:"path to script which is executed for every node joining the cluster, with its details in the environment and as JSON on stdin"`
+	OnNodeLeave              string     `id:"on-node-leave" desc:"path to script which is executed for every node leaving the cluster, like --on-node-join"`
+	OnNodeUpdate             string     `id:"on-node-update" desc:"path to script which is executed for every node changing its metadata or address, like --on-node-join"`
+	OnRouteChange            string     `id:"on-route-change" desc:"path to script which is executed for every node announcing or withdrawing routes, like --on-node-join with the changed routes"`
+	HealthScript             string     `id:"health-script" desc:"path to script which is executed periodically with a JSON health summary on stdin"`
+	HealthInterval           *duration  `id:"health-interval" desc:"interval in which to run the health script; it must also finish within this time" default:"1m"`
+	HealthFailureAction      string     `id:"health-failure-action" desc:"action when the health script fails (none/resync/exit)" default:"none"`
+	ExpectedMembers          int        `id:"expected-members" desc:"expected number of members, including this node, for partition detection; 0 uses the nodes which were members within --partition-window" default:"0"`
+	PartitionThreshold       int        `id:"partition-threshold" desc:"percentage of the expected members which must be visible, below which this node considers itself partitioned; 0 disables partition detection" default:"0"`
+	PartitionWindow          *duration  `id:"partition-window" desc:"time within which nodes must have been members to be expected by partition detection, unless --expected-members is set" default:"24h"`
+	PartitionScript          string     `id:"partition-script" desc:"path to script which is executed when this node becomes partitioned or recovers, with WESHER_PARTITIONED, WESHER_MEMBERS and WESHER_EXPECTED_MEMBERS set"`
+	KeepaliveInterval        *duration  `id:"keepalive-interval" desc:"interval for which to send keepalive packets" default:"30s"`
+	KeepaliveNATOnly         bool       `id:"keepalive-nat-only" desc:"only send keepalive packets between nodes if either of them is behind NAT"`
+	BehindNAT                string     `id:"behind-nat" desc:"whether this node is behind NAT (auto/yes/no); auto assumes so if the advertised address is not assigned locally" default:"auto"`
+	GossipRoaming            bool       `id:"gossip-roaming" desc:"announce the endpoints peers were observed roaming to, and use the ones announced by other nodes for peers not heard from recently"`
+	UpdateDelay              *duration  `id:"update-delay" desc:"time to wait for further cluster events before applying membership changes, so bursts are applied at once" default:"200ms"`
+	QuarantineFlaps          int        `id:"quarantine-flaps" desc:"number of joins, leaves and failed handshakes of a node within --quarantine-window after which it is temporarily excluded from the wireguard configuration; 0 disables quarantining" default:"0"`
+	QuarantineWindow         *duration  `id:"quarantine-window" desc:"window in which flaps of a node are counted" default:"5m"`
+	QuarantineHoldDown       *duration  `id:"quarantine-hold-down" desc:"time a flapping node is excluded, doubled for every repeated quarantine" default:"1m"`
+	GossipQueueDepth         int        `id:"gossip-queue-depth" desc:"maximum number of queued incoming gossip messages; lower values save memory on small devices" default:"1024"`
+	NoGossipCompression      bool       `id:"no-gossip-compression" desc:"disable compressing gossip messages, saving CPU time at the cost of larger packets"`
+	GossipOverOverlay        bool       `id:"gossip-over-overlay" desc:"move cluster membership traffic onto the overlay network once the mesh is up, so only the wireguard port must be reachable after joining"`
+	PushPullInterval         *duration  `id:"push-pull-interval" desc:"interval of complete state exchanges with a random node; longer intervals save bandwidth on large clusters" default:"1m"`
+	GossipNodes              int        `id:"gossip-nodes" desc:"number of random nodes each gossip message is sent to" default:"4"`
+	Standalone               bool       `desc:"run a single node without cluster membership gossip, only configuring the peers of --standalone-peers; for development, CI and air-gapped testing of scripts"`
+	StandalonePeers          string     `id:"standalone-peers" desc:"file listing the static peers of --standalone, as lines of node name, wireguard public key, overlay address and endpoint address (address or address:port)"`
 
 	// for easier local testing; will break etchosts entry
 	UseIPAsName bool `id:"ip-as-name" default:"false" opts:"hidden"`
@@ -49,6 +162,10 @@ func loadConfig() (*config, error) {
 	}
 
 	// perform some validation
+	if config.Output != outputText && config.Output != outputJSON {
+		return nil, fmt.Errorf("unsupported output format %q; expected %s or %s", config.Output, outputText, outputJSON)
+	}
+
 	if len(config.ClusterKey) != 0 && len(config.ClusterKey) != cluster.KeyLen {
 		return nil, fmt.Errorf("unsupported cluster key length; expected %d, got %d", cluster.KeyLen, len(config.ClusterKey))
 	}
@@ -57,6 +174,200 @@ func loadConfig() (*config, error) {
 		return nil, fmt.Errorf("unsupported overlay network size; net mask must be multiple of 8, got %d", bits)
 	}
 
+	for _, pattern := range append(append([]string{}, config.RoutedNetIfaces...), config.RoutedNetExcludeIfaces...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid interface pattern %q", pattern)
+		}
+	}
+
+	if config.NftSet != "" {
+		if _, err := common.ParseNftSet(config.NftSet); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.NodeName != "" && !common.ValidHostname(config.NodeName) {
+		return nil, fmt.Errorf("invalid node name %q; it must be a valid hostname", config.NodeName)
+	}
+
+	for _, reserved := range config.OverlayReserved {
+		if !(*net.IPNet)(config.OverlayNet).Contains(reserved.IP) {
+			return nil, fmt.Errorf("reserved range %s is outside of the overlay network %s", (*net.IPNet)(reserved), (*net.IPNet)(config.OverlayNet))
+		}
+	}
+
+	for _, vip := range config.VIPs {
+		ip := net.ParseIP(vip)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid virtual IP %q", vip)
+		}
+		if !(*net.IPNet)(config.OverlayNet).Contains(ip) {
+			return nil, fmt.Errorf("virtual IP %s is outside of the overlay network %s", ip, (*net.IPNet)(config.OverlayNet))
+		}
+	}
+	if len(config.VIPs) > 0 && config.StrictAllowedIPs {
+		return nil, fmt.Errorf("virtual IPs cannot be used with --strict-allowed-ips")
+	}
+
+	for i, secondary := range config.SecondaryNets {
+		if common.Overlaps((*net.IPNet)(config.OverlayNet), &secondary.IPNet) {
+			return nil, fmt.Errorf("secondary network %s overlaps the overlay network %s", &secondary.IPNet, (*net.IPNet)(config.OverlayNet))
+		}
+		for _, other := range config.SecondaryNets[:i] {
+			if common.Overlaps(&other.IPNet, &secondary.IPNet) {
+				return nil, fmt.Errorf("secondary networks %s and %s overlap", &other.IPNet, &secondary.IPNet)
+			}
+		}
+	}
+
+	switch config.OverlayAddrStrategy {
+	case addrStrategyName, addrStrategyPubKey, addrStrategySequential:
+	case addrStrategyStatic:
+		if config.OverlayAddrFile == "" {
+			return nil, fmt.Errorf("the %s overlay address strategy needs an overlay address file", addrStrategyStatic)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported overlay address strategy %q; expected %s, %s, %s or %s", config.OverlayAddrStrategy, addrStrategyName, addrStrategyPubKey, addrStrategySequential, addrStrategyStatic)
+	}
+
+	if config.GossipNodes < 1 || time.Duration(*config.PushPullInterval) <= 0 {
+		return nil, fmt.Errorf("the gossip fan-out and push/pull interval must be positive")
+	}
+
+	if config.MinMembers < 0 {
+		return nil, fmt.Errorf("invalid minimum number of members %d", config.MinMembers)
+	}
+
+	if time.Duration(*config.AdvertiseAddrCmdInterval) <= 0 {
+		return nil, fmt.Errorf("the advertise address command interval must be positive")
+	}
+	if time.Duration(*config.HealthInterval) <= 0 {
+		return nil, fmt.Errorf("the health interval must be positive")
+	}
+	if time.Duration(*config.ResumeCheckInterval) < 0 {
+		return nil, fmt.Errorf("the resume check interval must not be negative")
+	}
+	if time.Duration(*config.ReconcileInterval) < 0 {
+		return nil, fmt.Errorf("the reconcile interval must not be negative")
+	}
+	if time.Duration(*config.NodeUpdateScriptInterval) < 0 || time.Duration(*config.NodeUpdateScriptTimeout) <= 0 {
+		return nil, fmt.Errorf("the node update script interval must not be negative and its timeout must be positive")
+	}
+	if config.ScriptFailureLimit < 1 {
+		return nil, fmt.Errorf("invalid script failure limit %d", config.ScriptFailureLimit)
+	}
+
+	if config.WireguardEndpointPort < 0 || config.WireguardEndpointPort > 65535 {
+		return nil, fmt.Errorf("invalid wireguard endpoint port %d", config.WireguardEndpointPort)
+	}
+
+	switch config.BehindNAT {
+	case natAuto, natYes, natNo:
+	default:
+		return nil, fmt.Errorf("unsupported NAT setting %q; expected %s, %s or %s", config.BehindNAT, natAuto, natYes, natNo)
+	}
+
+	if config.PprofAddr != "" {
+		if err := checkPprofAddr(config.PprofAddr); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.PrometheusSDPort < 1 || config.PrometheusSDPort > 65535 {
+		return nil, fmt.Errorf("invalid Prometheus targets port %d", config.PrometheusSDPort)
+	}
+
+	if config.AnnounceExternalPeers && config.ExternalPeersFile == "" {
+		return nil, fmt.Errorf("announcing external peers needs --external-peers-file")
+	}
+
+	if len(config.FederationHosts) > 0 && config.FederationExport == "" {
+		return nil, fmt.Errorf("sharing host names with a federated mesh needs --federation-export")
+	}
+	if config.FederationExport != "" && config.FederationExport == config.FederationImport {
+		return nil, fmt.Errorf("federation export and import files must differ, the peer mesh writes the imported one")
+	}
+
+	if config.StandalonePeers != "" && !config.Standalone {
+		return nil, fmt.Errorf("static peers can only be used with --standalone")
+	}
+	if config.Standalone && config.GossipOverOverlay {
+		return nil, fmt.Errorf("gossiping over the overlay network cannot be used with --standalone")
+	}
+
+	switch config.Backend {
+	case wg.BackendKernel, wg.BackendFake:
+	default:
+		return nil, fmt.Errorf("unsupported wireguard backend %q; expected %s or %s", config.Backend, wg.BackendKernel, wg.BackendFake)
+	}
+
+	switch config.NameConflict {
+	case conflictLog, conflictSuffix, conflictAbort, conflictEvict:
+	default:
+		return nil, fmt.Errorf("unsupported name conflict policy %q; expected %s, %s, %s or %s", config.NameConflict, conflictLog, conflictSuffix, conflictAbort, conflictEvict)
+	}
+
+	switch config.ErrorPolicy {
+	case errorPolicyDegrade, errorPolicyFailFast:
+	default:
+		return nil, fmt.Errorf("unsupported error policy %q; expected %s or %s", config.ErrorPolicy, errorPolicyDegrade, errorPolicyFailFast)
+	}
+
+	switch config.ExistingInterface {
+	case wg.ExistingAdopt, wg.ExistingRecreate, wg.ExistingAbort:
+	default:
+		return nil, fmt.Errorf("unsupported existing interface policy %q; expected %s, %s or %s", config.ExistingInterface, wg.ExistingAdopt, wg.ExistingRecreate, wg.ExistingAbort)
+	}
+
+	if config.PartitionThreshold < 0 || config.PartitionThreshold > 100 {
+		return nil, fmt.Errorf("invalid partition threshold %d; expected a percentage between 0 and 100", config.PartitionThreshold)
+	}
+	if config.ExpectedMembers < 0 {
+		return nil, fmt.Errorf("invalid number of expected members %d", config.ExpectedMembers)
+	}
+	if config.PartitionScript != "" && config.PartitionThreshold == 0 {
+		return nil, fmt.Errorf("the partition script needs partition detection enabled with --partition-threshold")
+	}
+
+	switch config.HealthFailureAction {
+	case healthActionNone, healthActionResync, healthActionExit:
+	default:
+		return nil, fmt.Errorf("unsupported health failure action %q; expected %s, %s or %s", config.HealthFailureAction, healthActionNone, healthActionResync, healthActionExit)
+	}
+
+	if config.DSCP != "" {
+		if _, err := common.ParseDSCP(config.DSCP); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, alias := range config.Aliases {
+		if !common.ValidHostname(alias) {
+			return nil, fmt.Errorf("invalid alias %q", alias)
+		}
+	}
+
+	if _, err := common.ParseServices(config.Services); err != nil {
+		return nil, err
+	}
+
+	if _, err := common.ParseMetadata(config.Metadata); err != nil {
+		return nil, err
+	}
+
+	if _, err := common.ParseLabels(config.Labels); err != nil {
+		return nil, err
+	}
+	if _, err := common.ParseLabels(config.HostsLabels); err != nil {
+		return nil, fmt.Errorf("invalid hosts label selector: %w", err)
+	}
+
+	for _, routedNet := range config.RoutedNet {
+		if common.Overlaps((*net.IPNet)(config.OverlayNet), (*net.IPNet)(routedNet)) {
+			return nil, fmt.Errorf("overlay network %s overlaps routed network %s", (*net.IPNet)(config.OverlayNet), (*net.IPNet)(routedNet))
+		}
+	}
+
 	if config.BindAddr != "" && config.BindIface != "" {
 		return nil, fmt.Errorf("setting both bind address and bind interface is not supported")
 
@@ -75,6 +386,15 @@ func loadConfig() (*config, error) {
 				config.BindAddr = addr.IP.String()
 			}
 		}
+	} else if config.BindAddr == "" && config.BindIface == "" && config.GossipOverOverlay {
+		// gossip must also be received on the overlay address
+		config.BindAddr = "0.0.0.0"
+		if config.AdvertiseAddr == "" && config.AdvertiseIface == "" && config.AdvertiseAddrCmd == "" {
+			// memberlist only picks private addresses when bound to all of them
+			if config.AdvertiseAddr, err = sockaddr.GetPublicIP(); err != nil {
+				return nil, err
+			}
+		}
 	} else if config.BindAddr == "" && config.BindIface == "" {
 		// FIXME: this is a workaround for memberlist refusing to listen on public IPs if BindAddr==0.0.0.0
 		detectedBindAddr, err := sockaddr.GetPublicIP()
@@ -89,6 +409,48 @@ func loadConfig() (*config, error) {
 		}
 	}
 
+	if config.GossipOverOverlay {
+		if config.BindDevice != "" {
+			return nil, fmt.Errorf("gossiping over the overlay network cannot be used with a bind device")
+		}
+		if ip := net.ParseIP(config.BindAddr); ip == nil || !ip.IsUnspecified() {
+			return nil, fmt.Errorf("gossiping over the overlay network needs to bind to all addresses, not %s", config.BindAddr)
+		}
+	}
+
+	if config.SinglePort {
+		switch {
+		case config.GossipOverOverlay:
+			return nil, fmt.Errorf("a single port cannot be used with gossip over the overlay network")
+		case config.BindDevice != "":
+			return nil, fmt.Errorf("a single port cannot be used with a bind device")
+		case config.WireguardEndpointPort != 0:
+			return nil, fmt.Errorf("a single port cannot be used with --wireguard-endpoint-port, the cluster port is announced instead")
+		}
+	}
+
+	advertiseSources := 0
+	for _, source := range []string{config.AdvertiseAddr, config.AdvertiseIface, config.AdvertiseAddrCmd} {
+		if source != "" {
+			advertiseSources++
+		}
+	}
+	if advertiseSources > 1 {
+		return nil, fmt.Errorf("only one of advertise address, advertise interface or advertise address command may be set")
+	} else if config.AdvertiseIface != "" {
+		addr, err := common.InterfaceAddr(config.AdvertiseIface)
+		if err != nil {
+			return nil, err
+		}
+		config.AdvertiseAddr = addr
+	} else if config.AdvertiseAddrCmd != "" {
+		addr, err := common.CommandAddr(config.AdvertiseAddrCmd)
+		if err != nil {
+			return nil, err
+		}
+		config.AdvertiseAddr = addr
+	}
+
 	if _, err := ipaddr.Parse(config.AdvertiseAddr); err != nil {
 		config.AdvertiseAddr = ""
 	}
@@ -96,6 +458,185 @@ func loadConfig() (*config, error) {
 	return &config, nil
 }
 
+// nodeName provides the configured name of the local node, or an empty string to use the hostname
+func (c *config) nodeName() string {
+	if c.NodeName != "" {
+		return c.NodeName
+	}
+	if c.UseIPAsName && c.BindAddr != "0.0.0.0" {
+		return c.BindAddr
+	}
+	return ""
+}
+
+// error policies, applied when reconfiguring the node fails at runtime
+const (
+	errorPolicyDegrade  = "degrade"   // keep running with the failed parts, retrying the interface with backoff
+	errorPolicyFailFast = "fail-fast" // shut down with a non-zero exit status
+)
+
+// overlay address strategies
+const (
+	addrStrategyName       = "name"
+	addrStrategyPubKey     = "pubkey"
+	addrStrategySequential = "sequential"
+	addrStrategyStatic     = "static"
+)
+
+// addressStrategy provides the configured overlay address strategy
+func (c *config) addressStrategy(pubKey wgtypes.Key) (wg.AddressStrategy, error) {
+	reserved := c.overlayReserved()
+	switch c.OverlayAddrStrategy {
+	case addrStrategyPubKey:
+		return wg.HashPubKey{PubKey: pubKey, Reserved: reserved}, nil
+	case addrStrategySequential:
+		return wg.Sequential{Reserved: reserved}, nil
+	case addrStrategyStatic:
+		addrs, err := wg.LoadStaticAddrs(c.OverlayAddrFile)
+		if err != nil {
+			return nil, err
+		}
+		return wg.Static{Addrs: addrs}, nil
+	}
+	return wg.HashName{Reserved: reserved}, nil
+}
+
+// overlayReserved provides the reserved ranges of the overlay network
+func (c *config) overlayReserved() []*net.IPNet {
+	reserved := make([]*net.IPNet, len(c.OverlayReserved))
+	for i, r := range c.OverlayReserved {
+		reserved[i] = (*net.IPNet)(r)
+	}
+	return reserved
+}
+
+// secondaryPrefixes provides the prefixes of the secondary networks assigned to the node, derived from its name or,
+// with the pubkey strategy, its public key
+func (c *config) secondaryPrefixes(name string, pubKey wgtypes.Key) []net.IPNet {
+	data := []byte(name)
+	if c.OverlayAddrStrategy == addrStrategyPubKey {
+		data = pubKey[:]
+	}
+	prefixes := make([]net.IPNet, 0, len(c.SecondaryNets))
+	for _, secondary := range c.SecondaryNets {
+		prefixes = append(prefixes, wg.AssignPrefix(&secondary.IPNet, secondary.PrefixLen, data))
+	}
+	return prefixes
+}
+
+// vips provides the virtual IPs the local node is a candidate for
+func (c *config) vips() []net.IP {
+	vips := make([]net.IP, 0, len(c.VIPs))
+	for _, vip := range c.VIPs {
+		ip := net.ParseIP(vip) // validated in loadConfig
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		vips = append(vips, ip)
+	}
+	return vips
+}
+
+// hooks provides the hook scripts by event type
+func (c *config) hooks() hookScripts {
+	return hookScripts{
+		hookNodeJoin:    c.OnNodeJoin,
+		hookNodeLeave:   c.OnNodeLeave,
+		hookNodeUpdate:  c.OnNodeUpdate,
+		hookRouteChange: c.OnRouteChange,
+	}
+}
+
+// controlSocket provides the path of the control socket, defaulting to one per wireguard interface
+func (c *config) controlSocket() string {
+	if c.ControlSocket != "" {
+		return c.ControlSocket
+	}
+	return fmt.Sprintf(control.PathTemplate, c.Interface)
+}
+
+// joinHosts provides the hosts to join, from both flags and file
+// The file is read on every call, so it can be updated without restarting.
+func (c *config) joinHosts() []string {
+	hosts := append([]string{}, c.Join...)
+	if c.JoinFile == "" {
+		return hosts
+	}
+	content, err := ioutil.ReadFile(c.JoinFile)
+	if err != nil {
+		logrus.WithError(err).Warnf("could not read join file %s", c.JoinFile)
+		return hosts
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			hosts = append(hosts, line)
+		}
+	}
+	return hosts
+}
+
+// sshHostKeys reads the public SSH host keys of this node to be announced
+func (c *config) sshHostKeys() ([]string, error) {
+	keys := make([]string, 0, len(c.SSHHostKeys))
+	for _, keyFile := range c.SSHHostKeys {
+		content, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read SSH host key")
+		}
+		key, err := common.ParseSSHHostKey(string(content))
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not parse %s", keyFile)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// routedHosts provides the hosts behind routed networks to be announced, from both flags and file
+func (c *config) routedHosts() (map[string][]string, error) {
+	ipsToNames := make(map[string][]string)
+	if c.RoutedHostsFile != "" {
+		f, err := os.Open(c.RoutedHostsFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not open routed hosts file")
+		}
+		defer f.Close()
+		if ipsToNames, err = etchosts.ReadEntries(f); err != nil {
+			return nil, err
+		}
+	}
+	for _, entry := range c.RoutedHosts {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid routed host %q; expected NAME=IP", entry)
+		}
+		ipsToNames[parts[1]] = append(ipsToNames[parts[1]], parts[0])
+	}
+
+	for ip, names := range ipsToNames {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return nil, fmt.Errorf("invalid routed host address %q", ip)
+		}
+		routed := false
+		for _, routedNet := range c.RoutedNet {
+			routed = routed || (*net.IPNet)(routedNet).Contains(parsed)
+		}
+		if !routed {
+			return nil, fmt.Errorf("routed host address %s is not part of any routed network", ip)
+		}
+		for _, name := range names {
+			if !common.ValidHostname(name) {
+				return nil, fmt.Errorf("invalid routed host name %q", name)
+			}
+		}
+	}
+	return ipsToNames, nil
+}
+
 type network net.IPNet
 
 // UnmarshalText parses the provided byte array into the network receiver
@@ -107,3 +648,77 @@ func (n *network) UnmarshalText(data []byte) error {
 	*n = network(*ipnet)
 	return nil
 }
+
+// subnet is a secondary overlay network, of which every node is assigned a prefix of PrefixLen
+type subnet struct {
+	net.IPNet
+	PrefixLen int
+}
+
+// UnmarshalText parses the provided byte array into the secondary network receiver
+// Without a prefix length, nodes are assigned single addresses.
+func (n *subnet) UnmarshalText(data []byte) error {
+	parts := strings.SplitN(string(data), "=", 2)
+	_, ipnet, err := net.ParseCIDR(parts[0])
+	if err != nil {
+		return err
+	}
+	ones, size := ipnet.Mask.Size()
+	prefixLen := size
+	if len(parts) == 2 {
+		if prefixLen, err = strconv.Atoi(parts[1]); err != nil || prefixLen < ones || prefixLen > size {
+			return fmt.Errorf("invalid prefix length %q for secondary network %s", parts[1], ipnet)
+		}
+	}
+	*n = subnet{IPNet: *ipnet, PrefixLen: prefixLen}
+	return nil
+}
+
+type duration time.Duration
+
+// UnmarshalText parses the provided byte array into the duration receiver
+// Bare numbers are interpreted as seconds, for compatibility with options previously accepting only seconds.
+func (d *duration) UnmarshalText(data []byte) error {
+	if seconds, err := strconv.Atoi(string(data)); err == nil {
+		*d = duration(time.Duration(seconds) * time.Second)
+		return nil
+	}
+	parsed, err := time.ParseDuration(string(data))
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+type bandwidth uint64
+
+// bandwidthUnits maps tc-style rate suffixes to their multiplier in bits per second
+var bandwidthUnits = []struct {
+	suffix     string
+	multiplier float64
+}{
+	{"tbit", 1e12},
+	{"gbit", 1e9},
+	{"mbit", 1e6},
+	{"kbit", 1e3},
+	{"bit", 1},
+}
+
+// UnmarshalText parses the provided byte array into the bandwidth receiver
+// Rates use the same units as tc (e.g. 10mbit); bare numbers are bits per second.
+func (b *bandwidth) UnmarshalText(data []byte) error {
+	text, multiplier := strings.ToLower(string(data)), 1.0
+	for _, unit := range bandwidthUnits {
+		if strings.HasSuffix(text, unit.suffix) {
+			text, multiplier = strings.TrimSuffix(text, unit.suffix), unit.multiplier
+			break
+		}
+	}
+	rate, err := strconv.ParseFloat(text, 64)
+	if err != nil || rate < 0 {
+		return fmt.Errorf("invalid bandwidth %q", data)
+	}
+	*b = bandwidth(rate * multiplier)
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_config_documented(t *testing.T) {
+	readme, err := ioutil.ReadFile("README.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configType := reflect.TypeOf(config{})
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		if strings.Contains(field.Tag.Get("opts"), "hidden") {
+			continue
+		}
+		id := field.Tag.Get("id")
+		if id == "" {
+			id = strings.ToLower(field.Name)
+		}
+		env := "WESHER_" + strings.ToUpper(strings.Replace(id, "-", "_", -1))
+		row := "| `--" + id
+		if !strings.Contains(string(readme), row+" ") && !strings.Contains(string(readme), row+"`") {
+			t.Errorf("option --%s is not documented in the README", id)
+		}
+		if !strings.Contains(string(readme), "| "+env+" |") {
+			t.Errorf("environment variable %s of option --%s is not documented in the README", env, id)
+		}
+	}
+}
+
+func Test_duration_UnmarshalText(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"30s", 30 * time.Second, false},
+		{"1h30m", 90 * time.Minute, false},
+		{"45", 45 * time.Second, false},
+		{"0", 0, false},
+		{"soon", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			var d duration
+			err := d.UnmarshalText([]byte(tt.text))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("duration.UnmarshalText() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if time.Duration(d) != tt.want {
+				t.Errorf("duration.UnmarshalText() = %s, want %s", time.Duration(d), tt.want)
+			}
+		})
+	}
+}
+
+func Test_bandwidth_UnmarshalText(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    bandwidth
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"1500", 1500, false},
+		{"100kbit", 100 * 1000, false},
+		{"2.5Mbit", 2500 * 1000, false},
+		{"1gbit", 1000 * 1000 * 1000, false},
+		{"fast", 0, true},
+		{"-1mbit", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			var b bandwidth
+			err := b.UnmarshalText([]byte(tt.text))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("bandwidth.UnmarshalText() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if b != tt.want {
+				t.Errorf("bandwidth.UnmarshalText() = %d, want %d", b, tt.want)
+			}
+		})
+	}
+}
+
+func Test_subnet_UnmarshalText(t *testing.T) {
+	tests := []struct {
+		text      string
+		want      string
+		prefixLen int
+		wantErr   bool
+	}{
+		{"fd00:10::/48=64", "fd00:10::/48", 64, false},
+		{"172.16.0.0/16", "172.16.0.0/16", 32, false},
+		{"172.16.0.0/16=24", "172.16.0.0/16", 24, false},
+		{"172.16.0.0/16=8", "", 0, true},
+		{"172.16.0.0/16=33", "", 0, true},
+		{"172.16.0.0", "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			var n subnet
+			err := n.UnmarshalText([]byte(tt.text))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("subnet.UnmarshalText() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (n.IPNet.String() != tt.want || n.PrefixLen != tt.prefixLen) {
+				t.Errorf("subnet.UnmarshalText() = %s=%d, want %s=%d", &n.IPNet, n.PrefixLen, tt.want, tt.prefixLen)
+			}
+		})
+	}
+}
+
+func Test_config_joinHosts(t *testing.T) {
+	f, err := ioutil.TempFile("", "wesher-join")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# seeds\nnode1\n\n  node2:7947  # second\n")
+	f.Close()
+
+	c := &config{Join: []string{"node0"}, JoinFile: f.Name()}
+	want := []string{"node0", "node1", "node2:7947"}
+	if got := c.joinHosts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("config.joinHosts() = %v, want %v", got, want)
+	}
+
+	c.JoinFile = f.Name() + ".missing"
+	if got := c.joinHosts(); !reflect.DeepEqual(got, []string{"node0"}) {
+		t.Errorf("config.joinHosts() with missing file = %v, want %v", got, []string{"node0"})
+	}
+}
+
+func Test_config_nodeName(t *testing.T) {
+	tests := []struct {
+		config config
+		want   string
+	}{
+		{config{}, ""},
+		{config{NodeName: "node1", UseIPAsName: true, BindAddr: "10.1.1.1"}, "node1"},
+		{config{UseIPAsName: true, BindAddr: "10.1.1.1"}, "10.1.1.1"},
+		{config{UseIPAsName: true, BindAddr: "0.0.0.0"}, ""},
+	}
+	for _, tt := range tests {
+		if got := tt.config.nodeName(); got != tt.want {
+			t.Errorf("config.nodeName() = %q, want %q", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/costela/wesher/cluster"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// name conflict policies, applied when another node claims the name of the local node
+const (
+	conflictLog    = "log"
+	conflictSuffix = "suffix"
+	conflictAbort  = "abort"
+	conflictEvict  = "evict"
+)
+
+// conflictSuffixLen is the number of hex digits of the public key hash appended to conflicting names
+const conflictSuffixLen = 6
+
+// maxConflicts bounds the number of name conflicts kept for the status output
+const maxConflicts = 16
+
+// localIsNewer reports whether the local node, started at the provided time, is the newer claimant of the name
+// Claimants not announcing their start time run older versions, and are considered older. Claimants started within
+// the same second are ordered by public key, so exactly one of them considers itself newer.
+func localIsNewer(started time.Time, pubKey string, conflict cluster.Conflict) bool {
+	if conflict.OtherStarted.IsZero() || conflict.OtherStarted.Before(started) {
+		return true
+	}
+	return conflict.OtherStarted.Equal(started) && conflict.OtherPubKey != "" && pubKey > conflict.OtherPubKey
+}
+
+// nameConflicts keeps one entry per conflicting name and claimant, since the conflict is reported again for every
+// alive message of the other claimant
+type nameConflicts struct {
+	keys    []string // name and claimant address of the entries
+	entries []string // descriptions, oldest first
+}
+
+// add records the conflict, reporting whether it is a new one
+// At most maxConflicts entries are kept, forgetting the oldest ones.
+func (c *nameConflicts) add(conflict cluster.Conflict, at time.Time) bool {
+	key := conflict.Name + " " + conflict.OtherAddr
+	for _, known := range c.keys {
+		if known == key {
+			return false
+		}
+	}
+	if len(c.keys) == maxConflicts {
+		c.keys, c.entries = c.keys[1:], c.entries[1:]
+	}
+	c.keys = append(c.keys, key)
+	c.entries = append(c.entries, describeConflict(conflict, at))
+	return true
+}
+
+// list provides the descriptions of the conflicts, oldest first
+func (c *nameConflicts) list() []string {
+	return append([]string{}, c.entries...)
+}
+
+// suffixedName provides a name unlikely to conflict again, by appending a short hash of the public key
+func suffixedName(name string, pubKey wgtypes.Key) string {
+	sum := sha256.Sum256(pubKey[:])
+	return name + "-" + hex.EncodeToString(sum[:])[:conflictSuffixLen]
+}
+
+// describeConflict summarizes the conflict for the status output
+func describeConflict(conflict cluster.Conflict, at time.Time) string {
+	started := "unknown"
+	if !conflict.OtherStarted.IsZero() {
+		started = conflict.OtherStarted.UTC().Format(time.RFC3339)
+	}
+	return fmt.Sprintf("%s: %s claimed by %s (started %s) at %s", conflict.Name, conflict.Addr, conflict.OtherAddr, started, at.UTC().Format(time.RFC3339))
+}
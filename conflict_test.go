@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/costela/wesher/cluster"
+	"github.com/costela/wesher/common"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func Test_localIsNewer(t *testing.T) {
+	started := time.Unix(1588327200, 0)
+	tests := []struct {
+		name         string
+		otherStarted time.Time
+		otherPubKey  string
+		want         bool
+	}{
+		{"other older", started.Add(-time.Hour), "b", true},
+		{"other newer", started.Add(time.Hour), "b", false},
+		{"same time lower key", started, "a", true},
+		{"same time higher key", started, "c", false},
+		{"same time unknown key", started, "", false},
+		{"other unknown", time.Time{}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conflict := cluster.Conflict{OtherStarted: tt.otherStarted, OtherPubKey: tt.otherPubKey}
+			if got := localIsNewer(started, "b", conflict); got != tt.want {
+				t.Errorf("localIsNewer() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_nameConflicts_add(t *testing.T) {
+	conflicts := &nameConflicts{}
+	conflict := cluster.Conflict{Name: "node", OtherAddr: "10.0.0.1"}
+	if !conflicts.add(conflict, time.Now()) {
+		t.Errorf("add() = false for a new conflict")
+	}
+	if conflicts.add(conflict, time.Now()) {
+		t.Errorf("add() = true for a known conflict")
+	}
+	for i := 0; i < maxConflicts+2; i++ {
+		conflicts.add(cluster.Conflict{Name: "node", OtherAddr: fmt.Sprintf("10.0.1.%d", i)}, time.Now())
+	}
+	if got := conflicts.list(); len(got) != maxConflicts {
+		t.Errorf("list() has %d entries, want %d", len(got), maxConflicts)
+	}
+	if !conflicts.add(conflict, time.Now()) {
+		t.Errorf("add() = false for a forgotten conflict")
+	}
+}
+
+func Test_suffixedName(t *testing.T) {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := suffixedName("node", key.PublicKey())
+	if len(name) != len("node-")+conflictSuffixLen {
+		t.Errorf("suffixedName() = %s, want a %d digit suffix", name, conflictSuffixLen)
+	}
+	if !common.ValidHostname(name) {
+		t.Errorf("suffixedName() = %s is not a valid hostname", name)
+	}
+	if name != suffixedName("node", key.PublicKey()) {
+		t.Errorf("suffixedName() is not deterministic")
+	}
+	if name == suffixedName("node", other.PublicKey()) {
+		t.Errorf("suffixedName() = %s for different keys", name)
+	}
+}
@@ -0,0 +1,164 @@
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// PathTemplate is the default path of the control socket, depending on the wireguard interface name
+const PathTemplate = "/var/run/wesher/%s.sock"
+
+// timeout bounds the handling of a single request, including waiting for the daemon to pick it up
+const timeout = 30 * time.Second
+
+// Request is a command sent over the control socket
+// Requests must be answered using Reply, exactly once.
+type Request struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+
+	reply chan response
+}
+
+type response struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// NewRequest creates a request for handlers on other transports than the control socket, whose answer is then
+// awaited using Result
+func NewRequest(command string, args ...string) *Request {
+	return &Request{Command: command, Args: args, reply: make(chan response, 1)}
+}
+
+// Result waits for the answer to the request, providing the JSON encoded result or error
+func (r *Request) Result() (json.RawMessage, error) {
+	resp := <-r.reply
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return resp.Result, nil
+}
+
+// Reply answers the request with the provided result, which must be JSON encodable, or error
+func (r *Request) Reply(result interface{}, err error) {
+	resp := response{}
+	if err != nil {
+		resp.Error = err.Error()
+	} else if result != nil {
+		encoded, err := json.Marshal(result)
+		if err != nil {
+			resp.Error = fmt.Sprintf("could not encode result: %s", err)
+		}
+		resp.Result = encoded
+	}
+	r.reply <- resp
+}
+
+// Server accepts requests on a unix socket and forwards them to a channel, so they can be handled by the main loop
+// without further synchronization.
+type Server struct {
+	// Path is the path of the unix socket; it is replaced if it already exists.
+	Path string
+	// Logger is an optional logrus.StdLogger interface, used for debugging.
+	Logger log.StdLogger
+
+	requests chan *Request
+}
+
+// Requests provides the channel on which received requests are pushed
+func (s *Server) Requests() <-chan *Request {
+	if s.requests == nil {
+		s.requests = make(chan *Request)
+	}
+	return s.requests
+}
+
+// ListenAndServe starts serving requests on the unix socket; it only returns on error
+// Requests must be consumed from Requests.
+func (s *Server) ListenAndServe() error {
+	s.Requests()
+	if err := os.MkdirAll(path.Dir(s.Path), 0700); err != nil {
+		return errors.Wrap(err, "could not create control socket directory")
+	}
+	if err := os.Remove(s.Path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "could not remove stale control socket")
+	}
+	listener, err := net.Listen("unix", s.Path)
+	if err != nil {
+		return errors.Wrapf(err, "could not listen on control socket %s", s.Path)
+	}
+	defer listener.Close()
+	if err := os.Chmod(s.Path, 0600); err != nil {
+		return errors.Wrap(err, "could not restrict control socket permissions")
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return errors.Wrap(err, "could not accept control connection")
+		}
+		go s.serve(conn)
+	}
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout)) // nolint: errcheck // only fails on closed connections
+
+	req := &Request{reply: make(chan response, 1)}
+	if err := json.NewDecoder(conn).Decode(req); err != nil {
+		s.logf("could not decode control request: %s", err)
+		return
+	}
+	s.logf("received control request %q %v", req.Command, req.Args)
+
+	var resp response
+	select {
+	case s.requests <- req:
+		resp = <-req.reply
+	case <-time.After(timeout):
+		resp = response{Error: "timed out waiting for request to be handled"}
+	}
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		s.logf("could not send control response: %s", err)
+	}
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, args...)
+	}
+}
+
+// Send sends a command to the daemon listening on the provided control socket and decodes its result into result,
+// unless nil
+func Send(socketPath string, result interface{}, command string, args ...string) error {
+	conn, err := net.DialTimeout("unix", socketPath, timeout)
+	if err != nil {
+		return errors.Wrapf(err, "could not connect to control socket %s; is wesher running?", socketPath)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout)) // nolint: errcheck // only fails on closed connections
+
+	if err := json.NewEncoder(conn).Encode(Request{Command: command, Args: args}); err != nil {
+		return errors.Wrap(err, "could not send control request")
+	}
+	resp := response{}
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return errors.Wrap(err, "could not read control response")
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	if result == nil || len(resp.Result) == 0 {
+		return nil
+	}
+	return errors.Wrap(json.Unmarshal(resp.Result, result), "could not decode control response")
+}
@@ -0,0 +1,74 @@
+package control
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestServer_roundtrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wesher-control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &Server{Path: path.Join(dir, "control", "test.sock")}
+	requests := s.Requests()
+	go s.ListenAndServe() // nolint: errcheck
+	go func() {
+		for req := range requests {
+			switch req.Command {
+			case "echo":
+				req.Reply(req.Args, nil)
+			default:
+				req.Reply(nil, errors.New("unknown command"))
+			}
+		}
+	}()
+
+	// wait for the socket to appear
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(s.Path); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var result []string
+	if err := Send(s.Path, &result, "echo", "a", "b"); err != nil {
+		t.Fatalf("Send() error = %s", err)
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(result, want) {
+		t.Errorf("Send() result = %v, want %v", result, want)
+	}
+
+	if err := Send(s.Path, nil, "nope"); err == nil || err.Error() != "unknown command" {
+		t.Errorf("Send() error = %v, want unknown command", err)
+	}
+}
+
+func TestSend_notRunning(t *testing.T) {
+	if err := Send("/nonexistent/wesher.sock", nil, "echo"); err == nil {
+		t.Error("Send() to missing socket should fail")
+	}
+}
+
+func TestNewRequest_Result(t *testing.T) {
+	req := NewRequest("echo", "a")
+	go req.Reply(req.Args, nil)
+	result, err := req.Result()
+	if err != nil || string(result) != `["a"]` {
+		t.Errorf("Result() = %s, %v; want [\"a\"]", result, err)
+	}
+
+	req = NewRequest("nope")
+	go req.Reply(nil, errors.New("unknown command"))
+	if _, err := req.Result(); err == nil || err.Error() != "unknown command" {
+		t.Errorf("Result() error = %v, want unknown command", err)
+	}
+}
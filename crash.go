@@ -0,0 +1,51 @@
+package main
+
+import (
+	"runtime/debug"
+	"sync"
+
+	"github.com/costela/wesher/etchosts"
+	"github.com/costela/wesher/wg"
+	"github.com/sirupsen/logrus"
+)
+
+// crashCleanup provides a function removing the hosts entries and, if downInterface is set, the wireguard interface,
+// so a crash does not leave the system half-configured; it only runs once, however often it is called
+func crashCleanup(hostsFile *etchosts.EtcHosts, removeHosts bool, wgstate *wg.State, downInterface bool) func() {
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			logrus.Warn("cleaning up after crash...")
+			if removeHosts {
+				if err := hostsFile.WriteEntries(map[string][]string{}); err != nil {
+					logrus.WithError(err).Error("could not remove hosts entries")
+				}
+				if err := hostsFile.Flush(); err != nil {
+					logrus.WithError(err).Error("could not remove hosts entries")
+				}
+			}
+			if downInterface {
+				if err := wgstate.DownInterface(); err != nil {
+					logrus.WithError(err).Error("could not down interface")
+				}
+			}
+		})
+	}
+}
+
+// goRecover runs the function in a new goroutine, cleaning up on its panics like recoverCrash does for the main one
+func goRecover(cleanup func(), f func()) {
+	go func() {
+		defer recoverCrash(cleanup)
+		f()
+	}()
+}
+
+// recoverCrash cleans up on panics of the calling goroutine, before crashing as usual; it must be deferred
+func recoverCrash(cleanup func()) {
+	if r := recover(); r != nil {
+		logrus.Errorf("panic: %v\n%s", r, debug.Stack())
+		cleanup()
+		panic(r)
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func Test_recoverCrash(t *testing.T) {
+	cleanups := 0
+	defer func() {
+		if r := recover(); r != "boom" {
+			t.Errorf("recoverCrash() should panic again, got %v", r)
+		}
+		if cleanups != 1 {
+			t.Errorf("recoverCrash() ran cleanup %d times, want once", cleanups)
+		}
+	}()
+	func() {
+		defer recoverCrash(func() { cleanups++ })
+		panic("boom")
+	}()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/costela/wesher/control"
+	"github.com/pkg/errors"
+)
+
+// dbusTimeout bounds the wait for the main loop to pick up a D-Bus call
+const dbusTimeout = 30 * time.Second
+
+// dbusHandler provides the handler of D-Bus method calls, forwarding them as control requests to the main loop
+// Results are converted to the D-Bus types of the methods: a string dictionary for Status and a string array for Peers.
+func dbusHandler(requests chan<- *control.Request) func(method string) (interface{}, error) {
+	return func(method string) (interface{}, error) {
+		req := control.NewRequest(strings.ToLower(method))
+		select {
+		case requests <- req:
+		case <-time.After(dbusTimeout):
+			return nil, errors.New("timed out waiting for request to be handled")
+		}
+		result, err := req.Result()
+		if err != nil {
+			return nil, err
+		}
+
+		switch method {
+		case "Status":
+			status := statusResult{}
+			if err := json.Unmarshal(result, &status); err != nil {
+				return nil, errors.Wrap(err, "could not decode status")
+			}
+			return map[string]string{
+				"name":      status.Name,
+				"version":   status.Version,
+				"members":   strconv.Itoa(status.Members),
+				"leader":    status.Leader,
+				"is_leader": strconv.FormatBool(status.IsLeader),
+				"connected": strconv.FormatBool(status.Connected),
+				"conflicts": strings.Join(status.Conflicts, "; "),
+			}, nil
+		case "Peers":
+			peers := []string{}
+			if err := json.Unmarshal(result, &peers); err != nil {
+				return nil, errors.Wrap(err, "could not decode peers")
+			}
+			return peers, nil
+		}
+		return nil, nil
+	}
+}
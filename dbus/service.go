@@ -0,0 +1,201 @@
+package dbus
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	godbus "github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultName is the default well-known bus name of the service
+const DefaultName = "io.github.costela.wesher"
+
+// Path is the object path of the exported object
+const Path = "/io/github/costela/wesher"
+
+// Interface is the interface of the exported methods
+const Interface = "io.github.costela.wesher1"
+
+// reconnectDelay is the time waited before reconnecting to the bus after the connection failed or was lost
+var reconnectDelay = 5 * time.Second
+
+// Methods maps the exported methods to the D-Bus signature of their result
+var Methods = map[string]string{
+	"Status":     "a{ss}",
+	"Peers":      "as",
+	"Connect":    "",
+	"Disconnect": "",
+	"Resync":     "",
+}
+
+// Service exports the Methods on a D-Bus bus, so desktop tools can show and control the mesh state
+type Service struct {
+	// Address is the bus address; the system bus is used if not set.
+	Address string
+	// Name is the well-known bus name to own; if not set, will use DefaultName.
+	Name string
+	// Handler is called for every method call, and must provide a result matching the method's signature: a
+	// map[string]string for a{ss}, a []string for as, or nil.
+	Handler func(method string) (interface{}, error)
+	// Logger is an optional logrus.StdLogger interface, used for debugging.
+	Logger log.StdLogger
+}
+
+// Serve connects to the bus, claims the bus name and serves method calls, reconnecting whenever the connection to
+// the bus fails or is lost (e.g. on restarts of the bus); it only returns if the bus name cannot be owned
+func (s *Service) Serve() error {
+	for {
+		conn, err := s.connect()
+		if err != nil {
+			if _, ok := errors.Cause(err).(nameError); ok {
+				return err
+			}
+			s.logf("could not connect to D-Bus, retrying in %s: %s", reconnectDelay, err)
+			time.Sleep(reconnectDelay)
+			continue
+		}
+		s.logf("serving D-Bus interface %s as %s", Interface, s.name())
+		<-conn.Context().Done()
+		s.logf("lost connection to D-Bus, reconnecting in %s", reconnectDelay)
+		time.Sleep(reconnectDelay)
+	}
+}
+
+// nameError is returned when the bus name cannot be owned, which retrying does not fix
+type nameError string
+
+func (e nameError) Error() string {
+	return string(e)
+}
+
+// connect connects to the bus, exports the methods and claims the bus name
+func (s *Service) connect() (*godbus.Conn, error) {
+	var conn *godbus.Conn
+	var err error
+	if s.Address != "" {
+		conn, err = godbus.Dial(s.Address)
+	} else {
+		conn, err = godbus.SystemBusPrivate()
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "could not connect to bus")
+	}
+	if err := conn.Auth(nil); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "could not authenticate to bus")
+	}
+	if err := conn.Hello(); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "could not register on bus")
+	}
+
+	if err := conn.ExportMethodTable(s.methodTable(), Path, Interface); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "could not export methods")
+	}
+	if err := conn.Export(introspect.Introspectable(introspection()), Path, "org.freedesktop.DBus.Introspectable"); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "could not export introspection data")
+	}
+
+	reply, err := conn.RequestName(s.name(), godbus.NameFlagDoNotQueue)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "could not request bus name %s", s.name())
+	}
+	if reply != godbus.RequestNameReplyPrimaryOwner && reply != godbus.RequestNameReplyAlreadyOwner {
+		conn.Close()
+		return nil, nameError(fmt.Sprintf("could not own bus name %s; is another instance running or is the bus policy missing?", s.name()))
+	}
+	return conn, nil
+}
+
+// methodTable provides the exported functions of the Methods, calling the Handler
+func (s *Service) methodTable() map[string]interface{} {
+	call := func(method string, sender godbus.Sender) (interface{}, *godbus.Error) {
+		s.logf("received D-Bus call %s from %s", method, sender)
+		result, err := s.Handler(method)
+		if err != nil {
+			return nil, godbus.NewError(Interface+".Error.Failed", []interface{}{err.Error()})
+		}
+		return result, nil
+	}
+	invalid := func(method string, result interface{}) *godbus.Error {
+		return godbus.MakeFailedError(errors.Errorf("unexpected result %T of %s", result, method))
+	}
+
+	methods := map[string]interface{}{}
+	for method, sig := range Methods {
+		method := method
+		switch sig {
+		case "a{ss}":
+			methods[method] = func(sender godbus.Sender) (map[string]string, *godbus.Error) {
+				result, err := call(method, sender)
+				if err != nil {
+					return nil, err
+				}
+				m, ok := result.(map[string]string)
+				if !ok {
+					return nil, invalid(method, result)
+				}
+				return m, nil
+			}
+		case "as":
+			methods[method] = func(sender godbus.Sender) ([]string, *godbus.Error) {
+				result, err := call(method, sender)
+				if err != nil {
+					return nil, err
+				}
+				l, ok := result.([]string)
+				if !ok {
+					return nil, invalid(method, result)
+				}
+				return l, nil
+			}
+		default:
+			methods[method] = func(sender godbus.Sender) *godbus.Error {
+				_, err := call(method, sender)
+				return err
+			}
+		}
+	}
+	return methods
+}
+
+func (s *Service) name() string {
+	if s.Name == "" {
+		return DefaultName
+	}
+	return s.Name
+}
+
+func (s *Service) logf(format string, args ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, args...)
+	}
+}
+
+// introspection provides the introspection data of the exported object
+func introspection() string {
+	b := &strings.Builder{}
+	b.WriteString(`<!DOCTYPE node PUBLIC "-//freedesktop//DTD D-BUS Object Introspection 1.0//EN" "http://www.freedesktop.org/standards/dbus/1.0/introspect.dtd">` + "\n")
+	b.WriteString("<node>\n")
+	fmt.Fprintf(b, "  <interface name=%q>\n", Interface)
+	for _, method := range []string{"Status", "Peers", "Connect", "Disconnect", "Resync"} {
+		if sig := Methods[method]; sig != "" {
+			fmt.Fprintf(b, "    <method name=%q><arg type=%q direction=\"out\"/></method>\n", method, sig)
+		} else {
+			fmt.Fprintf(b, "    <method name=%q/>\n", method)
+		}
+	}
+	b.WriteString("  </interface>\n")
+	b.WriteString("  <interface name=\"org.freedesktop.DBus.Introspectable\">\n")
+	b.WriteString("    <method name=\"Introspect\"><arg type=\"s\" direction=\"out\"/></method>\n")
+	b.WriteString("  </interface>\n")
+	b.WriteString("</node>\n")
+	return b.String()
+}
@@ -0,0 +1,121 @@
+package dbus
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testBusConfig = `<!DOCTYPE busconfig PUBLIC "-//freedesktop//DTD D-Bus Bus Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/busconfig.dtd">
+<busconfig>
+  <type>session</type>
+  <listen>%s</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>
+`
+
+func TestService_Serve(t *testing.T) {
+	if _, err := exec.LookPath("dbus-daemon"); err != nil {
+		t.Skip("dbus-daemon not available")
+	}
+	if _, err := exec.LookPath("dbus-send"); err != nil {
+		t.Skip("dbus-send not available")
+	}
+	dir, err := ioutil.TempDir("", "wesher-dbus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	address := "unix:path=" + path.Join(dir, "bus")
+	configPath := path.Join(dir, "bus.conf")
+	if err := ioutil.WriteFile(configPath, []byte(fmt.Sprintf(testBusConfig, address)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	startDaemon := func() *exec.Cmd {
+		os.Remove(path.Join(dir, "bus"))
+		daemon := exec.Command("dbus-daemon", "--config-file="+configPath, "--nofork")
+		if err := daemon.Start(); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			if _, err := os.Stat(path.Join(dir, "bus")); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return daemon
+	}
+	daemon := startDaemon()
+	defer func() { daemon.Process.Kill() }() // nolint: errcheck
+	defer func(delay time.Duration) { reconnectDelay = delay }(reconnectDelay)
+	reconnectDelay = 10 * time.Millisecond
+
+	s := &Service{
+		Address: address,
+		Handler: func(method string) (interface{}, error) {
+			switch method {
+			case "Status":
+				return map[string]string{"leader": "node1"}, nil
+			case "Peers":
+				return []string{"node2", "node3"}, nil
+			}
+			return nil, fmt.Errorf("%s failed", method)
+		},
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- s.Serve() }()
+
+	send := func(method string) (string, error) {
+		var out []byte
+		var err error
+		for i := 0; i < 100; i++ { // wait for the name to be owned
+			out, err = exec.Command("dbus-send", "--bus="+address, "--print-reply", "--dest="+DefaultName, Path, Interface+"."+method).CombinedOutput()
+			if err == nil || !strings.Contains(string(out), "ServiceUnknown") {
+				break
+			}
+			select {
+			case err := <-errc:
+				t.Fatalf("Serve() error = %v", err)
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+		return string(out), err
+	}
+
+	out, err := send("Status")
+	if err != nil || !strings.Contains(out, `string "leader"`) || !strings.Contains(out, `string "node1"`) {
+		t.Errorf("Status() = %s, %v; want leader node1", out, err)
+	}
+	out, err = send("Peers")
+	if err != nil || !strings.Contains(out, `string "node2"`) || !strings.Contains(out, `string "node3"`) {
+		t.Errorf("Peers() = %s, %v; want node2 and node3", out, err)
+	}
+	out, err = send("Connect")
+	if err == nil || !strings.Contains(out, "Connect failed") {
+		t.Errorf("Connect() = %s, %v; want the handler error", out, err)
+	}
+	out, err = send("Nope")
+	if err == nil || !strings.Contains(out, "UnknownMethod") {
+		t.Errorf("Nope() = %s, %v; want UnknownMethod error", out, err)
+	}
+
+	// the service reconnects once the bus is back
+	daemon.Process.Kill() // nolint: errcheck
+	daemon.Wait()         // nolint: errcheck
+	daemon = startDaemon()
+	out, err = send("Peers")
+	if err != nil || !strings.Contains(out, `string "node2"`) {
+		t.Errorf("Peers() after bus restart = %s, %v; want node2 and node3", out, err)
+	}
+}
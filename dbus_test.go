@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/costela/wesher/control"
+)
+
+func Test_dbusHandler(t *testing.T) {
+	requests := make(chan *control.Request)
+	go func() {
+		for req := range requests {
+			switch req.Command {
+			case "status":
+				req.Reply(statusResult{Name: "node1", Members: 3, Leader: "node1", IsLeader: true, Connected: true}, nil)
+			case "peers":
+				req.Reply([]string{"node2", "node3"}, nil)
+			default:
+				req.Reply(nil, errors.New("failed"))
+			}
+		}
+	}()
+	defer close(requests)
+	handler := dbusHandler(requests)
+
+	status, err := handler("Status")
+	want := map[string]string{"name": "node1", "version": "", "members": "3", "leader": "node1", "is_leader": "true", "connected": "true", "conflicts": ""}
+	if err != nil || !reflect.DeepEqual(status, want) {
+		t.Errorf("Status = %v, %v; want %v", status, err, want)
+	}
+	peers, err := handler("Peers")
+	if err != nil || !reflect.DeepEqual(peers, []string{"node2", "node3"}) {
+		t.Errorf("Peers = %v, %v; want [node2 node3]", peers, err)
+	}
+	if _, err := handler("Connect"); err == nil || err.Error() != "failed" {
+		t.Errorf("Connect error = %v, want failed", err)
+	}
+}
@@ -0,0 +1,234 @@
+package dns
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	mdns "github.com/miekg/dns"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultDomain is the default domain under which node names are served
+const DefaultDomain = "wesher"
+
+// ttl is the time-to-live of all answers, in seconds; kept short since membership can change at any time
+const ttl = 5
+
+// Server answers DNS queries for node names and reverse queries for their addresses.
+// The zero value serves DefaultDomain; it must be started using ListenAndServe.
+type Server struct {
+	// Addr is the address (host:port) the server listens on, for both UDP and TCP.
+	Addr string
+	// Domain is the domain under which node names are served; if not set, will use DefaultDomain.
+	Domain string
+	// Logger is an optional logrus.StdLogger interface, used for debugging.
+	Logger log.StdLogger
+
+	entriesLock sync.RWMutex
+	names       map[string][]net.IP  // fqdn to addresses
+	ptrs        map[string][]string  // reverse name to fqdns
+	rotation    uint32               // rotates the order of names with several addresses, incremented per query
+	srvs        map[string][]Service // service fqdn (_NAME._PROTO) to its instances
+	serviceIPs  map[string][]net.IP  // fqdn of service names to the addresses of their instances
+	txts        map[string][]string  // fqdn of node names to their metadata, as KEY=VALUE
+}
+
+// Service is an instance of a named service, offered by a node on a port of its address
+type Service struct {
+	Name   string // e.g. web
+	Proto  string // tcp or udp
+	Target string // name of the node offering the service
+	IP     net.IP
+	Port   uint16
+}
+
+// SetEntries replaces the served entries
+// The provided map uses the same format as etchosts.EtcHosts.WriteEntries. Names shared by several addresses, e.g.
+// aliases of a service run on several nodes, are answered with all of them in rotating order, but left out of the
+// reverse entries.
+func (s *Server) SetEntries(ipsToNames map[string][]string) {
+	names := make(map[string][]net.IP)
+	for ipStr, ipNames := range ipsToNames {
+		ip := net.ParseIP(ipStr)
+		if ip == nil {
+			continue
+		}
+		for _, name := range ipNames {
+			fqdn := s.fqdn(name)
+			names[fqdn] = append(names[fqdn], ip)
+		}
+	}
+	ptrs := make(map[string][]string)
+	for ipStr, ipNames := range ipsToNames {
+		reverse, err := mdns.ReverseAddr(ipStr)
+		if err != nil {
+			continue
+		}
+		for _, name := range ipNames {
+			if fqdn := s.fqdn(name); len(names[fqdn]) == 1 {
+				ptrs[reverse] = append(ptrs[reverse], fqdn)
+			}
+		}
+	}
+	for _, ips := range names {
+		sort.Slice(ips, func(i, j int) bool { return bytes.Compare(ips[i].To16(), ips[j].To16()) < 0 })
+	}
+
+	s.entriesLock.Lock()
+	defer s.entriesLock.Unlock()
+	s.names = names
+	s.ptrs = ptrs
+}
+
+// SetServices replaces the served services
+// Services are answered with SRV records of their instances under _NAME._PROTO in the domain, and with the addresses of
+// their instances under NAME, unless that is already the name of a node.
+func (s *Server) SetServices(services []Service) {
+	srvs := make(map[string][]Service)
+	serviceIPs := make(map[string][]net.IP)
+	for _, service := range services {
+		srv := s.fqdn("_" + service.Name + "._" + service.Proto)
+		srvs[srv] = append(srvs[srv], service)
+		fqdn := s.fqdn(service.Name)
+		known := false
+		for _, ip := range serviceIPs[fqdn] {
+			known = known || ip.Equal(service.IP)
+		}
+		if !known {
+			serviceIPs[fqdn] = append(serviceIPs[fqdn], service.IP)
+		}
+	}
+	for _, instances := range srvs {
+		sort.Slice(instances, func(i, j int) bool { return instances[i].Target < instances[j].Target })
+	}
+	for _, ips := range serviceIPs {
+		sort.Slice(ips, func(i, j int) bool { return bytes.Compare(ips[i].To16(), ips[j].To16()) < 0 })
+	}
+
+	s.entriesLock.Lock()
+	defer s.entriesLock.Unlock()
+	s.srvs = srvs
+	s.serviceIPs = serviceIPs
+}
+
+// SetMetadata replaces the metadata of nodes, by node name
+// Metadata is answered with a TXT record per KEY=VALUE entry under the node name.
+func (s *Server) SetMetadata(metadata map[string]map[string]string) {
+	txts := make(map[string][]string, len(metadata))
+	for name, entries := range metadata {
+		if len(entries) == 0 {
+			continue
+		}
+		fqdn := s.fqdn(name)
+		for key, value := range entries {
+			txts[fqdn] = append(txts[fqdn], key+"="+value)
+		}
+		sort.Strings(txts[fqdn])
+	}
+
+	s.entriesLock.Lock()
+	defer s.entriesLock.Unlock()
+	s.txts = txts
+}
+
+// ListenAndServe starts serving DNS on both UDP and TCP; it only returns on error
+func (s *Server) ListenAndServe() error {
+	errc := make(chan error, 2)
+	for _, network := range []string{"udp", "tcp"} {
+		server := &mdns.Server{Addr: s.Addr, Net: network, Handler: s}
+		go func(network string) {
+			errc <- errors.Wrapf(server.ListenAndServe(), "could not serve DNS via %s on %s", network, s.Addr)
+		}(network)
+	}
+	return <-errc
+}
+
+// ServeDNS implements the miekg/dns.Handler interface
+func (s *Server) ServeDNS(w mdns.ResponseWriter, req *mdns.Msg) {
+	resp := &mdns.Msg{}
+	resp.SetReply(req)
+	resp.Authoritative = true
+
+	if len(req.Question) == 1 {
+		q := req.Question[0]
+		s.entriesLock.RLock()
+		resp.Answer, resp.Rcode = s.answer(q)
+		s.entriesLock.RUnlock()
+		if s.Logger != nil {
+			s.Logger.Printf("answering %s %s with %d records", mdns.TypeToString[q.Qtype], q.Name, len(resp.Answer))
+		}
+	} else {
+		resp.Rcode = mdns.RcodeFormatError
+	}
+
+	w.WriteMsg(resp) //nolint: errcheck // nothing we can do about it
+}
+
+// answer provides the records answering a question; must be called with entriesLock held
+func (s *Server) answer(q mdns.Question) ([]mdns.RR, int) {
+	name := strings.ToLower(q.Name)
+	hdr := func(rrtype uint16) mdns.RR_Header {
+		return mdns.RR_Header{Name: q.Name, Rrtype: rrtype, Class: mdns.ClassINET, Ttl: ttl}
+	}
+
+	if fqdns, ok := s.ptrs[name]; ok {
+		answers := make([]mdns.RR, 0, len(fqdns))
+		if q.Qtype == mdns.TypePTR || q.Qtype == mdns.TypeANY {
+			for _, fqdn := range fqdns {
+				answers = append(answers, &mdns.PTR{Hdr: hdr(mdns.TypePTR), Ptr: fqdn})
+			}
+		}
+		return answers, mdns.RcodeSuccess
+	}
+
+	if instances, ok := s.srvs[name]; ok {
+		answers := make([]mdns.RR, 0, len(instances))
+		if q.Qtype == mdns.TypeSRV || q.Qtype == mdns.TypeANY {
+			for _, instance := range instances {
+				answers = append(answers, &mdns.SRV{Hdr: hdr(mdns.TypeSRV), Port: instance.Port, Target: s.fqdn(instance.Target)})
+			}
+		}
+		return answers, mdns.RcodeSuccess
+	}
+
+	ips, ok := s.names[name]
+	if !ok {
+		ips, ok = s.serviceIPs[name]
+	}
+	texts, hasTexts := s.txts[name]
+	if !ok && !hasTexts {
+		return nil, mdns.RcodeNameError
+	}
+	answers := make([]mdns.RR, 0, len(ips)+len(texts))
+	offset := 0
+	if len(ips) > 1 {
+		offset = int(atomic.AddUint32(&s.rotation, 1)) % len(ips)
+	}
+	for i := range ips {
+		ip := ips[(offset+i)%len(ips)]
+		if ip4 := ip.To4(); ip4 != nil && (q.Qtype == mdns.TypeA || q.Qtype == mdns.TypeANY) {
+			answers = append(answers, &mdns.A{Hdr: hdr(mdns.TypeA), A: ip4})
+		} else if ip4 == nil && (q.Qtype == mdns.TypeAAAA || q.Qtype == mdns.TypeANY) {
+			answers = append(answers, &mdns.AAAA{Hdr: hdr(mdns.TypeAAAA), AAAA: ip})
+		}
+	}
+	if q.Qtype == mdns.TypeTXT || q.Qtype == mdns.TypeANY {
+		for _, text := range texts {
+			answers = append(answers, &mdns.TXT{Hdr: hdr(mdns.TypeTXT), Txt: []string{text}})
+		}
+	}
+	return answers, mdns.RcodeSuccess
+}
+
+func (s *Server) fqdn(name string) string {
+	domain := s.Domain
+	if domain == "" {
+		domain = DefaultDomain
+	}
+	return strings.ToLower(mdns.Fqdn(strings.TrimSuffix(name, ".") + "." + strings.Trim(domain, ".")))
+}
@@ -0,0 +1,159 @@
+package dns
+
+import (
+	"net"
+	"testing"
+
+	mdns "github.com/miekg/dns"
+)
+
+type fakeWriter struct {
+	mdns.ResponseWriter
+	msg *mdns.Msg
+}
+
+func (w *fakeWriter) WriteMsg(msg *mdns.Msg) error {
+	w.msg = msg
+	return nil
+}
+
+func query(s *Server, name string, qtype uint16) *mdns.Msg {
+	req := &mdns.Msg{}
+	req.SetQuestion(name, qtype)
+	w := &fakeWriter{}
+	s.ServeDNS(w, req)
+	return w.msg
+}
+
+func TestServer_ServeDNS(t *testing.T) {
+	s := &Server{}
+	s.SetEntries(map[string][]string{
+		"10.0.0.1":    {"node1", "db1"},
+		"2001:db8::2": {"node2"},
+	})
+
+	tests := []struct {
+		name      string
+		qname     string
+		qtype     uint16
+		wantRcode int
+		want      []string
+	}{
+		{"A record", "node1.wesher.", mdns.TypeA, mdns.RcodeSuccess, []string{"10.0.0.1"}},
+		{"A record for alias", "DB1.wesher.", mdns.TypeA, mdns.RcodeSuccess, []string{"10.0.0.1"}},
+		{"AAAA record", "node2.wesher.", mdns.TypeAAAA, mdns.RcodeSuccess, []string{"2001:db8::2"}},
+		{"no AAAA for IPv4 node", "node1.wesher.", mdns.TypeAAAA, mdns.RcodeSuccess, []string{}},
+		{"PTR record", "1.0.0.10.in-addr.arpa.", mdns.TypePTR, mdns.RcodeSuccess, []string{"node1.wesher.", "db1.wesher."}},
+		{"unknown name", "node3.wesher.", mdns.TypeA, mdns.RcodeNameError, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := query(s, tt.qname, tt.qtype)
+			if resp.Rcode != tt.wantRcode {
+				t.Errorf("ServeDNS() rcode = %d, want %d", resp.Rcode, tt.wantRcode)
+			}
+			if len(resp.Answer) != len(tt.want) {
+				t.Fatalf("ServeDNS() answers = %v, want %v", resp.Answer, tt.want)
+			}
+			for i, rr := range resp.Answer {
+				var got string
+				switch rr := rr.(type) {
+				case *mdns.A:
+					got = rr.A.String()
+				case *mdns.AAAA:
+					got = rr.AAAA.String()
+				case *mdns.PTR:
+					got = rr.Ptr
+				}
+				if got != tt.want[i] && net.ParseIP(got).String() != tt.want[i] {
+					t.Errorf("ServeDNS() answer %d = %s, want %s", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestServer_ServeDNS_shared(t *testing.T) {
+	s := &Server{}
+	s.SetEntries(map[string][]string{
+		"10.0.0.1": {"node1", "web"},
+		"10.0.0.2": {"node2", "web"},
+		"10.0.0.3": {"node3"},
+	})
+
+	firsts := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		resp := query(s, "web.wesher.", mdns.TypeA)
+		if len(resp.Answer) != 2 {
+			t.Fatalf("ServeDNS() answers = %v, want both nodes of the shared name", resp.Answer)
+		}
+		firsts[resp.Answer[0].(*mdns.A).A.String()] = true
+	}
+	if len(firsts) != 2 {
+		t.Errorf("ServeDNS() answered %v first, want the order to rotate", firsts)
+	}
+
+	resp := query(s, "1.0.0.10.in-addr.arpa.", mdns.TypePTR)
+	if len(resp.Answer) != 1 || resp.Answer[0].(*mdns.PTR).Ptr != "node1.wesher." {
+		t.Errorf("ServeDNS() PTR answers = %v, want only node1.wesher.", resp.Answer)
+	}
+}
+
+func TestServer_ServeDNS_services(t *testing.T) {
+	s := &Server{}
+	s.SetEntries(map[string][]string{
+		"10.0.0.1": {"node1"},
+		"10.0.0.2": {"node2"},
+	})
+	s.SetServices([]Service{
+		{Name: "web", Proto: "tcp", Target: "node2", IP: net.ParseIP("10.0.0.2"), Port: 8080},
+		{Name: "web", Proto: "tcp", Target: "node1", IP: net.ParseIP("10.0.0.1"), Port: 80},
+		{Name: "web", Proto: "udp", Target: "node1", IP: net.ParseIP("10.0.0.1"), Port: 443},
+		{Name: "node2", Proto: "tcp", Target: "node1", IP: net.ParseIP("10.0.0.1"), Port: 22},
+	})
+
+	resp := query(s, "_web._tcp.wesher.", mdns.TypeSRV)
+	if len(resp.Answer) != 2 {
+		t.Fatalf("ServeDNS() SRV answers = %v, want both instances", resp.Answer)
+	}
+	if srv := resp.Answer[0].(*mdns.SRV); srv.Target != "node1.wesher." || srv.Port != 80 {
+		t.Errorf("ServeDNS() SRV answer = %s, want node1.wesher. port 80", srv)
+	}
+	if resp := query(s, "web.wesher.", mdns.TypeA); len(resp.Answer) != 2 {
+		t.Errorf("ServeDNS() A answers = %v for the service name, want both instances", resp.Answer)
+	}
+	if resp := query(s, "node2.wesher.", mdns.TypeA); len(resp.Answer) != 1 || resp.Answer[0].(*mdns.A).A.String() != "10.0.0.2" {
+		t.Errorf("ServeDNS() A answers = %v for a node named like a service, want only the node", resp.Answer)
+	}
+	if resp := query(s, "_ssh._tcp.wesher.", mdns.TypeSRV); resp.Rcode != mdns.RcodeNameError {
+		t.Errorf("ServeDNS() rcode = %d for an unknown service, want %d", resp.Rcode, mdns.RcodeNameError)
+	}
+}
+
+func TestServer_ServeDNS_metadata(t *testing.T) {
+	s := &Server{}
+	s.SetEntries(map[string][]string{
+		"10.0.0.1": {"node1"},
+		"10.0.0.2": {"node2"},
+	})
+	s.SetMetadata(map[string]map[string]string{
+		"node1": {"rack": "r12", "dc": "fra1"},
+		"node2": {},
+	})
+
+	resp := query(s, "node1.wesher.", mdns.TypeTXT)
+	if len(resp.Answer) != 2 {
+		t.Fatalf("ServeDNS() TXT answers = %v, want one per entry", resp.Answer)
+	}
+	for i, want := range []string{"dc=fra1", "rack=r12"} {
+		if got := resp.Answer[i].(*mdns.TXT).Txt; len(got) != 1 || got[0] != want {
+			t.Errorf("ServeDNS() TXT answer %d = %v, want %s", i, got, want)
+		}
+	}
+	if resp := query(s, "node1.wesher.", mdns.TypeA); len(resp.Answer) != 1 {
+		t.Errorf("ServeDNS() A answers = %v for a node with metadata, want only its address", resp.Answer)
+	}
+	if resp := query(s, "node2.wesher.", mdns.TypeTXT); resp.Rcode != mdns.RcodeSuccess || len(resp.Answer) != 0 {
+		t.Errorf("ServeDNS() TXT answers = %v (rcode %d) for a node without metadata, want none", resp.Answer, resp.Rcode)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/costela/wesher/common"
+	"github.com/costela/wesher/wg"
+	"github.com/vishvananda/netlink"
+)
+
+// doctorTimeout bounds every network probe of the doctor subcommand
+const doctorTimeout = 2 * time.Second
+
+// wireguardOverhead is the encapsulation overhead of wireguard over IPv6, the worst case
+const wireguardOverhead = 80
+
+// doctorCheck is the outcome of a single diagnostic check
+type doctorCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+// doctorResult is the machine-readable report of the doctor subcommand
+type doctorResult struct {
+	OK     bool          `json:"ok"`
+	Checks []doctorCheck `json:"checks"`
+}
+
+// runDoctor implements the doctor subcommand: it diagnoses the system for the most common causes of a failing mesh,
+// without changing anything, printing a pass/fail report, and provides the exit code
+func runDoctor() int {
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	checks := []doctorCheck{
+		checkWireguardModule(config.Backend),
+		checkNetAdmin(config.Backend),
+	}
+	checks = append(checks, checkSeeds(config.joinHosts(), config.ClusterPort)...)
+	checks = append(checks,
+		checkMTU(config),
+		checkForwarding(config),
+		checkConflicts(config),
+		checkHostsFile(config.NoEtcHosts),
+	)
+	result := doctorResult{OK: true, Checks: checks}
+	for _, check := range checks {
+		result.OK = result.OK && check.OK
+	}
+
+	printResult(config.Output, result, func() {
+		for _, check := range result.Checks {
+			status := "PASS"
+			if !check.OK {
+				status = "FAIL"
+			}
+			fmt.Printf("%s  %s: %s\n", status, check.Name, check.Detail)
+		}
+	})
+	if !result.OK {
+		return 1
+	}
+	return 0
+}
+
+func checkWireguardModule(backend string) doctorCheck {
+	check := doctorCheck{Name: "wireguard", OK: true, Detail: "kernel module loaded"}
+	if backend == wg.BackendFake {
+		check.Detail = "not needed with the fake backend"
+		return check
+	}
+	if _, err := os.Stat("/sys/module/wireguard"); err != nil {
+		check.OK = false
+		check.Detail = "kernel module not loaded; load it with modprobe wireguard, or upgrade to a kernel including it (5.6+)"
+	}
+	return check
+}
+
+func checkNetAdmin(backend string) doctorCheck {
+	check := doctorCheck{Name: "capabilities", OK: true, Detail: "CAP_NET_ADMIN available"}
+	switch ok, err := hasCapability(capNetAdmin); {
+	case backend == wg.BackendFake:
+		check.Detail = "not needed with the fake backend"
+	case err != nil:
+		check.OK, check.Detail = false, fmt.Sprintf("could not check capabilities: %s", err)
+	case !ok:
+		check.OK, check.Detail = false, "missing CAP_NET_ADMIN, needed to manage the wireguard interface; run as root or grant it"
+	}
+	return check
+}
+
+// checkSeeds checks that the gossip port of every join host is reachable, over TCP and UDP
+// UDP cannot be confirmed without speaking the encrypted gossip protocol, so only explicitly refused probes fail.
+func checkSeeds(hosts []string, defaultPort int) []doctorCheck {
+	if len(hosts) == 0 {
+		return []doctorCheck{{Name: "seeds", OK: true, Detail: "no join hosts configured"}}
+	}
+	checks := make([]doctorCheck, 0, len(hosts))
+	for _, host := range hosts {
+		check := doctorCheck{Name: "seed " + host, OK: true}
+		addr := seedAddr(host, defaultPort)
+		problems := []string{}
+		if conn, err := net.DialTimeout("tcp", addr, doctorTimeout); err != nil {
+			problems = append(problems, fmt.Sprintf("TCP %s unreachable: %s", addr, err))
+		} else {
+			conn.Close()
+		}
+		if err := probeUDP(addr, doctorTimeout); err != nil {
+			problems = append(problems, fmt.Sprintf("UDP %s unreachable: %s", addr, err))
+		}
+		if len(problems) > 0 {
+			check.OK, check.Detail = false, strings.Join(problems, "; ")
+		} else {
+			check.Detail = fmt.Sprintf("TCP and UDP %s reachable", addr)
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+// seedAddr provides the address of a join host, adding the default port if it has none
+func seedAddr(host string, defaultPort int) string {
+	if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+		return net.JoinHostPort(ip.String(), strconv.Itoa(defaultPort))
+	}
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, strconv.Itoa(defaultPort))
+}
+
+// probeUDP sends an empty datagram and waits for an ICMP port unreachable, which is the only failure UDP reports
+func probeUDP(addr string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("udp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Write(nil); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout)) // nolint: errcheck
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return nil // nothing refused it
+		}
+		return err
+	}
+	return nil
+}
+
+func checkMTU(c *config) doctorCheck {
+	check := doctorCheck{Name: "mtu", OK: true}
+	linkMTU, iface, err := defaultRouteMTU()
+	if err != nil {
+		check.OK, check.Detail = false, fmt.Sprintf("could not get MTU of the default route: %s", err)
+		return check
+	}
+	if err := mtuProblem(c.MTU, linkMTU, (*net.IPNet)(c.OverlayNet).IP.To4() == nil); err != nil {
+		check.OK, check.Detail = false, fmt.Sprintf("%s (default route via %s)", err, iface)
+		return check
+	}
+	check.Detail = fmt.Sprintf("%d fits into the MTU %d of %s", c.MTU, linkMTU, iface)
+	return check
+}
+
+// mtuProblem describes why the wireguard MTU does not fit the MTU of the underlying link, if it does not
+func mtuProblem(mtu, linkMTU int, overlayIPv6 bool) error {
+	if mtu+wireguardOverhead > linkMTU {
+		return fmt.Errorf("%d plus %d bytes of wireguard overhead exceeds the link MTU %d, causing fragmentation; use at most --mtu %d", mtu, wireguardOverhead, linkMTU, linkMTU-wireguardOverhead)
+	}
+	if overlayIPv6 && mtu < 1280 {
+		return fmt.Errorf("%d is below the IPv6 minimum of 1280 needed by the IPv6 overlay network", mtu)
+	}
+	return nil
+}
+
+// defaultRouteMTU provides the MTU and name of the interface of the IPv4 default route
+func defaultRouteMTU() (int, string, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return 0, "", err
+	}
+	for _, route := range routes {
+		if route.Dst != nil {
+			continue
+		}
+		link, err := netlink.LinkByIndex(route.LinkIndex)
+		if err != nil {
+			return 0, "", err
+		}
+		return link.Attrs().MTU, link.Attrs().Name, nil
+	}
+	return 0, "", fmt.Errorf("no default route")
+}
+
+func checkForwarding(c *config) doctorCheck {
+	check := doctorCheck{Name: "ip forwarding", OK: true}
+	forward, err := common.Sysctl("net/ipv4/ip_forward")
+	if err != nil {
+		check.OK, check.Detail = false, fmt.Sprintf("could not check IPv4 forwarding: %s", err)
+		return check
+	}
+	routing := c.ProxyARPIface != "" || c.NDPProxyIface != "" || c.RoutedNetFile != ""
+	for _, routedNet := range c.RoutedNet {
+		if ones, bits := routedNet.Mask.Size(); ones != bits || !routedNet.IP.IsUnspecified() {
+			routing = true // not the default placeholder
+		}
+	}
+	switch {
+	case forward == "1":
+		check.Detail = "IPv4 forwarding enabled"
+	case routing:
+		check.OK, check.Detail = false, "IPv4 forwarding disabled, but needed to route networks for other nodes; enable net.ipv4.ip_forward"
+	default:
+		check.Detail = "IPv4 forwarding disabled; only needed to route networks for other nodes"
+	}
+	return check
+}
+
+func checkConflicts(c *config) doctorCheck {
+	check := doctorCheck{Name: "conflicts", OK: true}
+	overlayNet := (*net.IPNet)(c.OverlayNet)
+	problems := []string{}
+	if link, err := netlink.LinkByName(c.Interface); err == nil && link.Type() != "wireguard" {
+		problems = append(problems, fmt.Sprintf("%s already exists as a %s interface", c.Interface, link.Type()))
+	}
+	overlaps, err := common.LocalOverlaps(overlayNet, c.Interface)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("could not check routes: %s", err))
+	}
+	for _, overlap := range overlaps {
+		problems = append(problems, fmt.Sprintf("local route %s overlaps the overlay network %s", &overlap, overlayNet))
+	}
+	if len(problems) > 0 {
+		check.OK, check.Detail = false, strings.Join(problems, "; ")
+	} else {
+		check.Detail = fmt.Sprintf("no interface or route conflicts with %s on %s", overlayNet, c.Interface)
+	}
+	return check
+}
+
+func checkHostsFile(noEtcHosts bool) doctorCheck {
+	check := doctorCheck{Name: "hosts file", OK: true, Detail: "/etc/hosts writable"}
+	if noEtcHosts {
+		check.Detail = "not written with --no-etc-hosts"
+	} else if err := checkWritable("/etc/hosts"); err != nil {
+		check.OK, check.Detail = false, fmt.Sprintf("/etc/hosts cannot be written (disable with --no-etc-hosts): %s", err)
+	}
+	return check
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_mtuProblem(t *testing.T) {
+	tests := []struct {
+		name        string
+		mtu         int
+		linkMTU     int
+		overlayIPv6 bool
+		wantErr     bool
+	}{
+		{"default", 1420, 1500, false, false},
+		{"fragmenting", 1500, 1500, false, true},
+		{"pppoe", 1420, 1492, false, true},
+		{"ipv6 minimum", 1200, 1500, true, true},
+		{"ipv4 below ipv6 minimum", 1200, 1500, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := mtuProblem(tt.mtu, tt.linkMTU, tt.overlayIPv6); (err != nil) != tt.wantErr {
+				t.Errorf("mtuProblem() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_seedAddr(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"192.0.2.1", "192.0.2.1:7946"},
+		{"192.0.2.1:8000", "192.0.2.1:8000"},
+		{"2001:db8::1", "[2001:db8::1]:7946"},
+		{"[2001:db8::1]", "[2001:db8::1]:7946"},
+		{"[2001:db8::1]:8000", "[2001:db8::1]:8000"},
+		{"seed.example.com", "seed.example.com:7946"},
+	}
+	for _, tt := range tests {
+		if got := seedAddr(tt.host, 7946); got != tt.want {
+			t.Errorf("seedAddr(%q) = %s, want %s", tt.host, got, tt.want)
+		}
+	}
+}
+
+func Test_probeUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	if err := probeUDP(addr, 100*time.Millisecond); err != nil {
+		t.Errorf("probeUDP() of listening port error = %v, want none", err)
+	}
+	conn.Close()
+	if err := probeUDP(addr, time.Second); err == nil {
+		t.Error("probeUDP() of closed port should fail")
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/costela/wesher/common"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// stateDump holds the internal state written on SIGUSR1, to help diagnosing issues
+type stateDump struct {
+	Time           time.Time
+	Version        string
+	LocalNode      dumpNode
+	Leader         string
+	Members        []dumpNode
+	Peers          []dumpPeer
+	PendingRoutes  []string
+	PersistedNodes []dumpNode
+}
+
+// dumpNode is the human readable representation of a node and its decoded metadata
+type dumpNode struct {
+	Name        string
+	Addr        string
+	Port        uint16 `json:",omitempty"`
+	MetaVersion int
+	OverlayAddr string
+	Prefixes    []string `json:",omitempty"`
+	Routes      []string `json:",omitempty"`
+	PubKey      string
+	Version     string              `json:",omitempty"`
+	Aliases     []string            `json:",omitempty"`
+	RoutedHosts map[string][]string `json:",omitempty"`
+}
+
+// dumpPeer is the human readable representation of a wireguard peer; keys other than the public key are deliberately
+// left out
+type dumpPeer struct {
+	PublicKey         string
+	Endpoint          string
+	AllowedIPs        []string
+	LastHandshakeTime time.Time
+	ReceiveBytes      int64
+	TransmitBytes     int64
+	KeepaliveInterval string
+}
+
+func newDumpNode(node common.Node) dumpNode {
+	dn := dumpNode{
+		Name:        node.Name,
+		Addr:        node.Addr.String(),
+		Port:        node.Port,
+		MetaVersion: node.MetaVersion(),
+		OverlayAddr: node.OverlayAddr.String(),
+		Prefixes:    networkStrings(node.Prefixes),
+		Routes:      networkStrings(node.Routes),
+		PubKey:      node.PubKey,
+		Version:     node.Version,
+		Aliases:     node.Aliases,
+		RoutedHosts: node.RoutedHosts,
+	}
+	if node.Addr == nil {
+		dn.Addr = ""
+	}
+	return dn
+}
+
+func newDumpPeer(peer wgtypes.Peer) dumpPeer {
+	dp := dumpPeer{
+		PublicKey:         peer.PublicKey.String(),
+		AllowedIPs:        networkStrings(peer.AllowedIPs),
+		LastHandshakeTime: peer.LastHandshakeTime,
+		ReceiveBytes:      peer.ReceiveBytes,
+		TransmitBytes:     peer.TransmitBytes,
+		KeepaliveInterval: peer.PersistentKeepaliveInterval.String(),
+	}
+	if peer.Endpoint != nil {
+		dp.Endpoint = peer.Endpoint.String()
+	}
+	return dp
+}
+
+func networkStrings(networks []net.IPNet) []string {
+	result := make([]string, len(networks))
+	for i := range networks {
+		result[i] = networks[i].String()
+	}
+	return result
+}
+
+// dumpState writes the state dump to the provided file or, if empty, to the log
+func dumpState(dump stateDump, path string) error {
+	out, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "could not encode state dump")
+	}
+	if path == "" {
+		logrus.Infof("state dump:\n%s", out)
+		return nil
+	}
+	if err := ioutil.WriteFile(path, append(out, '\n'), 0600); err != nil {
+		return errors.Wrapf(err, "could not write state dump to %s", path)
+	}
+	logrus.Infof("state dumped to %s", path)
+	return nil
+}
@@ -2,20 +2,31 @@ package etchosts
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"path"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 )
 
 // DefaultBanner is the default magic comment used to identify entries managed by etchosts
 const DefaultBanner = "# ! MANAGED AUTOMATICALLY !"
 
+// selinuxXattr is the extended attribute holding the SELinux label of a file
+const selinuxXattr = "security.selinux"
+
 // DefaultPath is the default path used to write hosts entries
 const DefaultPath = "/etc/hosts"
 
@@ -29,16 +40,99 @@ type EtcHosts struct {
 	Path string
 	// Logger is an optional logrus.StdLogger interface, used for debugging.
 	Logger log.StdLogger
+	// MinInterval is the minimum time between two writes; writes requested earlier are deferred and coalesced, so
+	// bursts of changes result in a single write. Deferred writes can be forced using Flush.
+	MinInterval time.Duration
+
+	lock      sync.Mutex
+	entries   map[string][]string // most recently requested entries, see Watch
+	written   map[string][]string // entries of the last successful write, see ForgetWritten
+	pending   *time.Timer         // deferred write, see MinInterval
+	lastWrite time.Time
+
+	writeLock sync.Mutex // serializes writes to the hosts file
 }
 
 // WriteEntries is used to write the hosts entries to EtcHosts.Path
 // Each IP address with their (potentially multiple) hostnames are written to a line marked with EtcHosts.Banner, to
-// avoid overwriting preexisting entries.
+// avoid overwriting preexisting entries. The managed lines are rendered deterministically, and the file is left
+// untouched if rendering the entries would not change it. Entries unchanged since the last successful write are not
+// even compared against the file.
 func (eh *EtcHosts) WriteEntries(ipsToNames map[string][]string) error {
-	hostsPath := eh.Path
-	if hostsPath == "" {
-		hostsPath = DefaultPath
+	eh.lock.Lock()
+	eh.entries = copyEntries(ipsToNames)
+	if eh.pending == nil && eh.written != nil && reflect.DeepEqual(eh.written, eh.entries) {
+		eh.lock.Unlock()
+		return nil
+	}
+	if wait := eh.MinInterval - time.Since(eh.lastWrite); eh.MinInterval > 0 && wait > 0 {
+		if eh.pending == nil {
+			eh.pending = time.AfterFunc(wait, eh.writePending)
+		}
+		eh.lock.Unlock()
+		return nil
+	}
+	eh.lastWrite = time.Now()
+	eh.lock.Unlock()
+
+	return eh.write(copyEntries(ipsToNames))
+}
+
+// Flush immediately performs any write deferred because of MinInterval
+func (eh *EtcHosts) Flush() error {
+	eh.lock.Lock()
+	if eh.pending == nil || !eh.pending.Stop() {
+		eh.lock.Unlock()
+		return nil // nothing pending, or already being written
+	}
+	eh.pending = nil
+	eh.lastWrite = time.Now()
+	entries := copyEntries(eh.entries)
+	eh.lock.Unlock()
+
+	return eh.write(entries)
+}
+
+func (eh *EtcHosts) writePending() {
+	eh.lock.Lock()
+	eh.pending = nil
+	eh.lastWrite = time.Now()
+	entries := copyEntries(eh.entries)
+	eh.lock.Unlock()
+
+	if err := eh.write(entries); err != nil {
+		eh.logf("could not write deferred hosts entries: %s", err)
+	}
+}
+
+// ForgetWritten forgets the entries last written, so the next WriteEntries compares them against the file again, e.g.
+// after it was edited by hand
+func (eh *EtcHosts) ForgetWritten() {
+	eh.lock.Lock()
+	defer eh.lock.Unlock()
+	eh.written = nil
+}
+
+func (eh *EtcHosts) write(ipsToNames map[string][]string) (err error) {
+	hostsPath := eh.path()
+	eh.writeLock.Lock()
+	defer eh.writeLock.Unlock()
+	defer func() {
+		eh.lock.Lock()
+		defer eh.lock.Unlock()
+		eh.written = nil
+		if err == nil {
+			eh.written = copyEntries(ipsToNames)
+		}
+	}()
+
+	// Honor both the lock file and flock conventions of other tools editing the hosts file, and only read the file
+	// once they are held, so concurrent edits are merged instead of reverted.
+	release, err := eh.acquireLockFile()
+	if err != nil {
+		return err
 	}
+	defer release()
 
 	// We do not want to create the hosts file; if it's not there, we probably have the wrong path.
 	etcHosts, err := os.OpenFile(hostsPath, os.O_RDWR, 0644)
@@ -46,6 +140,22 @@ func (eh *EtcHosts) WriteEntries(ipsToNames map[string][]string) error {
 		return errors.Wrapf(err, "could not open %s for reading", hostsPath)
 	}
 	defer etcHosts.Close()
+	if err := flock(etcHosts); err != nil {
+		return err
+	}
+
+	current, err := ioutil.ReadAll(etcHosts)
+	if err != nil {
+		return errors.Wrapf(err, "could not read %s", hostsPath)
+	}
+	expected := &bytes.Buffer{}
+	if err := eh.writeEntries(bytes.NewReader(current), expected, ipsToNames); err != nil {
+		return err
+	}
+	if bytes.Equal(current, expected.Bytes()) {
+		eh.logf("hosts entries in %s are up-to-date", hostsPath)
+		return nil
+	}
 
 	// create tmpfile in same folder as
 	tmp, err := ioutil.TempFile(path.Dir(hostsPath), "etchosts")
@@ -63,35 +173,46 @@ func (eh *EtcHosts) WriteEntries(ipsToNames map[string][]string) error {
 		}
 	}(tmp)
 
-	if err := eh.writeEntries(etcHosts, tmp, ipsToNames); err != nil {
-		return err
+	if _, err := tmp.Write(expected.Bytes()); err != nil {
+		return errors.Wrap(err, "could not write tempfile")
 	}
 
 	return eh.movePreservePerms(tmp, etcHosts)
 }
 
+func (eh *EtcHosts) path() string {
+	if eh.Path == "" {
+		return DefaultPath
+	}
+	return eh.Path
+}
+
+func (eh *EtcHosts) logf(format string, args ...interface{}) {
+	if eh.Logger != nil {
+		eh.Logger.Printf(format, args...)
+	}
+}
+
+// writeEntries copies the hosts file, replacing the managed entries with a single block of the given entries
+// The block is placed where the first managed entry was, or appended, and sorted by IP address, so the same entries
+// always render to the same file regardless of the order they were provided in.
 func (eh *EtcHosts) writeEntries(orig io.Reader, dest io.Writer, ipsToNames map[string][]string) error {
 	banner := eh.Banner
 	if banner == "" {
 		banner = DefaultBanner
 	}
 
-	// go through file and update existing entries/prune nonexistent entries
+	// keep unmanaged lines in place and prune all managed ones
+	written := false
 	scanner := bufio.NewScanner(orig)
 	for scanner.Scan() {
 		line := scanner.Text()
 		if strings.HasSuffix(strings.TrimSpace(line), strings.TrimSpace(banner)) {
-			tokens := strings.Fields(line)
-			if len(tokens) < 1 {
-				continue // remove empty managed line
-			}
-			ip := tokens[0]
-			if names, ok := ipsToNames[ip]; ok {
-				err := eh.writeEntryWithBanner(dest, banner, ip, names)
-				if err != nil {
+			if !written {
+				if err := eh.writeBlock(dest, banner, ipsToNames); err != nil {
 					return err
 				}
-				delete(ipsToNames, ip) // otherwise we'll append it again below
+				written = true
 			}
 		} else {
 			// keep original unmanaged line
@@ -102,16 +223,60 @@ func (eh *EtcHosts) writeEntries(orig io.Reader, dest io.Writer, ipsToNames map[
 		return errors.Wrap(err, "error reading hosts file")
 	}
 
-	// append remaining entries to file
-	for ip, names := range ipsToNames {
-		if err := eh.writeEntryWithBanner(dest, banner, ip, names); err != nil {
+	if !written {
+		return eh.writeBlock(dest, banner, ipsToNames)
+	}
+	return nil
+}
+
+// writeBlock writes the managed entries, sorted by IP address
+func (eh *EtcHosts) writeBlock(dest io.Writer, banner string, ipsToNames map[string][]string) error {
+	ips := make([]string, 0, len(ipsToNames))
+	for ip := range ipsToNames {
+		ips = append(ips, ip)
+	}
+	sort.Slice(ips, func(i, j int) bool { return lessIP(ips[i], ips[j]) })
+	for _, ip := range ips {
+		if err := eh.writeEntryWithBanner(dest, banner, ip, normalizeNames(ipsToNames[ip])); err != nil {
 			return err
 		}
 	}
-
 	return nil
 }
 
+// lessIP orders IP addresses numerically, with IPv4 addresses first; unparsable addresses are ordered last
+func lessIP(a, b string) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	switch {
+	case ipA == nil || ipB == nil:
+		if (ipA == nil) != (ipB == nil) {
+			return ipB == nil
+		}
+		return a < b
+	case (ipA.To4() == nil) != (ipB.To4() == nil):
+		return ipA.To4() != nil
+	}
+	return bytes.Compare(ipA.To16(), ipB.To16()) < 0
+}
+
+// normalizeNames removes duplicate names and sorts them, except for the first one, which is the canonical name used
+// for reverse lookups
+func normalizeNames(names []string) []string {
+	if len(names) == 0 {
+		return names
+	}
+	seen := map[string]bool{names[0]: true}
+	rest := []string{}
+	for _, name := range names[1:] {
+		if !seen[name] {
+			seen[name] = true
+			rest = append(rest, name)
+		}
+	}
+	sort.Strings(rest)
+	return append([]string{names[0]}, rest...)
+}
+
 func (eh *EtcHosts) writeEntryWithBanner(tmp io.Writer, banner, ip string, names []string) error {
 	if ip != "" && len(names) > 0 {
 		if eh.Logger != nil {
@@ -124,38 +289,92 @@ func (eh *EtcHosts) writeEntryWithBanner(tmp io.Writer, banner, ip string, names
 	return nil
 }
 
+// movePreservePerms replaces dst with src, carrying over the ownership, mode and SELinux label of dst
+// If the attributes cannot be carried over, or src cannot be renamed, the content is copied into dst instead,
+// which keeps its attributes untouched.
 func (eh *EtcHosts) movePreservePerms(src, dst *os.File) error {
 	if err := src.Sync(); err != nil {
 		return errors.Wrapf(err, "could not sync changes to %s", src.Name())
 	}
 
-	etcHostsInfo, err := dst.Stat()
-	if err != nil {
-		return errors.Wrapf(err, "could not stat %s", dst.Name())
+	if err := copyAttributes(src, dst); err != nil {
+		log.Infof("could not preserve attributes of %s; falling back to copy (%s)", dst.Name(), err)
+		return copyContent(src, dst)
 	}
-
-	if err = os.Rename(src.Name(), dst.Name()); err != nil {
+	if err := os.Rename(src.Name(), dst.Name()); err != nil {
 		log.Infof("could not rename to %s; falling back to copy (%s)", dst.Name(), err)
-
-		if _, err := src.Seek(0, io.SeekStart); err != nil {
-			return err
-		}
-		if _, err := dst.Seek(0, io.SeekStart); err != nil {
-			return err
-		}
-		if err := dst.Truncate(0); err != nil {
-			return err
-		}
-		_, err = io.Copy(dst, src)
-		return err
+		return copyContent(src, dst)
 	}
+	return nil
+}
 
+// copyAttributes sets the ownership, mode and SELinux label of dst on src
+func copyAttributes(src, dst *os.File) error {
+	info, err := dst.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "could not stat %s", dst.Name())
+	}
 	// ensure we're not running with some umask that might break things
-
-	if err := src.Chmod(etcHostsInfo.Mode()); err != nil {
+	if err := src.Chmod(info.Mode()); err != nil {
 		return errors.Wrapf(err, "could not chmod %s", src.Name())
 	}
-	// TODO: also keep user?
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		if err := src.Chown(int(stat.Uid), int(stat.Gid)); err != nil {
+			return errors.Wrapf(err, "could not chown %s", src.Name())
+		}
+	}
 
+	size, err := unix.Fgetxattr(int(dst.Fd()), selinuxXattr, nil)
+	if err == unix.ENODATA || err == unix.ENOTSUP {
+		return nil // not labeled
+	}
+	if err != nil {
+		return errors.Wrapf(err, "could not get SELinux label of %s", dst.Name())
+	}
+	label := make([]byte, size)
+	n, err := unix.Fgetxattr(int(dst.Fd()), selinuxXattr, label)
+	if err != nil {
+		return errors.Wrapf(err, "could not get SELinux label of %s", dst.Name())
+	}
+	if err := unix.Fsetxattr(int(src.Fd()), selinuxXattr, label[:n], 0); err != nil {
+		return errors.Wrapf(err, "could not set SELinux label of %s", src.Name())
+	}
 	return nil
 }
+
+// copyContent overwrites the content of dst with the content of src
+func copyContent(src, dst *os.File) error {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := dst.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := dst.Truncate(0); err != nil {
+		return err
+	}
+	_, err := io.Copy(dst, src)
+	return err
+}
+
+// ReadEntries parses hosts entries in the /etc/hosts format, as used by WriteEntries
+// Comments and empty lines are ignored; names of repeated IP addresses are merged.
+func ReadEntries(r io.Reader) (map[string][]string, error) {
+	ipsToNames := make(map[string][]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		tokens := strings.Fields(line)
+		if len(tokens) < 2 {
+			continue
+		}
+		ipsToNames[tokens[0]] = append(ipsToNames[tokens[0]], tokens[1:]...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "error reading hosts entries")
+	}
+	return ipsToNames, nil
+}
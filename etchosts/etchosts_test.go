@@ -4,8 +4,14 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -89,6 +95,27 @@ func TestEtcHosts_writeEntries(t *testing.T) {
 			"1.2.3.4\tfoo bar\t# ! MANAGED AUTOMATICALLY !\n",
 			false,
 		},
+		{
+			"sorted block",
+			fields{},
+			args{strings.NewReader(""), map[string][]string{"10.0.0.10": {"c"}, "fd00::1": {"d"}, "10.0.0.9": {"b"}, "10.0.0.1": {"a"}}},
+			"10.0.0.1\ta\t# ! MANAGED AUTOMATICALLY !\n10.0.0.9\tb\t# ! MANAGED AUTOMATICALLY !\n10.0.0.10\tc\t# ! MANAGED AUTOMATICALLY !\nfd00::1\td\t# ! MANAGED AUTOMATICALLY !\n",
+			false,
+		},
+		{
+			"block replaces first managed entry",
+			fields{},
+			args{strings.NewReader("127.0.0.1 localhost\n1.2.3.5 old # ! MANAGED AUTOMATICALLY !\n::1 localhost\n1.2.3.4 foo # ! MANAGED AUTOMATICALLY !\n"), map[string][]string{"1.2.3.5": {"bar"}, "1.2.3.4": {"foo"}}},
+			"127.0.0.1 localhost\n1.2.3.4\tfoo\t# ! MANAGED AUTOMATICALLY !\n1.2.3.5\tbar\t# ! MANAGED AUTOMATICALLY !\n::1 localhost\n",
+			false,
+		},
+		{
+			"stable names",
+			fields{},
+			args{strings.NewReader(""), map[string][]string{"1.2.3.4": {"node1", "web", "db", "web"}}},
+			"1.2.3.4\tnode1 db web\t# ! MANAGED AUTOMATICALLY !\n",
+			false,
+		},
 		{
 			"custom banner",
 			fields{Banner: "# somebanner"},
@@ -118,3 +145,227 @@ func TestEtcHosts_writeEntries(t *testing.T) {
 
 // 1.2.3.4 foo bar # ! MANAGED AUTOMATICALLY !
 // 1.2.3.4 foo bar # ! MANAGED AUTOMATICALLY !
+
+func TestReadEntries(t *testing.T) {
+	orig := "# some comment\n\n192.168.1.10 printer printer.lan # managed\n192.168.1.11\n192.168.1.10 scanner\n"
+	got, err := ReadEntries(strings.NewReader(orig))
+	if err != nil {
+		t.Fatalf("ReadEntries() error = %v", err)
+	}
+	want := map[string][]string{"192.168.1.10": {"printer", "printer.lan", "scanner"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadEntries() = %v, want %v", got, want)
+	}
+}
+
+func BenchmarkEtcHosts_writeEntries(b *testing.B) {
+	ipsToNames := make(map[string][]string, 1000)
+	for i := 0; i < 1000; i++ {
+		ipsToNames[fmt.Sprintf("10.0.%d.%d", i/256, i%256)] = []string{fmt.Sprintf("node%d", i)}
+	}
+	orig := "127.0.0.1\tlocalhost\n::1\tlocalhost ip6-localhost\n"
+	eh := &EtcHosts{}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := eh.writeEntries(strings.NewReader(orig), ioutil.Discard, ipsToNames); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestEtcHosts_WriteEntries_unchanged(t *testing.T) {
+	f, err := ioutil.TempFile("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	eh := &EtcHosts{Path: f.Name()}
+	entries := map[string][]string{"1.2.3.4": {"foo"}, "1.2.3.5": {"bar", "baz"}}
+	if err := eh.WriteEntries(entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("WriteEntries() modified the provided entries")
+	}
+	info, _ := os.Stat(f.Name())
+	if err := eh.WriteEntries(map[string][]string{"1.2.3.5": {"bar", "baz"}, "1.2.3.4": {"foo"}}); err != nil {
+		t.Fatal(err)
+	}
+	if newInfo, _ := os.Stat(f.Name()); !os.SameFile(info, newInfo) {
+		t.Errorf("WriteEntries() rewrote a file with the same entries")
+	}
+	if err := eh.WriteEntries(map[string][]string{"1.2.3.4": {"foo"}}); err != nil {
+		t.Fatal(err)
+	}
+	if newInfo, _ := os.Stat(f.Name()); os.SameFile(info, newInfo) {
+		t.Errorf("WriteEntries() did not rewrite a file with different entries")
+	}
+}
+
+func TestEtcHosts_WriteEntries_MinInterval(t *testing.T) {
+	f, err := ioutil.TempFile("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	eh := &EtcHosts{Path: f.Name(), MinInterval: time.Hour}
+	for _, name := range []string{"foo", "bar", "baz"} {
+		if err := eh.WriteEntries(map[string][]string{"1.2.3.4": {name}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, _ := ioutil.ReadFile(f.Name())
+	if want := "1.2.3.4\tfoo\t# ! MANAGED AUTOMATICALLY !\n"; string(got) != want {
+		t.Errorf("WriteEntries() wrote %#v, want only the first write %#v", string(got), want)
+	}
+
+	if err := eh.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	got, _ = ioutil.ReadFile(f.Name())
+	if want := "1.2.3.4\tbaz\t# ! MANAGED AUTOMATICALLY !\n"; string(got) != want {
+		t.Errorf("Flush() wrote %#v, want the latest entries %#v", string(got), want)
+	}
+}
+
+func TestEtcHosts_WriteEntries_locked(t *testing.T) {
+	f, err := ioutil.TempFile("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+	defer func(timeout time.Duration) { lockTimeout = timeout }(lockTimeout)
+	lockTimeout = 100 * time.Millisecond
+
+	eh := &EtcHosts{Path: f.Name()}
+	if err := ioutil.WriteFile(eh.lockPath(), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := eh.WriteEntries(map[string][]string{"1.2.3.4": {"foo"}}); err == nil {
+		t.Error("WriteEntries() should fail while the lock file exists")
+	}
+
+	// another tool editing the file in the meantime is not reverted
+	if err := ioutil.WriteFile(f.Name(), []byte("127.0.0.1 localhost\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(eh.lockPath())
+	if err := eh.WriteEntries(map[string][]string{"1.2.3.4": {"foo"}}); err != nil {
+		t.Fatalf("WriteEntries() error = %v", err)
+	}
+	got, _ := ioutil.ReadFile(f.Name())
+	if want := "127.0.0.1 localhost\n1.2.3.4\tfoo\t# ! MANAGED AUTOMATICALLY !\n"; string(got) != want {
+		t.Errorf("WriteEntries() wrote %#v, want %#v", string(got), want)
+	}
+	if _, err := os.Stat(eh.lockPath()); !os.IsNotExist(err) {
+		t.Errorf("WriteEntries() left the lock file behind")
+	}
+}
+
+func TestEtcHosts_WriteEntries_preservesMode(t *testing.T) {
+	f, err := ioutil.TempFile("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+	if err := os.Chmod(f.Name(), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	eh := &EtcHosts{Path: f.Name()}
+	if err := eh.WriteEntries(map[string][]string{"1.2.3.4": {"foo"}}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("WriteEntries() changed mode to %s, want %s", info.Mode().Perm(), os.FileMode(0640))
+	}
+}
+
+func TestEtcHosts_WriteEntries_staleLock(t *testing.T) {
+	f, err := ioutil.TempFile("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+	defer func(timeout time.Duration) { lockTimeout = timeout }(lockTimeout)
+	lockTimeout = 100 * time.Millisecond
+
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Skip("could not run true:", err)
+	}
+	old := time.Now().Add(-2 * staleLockAge)
+
+	tests := []struct {
+		name    string
+		content string
+		mtime   time.Time
+		wantErr bool
+	}{
+		{"held by live process", strconv.Itoa(os.Getpid()), time.Now(), true},
+		{"held by exited process", strconv.Itoa(exited.Process.Pid), time.Now(), false},
+		{"without pid", "", time.Now(), true},
+		{"without pid too old", "", old, false},
+		{"held by live process too old", strconv.Itoa(os.Getpid()), old, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eh := &EtcHosts{Path: f.Name()}
+			if err := ioutil.WriteFile(eh.lockPath(), []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(eh.lockPath())
+			if err := os.Chtimes(eh.lockPath(), tt.mtime, tt.mtime); err != nil {
+				t.Fatal(err)
+			}
+			err := eh.WriteEntries(map[string][]string{"1.2.3.4": {"foo"}})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("WriteEntries() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEtcHosts_ForgetWritten(t *testing.T) {
+	f, err := ioutil.TempFile("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	eh := &EtcHosts{Path: f.Name()}
+	entries := map[string][]string{"1.2.3.4": {"foo"}}
+	if err := eh.WriteEntries(entries); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(f.Name(), []byte("127.0.0.1 localhost\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := eh.WriteEntries(entries); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(f.Name()); string(got) != "127.0.0.1 localhost\n" {
+		t.Errorf("WriteEntries() of unchanged entries wrote %#v, want the file untouched", string(got))
+	}
+
+	eh.ForgetWritten()
+	if err := eh.WriteEntries(entries); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadFile(f.Name())
+	if want := "127.0.0.1 localhost\n1.2.3.4\tfoo\t# ! MANAGED AUTOMATICALLY !\n"; string(got) != want {
+		t.Errorf("WriteEntries() after ForgetWritten() wrote %#v, want %#v", string(got), want)
+	}
+}
@@ -0,0 +1,106 @@
+package etchosts
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// lockTimeout bounds the time waited for other tools to release the hosts file
+var lockTimeout = 5 * time.Second
+
+const lockRetryInterval = 50 * time.Millisecond
+
+// staleLockAge is the age after which a lock file is considered left behind by a crashed tool
+var staleLockAge = time.Minute
+
+// lockPath provides the path of the lock file other tools create while editing the hosts file (e.g. /etc/hosts.lock)
+func (eh *EtcHosts) lockPath() string {
+	return eh.path() + ".lock"
+}
+
+// acquireLockFile creates the lock file, waiting for it to be removed if another tool holds it
+// Stale lock files, whose recorded owner is gone or which are older than staleLockAge, are removed instead of waited
+// for. The lock file must be released by calling the returned function.
+func (eh *EtcHosts) acquireLockFile() (func(), error) {
+	lockPath := eh.lockPath()
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		f, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			_, err = f.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+			f.Close()
+			if err != nil {
+				os.Remove(lockPath)
+				return nil, errors.Wrapf(err, "could not write lock file %s", lockPath)
+			}
+			return func() {
+				if err := os.Remove(lockPath); err != nil {
+					eh.logf("could not remove lock file %s: %s", lockPath, err)
+				}
+			}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, errors.Wrapf(err, "could not create lock file %s", lockPath)
+		}
+		if reason := staleLock(lockPath); reason != "" {
+			eh.logf("removing stale lock file %s: %s", lockPath, reason)
+			if err := os.Remove(lockPath); err != nil && !os.IsNotExist(err) {
+				return nil, errors.Wrapf(err, "could not remove stale lock file %s", lockPath)
+			}
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.Errorf("timed out waiting for %s to be removed", lockPath)
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
+
+// staleLock describes why the lock file is stale, or returns an empty string if it is still held
+// Lock files without a recorded pid (as created by some tools) are only considered stale by their age.
+func staleLock(lockPath string) string {
+	info, err := os.Stat(lockPath)
+	if err != nil {
+		return "" // removed in the meantime
+	}
+	if age := time.Since(info.ModTime()); age > staleLockAge {
+		return "created " + age.Round(time.Second).String() + " ago"
+	}
+	content, err := ioutil.ReadFile(lockPath)
+	if err != nil {
+		return ""
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil || pid <= 0 {
+		return ""
+	}
+	if err := unix.Kill(pid, 0); err == unix.ESRCH {
+		return "process " + strconv.Itoa(pid) + " is gone"
+	}
+	return ""
+}
+
+// flock takes an exclusive advisory lock on the opened hosts file, waiting for other holders to release it
+// The lock is released when the file is closed.
+func flock(f *os.File) error {
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err == nil {
+			return nil
+		}
+		if err != unix.EWOULDBLOCK {
+			return errors.Wrapf(err, "could not lock %s", f.Name())
+		}
+		if time.Now().After(deadline) {
+			return errors.Errorf("timed out waiting for lock on %s", f.Name())
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
@@ -0,0 +1,99 @@
+package etchosts
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path"
+	"time"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// watchSettleTime is the time to wait after a modification before re-applying entries, to coalesce bursts of events
+const watchSettleTime = 500 * time.Millisecond
+
+// Watch re-applies the most recently written entries whenever the hosts file is modified by someone else
+// (e.g. cloud-init, NetworkManager or configuration management tools overwriting it).
+// The watch runs in the background until the process exits.
+func (eh *EtcHosts) Watch() error {
+	hostsPath := eh.path()
+
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return errors.Wrap(err, "could not initialize inotify")
+	}
+	// watch the directory, since the file itself may be replaced via rename
+	if _, err := unix.InotifyAddWatch(fd, path.Dir(hostsPath), unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO|unix.IN_CREATE); err != nil {
+		unix.Close(fd)
+		return errors.Wrapf(err, "could not watch %s", path.Dir(hostsPath))
+	}
+
+	changes := make(chan struct{}, 1)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := unix.Read(fd, buf)
+			if err != nil {
+				eh.logf("stopped watching %s: %s", hostsPath, err)
+				return
+			}
+			for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+				event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				nameStart := offset + unix.SizeofInotifyEvent
+				name := string(bytes.TrimRight(buf[nameStart:nameStart+int(event.Len)], "\x00"))
+				offset = nameStart + int(event.Len)
+				if name == path.Base(hostsPath) {
+					select {
+					case changes <- struct{}{}:
+					default: // already pending
+					}
+				}
+			}
+		}
+	}()
+
+	go func() {
+		for range changes {
+			time.Sleep(watchSettleTime)
+			if err := eh.reassert(); err != nil {
+				eh.logf("could not re-apply hosts entries: %s", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// reassert writes the most recently written entries again, unless the hosts file already contains them
+func (eh *EtcHosts) reassert() error {
+	eh.lock.Lock()
+	entries := eh.entries
+	eh.lock.Unlock()
+	if entries == nil {
+		return nil // nothing written yet
+	}
+
+	current, err := ioutil.ReadFile(eh.path())
+	if err != nil {
+		return errors.Wrapf(err, "could not read %s", eh.path())
+	}
+	expected := &bytes.Buffer{}
+	if err := eh.writeEntries(bytes.NewReader(current), expected, copyEntries(entries)); err != nil {
+		return err
+	}
+	if bytes.Equal(current, expected.Bytes()) {
+		return nil // still up-to-date; most likely our own write
+	}
+	eh.logf("hosts file %s was modified externally; re-applying entries", eh.path())
+	eh.ForgetWritten()
+	return eh.WriteEntries(entries)
+}
+
+func copyEntries(ipsToNames map[string][]string) map[string][]string {
+	result := make(map[string][]string, len(ipsToNames))
+	for ip, names := range ipsToNames {
+		result[ip] = append([]string{}, names...)
+	}
+	return result
+}
@@ -0,0 +1,44 @@
+package etchosts
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestEtcHosts_reassert(t *testing.T) {
+	f, err := ioutil.TempFile("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	eh := &EtcHosts{Path: f.Name()}
+	if err := eh.WriteEntries(map[string][]string{"1.2.3.4": {"foo"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate some other tool overwriting the file
+	if err := ioutil.WriteFile(f.Name(), []byte("127.0.0.1 localhost\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := eh.reassert(); err != nil {
+		t.Fatalf("reassert() error = %v", err)
+	}
+
+	got, _ := ioutil.ReadFile(f.Name())
+	want := "127.0.0.1 localhost\n1.2.3.4\tfoo\t# ! MANAGED AUTOMATICALLY !\n"
+	if string(got) != want {
+		t.Errorf("reassert() wrote %#v, want %#v", string(got), want)
+	}
+
+	// an up-to-date file is left alone
+	info, _ := os.Stat(f.Name())
+	if err := eh.reassert(); err != nil {
+		t.Fatalf("reassert() error = %v", err)
+	}
+	if newInfo, _ := os.Stat(f.Name()); !os.SameFile(info, newInfo) {
+		t.Errorf("reassert() rewrote an up-to-date file")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"time"
+
+	"github.com/costela/wesher/common"
+	"github.com/sirupsen/logrus"
+)
+
+// eventLogFiles is the number of rotated event log files kept
+const eventLogFiles = 3
+
+// event is a membership or reconfiguration event written to the event log, for troubleshooting convergence issues
+type event struct {
+	Time        time.Time `json:"time"`
+	Type        string    `json:"type"` // membership, resync, retry, drift, resume, quarantine, routes, connect, disconnect, health, update-script, hook-script, conflict, partition, partition-healed or shutdown
+	Joined      []string  `json:"joined,omitempty"`
+	Left        []string  `json:"left,omitempty"`
+	Updated     []string  `json:"updated,omitempty"`
+	PeersBefore []string  `json:"peers_before,omitempty"`
+	PeersAfter  []string  `json:"peers_after,omitempty"`
+	Routes      []string  `json:"routes,omitempty"`
+	Drift       []string  `json:"drift,omitempty"`       // differences of the wireguard state repaired
+	DurationMs  float64   `json:"duration_ms,omitempty"` // time spent applying the change
+	Failures    []string  `json:"failures,omitempty"`
+}
+
+// membershipEvent describes the change from the previous to the current members
+func membershipEvent(before, after []common.Node) event {
+	ev := event{Time: time.Now(), Type: "membership", PeersBefore: nodeNames(before), PeersAfter: nodeNames(after)}
+	previous := make(map[string]common.Node, len(before))
+	for _, node := range before {
+		previous[node.Name] = node
+	}
+	for _, node := range after {
+		old, ok := previous[node.Name]
+		switch {
+		case !ok:
+			ev.Joined = append(ev.Joined, node.Name)
+		case !bytes.Equal(old.Meta, node.Meta) || !old.Addr.Equal(node.Addr):
+			ev.Updated = append(ev.Updated, node.Name)
+		}
+		delete(previous, node.Name)
+	}
+	ev.Left = make([]string, 0, len(previous))
+	for name := range previous {
+		ev.Left = append(ev.Left, name)
+	}
+	sort.Strings(ev.Left)
+	return ev
+}
+
+// scriptType provides the type of the event for scripts: join, leave or update for membership events with only one kind
+// of change, the event type otherwise
+func (ev event) scriptType() string {
+	switch {
+	case ev.Type != "membership":
+		return ev.Type
+	case len(ev.Joined) > 0 && len(ev.Left) == 0 && len(ev.Updated) == 0:
+		return "join"
+	case len(ev.Left) > 0 && len(ev.Joined) == 0 && len(ev.Updated) == 0:
+		return "leave"
+	case len(ev.Updated) > 0 && len(ev.Joined) == 0 && len(ev.Left) == 0:
+		return "update"
+	}
+	return ev.Type
+}
+
+// changed provides the names of the nodes which joined, left or were updated, sorted
+func (ev event) changed() []string {
+	names := append(append(append([]string{}, ev.Joined...), ev.Left...), ev.Updated...)
+	sort.Strings(names)
+	return names
+}
+
+// done records the time spent since the event and the failures applying it
+func (ev event) done(failures []string) event {
+	ev.DurationMs = float64(time.Since(ev.Time)) / float64(time.Millisecond)
+	ev.Failures = failures
+	return ev
+}
+
+func nodeNames(nodes []common.Node) []string {
+	names := make([]string, len(nodes))
+	for i, node := range nodes {
+		names[i] = node.Name
+	}
+	sort.Strings(names)
+	return names
+}
+
+// writeEvent writes the event to the event log, if enabled
+func writeEvent(eventLog *common.EventLog, ev event) {
+	if eventLog == nil {
+		return
+	}
+	if err := eventLog.Write(ev); err != nil {
+		logrus.WithError(err).Warn("could not write event log")
+	}
+}
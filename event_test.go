@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/costela/wesher/common"
+)
+
+func Test_membershipEvent(t *testing.T) {
+	before := []common.Node{
+		{Name: "stays", Addr: net.ParseIP("192.0.2.1"), Meta: []byte("a")},
+		{Name: "changes", Addr: net.ParseIP("192.0.2.2"), Meta: []byte("a")},
+		{Name: "leaves", Addr: net.ParseIP("192.0.2.3")},
+	}
+	after := []common.Node{
+		{Name: "stays", Addr: net.ParseIP("192.0.2.1"), Meta: []byte("a")},
+		{Name: "changes", Addr: net.ParseIP("192.0.2.2"), Meta: []byte("b")},
+		{Name: "joins", Addr: net.ParseIP("192.0.2.4")},
+	}
+	ev := membershipEvent(before, after)
+	if !reflect.DeepEqual(ev.Joined, []string{"joins"}) || !reflect.DeepEqual(ev.Left, []string{"leaves"}) || !reflect.DeepEqual(ev.Updated, []string{"changes"}) {
+		t.Errorf("membershipEvent() joined %v, left %v, updated %v; want [joins], [leaves], [changes]", ev.Joined, ev.Left, ev.Updated)
+	}
+	if want := []string{"changes", "joins", "stays"}; !reflect.DeepEqual(ev.PeersAfter, want) {
+		t.Errorf("membershipEvent() peers after = %v, want %v", ev.PeersAfter, want)
+	}
+}
+
+func Test_event_scriptType(t *testing.T) {
+	tests := []struct {
+		ev          event
+		wantType    string
+		wantChanged []string
+	}{
+		{event{Type: "membership", Joined: []string{"node2"}}, "join", []string{"node2"}},
+		{event{Type: "membership", Left: []string{"node3", "node2"}}, "leave", []string{"node2", "node3"}},
+		{event{Type: "membership", Updated: []string{"node2"}}, "update", []string{"node2"}},
+		{event{Type: "membership", Joined: []string{"node3"}, Left: []string{"node2"}}, "membership", []string{"node2", "node3"}},
+		{event{Type: "resync"}, "resync", []string{}},
+	}
+	for _, tt := range tests {
+		if got := tt.ev.scriptType(); got != tt.wantType {
+			t.Errorf("%+v.scriptType() = %s, want %s", tt.ev, got, tt.wantType)
+		}
+		if got := tt.ev.changed(); !reflect.DeepEqual(got, tt.wantChanged) {
+			t.Errorf("%+v.changed() = %v, want %v", tt.ev, got, tt.wantChanged)
+		}
+	}
+}
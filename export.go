@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/costela/wesher/common"
+	"github.com/costela/wesher/control"
+	"github.com/costela/wesher/wg"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// export formats
+const (
+	exportWgQuick = "wg-quick"
+)
+
+// exportResult is the current wireguard configuration of the running daemon, as provided by the export subcommand
+type exportResult struct {
+	Name       string       `json:"name"`
+	Interface  string       `json:"interface"`
+	PrivateKey string       `json:"private_key"`
+	Address    string       `json:"address"`
+	ListenPort int          `json:"listen_port"`
+	MTU        int          `json:"mtu"`
+	Peers      []exportPeer `json:"peers"`
+}
+
+// exportPeer is a configured wireguard peer, named after its node if it is still a member
+type exportPeer struct {
+	Name                string   `json:"name,omitempty"`
+	PublicKey           string   `json:"public_key"`
+	Endpoint            string   `json:"endpoint,omitempty"`
+	AllowedIPs          []string `json:"allowed_ips"`
+	PersistentKeepalive int      `json:"persistent_keepalive,omitempty"` // seconds
+}
+
+// newExportResult describes the wireguard configuration applied to the interface
+func newExportResult(name, iface string, state *wg.State, peers []wgtypes.Peer, members []common.Node) exportResult {
+	names := make(map[string]string, len(members))
+	for _, node := range members {
+		names[node.PubKey] = node.Name
+	}
+	for _, peer := range state.ExternalPeers {
+		names[peer.PubKey.String()] = peer.Name + " (external)"
+	}
+	result := exportResult{
+		Name:       name,
+		Interface:  iface,
+		PrivateKey: state.PrivKey.String(),
+		Address:    state.OverlayAddr.String(),
+		ListenPort: state.Port,
+		MTU:        state.MTU,
+		Peers:      make([]exportPeer, 0, len(peers)),
+	}
+	for _, peer := range peers {
+		ep := exportPeer{
+			Name:                names[peer.PublicKey.String()],
+			PublicKey:           peer.PublicKey.String(),
+			AllowedIPs:          networkStrings(peer.AllowedIPs),
+			PersistentKeepalive: int(peer.PersistentKeepaliveInterval / time.Second),
+		}
+		if peer.Endpoint != nil {
+			ep.Endpoint = peer.Endpoint.String()
+		}
+		result.Peers = append(result.Peers, ep)
+	}
+	return result
+}
+
+// formatWgQuick formats the configuration as a wg-quick file
+func formatWgQuick(result exportResult, now time.Time) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# wireguard configuration of wesher interface %s on node %s, exported %s\n", result.Interface, result.Name, now.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "[Interface]\nPrivateKey = %s\nAddress = %s\nListenPort = %d\nMTU = %d\n", result.PrivateKey, result.Address, result.ListenPort, result.MTU)
+	for _, peer := range result.Peers {
+		b.WriteString("\n")
+		if peer.Name != "" {
+			fmt.Fprintf(&b, "# %s\n", peer.Name)
+		}
+		fmt.Fprintf(&b, "[Peer]\nPublicKey = %s\n", peer.PublicKey)
+		if peer.Endpoint != "" {
+			fmt.Fprintf(&b, "Endpoint = %s\n", peer.Endpoint)
+		}
+		if len(peer.AllowedIPs) > 0 {
+			fmt.Fprintf(&b, "AllowedIPs = %s\n", strings.Join(peer.AllowedIPs, ", "))
+		}
+		if peer.PersistentKeepalive > 0 {
+			fmt.Fprintf(&b, "PersistentKeepalive = %d\n", peer.PersistentKeepalive)
+		}
+	}
+	return b.String()
+}
+
+// runExport implements the export subcommand, printing the current wireguard configuration of the running daemon
+// It takes a --format option, which is removed from the arguments before loading the configuration.
+func runExport(args []string) int {
+	format := takeFormatArg(exportWgQuick)
+	if len(args) != 0 || format != exportWgQuick {
+		fmt.Fprintf(os.Stderr, "usage: wesher export [--format %s]\n", exportWgQuick)
+		return 2
+	}
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	result := exportResult{}
+	if err := control.Send(config.controlSocket(), &result, "export"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	printResult(config.Output, result, func() { fmt.Print(formatWgQuick(result, time.Now())) })
+	return 0
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/costela/wesher/common"
+	"github.com/costela/wesher/wg"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func Test_formatWgQuick(t *testing.T) {
+	key, _ := wgtypes.GeneratePrivateKey()
+	peerKey, _ := wgtypes.GeneratePrivateKey()
+	state := &wg.State{
+		PrivKey:     key,
+		OverlayAddr: net.IPNet{IP: net.ParseIP("10.0.0.1").To4(), Mask: net.CIDRMask(32, 32)},
+		Port:        51820,
+		MTU:         1420,
+	}
+	_, routed, _ := net.ParseCIDR("192.168.1.0/24")
+	peers := []wgtypes.Peer{
+		{
+			PublicKey:                   peerKey.PublicKey(),
+			Endpoint:                    &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51820},
+			AllowedIPs:                  []net.IPNet{{IP: net.ParseIP("10.0.0.2").To4(), Mask: net.CIDRMask(32, 32)}, *routed},
+			PersistentKeepaliveInterval: 25 * time.Second,
+		},
+		{PublicKey: key.PublicKey()}, // no longer a member
+	}
+	members := []common.Node{{Name: "node2"}}
+	members[0].PubKey = peerKey.PublicKey().String()
+
+	got := formatWgQuick(newExportResult("node1", "wgoverlay", state, peers, members), time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	want := `# wireguard configuration of wesher interface wgoverlay on node node1, exported 2020-01-02T03:04:05Z
+[Interface]
+PrivateKey = ` + key.String() + `
+Address = 10.0.0.1/32
+ListenPort = 51820
+MTU = 1420
+
+# node2
+[Peer]
+PublicKey = ` + peerKey.PublicKey().String() + `
+Endpoint = 192.0.2.1:51820
+AllowedIPs = 10.0.0.2/32, 192.168.1.0/24
+PersistentKeepalive = 25
+
+[Peer]
+PublicKey = ` + key.PublicKey().String() + `
+`
+	if got != want {
+		t.Errorf("formatWgQuick() = %s, want %s", got, want)
+	}
+}
@@ -3,20 +3,23 @@ module github.com/costela/wesher
 require (
 	github.com/armon/go-metrics v0.3.3 // indirect
 	github.com/cenkalti/backoff v2.2.1+incompatible
+	github.com/godbus/dbus/v5 v5.0.3
 	github.com/google/btree v1.0.0 // indirect
 	github.com/hashicorp/go-immutable-radix v1.2.0 // indirect
-	github.com/hashicorp/go-msgpack v1.1.5 // indirect
+	github.com/hashicorp/go-msgpack v1.1.5
 	github.com/hashicorp/go-sockaddr v1.0.2
 	github.com/hashicorp/go-uuid v1.0.2 // indirect
 	github.com/hashicorp/golang-lru v0.5.4 // indirect
 	github.com/hashicorp/memberlist v0.2.2
 	github.com/mattn/go-isatty v0.0.12
-	github.com/mikioh/ipaddr v0.0.0-20190404000644-d465c8ab6721 // indirect
+	github.com/miekg/dns v1.1.26
+	github.com/mikioh/ipaddr v0.0.0-20190404000644-d465c8ab6721
 	github.com/pkg/errors v0.9.1
 	github.com/sirupsen/logrus v1.7.0
 	github.com/stevenroose/gonfig v0.1.5
 	github.com/stretchr/testify v1.5.1 // indirect
 	github.com/vishvananda/netlink v1.1.0
+	golang.org/x/sys v0.0.0-20200202164722-d101bd2416d5
 	golang.zx2c4.com/wireguard/wgctrl v0.0.0-20200324154536-ceff61240acf
 )
 
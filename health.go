@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"sort"
+	"time"
+
+	"github.com/costela/wesher/common"
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// health failure actions
+const (
+	healthActionNone   = "none"
+	healthActionResync = "resync"
+	healthActionExit   = "exit"
+)
+
+// staleHandshakeAge is the age after which a handshake is considered stale; wireguard renews handshakes every 2
+// minutes while traffic (including keepalives) flows, and stops accepting their keys after 3 minutes
+const staleHandshakeAge = 3 * time.Minute
+
+// handshakeCheckInterval is the interval at which failed handshakes are counted as flaps, see failedHandshakes
+const handshakeCheckInterval = 30 * time.Second
+
+// healthSummary is the health information passed to the health script as JSON
+type healthSummary struct {
+	Time            time.Time `json:"time"`
+	Name            string    `json:"name"`
+	Members         int       `json:"members"` // including the local node
+	Peers           int       `json:"peers"`   // configured on the wireguard interface
+	StaleHandshakes []string  `json:"stale_handshakes"`
+	Connected       bool      `json:"connected"`
+	Partitioned     bool      `json:"partitioned"` // see --partition-threshold
+	// ScriptFailures holds the consecutive failures of the node update and hook scripts currently failing, by path
+	ScriptFailures map[string]int `json:"script_failures"`
+}
+
+// newHealthSummary summarizes the health of the provided wireguard peers of the members at the provided time
+// Peers with stale or missing handshakes are listed by the name of their node, or by public key for unknown peers.
+func newHealthSummary(name string, members []common.Node, peers []wgtypes.Peer, now time.Time) healthSummary {
+	summary := healthSummary{
+		Time:            now,
+		Name:            name,
+		Members:         len(members) + 1,
+		Peers:           len(peers),
+		StaleHandshakes: []string{},
+		ScriptFailures:  map[string]int{},
+	}
+	names := make(map[string]string, len(members))
+	for _, node := range members {
+		names[node.PubKey] = node.Name
+	}
+	for _, peer := range peers {
+		if now.Sub(peer.LastHandshakeTime) <= staleHandshakeAge {
+			continue
+		}
+		key := peer.PublicKey.String()
+		if name, ok := names[key]; ok {
+			key = name
+		}
+		summary.StaleHandshakes = append(summary.StaleHandshakes, key)
+	}
+	sort.Strings(summary.StaleHandshakes)
+	return summary
+}
+
+// failedHandshakes provides the names of the members whose peers, sending persistent keepalives, have not completed a
+// handshake for staleHandshakeAge since they were first seen, to be quarantined like flapping nodes
+// seen holds the time each peer was first seen and is updated; peers without keepalives are skipped, since they do not
+// renew handshakes while idle. If no peer completed a recent handshake, the local node is most likely offline instead,
+// and none is reported.
+func failedHandshakes(members []common.Node, peers []wgtypes.Peer, seen map[wgtypes.Key]time.Time, now time.Time) []string {
+	names := make(map[string]string, len(members))
+	for _, node := range members {
+		names[node.PubKey] = node.Name
+	}
+	current := make(map[wgtypes.Key]bool, len(peers))
+	failed := []string{}
+	healthy := false
+	for _, peer := range peers {
+		current[peer.PublicKey] = true
+		if _, ok := seen[peer.PublicKey]; !ok {
+			seen[peer.PublicKey] = now
+		}
+		if peer.PersistentKeepaliveInterval <= 0 {
+			continue
+		}
+		if now.Sub(peer.LastHandshakeTime) <= staleHandshakeAge {
+			healthy = true
+			continue
+		}
+		if name, ok := names[peer.PublicKey.String()]; ok && now.Sub(seen[peer.PublicKey]) > staleHandshakeAge {
+			failed = append(failed, name)
+		}
+	}
+	for key := range seen {
+		if !current[key] {
+			delete(seen, key) // removed, e.g. quarantined; the handshake starts over once it is added again
+		}
+	}
+	if !healthy {
+		return nil
+	}
+	sort.Strings(failed)
+	return failed
+}
+
+// runHealthScript runs the health script with the summary on stdin, failing if it does not succeed within timeout
+func runHealthScript(ctx context.Context, script string, summary healthSummary, timeout time.Duration) error {
+	input, err := json.Marshal(summary)
+	if err != nil {
+		return errors.Wrap(err, "could not encode health summary")
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, script)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return errors.Wrapf(cmd.Run(), "health-script %s failed", script)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/costela/wesher/common"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func Test_newHealthSummary(t *testing.T) {
+	now := time.Now()
+	fresh, _ := wgtypes.GeneratePrivateKey()
+	stale, _ := wgtypes.GeneratePrivateKey()
+	unknown, _ := wgtypes.GeneratePrivateKey()
+	members := []common.Node{{Name: "node2"}, {Name: "node3"}}
+	members[0].PubKey = fresh.PublicKey().String()
+	members[1].PubKey = stale.PublicKey().String()
+	peers := []wgtypes.Peer{
+		{PublicKey: fresh.PublicKey(), LastHandshakeTime: now.Add(-time.Minute)},
+		{PublicKey: stale.PublicKey(), LastHandshakeTime: now.Add(-time.Hour)},
+		{PublicKey: unknown.PublicKey()}, // never handshaked
+	}
+
+	summary := newHealthSummary("node1", members, peers, now)
+	if summary.Members != 3 || summary.Peers != 3 {
+		t.Errorf("newHealthSummary() members = %d, peers = %d; want 3, 3", summary.Members, summary.Peers)
+	}
+	want := []string{unknown.PublicKey().String(), "node3"}
+	if want[0] > want[1] {
+		want[0], want[1] = want[1], want[0]
+	}
+	if !reflect.DeepEqual(summary.StaleHandshakes, want) {
+		t.Errorf("newHealthSummary() stale handshakes = %v, want %v", summary.StaleHandshakes, want)
+	}
+}
+
+func Test_failedHandshakes(t *testing.T) {
+	now := time.Now()
+	keys := make([]wgtypes.Key, 4)
+	members := make([]common.Node, len(keys))
+	for i := range keys {
+		key, _ := wgtypes.GeneratePrivateKey()
+		keys[i] = key.PublicKey()
+		members[i] = common.Node{Name: fmt.Sprintf("node%d", i+2)}
+		members[i].PubKey = keys[i].String()
+	}
+	keepalive := 25 * time.Second
+	peers := []wgtypes.Peer{
+		{PublicKey: keys[0], PersistentKeepaliveInterval: keepalive, LastHandshakeTime: now.Add(-time.Minute)},
+		{PublicKey: keys[1], PersistentKeepaliveInterval: keepalive, LastHandshakeTime: now.Add(-time.Hour)},
+		{PublicKey: keys[2], LastHandshakeTime: now.Add(-time.Hour)}, // idle without keepalives
+		{PublicKey: keys[3], PersistentKeepaliveInterval: keepalive}, // never handshaked
+	}
+	seen := map[wgtypes.Key]time.Time{}
+
+	if got := failedHandshakes(members, peers, seen, now); len(got) != 0 {
+		t.Errorf("failedHandshakes() of just seen peers = %v, want none", got)
+	}
+	now = now.Add(staleHandshakeAge + time.Second)
+	peers[0].LastHandshakeTime = now
+	if got := failedHandshakes(members, peers, seen, now); !reflect.DeepEqual(got, []string{"node3", "node5"}) {
+		t.Errorf("failedHandshakes() = %v, want [node3 node5]", got)
+	}
+	peers[0].LastHandshakeTime = time.Time{}
+	if got := failedHandshakes(members, peers, seen, now); len(got) != 0 {
+		t.Errorf("failedHandshakes() without any recent handshake = %v, want none", got)
+	}
+
+	peers[0].LastHandshakeTime = now
+	if got := failedHandshakes(members, peers[:1], seen, now); len(got) != 0 || len(seen) != 1 {
+		t.Errorf("failedHandshakes() = %v with %d peers seen, want the removed peers forgotten", got, len(seen))
+	}
+	if got := failedHandshakes(members, peers, seen, now); len(got) != 0 {
+		t.Errorf("failedHandshakes() of added again peers = %v, want none", got)
+	}
+}
+
+func Test_runHealthScript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wesher-health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := path.Join(dir, "health.sh")
+	// fail unless the summary reports stale handshakes
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\ngrep -q '\"stale_handshakes\":\\[\"'\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	summary := healthSummary{Name: "node1", StaleHandshakes: []string{}}
+	if err := runHealthScript(context.Background(), script, summary, time.Second); err == nil {
+		t.Error("runHealthScript() should fail when the script fails")
+	}
+	summary.StaleHandshakes = []string{"node2"}
+	if err := runHealthScript(context.Background(), script, summary, time.Second); err != nil {
+		t.Errorf("runHealthScript() error = %v", err)
+	}
+}
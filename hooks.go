@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+
+	"github.com/costela/wesher/common"
+)
+
+// hook event types, passed to hook scripts as WESHER_EVENT_TYPE
+const (
+	hookNodeJoin    = "node-join"
+	hookNodeLeave   = "node-leave"
+	hookNodeUpdate  = "node-update"
+	hookRouteChange = "route-change"
+)
+
+// hookScripts are the scripts run per changed node, by event type; empty if not set
+type hookScripts map[string]string
+
+// paths provides the paths of the hook scripts which are set
+func (h hookScripts) paths() []string {
+	paths := make([]string, 0, len(h))
+	for _, path := range h {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// hookRuns provides the runs of the hook scripts for the membership event of the change from the previous to the
+// current members
+// Every joined, departed or updated node of the event gets a run, sorted by name, followed by a run for every one whose
+// routes changed; each with the details of the node in the environment and as JSON on stdin. For departed nodes, these
+// are the last known ones.
+func hookRuns(hooks hookScripts, ev event, before, after []common.Node) []hookRun {
+	previous := make(map[string]common.Node, len(before))
+	for _, node := range before {
+		previous[node.Name] = node
+	}
+	current := make(map[string]common.Node, len(after))
+	for _, node := range after {
+		current[node.Name] = node
+	}
+
+	var runs []hookRun
+	add := func(event string, node common.Node, extraEnv ...string) {
+		if hooks[event] == "" {
+			return
+		}
+		input, _ := json.Marshal(newMemberEntry(node)) // cannot fail for plain strings and maps
+		env := append([]string{
+			"WESHER_EVENT_TYPE=" + event,
+			"WESHER_NODE_NAME=" + node.Name,
+			"WESHER_NODE_ADDR=" + node.Addr.String(),
+			"WESHER_NODE_OVERLAY_ADDR=" + node.OverlayAddr.IP.String(),
+			"WESHER_NODE_ROUTES=" + strings.Join(networkStrings(node.Routes), " "),
+		}, extraEnv...)
+		runs = append(runs, hookRun{Path: hooks[event], scriptRun: scriptRun{Env: env, Stdin: input}})
+	}
+
+	joined := make(map[string]bool, len(ev.Joined))
+	for _, name := range ev.Joined {
+		joined[name] = true
+	}
+	names := ev.changed() // routes are part of the metadata, so only changed nodes can have changed routes
+	for _, name := range names {
+		node, isMember := current[name]
+		switch {
+		case joined[name]:
+			add(hookNodeJoin, node)
+		case !isMember:
+			add(hookNodeLeave, previous[name])
+		default:
+			add(hookNodeUpdate, node)
+		}
+	}
+	for _, name := range names {
+		node, isMember := current[name]
+		if !isMember {
+			node = previous[name]
+		}
+		added, removed := changedRoutes(previous[name].Routes, current[name].Routes)
+		if len(added) > 0 || len(removed) > 0 {
+			add(hookRouteChange, node, "WESHER_ROUTES_ADDED="+strings.Join(added, " "), "WESHER_ROUTES_REMOVED="+strings.Join(removed, " "))
+		}
+	}
+	return runs
+}
+
+// changedRoutes provides the routes only in after and the ones only in before
+func changedRoutes(before, after []net.IPNet) (added, removed []string) {
+	old := make(map[string]bool, len(before))
+	for _, route := range networkStrings(before) {
+		old[route] = true
+	}
+	for _, route := range networkStrings(after) {
+		if !old[route] {
+			added = append(added, route)
+		}
+		delete(old, route)
+	}
+	for _, route := range networkStrings(before) {
+		if old[route] {
+			removed = append(removed, route)
+		}
+	}
+	return added, removed
+}
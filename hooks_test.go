@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/costela/wesher/common"
+)
+
+func envValue(env []string, key string) string {
+	for _, entry := range env {
+		if strings.HasPrefix(entry, key+"=") {
+			return strings.TrimPrefix(entry, key+"=")
+		}
+	}
+	return ""
+}
+
+func Test_hookRuns(t *testing.T) {
+	route := func(cidr string) []net.IPNet {
+		_, network, _ := net.ParseCIDR(cidr)
+		return []net.IPNet{*network}
+	}
+	node := func(name string, meta string, routes []net.IPNet) common.Node {
+		n := common.Node{Name: name, Addr: net.ParseIP("192.0.2.1"), Meta: []byte(meta)}
+		n.OverlayAddr = net.IPNet{IP: net.ParseIP("10.0.0.1"), Mask: net.CIDRMask(32, 32)}
+		n.Routes = routes
+		return n
+	}
+	before := []common.Node{node("a", "1", route("192.168.1.0/24")), node("b", "1", nil), node("c", "1", nil)}
+	after := []common.Node{node("d", "1", route("192.168.3.0/24")), node("a", "2", route("192.168.2.0/24")), node("c", "1", nil)}
+	hooks := hookScripts{hookNodeJoin: "join.sh", hookNodeLeave: "leave.sh", hookNodeUpdate: "update.sh", hookRouteChange: "routes.sh"}
+
+	type call struct {
+		path, node, added, removed string
+	}
+	var got []call
+	for _, run := range hookRuns(hooks, membershipEvent(before, after), before, after) {
+		c := call{path: run.Path, node: envValue(run.Env, "WESHER_NODE_NAME"), added: envValue(run.Env, "WESHER_ROUTES_ADDED"), removed: envValue(run.Env, "WESHER_ROUTES_REMOVED")}
+		got = append(got, c)
+	}
+	want := []call{
+		{path: "update.sh", node: "a"},
+		{path: "leave.sh", node: "b"},
+		{path: "join.sh", node: "d"},
+		{path: "routes.sh", node: "a", added: "192.168.2.0/24", removed: "192.168.1.0/24"},
+		{path: "routes.sh", node: "d", added: "192.168.3.0/24"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("hookRuns() = %+v, want %+v", got, want)
+	}
+
+	if runs := hookRuns(hookScripts{hookNodeJoin: "join.sh"}, membershipEvent(before, after), before, after); len(runs) != 1 || runs[0].Path != "join.sh" {
+		t.Errorf("hookRuns() = %+v, want only the join hook", runs)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// identityPathTemplate is the path of the persisted identity, depending on the wireguard interface name
+var identityPathTemplate = "/var/lib/wesher/%s.identity.json"
+
+// identity is what identifies a node to the rest of the mesh besides its name, persisted with --persist-identity so
+// renamed nodes keep their overlay address and wireguard key
+type identity struct {
+	Name        string `json:"name"`
+	PrivateKey  string `json:"private_key"`
+	OverlayAddr string `json:"overlay_addr"`
+}
+
+// loadIdentity loads the persisted identity of the interface, providing nil if there is none
+func loadIdentity(iface string) (*identity, error) {
+	content, err := ioutil.ReadFile(fmt.Sprintf(identityPathTemplate, iface))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read identity")
+	}
+	id := &identity{}
+	if err := json.Unmarshal(content, id); err != nil {
+		return nil, errors.Wrap(err, "could not decode identity")
+	}
+	return id, nil
+}
+
+// save persists the identity of the interface, only readable by its owner since it contains the private key
+func (id *identity) save(iface string) error {
+	identityPath := fmt.Sprintf(identityPathTemplate, iface)
+	if err := os.MkdirAll(path.Dir(identityPath), 0700); err != nil {
+		return errors.Wrap(err, "could not create identity directory")
+	}
+	content, err := json.MarshalIndent(id, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "could not encode identity")
+	}
+	return errors.Wrap(ioutil.WriteFile(identityPath, content, 0600), "could not write identity")
+}
+
+// key provides the persisted private key
+func (id *identity) key() (wgtypes.Key, error) {
+	key, err := wgtypes.ParseKey(id.PrivateKey)
+	return key, errors.Wrap(err, "could not decode persisted private key")
+}
+
+// overlayAddr provides the persisted overlay address, if it is part of the overlay network
+func (id *identity) overlayAddr(overlayNet *net.IPNet) (net.IP, bool) {
+	ip := net.ParseIP(id.OverlayAddr)
+	if ip == nil || !overlayNet.Contains(ip) {
+		return nil, false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return ip, true
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func Test_identity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wesher-identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(template string) { identityPathTemplate = template }(identityPathTemplate)
+	identityPathTemplate = path.Join(dir, "%s.identity.json")
+
+	if id, err := loadIdentity("wg0"); err != nil || id != nil {
+		t.Fatalf("loadIdentity() without identity = %v, %v; want nothing", id, err)
+	}
+
+	key, _ := wgtypes.GeneratePrivateKey()
+	if err := (&identity{Name: "old", PrivateKey: key.String(), OverlayAddr: "10.0.0.1"}).save("wg0"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path.Join(dir, "wg0.identity.json")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("identity file = %v, %v; want mode 0600", info, err)
+	}
+	id, err := loadIdentity("wg0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := id.key(); err != nil || loaded != key {
+		t.Errorf("identity.key() = %s, %v; want %s", loaded, err, key)
+	}
+	_, overlayNet, _ := net.ParseCIDR("10.0.0.0/8")
+	if ip, ok := id.overlayAddr(overlayNet); !ok || ip.String() != "10.0.0.1" {
+		t.Errorf("identity.overlayAddr() = %s, %t; want 10.0.0.1", ip, ok)
+	}
+	_, otherNet, _ := net.ParseCIDR("192.168.0.0/16")
+	if _, ok := id.overlayAddr(otherNet); ok {
+		t.Error("identity.overlayAddr() should ignore addresses outside of the overlay network")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/costela/wesher/common"
+	"github.com/costela/wesher/control"
+	"github.com/pkg/errors"
+)
+
+// inventory formats
+const (
+	inventoryAnsible = "ansible"
+)
+
+// inventoryHost is a member as listed by the inventory subcommand
+type inventoryHost struct {
+	Name        string            `json:"name"`
+	OverlayAddr string            `json:"overlay_addr"`
+	Labels      map[string]string `json:"labels,omitempty"`
+}
+
+// newInventoryHosts lists the nodes, sorted by name
+func newInventoryHosts(nodes []common.Node) []inventoryHost {
+	hosts := make([]inventoryHost, 0, len(nodes))
+	for _, node := range nodes {
+		hosts = append(hosts, inventoryHost{Name: node.Name, OverlayAddr: node.OverlayAddr.IP.String(), Labels: node.Labels})
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Name < hosts[j].Name })
+	return hosts
+}
+
+// ansibleGroup is a group of an Ansible dynamic inventory
+type ansibleGroup struct {
+	Hosts []string `json:"hosts"`
+}
+
+// formatAnsible formats the hosts as Ansible dynamic inventory, as printed by inventory scripts called with --list
+// Every host is reachable via its overlay address and part of a group per label, named KEY_VALUE; the variables of
+// each host are included, so Ansible needs not query them one by one.
+func formatAnsible(hosts []inventoryHost) ([]byte, error) {
+	groups := map[string]ansibleGroup{"all": {Hosts: []string{}}}
+	hostVars := make(map[string]map[string]interface{}, len(hosts))
+	for _, host := range hosts {
+		groups["all"] = ansibleGroup{Hosts: append(groups["all"].Hosts, host.Name)}
+		for key, value := range host.Labels {
+			name := ansibleGroupName(key + "_" + value)
+			groups[name] = ansibleGroup{Hosts: append(groups[name].Hosts, host.Name)}
+		}
+		hostVars[host.Name] = map[string]interface{}{
+			"ansible_host":        host.OverlayAddr,
+			"wesher_overlay_addr": host.OverlayAddr,
+			"wesher_labels":       host.Labels,
+		}
+	}
+	inventory := make(map[string]interface{}, len(groups)+1)
+	for name, group := range groups {
+		sort.Strings(group.Hosts)
+		inventory[name] = group
+	}
+	inventory["_meta"] = map[string]interface{}{"hostvars": hostVars}
+	return json.MarshalIndent(inventory, "", "  ")
+}
+
+// ansibleGroupName replaces the characters Ansible does not accept in group names by underscores
+func ansibleGroupName(name string) string {
+	return strings.Map(func(c rune) rune {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' {
+			return c
+		}
+		return '_'
+	}, name)
+}
+
+// writeAnsibleInventory atomically replaces the inventory file with the nodes
+func writeAnsibleInventory(filePath string, nodes []common.Node) error {
+	content, err := formatAnsible(newInventoryHosts(nodes))
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(common.WriteFileAtomic(filePath, content, 0644), "could not write Ansible inventory file")
+}
+
+// runInventory implements the inventory subcommand, listing the members of the running daemon
+// It takes a --format option like export, and ignores the --list option Ansible calls inventory scripts with.
+func runInventory(args []string) int {
+	format := takeFormatArg(inventoryAnsible)
+	for i := 1; i < len(os.Args); i++ {
+		if os.Args[i] == "--list" {
+			os.Args = append(os.Args[:i], os.Args[i+1:]...)
+			i--
+		}
+	}
+	if len(args) != 0 || format != inventoryAnsible {
+		fmt.Fprintf(os.Stderr, "usage: wesher inventory [--format %s]\n", inventoryAnsible)
+		return 2
+	}
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	hosts := []inventoryHost{}
+	if err := control.Send(config.controlSocket(), &hosts, "inventory"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	content, err := formatAnsible(hosts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(string(content))
+	return 0
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func Test_formatAnsible(t *testing.T) {
+	hosts := []inventoryHost{
+		{Name: "node1", OverlayAddr: "10.0.0.1", Labels: map[string]string{"env": "prod", "zone": "eu-1"}},
+		{Name: "node2", OverlayAddr: "10.0.0.2", Labels: map[string]string{"env": "prod"}},
+	}
+	content, err := formatAnsible(hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var inventory struct {
+		All      ansibleGroup `json:"all"`
+		EnvProd  ansibleGroup `json:"env_prod"`
+		ZoneEU1  ansibleGroup `json:"zone_eu_1"`
+		Metadata struct {
+			HostVars map[string]map[string]interface{} `json:"hostvars"`
+		} `json:"_meta"`
+	}
+	if err := json.Unmarshal(content, &inventory); err != nil {
+		t.Fatalf("formatAnsible() = %s, not valid JSON: %s", content, err)
+	}
+	if want := []string{"node1", "node2"}; !reflect.DeepEqual(inventory.All.Hosts, want) || !reflect.DeepEqual(inventory.EnvProd.Hosts, want) {
+		t.Errorf("formatAnsible() groups all = %v, env_prod = %v, want %v", inventory.All.Hosts, inventory.EnvProd.Hosts, want)
+	}
+	if want := []string{"node1"}; !reflect.DeepEqual(inventory.ZoneEU1.Hosts, want) {
+		t.Errorf("formatAnsible() group zone_eu_1 = %v, want %v", inventory.ZoneEU1.Hosts, want)
+	}
+	if got := inventory.Metadata.HostVars["node2"]["ansible_host"]; got != "10.0.0.2" {
+		t.Errorf("formatAnsible() ansible_host of node2 = %v, want 10.0.0.2", got)
+	}
+}
@@ -1,17 +1,24 @@
 package main // import "github.com/costela/wesher"
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log"
 	"net"
 	"os"
-	"os/exec"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/cenkalti/backoff"
 	"github.com/costela/wesher/cluster"
 	"github.com/costela/wesher/common"
+	"github.com/costela/wesher/control"
+	"github.com/costela/wesher/dbus"
+	"github.com/costela/wesher/dns"
 	"github.com/costela/wesher/etchosts"
 	"github.com/costela/wesher/wg"
 	"github.com/sirupsen/logrus"
@@ -20,13 +27,18 @@ import (
 var version = "dev"
 
 func main() {
+	// Subcommands
+	runSubcommand()
+
 	// General initialization
 	config, err := loadConfig()
 	if err != nil {
 		logrus.Fatal(err)
 	}
 	if config.Version {
-		fmt.Println(version)
+		printResult(config.Output, struct {
+			Version string `json:"version"`
+		}{version}, func() { fmt.Println(version) })
 		os.Exit(0)
 	}
 	logLevel, err := logrus.ParseLevel(config.LogLevel)
@@ -37,114 +49,575 @@ func main() {
 
 	logrus.Infof("\tAdvertiseAddr: %s", config.AdvertiseAddr)
 
+	// With a single port, wireguard traffic is relayed from the cluster port, whose socket gossip shares
+	var relay *wg.Relay
+	if config.SinglePort {
+		if relay, err = wg.NewRelay(net.JoinHostPort(config.BindAddr, strconv.Itoa(config.ClusterPort)), config.WireguardPort); err != nil {
+			logrus.WithError(err).Fatal("could not relay wireguard traffic on the cluster port")
+		}
+	}
+
 	// Create the wireguard and cluster configuration
-	cluster, err := cluster.New(config.Interface, config.Init, config.ClusterKey, config.BindAddr, config.ClusterPort, config.AdvertiseAddr, config.ClusterPort, config.UseIPAsName)
+	cluster, err := newCluster(config, relay)
 	if err != nil {
 		logrus.WithError(err).Fatal("could not create cluster")
 	}
 
-	keepaliveDuration, err := time.ParseDuration(config.KeepaliveInterval)
-	if err != nil {
-		logrus.WithError(err).Fatal("could not parse time duration for keepalive")
+	if !common.ValidHostname(cluster.LocalName()) {
+		logrus.Warnf("node name %q is not a valid hostname, which breaks its hosts entries on other nodes; set a valid one with --node-name", cluster.LocalName())
 	}
 
-	wgstate, localNode, err := wg.New(config.Interface, config.WireguardPort, config.MTU, (*net.IPNet)(config.OverlayNet), cluster.LocalName, &keepaliveDuration)
+	keepaliveDuration := time.Duration(*config.KeepaliveInterval)
+
+	backend, err := wg.NewBackend(config.Backend)
+	if err != nil {
+		logrus.WithError(err).Fatal("could not instantiate wireguard backend")
+	}
+	wgstate, localNode, err := wg.New(backend, config.Interface, config.WireguardPort, config.MTU, (*net.IPNet)(config.OverlayNet), cluster.LocalName(), &keepaliveDuration, config.BindDevice)
 	if err != nil {
 		logrus.WithError(err).Fatal("could not instantiate wireguard controller")
 	}
 
-	// Prepare the rejoin timer
-	rejoin := make(<-chan time.Time)
-	if config.Rejoin > 0 {
-		rejoin = time.Tick(time.Duration(1000000000 * config.Rejoin))
+	// Reuse the identity of previous runs, so renamed nodes keep their wireguard key and overlay address
+	var persisted *identity
+	if config.PersistIdentity {
+		if persisted, err = loadIdentity(config.Interface); err != nil {
+			logrus.WithError(err).Fatal("could not load persisted identity")
+		}
+		if persisted != nil {
+			key, err := persisted.key()
+			if err != nil {
+				logrus.WithError(err).Fatal("could not load persisted identity")
+			}
+			wgstate.SetPrivateKey(key)
+			localNode.PubKey = wgstate.PubKey.String()
+		}
+	}
+
+	// Assign the overlay address, avoiding the addresses of known nodes
+	strategy, err := config.addressStrategy(wgstate.PubKey)
+	if err != nil {
+		logrus.WithError(err).Fatal("could not prepare overlay address assignment")
+	}
+	if err := wgstate.AssignOverlayAddr(strategy, (*net.IPNet)(config.OverlayNet), cluster.LocalName(), knownOverlayAddrs(cluster.PersistedNodes(), cluster.LocalName())); err != nil {
+		logrus.WithError(err).Fatal("could not assign overlay address")
+	}
+	if persisted != nil {
+		if ip, ok := persisted.overlayAddr((*net.IPNet)(config.OverlayNet)); ok {
+			wgstate.OverlayAddr.IP = ip
+			if persisted.Name != cluster.LocalName() {
+				logrus.Infof("node was renamed from %s to %s, keeping overlay address %s and wireguard key", persisted.Name, cluster.LocalName(), ip)
+			}
+		} else {
+			logrus.Warnf("persisted overlay address %s is not part of the overlay network, assigning %s", persisted.OverlayAddr, wgstate.OverlayAddr.IP)
+		}
+	}
+	localNode.OverlayAddr = wgstate.OverlayAddr
+	localNode.Prefixes = config.secondaryPrefixes(cluster.LocalName(), wgstate.PubKey)
+	if config.PersistIdentity {
+		id := &identity{Name: cluster.LocalName(), PrivateKey: wgstate.PrivKey.String(), OverlayAddr: wgstate.OverlayAddr.IP.String()}
+		if err := id.save(config.Interface); err != nil {
+			logrus.WithError(err).Error("could not persist identity")
+		}
+	}
+
+	warnOverlayOverlaps((*net.IPNet)(config.OverlayNet), config.Interface)
+
+	// Check an interface left by a previous run, which is otherwise reused
+	mismatches, err := wgstate.ExistingMismatches((*net.IPNet)(config.OverlayNet))
+	if err != nil {
+		logrus.WithError(err).Fatal("could not inspect existing interface")
+	}
+	if len(mismatches) > 0 {
+		switch config.ExistingInterface {
+		case wg.ExistingAdopt:
+			logrus.Warnf("adopting existing interface %s, replacing its configuration: %s", config.Interface, strings.Join(mismatches, "; "))
+		case wg.ExistingRecreate:
+			logrus.Warnf("recreating existing interface %s: %s", config.Interface, strings.Join(mismatches, "; "))
+			if err := wgstate.DownInterface(); err != nil {
+				logrus.WithError(err).Fatal("could not remove existing interface")
+			}
+		default:
+			logrus.Fatalf("existing interface %s does not match the configuration (%s); remove it or see --existing-interface", config.Interface, strings.Join(mismatches, "; "))
+		}
+	}
+
+	localNode.Name = cluster.LocalName()
+	localNode.Version = version
+	common.LocalFacts(localNode)
+	localNode.Started = time.Now().Unix()
+	localNode.EndpointPort = uint16(config.WireguardEndpointPort)
+	if config.SinglePort {
+		localNode.EndpointPort = uint16(config.ClusterPort)
+		wgstate.Relay = relay
+	}
+	localNode.Aliases = config.Aliases
+	localNode.VIPCandidates = config.vips()
+	localNode.Labels, _ = common.ParseLabels(config.Labels) // validated in loadConfig
+	localNode.Services, _ = common.ParseServices(config.Services)
+	localNode.Metadata, _ = common.ParseMetadata(config.Metadata)
+	localNode.IngressLimit = uint64(*config.IngressLimit)
+	wgstate.EgressLimit = uint64(*config.EgressLimit)
+	if localNode.BehindNAT, err = behindNAT(config.BehindNAT, cluster.LocalAddr()); err != nil {
+		logrus.WithError(err).Warn("could not detect NAT, assuming none")
+	}
+	wgstate.BehindNAT = localNode.BehindNAT
+	wgstate.KeepaliveNATOnly = config.KeepaliveNATOnly
+	wgstate.AdoptRoamed = config.GossipRoaming
+	wgstate.StrictAllowedIPs = config.StrictAllowedIPs
+	wgstate.PeerEgressLimit = uint64(*config.PeerEgressLimit)
+	if localNode.RoutedHosts, err = config.routedHosts(); err != nil {
+		logrus.WithError(err).Fatal("could not load routed hosts")
+	}
+	if localNode.SSHHostKeys, err = config.sshHostKeys(); err != nil {
+		logrus.WithError(err).Fatal("could not load SSH host keys")
+	}
+	if config.ExternalPeersFile != "" {
+		if wgstate.ExternalPeers, err = wg.LoadExternalPeers(config.ExternalPeersFile); err != nil {
+			logrus.WithError(err).Fatal("could not load external peers")
+		}
+	}
+	var externalRoutes []net.IPNet // announced on behalf of the external peers
+	if config.AnnounceExternalPeers {
+		externalRoutes = wg.ExternalNetworks(wgstate.ExternalPeers)
 	}
 
 	// Prepare the /etc/hosts writer
 	hostsFile := &etchosts.EtcHosts{
-		Banner: "# ! managed automatically by wesher interface " + config.Interface,
-		Logger: logrus.StandardLogger(),
+		Banner:      "# ! managed automatically by wesher interface " + config.Interface,
+		Logger:      logrus.StandardLogger(),
+		MinInterval: time.Duration(*config.EtcHostsInterval),
+	}
+
+	m := newMesh(config, cluster, wgstate, localNode, hostsFile)
+	m.strategy = strategy
+	m.externalRoutes = externalRoutes
+
+	// Import the networks and host names of a federated mesh, shared by its instance on this gateway host
+	m.staticRoutedHosts = localNode.RoutedHosts
+	if config.FederationImport != "" {
+		f, err := common.ReadFederationFile(config.FederationImport)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			logrus.WithError(err).Fatal("could not import federated mesh")
+		}
+		if err != nil {
+			logrus.Warnf("federation file %s does not exist yet, waiting for the peer mesh to write it", config.FederationImport)
+		}
+		m.importFederation(f)
+		m.federationc = common.WatchFederationFile(config.FederationImport)
+	}
+	localNode.Routes = m.announcedRoutes()
+
+	// Clean up on panics and fatal errors from here on
+	cleanup := crashCleanup(hostsFile, !config.NoEtcHosts && !config.LeaveIntact, wgstate, config.DownOnCrash)
+	logrus.RegisterExitHandler(cleanup)
+	defer recoverCrash(cleanup)
+	m.cleanup = cleanup
+
+	if !config.NoEtcHosts && !config.NoEtcHostsWatch {
+		if err := hostsFile.Watch(); err != nil {
+			logrus.WithError(err).Warn("could not watch hosts file for external modifications")
+		}
+	}
+
+	// Prepare the DNS server
+	if config.DNSAddr != "" {
+		m.dnsServer = &dns.Server{
+			Addr:   config.DNSAddr,
+			Domain: config.DNSDomain,
+			Logger: log.New(logrus.StandardLogger().WriterLevel(logrus.DebugLevel), "", 0),
+		}
+		goRecover(cleanup, func() {
+			logrus.WithError(m.dnsServer.ListenAndServe()).Fatal("could not serve DNS")
+		})
+	}
+
+	shutdownTimeout := time.Duration(*config.ShutdownTimeout)
+	// Enable proxy-ARP, so LAN hosts can reach remote addresses inside the LAN without changing their gateway
+	if config.ProxyARPIface != "" {
+		if m.restoreProxyARP, err = enableProxyARP(config.ProxyARPIface); err != nil {
+			logrus.WithError(err).Fatal("could not enable proxy-ARP")
+		}
+	}
+
+	// Enable NDP proxying, the IPv6 equivalent
+	if config.NDPProxyIface != "" {
+		ndpProxy := &common.NDPProxy{Iface: config.NDPProxyIface}
+		previous, err := ndpProxy.Enable()
+		if err != nil {
+			logrus.WithError(err).Fatal("could not enable NDP proxying")
+		}
+		if forward, err := common.Sysctl("net/ipv6/conf/all/forwarding"); err == nil && forward != "1" {
+			logrus.Warn("NDP proxying is enabled, but IPv6 forwarding is disabled; LAN hosts will not reach the mesh")
+		}
+		m.ndpProxy = ndpProxy
+		m.restoreNDPProxy = func() {
+			if err := ndpProxy.Restore(previous); err != nil {
+				logrus.WithError(err).Error("could not restore NDP proxying setting")
+			}
+		}
+	}
+
+	// Prepare the nftables set of overlay addresses
+	if config.NftSet != "" {
+		if m.nftSet, err = common.ParseNftSet(config.NftSet); err != nil {
+			logrus.WithError(err).Fatal("could not prepare nftables set")
+		}
+	}
+
+	// Place the interface into a firewalld zone; firewalld tracks interfaces by name, so it need not exist yet
+	if config.FirewalldZone != "" {
+		m.firewalldZone = &common.FirewalldZone{Zone: config.FirewalldZone, Iface: config.Interface}
+		if err := m.firewalldZone.Add(); err != nil {
+			logrus.WithError(err).Error("could not add interface to firewalld zone")
+		}
+	}
+
+	// Mark the packets of the wireguard socket, so nftables can set their DSCP field
+	if config.DSCP != "" {
+		dscp, _ := common.ParseDSCP(config.DSCP) // already validated
+		wgstate.MarkPackets = true
+		m.dscpMarking = &common.DSCPMarking{Iface: config.Interface, Mark: config.WireguardPort, DSCP: dscp}
+		if err := m.dscpMarking.Apply(); err != nil {
+			logrus.WithError(err).Error("could not set up DSCP marking")
+		}
+	}
+
+	// Prepare the event log
+	if config.EventLog != "" {
+		m.eventLog = &common.EventLog{Path: config.EventLog, MaxSize: int64(config.EventLogMaxSize) << 20, MaxFiles: eventLogFiles}
+	}
+
+	// Prepare unreachable routes for departed nodes
+	if *config.UnreachableDeparted > 0 {
+		m.blackholes = &common.Blackholes{Duration: time.Duration(*config.UnreachableDeparted)}
+	}
+
+	// Handle termination signals by cancelling any in-flight work
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+	incomingSigs := make(chan os.Signal, 1)
+	signal.Notify(incomingSigs, syscall.SIGTERM, os.Interrupt)
+	goRecover(cleanup, func() {
+		<-incomingSigs
+		logrus.Info("terminating...")
+		cancel()
+		time.AfterFunc(shutdownTimeout, func() {
+			logrus.Errorf("could not shut down cleanly within %s", shutdownTimeout)
+			os.Exit(1)
+		})
+	})
+
+	m.routedNets = make([]*net.IPNet, len(config.RoutedNet))
+	for index, routedNetItem := range config.RoutedNet {
+		logrus.Debugf("adding network %s", routedNetItem)
+		m.routedNets[index] = (*net.IPNet)(routedNetItem)
+	}
+	m.staticRoutedNets = m.routedNets
+	if config.RoutedNetFile != "" {
+		fileNets, err := common.NetworksFile(config.RoutedNetFile)
+		if err != nil {
+			logrus.WithError(err).Fatal("could not load routed networks")
+		}
+		m.routedNets = append(m.staticRoutedNets, acceptedRoutedNets(fileNets, (*net.IPNet)(config.OverlayNet))...)
+		m.routedNetFilec = common.WatchNetworksFile(config.RoutedNetFile)
+	}
+	routesFilterc := make(chan []*net.IPNet)
+	m.routesFilterc = routesFilterc
+	m.routesc = common.Routes(m.routedNets, common.InterfaceFilter{Include: config.RoutedNetIfaces, Exclude: config.RoutedNetExcludeIfaces}, routesFilterc)
+
+	// Prepare quarantining of flapping nodes
+	if config.QuarantineFlaps > 0 {
+		m.quarantine = &common.Quarantine{
+			Threshold: config.QuarantineFlaps,
+			Window:    time.Duration(*config.QuarantineWindow),
+			HoldDown:  time.Duration(*config.QuarantineHoldDown),
+		}
+	}
+
+	// Detect partitions from sharp drops of the visible members
+	if config.PartitionThreshold > 0 {
+		m.partition = &common.Partition{Threshold: config.PartitionThreshold}
+	}
+
+	// Expose metrics
+	metrics := &common.Metrics{}
+	registerClusterMetrics(metrics, cluster, m.isLeader)
+	m.counters = registerFailureCounters(metrics, cluster)
+	if m.partition != nil {
+		registerPartitionMetrics(metrics, m.partition)
+	}
+	if config.MetricsAddr != "" {
+		goRecover(cleanup, func() { serveMetrics(config.MetricsAddr, metrics) })
+	}
+	if config.PprofAddr != "" {
+		goRecover(cleanup, func() { servePprof(config.PprofAddr) })
+	}
+
+	// Run the node update script from a worker, see --node-update-script-interval
+	registerScriptMetrics(metrics, m.scriptFailures, config.NodeUpdateScript, config.hooks())
+	if config.NodeUpdateScript != "" {
+		m.updateScript = newScriptRunner(config.NodeUpdateScript, []string{config.Interface}, time.Duration(*config.NodeUpdateScriptInterval), time.Duration(*config.NodeUpdateScriptTimeout))
+		m.updateScript.Failures = m.scriptFailures
+		m.updateScriptErrors = m.updateScript.Errors()
+		goRecover(cleanup, func() { m.updateScript.Run(ctx) })
+	}
+
+	// Run the hook scripts from another worker, in order
+	if config.OnNodeJoin != "" || config.OnNodeLeave != "" || config.OnNodeUpdate != "" || config.OnRouteChange != "" {
+		m.hooks = newHookQueue([]string{config.Interface}, time.Duration(*config.NodeUpdateScriptTimeout))
+		m.hooks.Failures = m.scriptFailures
+		m.hookErrors = m.hooks.Errors()
+		goRecover(cleanup, func() { m.hooks.Run(ctx) })
+	}
+
+	// Prepare the control socket
+	controlServer := &control.Server{
+		Path:   config.controlSocket(),
+		Logger: log.New(logrus.StandardLogger().WriterLevel(logrus.DebugLevel), "", 0),
+	}
+	m.controlRequests = controlServer.Requests()
+	goRecover(cleanup, func() {
+		logrus.WithError(controlServer.ListenAndServe()).Error("could not serve control socket")
+	})
+
+	// Export the D-Bus interface, forwarding its calls like control requests
+	dbusRequests := make(chan *control.Request)
+	m.dbusRequests = dbusRequests
+	if config.DBus {
+		dbusService := &dbus.Service{
+			Name:    config.DBusName,
+			Handler: dbusHandler(dbusRequests),
+			Logger:  log.New(logrus.StandardLogger().WriterLevel(logrus.DebugLevel), "", 0),
+		}
+		goRecover(cleanup, func() {
+			logrus.WithError(dbusService.Serve()).Error("could not serve D-Bus interface")
+		})
 	}
 
 	// Join the cluster
 	cluster.Update(localNode)
+	cluster.UpdateDelay = time.Duration(*config.UpdateDelay)
+	cluster.NoState = config.NoStateCache
+	cluster.MaxStateNodes = config.StateMaxNodes
 	nodec := cluster.Members() // avoid deadlocks by starting before join
 	if err := backoff.RetryNotify(
-		func() error { return cluster.Join(config.Join) },
-		backoff.NewExponentialBackOff(),
+		func() error { return cluster.Join(config.joinHosts()) },
+		backoff.WithContext(backoff.NewExponentialBackOff(), ctx),
 		func(err error, dur time.Duration) {
 			logrus.WithError(err).Errorf("could not join cluster, retrying in %s", dur)
 		},
 	); err != nil {
+		if ctx.Err() != nil {
+			m.shutdown()
+			os.Exit(m.exitCode)
+		}
 		logrus.WithError(err).Fatal("could not join cluster")
 	}
 
-	routedNets := make([]*net.IPNet, len(config.RoutedNet))
-	for index, routedNetItem := range config.RoutedNet {
-		logrus.Debugf("adding network %s", routedNetItem)
-		routedNets[index] = (*net.IPNet)(routedNetItem)
+	m.run(ctx, nodec)
+	os.Exit(m.exitCode)
+}
+
+// handleKV handles the key/value store control commands, providing their result
+func handleKV(c *cluster.Cluster, command string, args []string) (interface{}, error) {
+	switch {
+	case command == "kv-list":
+		return c.KV(), nil
+	case command == "kv-get" && len(args) == 1:
+		value, ok := c.KV()[args[0]]
+		if !ok {
+			return nil, fmt.Errorf("key %q not found", args[0])
+		}
+		return value, nil
+	case command == "kv-set" && len(args) == 2:
+		return nil, c.SetKV(args[0], args[1])
+	case command == "kv-del" && len(args) == 1:
+		return nil, c.DeleteKV(args[0])
 	}
+	return nil, fmt.Errorf("invalid arguments %v for %q", args, command)
+}
 
-	// Main loop
-	routesc := common.Routes(routedNets)
-	incomingSigs := make(chan os.Signal, 1)
-	signal.Notify(incomingSigs, syscall.SIGTERM, os.Interrupt)
-	logrus.Debug("waiting for cluster events")
-	for {
-		select {
-		case rawNodes := <-nodec:
-			nodes := make([]common.Node, 0, len(rawNodes))
-			hosts := make(map[string][]string, len(rawNodes))
-			logrus.Info("cluster members:\n")
-			for _, node := range rawNodes {
-
-				if err := node.DecodeMeta(); err != nil {
-					logrus.Warnf("\t addr: %s, could not decode metadata", node.Addr)
-					continue
-				}
-				logrus.Infof("\taddr: %s, overlay: %s, pubkey: %s, net: %s, routes: %s", node.Addr, node.OverlayAddr, node.PubKey, node.Routes)
-				nodes = append(nodes, node)
-				hosts[node.OverlayAddr.IP.String()] = []string{node.Name}
-			}
-			if err := wgstate.SetUpInterface(nodes, routedNets); err != nil {
-				logrus.WithError(err).Error("could not up interface")
-				wgstate.DownInterface()
-			}
-			if !config.NoEtcHosts {
-				if err := hostsFile.WriteEntries(hosts); err != nil {
-					logrus.WithError(err).Error("could not write hosts entries")
-				}
-			}
-			if len(config.NodeUpdateScript) > 0 {
-				updateScript, _ := exec.LookPath(config.NodeUpdateScript)
-				cmd := &exec.Cmd{
-					Path:   updateScript,
-					Args:   []string{updateScript, config.Interface},
-					Stdout: os.Stdout,
-					Stderr: os.Stderr,
-				}
-				if err := cmd.Run(); err != nil {
-					logrus.Errorf("error while executing node-update-script %s: %s", config.NodeUpdateScript, err)
-				}
-			}
-		case routes := <-routesc:
-			logrus.Info("announcing new routes...")
-			localNode.Routes = routes
-			cluster.Update(localNode)
-		case <-rejoin:
-			logrus.Debug("rejoining missing join nodes...")
-			cluster.Join(config.Join)
-		case <-incomingSigs:
-			logrus.Info("terminating...")
-			cluster.Leave()
-			if !config.NoEtcHosts {
-				if err := hostsFile.WriteEntries(map[string][]string{}); err != nil {
-					logrus.WithError(err).Error("could not remove stale hosts entries")
-				}
-			}
-			if err := wgstate.DownInterface(); err != nil {
-				logrus.WithError(err).Error("could not down interface")
+// warnOverlayOverlaps loudly warns about local routes overlapping the overlay network, since they would silently
+// blackhole part of the mesh traffic
+func warnOverlayOverlaps(overlayNet *net.IPNet, iface string) {
+	overlaps, err := common.LocalOverlaps(overlayNet, iface)
+	if err != nil {
+		logrus.WithError(err).Warn("could not check overlay network for overlaps")
+		return
+	}
+	for _, overlap := range overlaps {
+		logrus.Warnf("local route %s overlaps overlay network %s; mesh traffic to it will likely be misrouted", &overlap, overlayNet)
+	}
+}
+
+// acceptedRoutedNets filters out routed networks overlapping the overlay network, which cannot be routed
+func acceptedRoutedNets(networks []*net.IPNet, overlayNet *net.IPNet) []*net.IPNet {
+	accepted := make([]*net.IPNet, 0, len(networks))
+	for _, network := range networks {
+		if common.Overlaps(overlayNet, network) {
+			logrus.Warnf("ignoring routed network %s overlapping overlay network %s", network, overlayNet)
+			continue
+		}
+		logrus.Debugf("adding network %s", network)
+		accepted = append(accepted, network)
+	}
+	return accepted
+}
+
+// acceptedPrefixes filters the prefixes announced by the node, keeping only those of the prefix length configured for
+// their secondary network, so nodes cannot claim other addresses; with strict allowed IPs, none are kept
+func acceptedPrefixes(node common.Node, secondaryNets []*subnet, strict bool) []net.IPNet {
+	accepted := make([]net.IPNet, 0, len(node.Prefixes))
+	for _, prefix := range node.Prefixes {
+		valid := false
+		for _, secondary := range secondaryNets {
+			ones, _ := prefix.Mask.Size()
+			valid = valid || (secondary.Contains(prefix.IP) && ones == secondary.PrefixLen)
+		}
+		switch {
+		case strict:
+			logrus.Debugf("\tignoring prefix %s of node %s, see --strict-allowed-ips", &prefix, node.Name)
+		case !valid:
+			logrus.Warnf("ignoring prefix %s of node %s outside of the secondary networks", &prefix, node.Name)
+		default:
+			accepted = append(accepted, prefix)
+		}
+	}
+	return accepted
+}
+
+// acceptedVIPs filters the virtual IPs the node is a candidate for, keeping only those inside the overlay network, so
+// nodes cannot attract traffic for other addresses; with strict allowed IPs, none are kept
+func acceptedVIPs(node common.Node, overlayNet *net.IPNet, strict bool) []net.IP {
+	accepted := make([]net.IP, 0, len(node.VIPCandidates))
+	for _, vip := range node.VIPCandidates {
+		switch {
+		case strict:
+			logrus.Debugf("\tignoring virtual IP %s of node %s, see --strict-allowed-ips", vip, node.Name)
+		case !overlayNet.Contains(vip):
+			logrus.Warnf("ignoring virtual IP %s of node %s outside of the overlay network", vip, node.Name)
+		default:
+			accepted = append(accepted, vip)
+		}
+	}
+	return accepted
+}
+
+// enableProxyARP enables proxy-ARP on the provided interface, making the kernel answer ARP requests for addresses
+// routed via other interfaces, like remote overlay addresses or routed networks overlapping the LAN
+// It provides a function restoring the previous setting.
+func enableProxyARP(iface string) (func(), error) {
+	name := fmt.Sprintf("net/ipv4/conf/%s/proxy_arp", iface)
+	previous, err := common.SetSysctl(name, "1")
+	if err != nil {
+		return nil, err
+	}
+	if forward, err := common.Sysctl("net/ipv4/ip_forward"); err == nil && forward != "1" {
+		logrus.Warn("proxy-ARP is enabled, but IPv4 forwarding is disabled; LAN hosts will not reach the mesh")
+	}
+	return func() {
+		if _, err := common.SetSysctl(name, previous); err != nil {
+			logrus.WithError(err).Error("could not restore proxy-ARP setting")
+		}
+	}, nil
+}
+
+// knownOverlayAddrs provides the overlay addresses of the persisted nodes other than the local one
+func knownOverlayAddrs(nodes []common.Node, localName string) []net.IP {
+	addrs := make([]net.IP, 0, len(nodes))
+	for _, node := range nodes {
+		if node.Name == localName || node.DecodeMeta() != nil {
+			continue
+		}
+		addrs = append(addrs, node.OverlayAddr.IP)
+	}
+	return addrs
+}
+
+// warnVersionSkew warns about nodes running wesher versions unable to decode the local node's metadata
+func warnVersionSkew(node common.Node) {
+	if node.MetaVersion() < common.MetaVersion {
+		nodeVersion := node.Version
+		if nodeVersion == "" {
+			nodeVersion = "unknown"
+		}
+		logrus.Warnf("node %s runs wesher version %s with metadata version %d, which cannot decode this node's metadata version %d; please upgrade it", node.Name, nodeVersion, node.MetaVersion(), common.MetaVersion)
+	}
+}
+
+// mergeHosts provides the union of both host name maps, by address
+func mergeHosts(a, b map[string][]string) map[string][]string {
+	merged := make(map[string][]string, len(a)+len(b))
+	for _, hosts := range []map[string][]string{a, b} {
+		for ip, names := range hosts {
+			merged[ip] = append(merged[ip], names...)
+		}
+	}
+	return merged
+}
+
+// dnsServices provides the services offered by the nodes, only including nodes with the labels of the selector like
+// their hosts entries
+func dnsServices(nodes []common.Node, selector map[string]string) []dns.Service {
+	services := make([]dns.Service, 0)
+	for _, node := range nodes {
+		if !common.MatchLabels(node.Labels, selector) {
+			continue
+		}
+		for _, service := range node.Services {
+			services = append(services, dns.Service{Name: service.Name, Proto: service.Proto, Target: node.Name, IP: node.OverlayAddr.IP, Port: service.Port})
+		}
+	}
+	return services
+}
+
+// dnsMetadata provides the metadata of the nodes by name, only including nodes with the labels of the selector like
+// their hosts entries
+func dnsMetadata(nodes []common.Node, selector map[string]string) map[string]map[string]string {
+	metadata := make(map[string]map[string]string, len(nodes))
+	for _, node := range nodes {
+		if common.MatchLabels(node.Labels, selector) && len(node.Metadata) > 0 {
+			metadata[node.Name] = node.Metadata
+		}
+	}
+	return metadata
+}
+
+// hostNames provides the names under which the node is added to the hosts file
+func hostNames(node common.Node) []string {
+	names := []string{node.Name}
+	for _, alias := range node.Aliases {
+		if !common.ValidHostname(alias) {
+			logrus.Warnf("ignoring invalid alias %q of node %s", alias, node.Name)
+			continue
+		}
+		names = append(names, alias)
+	}
+	return names
+}
+
+// routedHostNames provides the hosts behind the node's routed networks
+// Only hosts in networks actually routed to the node are accepted, to avoid nodes hijacking arbitrary names.
+func routedHostNames(node common.Node) map[string][]string {
+	result := make(map[string][]string, len(node.RoutedHosts))
+	for ip, names := range node.RoutedHosts {
+		parsed := net.ParseIP(ip)
+		routed := false
+		for _, route := range node.Routes {
+			routed = routed || (parsed != nil && route.Contains(parsed))
+		}
+		if !routed {
+			logrus.Warnf("ignoring routed host %s of node %s outside of its routed networks", ip, node.Name)
+			continue
+		}
+		for _, name := range names {
+			if !common.ValidHostname(name) {
+				logrus.Warnf("ignoring invalid routed host name %q of node %s", name, node.Name)
+				continue
 			}
-			os.Exit(0)
+			result[ip] = append(result[ip], name)
 		}
 	}
+	return result
 }
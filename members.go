@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+
+	"github.com/costela/wesher/common"
+	"github.com/pkg/errors"
+)
+
+// membersFile is the content of --members-file
+type membersFile struct {
+	Local   string        `json:"local"` // name of the node writing the file
+	Members []memberEntry `json:"members"`
+}
+
+// memberEntry describes a member in --members-file
+type memberEntry struct {
+	Name        string              `json:"name"`
+	Addr        string              `json:"addr"`
+	OverlayAddr string              `json:"overlay_addr"`
+	PubKey      string              `json:"pub_key"`
+	Prefixes    []string            `json:"prefixes"`
+	Routes      []string            `json:"routes"`
+	Aliases     []string            `json:"aliases"`
+	RoutedHosts map[string][]string `json:"routed_hosts"`
+	Labels      map[string]string   `json:"labels"`
+	Services    []string            `json:"services"`
+	Metadata    map[string]string   `json:"metadata"`
+	Version     string              `json:"version,omitempty"`
+}
+
+// newMembersFile describes the nodes, sorted by name
+func newMembersFile(localName string, nodes []common.Node) membersFile {
+	members := make([]memberEntry, 0, len(nodes))
+	for _, node := range nodes {
+		members = append(members, newMemberEntry(node))
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+	return membersFile{Local: localName, Members: members}
+}
+
+// newMemberEntry describes the node
+// Lists and maps are never null, sparing templates from checking for them.
+func newMemberEntry(node common.Node) memberEntry {
+	entry := memberEntry{
+		Name:        node.Name,
+		Addr:        node.Addr.String(),
+		OverlayAddr: node.OverlayAddr.IP.String(),
+		PubKey:      node.PubKey,
+		Prefixes:    networkStrings(node.Prefixes),
+		Routes:      networkStrings(node.Routes),
+		Aliases:     append([]string{}, node.Aliases...),
+		RoutedHosts: node.RoutedHosts,
+		Labels:      node.Labels,
+		Services:    make([]string, 0, len(node.Services)),
+		Metadata:    node.Metadata,
+		Version:     node.Version,
+	}
+	if entry.RoutedHosts == nil {
+		entry.RoutedHosts = map[string][]string{}
+	}
+	if entry.Labels == nil {
+		entry.Labels = map[string]string{}
+	}
+	if entry.Metadata == nil {
+		entry.Metadata = map[string]string{}
+	}
+	for _, service := range node.Services {
+		entry.Services = append(entry.Services, service.String())
+	}
+	return entry
+}
+
+// writeMembersFile atomically replaces the members file with the nodes, unless its content is unchanged, so tools
+// watching it only react to actual changes
+func writeMembersFile(filePath, localName string, nodes []common.Node) error {
+	content, err := json.MarshalIndent(newMembersFile(localName, nodes), "", "  ")
+	if err != nil {
+		return err
+	}
+	content = append(content, '\n')
+	if existing, err := ioutil.ReadFile(filePath); err == nil && bytes.Equal(existing, content) {
+		return nil
+	}
+	return errors.Wrap(common.WriteFileAtomic(filePath, content, 0644), "could not write members file")
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/costela/wesher/common"
+)
+
+func Test_writeMembersFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wesher-members")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filePath := path.Join(dir, "members.json")
+
+	node1 := common.Node{Name: "node1", Addr: net.ParseIP("192.0.2.1")}
+	node1.OverlayAddr = net.IPNet{IP: net.ParseIP("10.0.0.1"), Mask: net.CIDRMask(32, 32)}
+	node1.Routes = []net.IPNet{{IP: net.ParseIP("192.168.1.0"), Mask: net.CIDRMask(24, 32)}}
+	node1.Labels = map[string]string{"env": "prod"}
+	node1.Services = []common.Service{{Name: "web", Port: 8080, Proto: common.ProtoTCP}}
+	node2 := common.Node{Name: "node2", Addr: net.ParseIP("192.0.2.2")}
+	node2.OverlayAddr = net.IPNet{IP: net.ParseIP("10.0.0.2"), Mask: net.CIDRMask(32, 32)}
+
+	if err := writeMembersFile(filePath, "node1", []common.Node{node2, node1}); err != nil {
+		t.Fatal(err)
+	}
+	want := `{
+  "local": "node1",
+  "members": [
+    {
+      "name": "node1",
+      "addr": "192.0.2.1",
+      "overlay_addr": "10.0.0.1",
+      "pub_key": "",
+      "prefixes": [],
+      "routes": [
+        "192.168.1.0/24"
+      ],
+      "aliases": [],
+      "routed_hosts": {},
+      "labels": {
+        "env": "prod"
+      },
+      "services": [
+        "web=8080/tcp"
+      ],
+      "metadata": {}
+    },
+    {
+      "name": "node2",
+      "addr": "192.0.2.2",
+      "overlay_addr": "10.0.0.2",
+      "pub_key": "",
+      "prefixes": [],
+      "routes": [],
+      "aliases": [],
+      "routed_hosts": {},
+      "labels": {},
+      "services": [],
+      "metadata": {}
+    }
+  ]
+}
+`
+	if got, _ := ioutil.ReadFile(filePath); string(got) != want {
+		t.Errorf("writeMembersFile() wrote %s, want %s", got, want)
+	}
+
+	past := time.Now().Add(-time.Hour)
+	os.Chtimes(filePath, past, past)
+	if err := writeMembersFile(filePath, "node1", []common.Node{node1, node2}); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(filePath); !info.ModTime().Equal(past) {
+		t.Errorf("writeMembersFile() replaced the file although its content did not change")
+	}
+}
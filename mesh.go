@@ -0,0 +1,944 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/costela/wesher/cluster"
+	"github.com/costela/wesher/common"
+	"github.com/costela/wesher/control"
+	"github.com/costela/wesher/dns"
+	"github.com/costela/wesher/etchosts"
+	"github.com/costela/wesher/wg"
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// mesh follows the cluster members and applies them to the wireguard interface, the hosts entries and the other
+// outputs, from a single main loop
+// Optional outputs and inputs are left nil when not configured.
+type mesh struct {
+	config    *config
+	cluster   *cluster.Cluster
+	wgstate   *wg.State
+	localNode *common.Node
+	strategy  wg.AddressStrategy
+	hostsFile *etchosts.EtcHosts
+	eventLog  *common.EventLog
+	counters  failureCounters
+
+	hostsSelector   map[string]string
+	overlayReserved []*net.IPNet
+	overlayIPv6     bool
+
+	// optional outputs
+	dnsServer       *dns.Server
+	nftSet          *common.NftSet
+	ndpProxy        *common.NDPProxy
+	firewalldZone   *common.FirewalldZone
+	dscpMarking     *common.DSCPMarking
+	blackholes      *common.Blackholes
+	quarantine      *common.Quarantine
+	partition       *common.Partition
+	updateScript    *scriptRunner
+	hooks           *hookQueue
+	scriptFailures  *scriptFailures
+	restoreProxyARP func()
+	restoreNDPProxy func()
+
+	// routes announced by the local node, by source
+	routedNets        []*net.IPNet
+	staticRoutedNets  []*net.IPNet
+	staticRoutedHosts map[string][]string
+	discoveredRoutes  []net.IPNet
+	manualRoutes      []net.IPNet
+	externalRoutes    []net.IPNet
+	federatedRoutes   []net.IPNet
+
+	// inputs of the main loop besides the cluster members
+	routesc            <-chan []net.IPNet
+	routesFilterc      chan<- []*net.IPNet
+	routedNetFilec     <-chan []*net.IPNet
+	federationc        <-chan common.Federation
+	controlRequests    <-chan *control.Request
+	dbusRequests       <-chan *control.Request
+	updateScriptErrors <-chan error
+	hookErrors         <-chan error
+
+	// state of the main loop
+	members        []common.Node
+	memberHosts    map[string][]string
+	leader         string
+	leading        int32             // 1 while the local node is the leader; read atomically by the metrics
+	vipOwners      map[string]string // owner of each virtual IP, by address
+	routeConflicts []string          // routed networks announced by more than one node, for the status output
+	conflicts      *nameConflicts    // name conflicts of the local node, for the status output
+	reservedWarned map[string]bool   // nodes already warned about using reserved addresses
+	// quorate is set once enough members are known to configure the interface, see --min-members
+	quorate bool
+	// disconnected is set while the mesh is torn down locally on request, while still following the cluster
+	disconnected bool
+	// failed interface configurations are retried with exponential backoff, until one succeeds; see --error-policy
+	interfaceBackoff *backoff.ExponentialBackOff
+	interfaceRetry   <-chan time.Time
+	retryNodes       []common.Node // nodes of the failed interface configuration
+	quarantineEnd    <-chan time.Time
+	handshakeSeen    map[wgtypes.Key]time.Time // peers checked for failed handshakes, by the time first seen
+	blackholesEnd    <-chan time.Time
+	healthResults    chan error
+	healthRunning    bool
+
+	cancel   context.CancelFunc // stops the main loop
+	cleanup  func()             // cleans up on panics of goroutines started by the main loop, see recoverCrash
+	exitCode int                // set on failures the service manager should restart on
+}
+
+// newMesh prepares the main loop for the local node, without any optional inputs or outputs
+func newMesh(config *config, cluster *cluster.Cluster, wgstate *wg.State, localNode *common.Node, hostsFile *etchosts.EtcHosts) *mesh {
+	interfaceBackoff := backoff.NewExponentialBackOff()
+	interfaceBackoff.MaxElapsedTime = 0 // never give up
+	m := &mesh{
+		config:           config,
+		cluster:          cluster,
+		wgstate:          wgstate,
+		localNode:        localNode,
+		hostsFile:        hostsFile,
+		overlayReserved:  config.overlayReserved(),
+		overlayIPv6:      localNode.OverlayAddr.IP.To4() == nil,
+		scriptFailures:   newScriptFailures(),
+		restoreProxyARP:  func() {},
+		restoreNDPProxy:  func() {},
+		cleanup:          func() {},
+		vipOwners:        map[string]string{},
+		routeConflicts:   []string{},
+		conflicts:        &nameConflicts{},
+		reservedWarned:   make(map[string]bool),
+		handshakeSeen:    make(map[wgtypes.Key]time.Time),
+		quorate:          config.MinMembers <= 1,
+		interfaceBackoff: interfaceBackoff,
+		healthResults:    make(chan error, 1),
+	}
+	m.hostsSelector, _ = common.ParseLabels(config.HostsLabels) // validated in loadConfig
+	return m
+}
+
+// run is the main loop, handling the cluster members provided by nodec and all other inputs until ctx is done
+func (m *mesh) run(ctx context.Context, nodec <-chan []common.Node) {
+	config := m.config
+
+	// Prepare the rejoin timer
+	rejoin := make(<-chan time.Time)
+	if *config.Rejoin > 0 {
+		rejoin = time.Tick(time.Duration(*config.Rejoin))
+	}
+
+	// Detect resuming from suspend, see --resume-check-interval
+	resumec := make(<-chan time.Duration)
+	if *config.ResumeCheckInterval > 0 {
+		resumec = common.Resumes(time.Duration(*config.ResumeCheckInterval))
+	}
+
+	advertisec := make(<-chan string)
+	if config.AdvertiseIface != "" {
+		advertisec = common.InterfaceAddrs(config.AdvertiseIface, config.AdvertiseAddr)
+	} else if config.AdvertiseAddrCmd != "" {
+		advertisec = common.CommandAddrs(config.AdvertiseAddrCmd, config.AdvertiseAddr, time.Duration(*config.AdvertiseAddrCmdInterval))
+	}
+
+	// Periodically repair drift of the wireguard state, see --reconcile-interval
+	driftc := make(<-chan time.Time)
+	if *config.ReconcileInterval > 0 {
+		driftc = time.Tick(time.Duration(*config.ReconcileInterval))
+	}
+	// and right away when the interface is changed externally
+	interfacec := make(<-chan []string)
+	if config.Backend == wg.BackendKernel {
+		interfacec = wg.WatchInterface(config.Interface, config.BindDevice)
+	}
+
+	// Run the health script periodically
+	healthc := make(<-chan time.Time)
+	if config.HealthScript != "" {
+		healthc = time.Tick(time.Duration(*config.HealthInterval))
+	}
+
+	// Check the endpoints peers roamed to periodically
+	roamingc := time.Tick(roamingInterval)
+
+	// Quarantine nodes failing handshakes, see --quarantine-flaps
+	handshakec := make(<-chan time.Time)
+	if m.quarantine != nil {
+		handshakec = time.Tick(handshakeCheckInterval)
+	}
+
+	// Handle debugging and resync signals
+	resyncSigs := make(chan os.Signal, 1)
+	signal.Notify(resyncSigs, syscall.SIGUSR2)
+	defer signal.Stop(resyncSigs)
+	dumpSigs := make(chan os.Signal, 1)
+	signal.Notify(dumpSigs, syscall.SIGUSR1)
+	defer signal.Stop(dumpSigs)
+	logrus.Debug("waiting for cluster events")
+	for {
+		select {
+		case rawNodes := <-nodec:
+			m.membersChanged(ctx, rawNodes)
+		case routes := <-m.routesc:
+			warnOverlayOverlaps((*net.IPNet)(config.OverlayNet), config.Interface)
+			logrus.Info("announcing new routes...")
+			m.discoveredRoutes = routes
+			m.localNode.Routes = m.announcedRoutes()
+			m.cluster.Update(m.localNode)
+			writeEvent(m.eventLog, event{Time: time.Now(), Type: "routes", Routes: networkStrings(m.localNode.Routes)})
+			m.exportFederation()
+		case f := <-m.federationc:
+			logrus.Info("federated mesh changed, announcing its networks...")
+			m.importFederation(f)
+			m.localNode.Routes = m.announcedRoutes()
+			m.cluster.Update(m.localNode)
+			writeEvent(m.eventLog, event{Time: time.Now(), Type: "routes", Routes: networkStrings(m.localNode.Routes)})
+		case fileNets := <-m.routedNetFilec:
+			logrus.Info("routed networks file changed, re-announcing routes...")
+			m.routedNets = append(append([]*net.IPNet{}, m.staticRoutedNets...), acceptedRoutedNets(fileNets, (*net.IPNet)(config.OverlayNet))...)
+			m.routesFilterc <- m.routedNets
+		case addr := <-advertisec:
+			logrus.Infof("advertise address changed to %s, rejoining...", addr)
+			if err := m.cluster.SetAdvertiseAddr(addr, time.Duration(*config.LeaveTimeout)); err != nil {
+				logrus.WithError(err).Error("could not advertise new address")
+			}
+		case conflict := <-m.cluster.Conflicts():
+			m.nameConflict(conflict)
+		case <-rejoin:
+			logrus.Debug("rejoining missing join nodes...")
+			m.cluster.Join(config.joinHosts())
+		case suspended := <-resumec:
+			logrus.Infof("resumed after %s of suspend, reconnecting...", suspended.Round(time.Second))
+			if m.disconnected {
+				break
+			}
+			if err := m.wgstate.ResolveExternalEndpoints(); err != nil {
+				logrus.WithError(err).Warn("could not resolve external peers again")
+			}
+			if err := m.cluster.Join(config.joinHosts()); err != nil {
+				logrus.WithError(err).Warn("could not rejoin the cluster")
+			}
+			m.wgstate.Resume()
+			ev := event{Time: time.Now(), Type: "resume", PeersAfter: nodeNames(m.members)}
+			writeEvent(m.eventLog, ev.done(m.reconcile(ev, m.members, m.memberHosts)))
+			if err := m.wgstate.InitiateHandshakes(m.members); err != nil {
+				logrus.WithError(err).Warn("could not initiate handshakes")
+			}
+		case req := <-m.controlRequests:
+			m.handleRequest(req)
+		case req := <-m.dbusRequests:
+			m.handleRequest(req)
+		case <-resyncSigs:
+			m.resync()
+		case <-m.blackholesEnd:
+			if err := m.blackholes.Expire(time.Now()); err != nil {
+				logrus.WithError(err).Error("could not remove expired unreachable routes")
+			}
+			if next := m.blackholes.Next(); !next.IsZero() {
+				m.blackholesEnd = time.After(time.Until(next))
+			}
+		case <-m.interfaceRetry:
+			if m.disconnected {
+				break
+			}
+			logrus.Info("retrying interface configuration...")
+			ev := event{Time: time.Now(), Type: "retry", PeersAfter: nodeNames(m.members)}
+			failures := []string{}
+			if err := m.setUpInterface(m.retryNodes); err != nil {
+				m.counters.reconfiguration.Inc()
+				logrus.WithError(err).Error("could not up interface")
+				failures = append(failures, fmt.Sprintf("could not up interface: %s", err))
+			}
+			writeEvent(m.eventLog, ev.done(failures))
+		case <-driftc:
+			m.repairDrift()
+		case changes := <-interfacec:
+			logrus.Debugf("interface changed: %s", strings.Join(changes, "; "))
+			m.repairDrift()
+		case <-m.quarantineEnd:
+			if m.disconnected {
+				break
+			}
+			logrus.Info("quarantine ended, re-applying members...")
+			ev := event{Time: time.Now(), Type: "quarantine", PeersAfter: nodeNames(m.members)}
+			writeEvent(m.eventLog, ev.done(m.reconcile(ev, m.members, m.memberHosts)))
+		case <-roamingc:
+			if m.disconnected {
+				break
+			}
+			observed, err := m.wgstate.UpdateRoaming(m.members, time.Now())
+			if err != nil {
+				logrus.WithError(err).Warn("could not update roamed endpoints")
+				break
+			}
+			if config.GossipRoaming && !sameEndpoints(observed, m.localNode.Roamed) {
+				logrus.Infof("announcing %d endpoints peers roamed to...", len(observed))
+				m.localNode.Roamed = observed
+				m.cluster.Update(m.localNode)
+			}
+		case <-handshakec:
+			m.checkHandshakes(time.Now())
+		case <-healthc:
+			if m.healthRunning {
+				logrus.Warn("health script still running, skipping health check")
+				break
+			}
+			peers, err := m.wgstate.Peers()
+			if err != nil && !m.disconnected {
+				logrus.WithError(err).Warn("could not get wireguard peers for health check")
+			}
+			summary := newHealthSummary(m.cluster.LocalName(), m.members, peers, time.Now())
+			summary.Connected = !m.disconnected
+			summary.ScriptFailures = m.scriptFailures.Consecutive()
+			if m.partition != nil {
+				summary.Partitioned, _, _ = m.partition.Partitioned()
+			}
+			m.healthRunning = true
+			goRecover(m.cleanup, func() {
+				m.healthResults <- runHealthScript(ctx, config.HealthScript, summary, time.Duration(*config.HealthInterval))
+			})
+		case err := <-m.updateScriptErrors:
+			m.counters.updateScript.Inc()
+			logrus.WithError(err).Error("error while executing node-update-script")
+			writeEvent(m.eventLog, event{Time: time.Now(), Type: "update-script", Failures: []string{err.Error()}})
+			if config.ErrorPolicy == errorPolicyFailFast && m.scriptFailures.Max(config.NodeUpdateScript) >= config.ScriptFailureLimit {
+				logrus.Error("shutting down after node-update-script failures, see --error-policy")
+				m.exitCode = 1
+				m.cancel()
+			}
+		case err := <-m.hookErrors:
+			m.counters.hookScript.Inc()
+			logrus.WithError(err).Error("error while executing hook script")
+			writeEvent(m.eventLog, event{Time: time.Now(), Type: "hook-script", Failures: []string{err.Error()}})
+			if config.ErrorPolicy == errorPolicyFailFast && m.scriptFailures.Max(config.hooks().paths()...) >= config.ScriptFailureLimit {
+				logrus.Error("shutting down after hook script failures, see --error-policy")
+				m.exitCode = 1
+				m.cancel()
+			}
+		case err := <-m.healthResults:
+			m.healthRunning = false
+			if err == nil {
+				break
+			}
+			logrus.WithError(err).Errorf("health check failed, action: %s", config.HealthFailureAction)
+			writeEvent(m.eventLog, event{Time: time.Now(), Type: "health", Failures: []string{err.Error()}})
+			switch config.HealthFailureAction {
+			case healthActionResync:
+				m.resync()
+			case healthActionExit:
+				m.exitCode = 1
+				m.cancel()
+			}
+		case <-dumpSigs:
+			m.dump()
+		case <-ctx.Done():
+			m.shutdown()
+			return
+		}
+	}
+}
+
+// membersChanged applies the current cluster members
+func (m *mesh) membersChanged(ctx context.Context, rawNodes []common.Node) {
+	config := m.config
+	nodes := make([]common.Node, 0, len(rawNodes))
+	hosts := make(map[string][]string, len(rawNodes))
+	logrus.Info("cluster members:\n")
+	for _, node := range rawNodes {
+
+		if err := node.DecodeMeta(); err != nil {
+			if errors.Is(err, common.ErrUnsupportedMetaVersion) {
+				logrus.Warnf("\taddr: %s, uses metadata version %d, which this node (version %s, metadata version %d) cannot decode; please upgrade", node.Addr, node.MetaVersion(), version, common.MetaVersion)
+			} else {
+				logrus.WithError(err).Warnf("\taddr: %s, could not decode metadata", node.Addr)
+			}
+			continue
+		}
+		warnVersionSkew(node)
+		if config.StrictAllowedIPs && (len(node.Routes) > 0 || len(node.RoutedHosts) > 0) {
+			logrus.Debugf("\tignoring routes %s and routed hosts of node %s, see --strict-allowed-ips", node.Routes, node.Name)
+			node.Routes, node.RoutedHosts = nil, nil
+		}
+		node.Prefixes = acceptedPrefixes(node, config.SecondaryNets, config.StrictAllowedIPs)
+		node.VIPCandidates = acceptedVIPs(node, (*net.IPNet)(config.OverlayNet), config.StrictAllowedIPs)
+		if r := wg.ReservedRange(m.overlayReserved, node.OverlayAddr.IP); r != nil && !m.reservedWarned[node.Name] {
+			logrus.Warnf("node %s uses overlay address %s of reserved range %s; this is only expected for static assignments", node.Name, node.OverlayAddr.IP, r)
+			m.reservedWarned[node.Name] = true
+		}
+		logrus.Infof("\taddr: %s, overlay: %s, prefixes: %s, pubkey: %s, routes: %s, version: %s", node.Addr, node.OverlayAddr, node.Prefixes, node.PubKey, node.Routes, node.Version)
+		nodes = append(nodes, node)
+		if !common.MatchLabels(node.Labels, m.hostsSelector) {
+			continue // still part of the mesh, only hidden from the hosts entries
+		}
+		hosts[node.OverlayAddr.IP.String()] = hostNames(node)
+		for ip, names := range routedHostNames(node) {
+			hosts[ip] = append(hosts[ip], names...)
+		}
+	}
+	previousMembers := m.members
+	m.members, m.memberHosts = nodes, hosts
+	if m.quarantine != nil {
+		m.quarantine.Observe(previousMembers, nodes, time.Now())
+	}
+	if m.partition != nil {
+		expected := config.ExpectedMembers
+		if expected == 0 {
+			expected = m.cluster.RecentNodes(time.Duration(*config.PartitionWindow), time.Now()) + 1
+		}
+		if m.partition.Observe(len(nodes)+1, expected) {
+			m.partitionChanged(ctx)
+		}
+	}
+	if config.PrometheusSDFile != "" {
+		if err := writePromTargets(config.PrometheusSDFile, append([]common.Node{*m.localNode}, nodes...), config.PrometheusSDPort); err != nil {
+			logrus.WithError(err).Error("could not update Prometheus targets")
+		}
+	}
+	if config.InventoryFile != "" {
+		if err := writeAnsibleInventory(config.InventoryFile, append([]common.Node{*m.localNode}, nodes...)); err != nil {
+			logrus.WithError(err).Error("could not update Ansible inventory")
+		}
+	}
+	if config.MembersFile != "" {
+		if err := writeMembersFile(config.MembersFile, m.localNode.Name, append([]common.Node{*m.localNode}, nodes...)); err != nil {
+			logrus.WithError(err).Error("could not update members file")
+		}
+	}
+	if err := writeSSHFiles(config.SSHConfigFile, config.SSHKnownHostsFile, append([]common.Node{*m.localNode}, nodes...)); err != nil {
+		logrus.WithError(err).Error("could not update SSH files")
+	}
+	if m.disconnected {
+		logrus.Debug("disconnected, not applying membership changes")
+		return
+	}
+	if m.blackholes != nil {
+		if err := m.blackholes.Update(previousMembers, nodes, time.Now()); err != nil {
+			logrus.WithError(err).Error("could not update unreachable routes of departed nodes")
+		}
+		if next := m.blackholes.Next(); !next.IsZero() {
+			logrus.Debugf("routing %s as unreachable", m.blackholes.Networks())
+			m.blackholesEnd = time.After(time.Until(next))
+		}
+	}
+	if _, err := m.wgstate.UpdateRoaming(nodes, time.Now()); err != nil {
+		logrus.WithError(err).Debug("could not update roamed endpoints")
+	}
+	ev := membershipEvent(previousMembers, nodes)
+	failures := m.reconcile(ev, nodes, hosts)
+	writeEvent(m.eventLog, ev.done(failures))
+	if m.hooks != nil {
+		m.hooks.Submit(hookRuns(config.hooks(), ev, previousMembers, nodes)...)
+	}
+	m.exportFederation()
+	if config.GossipOverOverlay && m.quorate && len(failures) == 0 {
+		// the mesh is up, so gossip can follow it; nodes keep advertising their underlay address
+		overlayAddrs := make(map[string]net.IP, len(nodes))
+		for _, node := range nodes {
+			overlayAddrs[node.Addr.String()] = node.OverlayAddr.IP
+		}
+		m.cluster.SetOverlayAddrs(overlayAddrs)
+	}
+	if config.FlushConntrack {
+		withdrawn := common.WithdrawnNetworks(previousMembers, nodes)
+		if flushed, err := common.FlushConntrack(withdrawn); err != nil {
+			logrus.WithError(err).Error("could not flush conntrack entries of withdrawn networks")
+		} else if flushed > 0 {
+			logrus.Infof("flushed %d conntrack entries of withdrawn networks %s", flushed, withdrawn)
+		}
+	}
+}
+
+// reconcile applies the desired state for the provided members to the wireguard interface and hosts entries
+// It provides the failures, which are logged already.
+// The event causing it is passed on to the node update script.
+func (m *mesh) reconcile(ev event, nodes []common.Node, hosts map[string][]string) []string {
+	config := m.config
+	if !m.quorate {
+		if known := len(nodes) + 1; known < config.MinMembers {
+			logrus.Infof("waiting for %d members before configuring the interface, %d known", config.MinMembers, known)
+			return nil
+		}
+		logrus.Infof("%d members known, configuring the interface", len(nodes)+1)
+		m.quorate = true
+	}
+	failures := []string{}
+	fail := func(err error, msg string) {
+		m.counters.reconfiguration.Inc()
+		logrus.WithError(err).Error(msg)
+		failures = append(failures, fmt.Sprintf("%s: %s", msg, err))
+	}
+	if m.quarantine != nil {
+		now := time.Now()
+		var excluded []string
+		if nodes, excluded = m.quarantine.Filter(nodes, now); len(excluded) > 0 {
+			logrus.Warnf("excluding flapping nodes %s from the wireguard configuration", excluded)
+		}
+		if next := m.quarantine.Next(now); !next.IsZero() {
+			m.quarantineEnd = time.After(next.Sub(now))
+		}
+	}
+	if newLeader := common.Leader(m.cluster.LocalName(), nodes); newLeader != m.leader {
+		logrus.Infof("mesh leader is now %s", newLeader)
+		m.leader = newLeader
+	}
+	leading := int32(0)
+	if m.leader == m.cluster.LocalName() {
+		leading = 1
+	}
+	atomic.StoreInt32(&m.leading, leading)
+	owners := common.VIPOwners(m.cluster.LocalName(), m.localNode.VIPCandidates, nodes)
+	for vip, owner := range owners {
+		if m.vipOwners[vip] != owner {
+			logrus.Infof("virtual IP %s is now owned by %s", vip, owner)
+		}
+	}
+	m.vipOwners = owners
+	for i := range nodes {
+		nodes[i].VIPs = common.OwnedVIPs(nodes[i].Name, owners)
+	}
+	m.wgstate.VIPs = common.OwnedVIPs(m.cluster.LocalName(), owners)
+	m.routeConflicts = []string{}
+	for _, conflict := range common.ResolveRouteConflicts(nodes) {
+		logrus.Warnf("routed network conflict: %s", conflict)
+		m.routeConflicts = append(m.routeConflicts, conflict.String())
+	}
+	if err := m.setUpInterface(nodes); err != nil {
+		fail(err, "could not up interface")
+	}
+	if m.nftSet != nil {
+		ips := []net.IP{m.localNode.OverlayAddr.IP}
+		for _, node := range nodes {
+			ips = append(ips, node.OverlayAddr.IP)
+		}
+		if err := m.nftSet.Update(ips, m.overlayIPv6); err != nil {
+			fail(err, "could not update nftables set")
+		}
+	}
+	if m.ndpProxy != nil {
+		if err := m.ndpProxy.SetNodes(nodes); err != nil {
+			fail(err, "could not update NDP proxy entries")
+		}
+	}
+	if m.dnsServer != nil {
+		dnsEntries := map[string][]string{m.localNode.OverlayAddr.IP.String(): hostNames(*m.localNode)}
+		for ip, names := range hosts {
+			dnsEntries[ip] = names
+		}
+		m.dnsServer.SetEntries(dnsEntries)
+		m.dnsServer.SetServices(dnsServices(append([]common.Node{*m.localNode}, nodes...), m.hostsSelector))
+		m.dnsServer.SetMetadata(dnsMetadata(append([]common.Node{*m.localNode}, nodes...), m.hostsSelector))
+	}
+	if !config.NoEtcHosts {
+		if err := m.hostsFile.WriteEntries(hosts); err != nil {
+			m.counters.hostsWrite.Inc()
+			fail(err, "could not write hosts entries")
+		}
+	}
+	if m.updateScript != nil {
+		input, err := json.Marshal(newMembersFile(m.cluster.LocalName(), append([]common.Node{*m.localNode}, nodes...)))
+		if err != nil {
+			logrus.WithError(err).Error("could not encode members for node-update-script")
+		}
+		m.updateScript.Submit(scriptRun{
+			Env: []string{
+				"WESHER_LEADER=" + m.leader,
+				fmt.Sprintf("WESHER_IS_LEADER=%t", m.leader == m.cluster.LocalName()),
+				"WESHER_EVENT_TYPE=" + ev.scriptType(),
+				"WESHER_CHANGED_NODE=" + strings.Join(ev.changed(), " "),
+				fmt.Sprintf("WESHER_MEMBER_COUNT=%d", len(nodes)+1),
+				"WESHER_OVERLAY_ADDR=" + m.localNode.OverlayAddr.IP.String(),
+			},
+			Stdin: input,
+		})
+	}
+	if len(failures) > 0 && config.ErrorPolicy == errorPolicyFailFast {
+		logrus.Errorf("shutting down after %d failures, see --error-policy", len(failures))
+		m.exitCode = 1
+		m.cancel()
+	}
+	return failures
+}
+
+// setUpInterface configures the wireguard interface for the nodes
+// If it fails, the interface is removed and, unless failing fast, only its configuration is retried with backoff.
+func (m *mesh) setUpInterface(nodes []common.Node) error {
+	if err := m.wgstate.SetUpInterface(nodes, m.routedNets); err != nil {
+		m.wgstate.DownInterface()
+		if m.config.ErrorPolicy != errorPolicyFailFast {
+			retry := m.interfaceBackoff.NextBackOff()
+			logrus.Infof("retrying interface configuration in %s", retry)
+			m.interfaceRetry, m.retryNodes = time.After(retry), nodes
+		}
+		return err
+	}
+	m.interfaceBackoff.Reset()
+	m.interfaceRetry, m.retryNodes = make(<-chan time.Time), nil
+	return nil
+}
+
+// announcedRoutes provides the routes announced by the local node
+func (m *mesh) announcedRoutes() []net.IPNet {
+	return common.AggregateNetworks(append(append(append(append([]net.IPNet{}, m.discoveredRoutes...), m.manualRoutes...), m.externalRoutes...), m.federatedRoutes...))
+}
+
+// importFederation imports the networks and host names of a federated mesh, shared by its instance on this gateway
+// host
+func (m *mesh) importFederation(f common.Federation) {
+	m.federatedRoutes = f.Routes((*net.IPNet)(m.config.OverlayNet))
+	m.localNode.RoutedHosts = mergeHosts(m.staticRoutedHosts, f.Hosts)
+}
+
+// exportFederation shares the networks and selected host names of the mesh with the instance of a federated mesh
+func (m *mesh) exportFederation() {
+	if m.config.FederationExport == "" {
+		return
+	}
+	routes := append(append(append([]net.IPNet{}, m.discoveredRoutes...), m.manualRoutes...), m.externalRoutes...)
+	hosts := mergeHosts(m.staticRoutedHosts, m.memberHosts)
+	hosts[m.localNode.OverlayAddr.IP.String()] = append(hosts[m.localNode.OverlayAddr.IP.String()], hostNames(*m.localNode)...)
+	for _, node := range m.members {
+		routes = append(routes, node.Routes...)
+	}
+	f := common.NewFederation((*net.IPNet)(m.config.OverlayNet), routes, hosts, m.config.FederationHosts)
+	if err := common.WriteFederationFile(m.config.FederationExport, f); err != nil {
+		logrus.WithError(err).Error("could not export mesh to the federated mesh")
+	}
+}
+
+// handleRequest answers runtime commands, received over the control socket or D-Bus
+func (m *mesh) handleRequest(req *control.Request) {
+	config := m.config
+	switch req.Command {
+	case "status":
+		pushPull, gossipNodes := m.cluster.RecommendedGossip()
+		convergence := m.cluster.Convergence()
+		partitioned := false
+		if m.partition != nil {
+			partitioned, _, _ = m.partition.Partitioned()
+		}
+		req.Reply(statusResult{
+			Name:           m.cluster.LocalName(),
+			Version:        version,
+			Members:        len(m.members) + 1, // including the local node
+			Leader:         m.leader,
+			IsLeader:       m.leader == m.cluster.LocalName(),
+			VIPs:           m.vipOwners,
+			Connected:      !m.disconnected,
+			Conflicts:      m.conflicts.list(),
+			RouteConflicts: m.routeConflicts,
+			Waiting:        !m.quorate,
+			Partitioned:    partitioned,
+			KeyMismatches:  keyMismatchNames(m.cluster.KeyMismatches()),
+			Gossip: gossipStatus{
+				PushPullInterval:            time.Duration(*config.PushPullInterval).String(),
+				GossipNodes:                 config.GossipNodes,
+				RecommendedPushPullInterval: pushPull.String(),
+				RecommendedGossipNodes:      gossipNodes,
+			},
+			Convergence: newConvergenceStatus(convergence, time.Now()),
+			Nodes:       newNodeFacts(append([]common.Node{*m.localNode}, m.members...)),
+		}, nil)
+	case "peers":
+		req.Reply(nodeNames(m.members), nil)
+	case "disconnect":
+		if m.disconnected {
+			req.Reply(nil, nil)
+			break
+		}
+		logrus.Info("disconnecting from the mesh on request...")
+		m.disconnected = true
+		m.cluster.SetOverlayAddrs(nil) // gossip falls back to the underlay while the mesh is down
+		failures := []string{}
+		if err := m.wgstate.DownInterface(); err != nil {
+			logrus.WithError(err).Error("could not down interface")
+			failures = append(failures, fmt.Sprintf("could not down interface: %s", err))
+		}
+		if !config.NoEtcHosts {
+			if err := m.hostsFile.WriteEntries(map[string][]string{}); err != nil {
+				m.counters.hostsWrite.Inc()
+				logrus.WithError(err).Error("could not remove hosts entries")
+				failures = append(failures, fmt.Sprintf("could not remove hosts entries: %s", err))
+			}
+		}
+		ev := event{Time: time.Now(), Type: "disconnect", PeersBefore: nodeNames(m.members)}
+		writeEvent(m.eventLog, ev.done(failures))
+		req.Reply(nil, nil)
+	case "connect":
+		if !m.disconnected {
+			req.Reply(nil, nil)
+			break
+		}
+		logrus.Info("reconnecting to the mesh on request...")
+		m.disconnected = false
+		if err := m.cluster.Join(config.joinHosts()); err != nil {
+			logrus.WithError(err).Warn("could not rejoin cluster; using the current members")
+		}
+		ev := event{Time: time.Now(), Type: "connect", PeersAfter: nodeNames(m.members)}
+		writeEvent(m.eventLog, ev.done(m.reconcile(ev, m.members, m.memberHosts)))
+		req.Reply(nil, nil)
+	case "resync":
+		m.resync()
+		req.Reply(nil, nil)
+	case "export":
+		peers, err := m.wgstate.Peers()
+		if err != nil {
+			req.Reply(nil, err)
+			break
+		}
+		req.Reply(newExportResult(m.cluster.LocalName(), config.Interface, m.wgstate, peers, m.members), nil)
+	case "inventory":
+		req.Reply(newInventoryHosts(append([]common.Node{*m.localNode}, m.members...)), nil)
+	case "rotate-cluster-key":
+		logrus.Info("rotating cluster key on request...")
+		goRecover(m.cleanup, func() { // waits for the acknowledgements of all members
+			key, switched, err := m.cluster.RotateKey(keyRotationTimeout)
+			if err != nil {
+				logrus.WithError(err).Error("could not rotate cluster key")
+				req.Reply(nil, err)
+				return
+			}
+			req.Reply(rotateKeyResult{Key: base64.StdEncoding.EncodeToString(key), Members: switched}, nil)
+		})
+	case "kv-list", "kv-get", "kv-set", "kv-del":
+		req.Reply(handleKV(m.cluster, req.Command, req.Args))
+	case "metadata-list":
+		req.Reply(m.localNode.Metadata, nil)
+	case "metadata-set", "metadata-del":
+		metadata, err := changeMetadata(m.localNode.Metadata, req.Command == "metadata-set", req.Args)
+		if err != nil {
+			req.Reply(nil, err)
+			break
+		}
+		logrus.Infof("announcing changed metadata %s...", req.Args)
+		m.localNode.Metadata = metadata
+		m.cluster.Update(m.localNode)
+		req.Reply(nil, nil)
+	case "route-list":
+		req.Reply(networkStrings(m.localNode.Routes), nil)
+	case "route-add", "route-del":
+		routes, err := changeRoutes(m.manualRoutes, req.Command == "route-add", req.Args, m.routedNets)
+		if err != nil {
+			req.Reply(nil, err)
+			break
+		}
+		logrus.Infof("announcing manually changed routes %s...", req.Args)
+		m.manualRoutes = routes
+		m.localNode.Routes = m.announcedRoutes()
+		m.cluster.Update(m.localNode)
+		writeEvent(m.eventLog, event{Time: time.Now(), Type: "routes", Routes: networkStrings(m.localNode.Routes)})
+		req.Reply(networkStrings(m.localNode.Routes), nil)
+	default:
+		req.Reply(nil, fmt.Errorf("unknown command %q", req.Command))
+	}
+}
+
+// nameConflict handles another node claiming the name of the local node, see --name-conflict
+func (m *mesh) nameConflict(conflict cluster.Conflict) {
+	config := m.config
+	if !m.conflicts.add(conflict, time.Now()) {
+		return // reported again for every alive message of the other claimant
+	}
+	newer := localIsNewer(time.Unix(m.localNode.Started, 0), m.localNode.PubKey, conflict)
+	writeEvent(m.eventLog, event{Time: time.Now(), Type: "conflict", Failures: []string{describeConflict(conflict, time.Now())}})
+	switch {
+	case config.NameConflict == conflictAbort && newer:
+		logrus.Fatalf("node name %s is already claimed by the older node %s; set a distinct one with --node-name", conflict.Name, conflict.OtherAddr)
+	case config.NameConflict == conflictEvict && !newer:
+		logrus.Warnf("node name %s is now claimed by the newer node %s, leaving the cluster", conflict.Name, conflict.OtherAddr)
+		m.cancel()
+	case config.NameConflict == conflictSuffix && newer:
+		name := suffixedName(conflict.Name, m.wgstate.PubKey)
+		logrus.Warnf("node name %s is already claimed by the older node %s, renaming to %s", conflict.Name, conflict.OtherAddr, name)
+		if err := m.cluster.Rename(name, time.Duration(*config.LeaveTimeout)); err != nil {
+			logrus.WithError(err).Error("could not rename node")
+			return
+		}
+		// the other claimant likely got the same overlay address, if derived from the name
+		if err := m.wgstate.AssignOverlayAddr(m.strategy, (*net.IPNet)(config.OverlayNet), name, knownOverlayAddrs(m.members, name)); err != nil {
+			logrus.WithError(err).Warn("could not assign a new overlay address, keeping the current one")
+		}
+		m.localNode.Name = name
+		m.localNode.OverlayAddr = m.wgstate.OverlayAddr
+		m.localNode.Prefixes = config.secondaryPrefixes(name, m.wgstate.PubKey)
+		if config.PersistIdentity {
+			id := &identity{Name: name, PrivateKey: m.wgstate.PrivKey.String(), OverlayAddr: m.wgstate.OverlayAddr.IP.String()}
+			if err := id.save(config.Interface); err != nil {
+				logrus.WithError(err).Error("could not persist identity")
+			}
+		}
+		m.resync()
+	}
+}
+
+// partitionChanged reports the node becoming partitioned or recovering
+func (m *mesh) partitionChanged(ctx context.Context) {
+	partitioned, visible, expected := m.partition.Partitioned()
+	ev := event{Time: time.Now(), Type: "partition", PeersAfter: nodeNames(m.members)}
+	if partitioned {
+		logrus.Warnf("only %d of %d expected members are visible, this node is likely partitioned from the cluster", visible, expected)
+	} else {
+		logrus.Infof("%d of %d expected members are visible again, partition healed", visible, expected)
+		ev.Type = "partition-healed"
+	}
+	writeEvent(m.eventLog, ev)
+	if m.config.PartitionScript != "" {
+		goRecover(m.cleanup, func() {
+			if err := runPartitionScript(ctx, m.config.PartitionScript, time.Duration(*m.config.NodeUpdateScriptTimeout), partitioned, visible, expected); err != nil {
+				logrus.WithError(err).Error("could not run partition script")
+			}
+		})
+	}
+}
+
+// isLeader reports whether the local node is the mesh leader; it is safe for concurrent use
+func (m *mesh) isLeader() bool {
+	return atomic.LoadInt32(&m.leading) == 1
+}
+
+// resync forces re-gossiping the local node and re-applying the current members
+func (m *mesh) resync() {
+	logrus.Info("forcing resync...")
+	m.cluster.Update(m.localNode)
+	if m.disconnected {
+		return
+	}
+	m.wgstate.ForgetApplied() // it may have been changed by hand
+	m.hostsFile.ForgetWritten()
+	ev := event{Time: time.Now(), Type: "resync", PeersAfter: nodeNames(m.members)}
+	writeEvent(m.eventLog, ev.done(m.reconcile(ev, m.members, m.memberHosts)))
+}
+
+// checkHandshakes counts failed handshakes of peers as flaps, applying the members again if that quarantines any node
+func (m *mesh) checkHandshakes(now time.Time) {
+	if m.disconnected || !m.quorate {
+		return
+	}
+	peers, err := m.wgstate.Peers()
+	if err != nil {
+		logrus.WithError(err).Warn("could not get wireguard peers for handshake check")
+		return
+	}
+	failed := failedHandshakes(m.members, peers, m.handshakeSeen, now)
+	if len(failed) == 0 {
+		return
+	}
+	logrus.Debugf("handshakes with %s failed", failed)
+	_, before := m.quarantine.Filter(m.members, now)
+	m.quarantine.ObserveHandshakes(failed, now)
+	if _, after := m.quarantine.Filter(m.members, now); len(after) == len(before) {
+		return
+	}
+	ev := event{Time: now, Type: "quarantine", PeersAfter: nodeNames(m.members)}
+	writeEvent(m.eventLog, ev.done(m.reconcile(ev, m.members, m.memberHosts)))
+}
+
+// repairDrift compares the wireguard state against the desired one, reapplying it if they differ
+func (m *mesh) repairDrift() {
+	if m.disconnected || !m.quorate {
+		return
+	}
+	drift, err := m.wgstate.Drift(m.members, m.routedNets)
+	if err != nil {
+		logrus.WithError(err).Warn("could not compare the wireguard state against the desired state")
+		return
+	}
+	if len(drift) == 0 {
+		return
+	}
+	m.counters.drift.Inc()
+	logrus.Warnf("wireguard state drifted, repairing: %s", strings.Join(drift, "; "))
+	ev := event{Time: time.Now(), Type: "drift", Drift: drift, PeersAfter: nodeNames(m.members)}
+	writeEvent(m.eventLog, ev.done(m.reconcile(ev, m.members, m.memberHosts)))
+}
+
+// dump writes the state of the main loop to the dump file, for debugging
+func (m *mesh) dump() {
+	dump := stateDump{
+		Time:          time.Now(),
+		Version:       version,
+		LocalNode:     newDumpNode(*m.localNode),
+		Leader:        m.leader,
+		PendingRoutes: networkStrings(m.localNode.Routes),
+	}
+	for _, node := range m.members {
+		dump.Members = append(dump.Members, newDumpNode(node))
+	}
+	peers, err := m.wgstate.Peers()
+	if err != nil {
+		logrus.WithError(err).Warn("could not dump wireguard peers")
+	}
+	for _, peer := range peers {
+		dump.Peers = append(dump.Peers, newDumpPeer(peer))
+	}
+	for _, node := range m.cluster.PersistedNodes() {
+		if err := node.DecodeMeta(); err != nil {
+			logrus.WithError(err).Warnf("could not decode persisted metadata of %s", node.Name)
+		}
+		dump.PersistedNodes = append(dump.PersistedNodes, newDumpNode(node))
+	}
+	if err := dumpState(dump, m.config.DumpFile); err != nil {
+		logrus.WithError(err).Error("could not dump state")
+	}
+}
+
+// shutdown leaves the cluster and removes the local configuration, unless it is to be left intact
+func (m *mesh) shutdown() {
+	config := m.config
+	writeEvent(m.eventLog, event{Time: time.Now(), Type: "shutdown"})
+	m.cluster.Leave(time.Duration(*config.LeaveTimeout))
+	if m.blackholes != nil {
+		if err := m.blackholes.Clear(); err != nil {
+			logrus.WithError(err).Error("could not remove unreachable routes")
+		}
+	}
+	if config.LeaveIntact {
+		logrus.Info("leaving hosts entries and interface in place")
+		if err := m.hostsFile.Flush(); err != nil {
+			logrus.WithError(err).Error("could not write pending hosts entries")
+		}
+		return
+	}
+	if !config.NoEtcHosts {
+		if err := m.hostsFile.WriteEntries(map[string][]string{}); err != nil {
+			logrus.WithError(err).Error("could not remove stale hosts entries")
+		}
+		if err := m.hostsFile.Flush(); err != nil {
+			logrus.WithError(err).Error("could not remove stale hosts entries")
+		}
+	}
+	if err := m.wgstate.DownInterface(); err != nil {
+		logrus.WithError(err).Error("could not down interface")
+	}
+	if m.nftSet != nil {
+		if err := m.nftSet.Update(nil, m.overlayIPv6); err != nil {
+			logrus.WithError(err).Error("could not clear nftables set")
+		}
+	}
+	if m.firewalldZone != nil {
+		if err := m.firewalldZone.Remove(); err != nil {
+			logrus.WithError(err).Error("could not remove interface from firewalld zone")
+		}
+	}
+	if m.dscpMarking != nil {
+		if err := m.dscpMarking.Remove(); err != nil {
+			logrus.WithError(err).Error("could not remove DSCP marking")
+		}
+	}
+	m.restoreProxyARP()
+	m.restoreNDPProxy()
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/costela/wesher/cluster"
+	"github.com/costela/wesher/common"
+	"github.com/costela/wesher/control"
+	"github.com/costela/wesher/etchosts"
+	"github.com/costela/wesher/wg"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// testMesh prepares a mesh of a standalone cluster with the provided static peers and a fake wireguard backend
+func testMesh(t *testing.T, peers []common.Node) (*mesh, *wg.Fake) {
+	zero, keepalive := duration(0), 30*time.Second
+	_, overlayNet, _ := net.ParseCIDR("10.0.0.0/24")
+	config := &config{
+		Interface:           "wgmesh",
+		WireguardPort:       51820,
+		MTU:                 1420,
+		OverlayNet:          (*network)(overlayNet),
+		Backend:             wg.BackendFake,
+		NoEtcHosts:          true,
+		Rejoin:              &zero,
+		ResumeCheckInterval: &zero,
+		ReconcileInterval:   &zero,
+		LeaveTimeout:        &zero,
+		PushPullInterval:    &zero,
+	}
+	c, err := cluster.NewStandalone("local", "192.0.2.1", peers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := wg.NewFake()
+	wgstate, localNode, err := wg.New(backend, config.Interface, config.WireguardPort, config.MTU, overlayNet, "local", &keepalive, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	localNode.Name = "local"
+	m := newMesh(config, c, wgstate, localNode, &etchosts.EtcHosts{})
+	m.counters = registerFailureCounters(&common.Metrics{}, c)
+	return m, backend
+}
+
+// request sends the control request to the main loop, providing its decoded result
+func request(t *testing.T, requests chan<- *control.Request, result interface{}, command string, args ...string) {
+	req := control.NewRequest(command, args...)
+	select {
+	case requests <- req:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("main loop did not accept %s request", command)
+	}
+	encoded, err := req.Result()
+	if err != nil {
+		t.Fatalf("%s request error = %v", command, err)
+	}
+	if result != nil {
+		if err := json.Unmarshal(encoded, result); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_mesh_run(t *testing.T) {
+	key, _ := wgtypes.GeneratePrivateKey()
+	peer, err := staticPeer("peer", key.PublicKey().String(), "10.0.0.2", "192.0.2.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, backend := testMesh(t, []common.Node{peer})
+	requests := make(chan *control.Request)
+	m.controlRequests = requests
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+	done := make(chan struct{})
+	go func() {
+		m.run(ctx, m.cluster.Members())
+		close(done)
+	}()
+
+	var peers []string
+	for i := 0; i < 100 && len(peers) == 0; i++ { // the members are applied asynchronously
+		request(t, requests, &peers, "peers")
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !reflect.DeepEqual(peers, []string{"peer"}) {
+		t.Fatalf("peers = %v, want [peer]", peers)
+	}
+	devicePeers := func() []wgtypes.Peer {
+		device, err := backend.Stats("wgmesh")
+		if err != nil {
+			return nil
+		}
+		return device.Peers
+	}
+	if got := devicePeers(); len(got) != 1 || got[0].PublicKey != key.PublicKey() {
+		t.Errorf("device peers = %v, want the static peer", got)
+	}
+
+	status := statusResult{}
+	request(t, requests, &status, "status")
+	if status.Members != 2 || !status.Connected || status.Leader == "" {
+		t.Errorf("status = %+v, want 2 connected members with a leader", status)
+	}
+	if m.isLeader() != (status.Leader == "local") {
+		t.Errorf("isLeader() = %t with leader %s", m.isLeader(), status.Leader)
+	}
+
+	request(t, requests, nil, "disconnect")
+	if _, err := backend.Stats("wgmesh"); !os.IsNotExist(err) {
+		t.Errorf("device after disconnect error = %v, want it removed", err)
+	}
+	request(t, requests, nil, "connect")
+	if got := devicePeers(); len(got) != 1 {
+		t.Errorf("device peers after connect = %v, want the static peer", got)
+	}
+	if err := backend.ConfigurePeers("wgmesh", wgtypes.Config{ReplacePeers: true}); err != nil { // changed by hand
+		t.Fatal(err)
+	}
+	request(t, requests, nil, "resync")
+	if got := devicePeers(); len(got) != 1 {
+		t.Errorf("device peers after resync = %v, want the static peer restored", got)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("main loop did not stop")
+	}
+	if _, err := backend.Stats("wgmesh"); !os.IsNotExist(err) {
+		t.Errorf("device after shutdown error = %v, want it removed", err)
+	}
+}
+
+func Test_mesh_reconcile_minMembers(t *testing.T) {
+	m, backend := testMesh(t, nil)
+	m.config.MinMembers = 3
+	m.quorate = false
+	key, _ := wgtypes.GeneratePrivateKey()
+	peer, err := staticPeer("peer", key.PublicKey().String(), "10.0.0.2", "192.0.2.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.membersChanged(context.Background(), []common.Node{peer})
+	if _, err := backend.Stats("wgmesh"); !os.IsNotExist(err) || m.quorate {
+		t.Errorf("device with 2 of 3 members error = %v, want it not created yet", err)
+	}
+	other, _ := wgtypes.GeneratePrivateKey()
+	second, err := staticPeer("second", other.PublicKey().String(), "10.0.0.3", "192.0.2.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.membersChanged(context.Background(), []common.Node{peer, second})
+	if device, err := backend.Stats("wgmesh"); err != nil || len(device.Peers) != 2 || !m.quorate {
+		t.Errorf("device with 3 of 3 members = %v, %v; want both peers", device, err)
+	}
+}
+
+// failingBackend fails bringing up the interface a number of times
+type failingBackend struct {
+	*wg.Fake
+	failures int
+}
+
+func (b *failingBackend) Up(iface string, addr net.IPNet, mtu int) error {
+	if b.failures > 0 {
+		b.failures--
+		return errors.New("device busy")
+	}
+	return b.Fake.Up(iface, addr, mtu)
+}
+
+func Test_mesh_setUpInterface_retry(t *testing.T) {
+	m, _ := testMesh(t, nil)
+	backend := &failingBackend{Fake: wg.NewFake(), failures: 1}
+	keepalive := 30 * time.Second
+	wgstate, _, err := wg.New(backend, m.config.Interface, m.config.WireguardPort, m.config.MTU, (*net.IPNet)(m.config.OverlayNet), "local", &keepalive, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.wgstate = wgstate
+	key, _ := wgtypes.GeneratePrivateKey()
+	peer, err := staticPeer("peer", key.PublicKey().String(), "10.0.0.2", "192.0.2.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.membersChanged(context.Background(), []common.Node{peer})
+	if len(m.retryNodes) != 1 {
+		t.Fatalf("retry nodes after failure = %v, want the peer", m.retryNodes)
+	}
+	select {
+	case <-m.interfaceRetry:
+	case <-time.After(5 * time.Second):
+		t.Fatal("interface configuration was not retried")
+	}
+	if err := m.setUpInterface(m.retryNodes); err != nil {
+		t.Fatalf("setUpInterface() error = %v", err)
+	}
+	if device, err := backend.Stats("wgmesh"); err != nil || len(device.Peers) != 1 {
+		t.Errorf("device after retry = %v, %v; want the peer", device, err)
+	}
+	if m.retryNodes != nil {
+		t.Errorf("retry nodes after success = %v, want none", m.retryNodes)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/costela/wesher/cluster"
+	"github.com/costela/wesher/common"
+	"github.com/sirupsen/logrus"
+)
+
+// registerClusterMetrics registers the gauges describing the convergence of the cluster and the leadership of the
+// local node, as reported by isLeader
+func registerClusterMetrics(metrics *common.Metrics, c *cluster.Cluster, isLeader func() bool) {
+	metrics.GaugeFunc("wesher_cluster_members", "Number of cluster members, including the local node.", func() float64 {
+		return float64(c.Convergence().Members)
+	})
+	metrics.GaugeFunc("wesher_cluster_suspect_members", "Number of members suspected to have failed, but not declared dead yet.", func() float64 {
+		return float64(c.Convergence().Suspects)
+	})
+	metrics.GaugeFunc("wesher_cluster_health_score", "Memberlist awareness score; 0 is healthy, higher values mean the local node has trouble reaching others in time.", func() float64 {
+		return float64(c.Convergence().HealthScore)
+	})
+	metrics.GaugeFunc("wesher_cluster_last_push_pull_timestamp_seconds", "Unix time of the last complete state exchange with another node; 0 if none yet.", func() float64 {
+		last := c.Convergence().LastPushPull
+		if last.IsZero() {
+			return 0
+		}
+		return float64(last.UnixNano()) / 1e9
+	})
+	metrics.GaugeFunc("wesher_is_leader", "Whether the local node is the mesh leader (1) or not (0).", func() float64 {
+		if isLeader() {
+			return 1
+		}
+		return 0
+	})
+}
+
+// registerPartitionMetrics registers the gauges describing partition detection
+func registerPartitionMetrics(metrics *common.Metrics, p *common.Partition) {
+	metrics.GaugeFunc("wesher_partitioned", "Whether the local node considers itself partitioned from the cluster (1) or not (0).", func() float64 {
+		if partitioned, _, _ := p.Partitioned(); partitioned {
+			return 1
+		}
+		return 0
+	})
+	metrics.GaugeFunc("wesher_expected_members", "Number of members expected by partition detection, including the local node.", func() float64 {
+		_, _, expected := p.Partitioned()
+		return float64(expected)
+	})
+}
+
+// failureCounters count failures which otherwise only show up as repeated log lines, for alerting
+type failureCounters struct {
+	reconfiguration *common.Counter
+	hostsWrite      *common.Counter
+	updateScript    *common.Counter
+	hookScript      *common.Counter
+	drift           *common.Counter
+}
+
+// registerFailureCounters registers the counters of join attempts and failures
+func registerFailureCounters(metrics *common.Metrics, c *cluster.Cluster) failureCounters {
+	metrics.CounterFunc("wesher_join_attempts_total", "Number of attempts to join cluster nodes.", func() float64 {
+		attempts, _ := c.JoinStats()
+		return float64(attempts)
+	})
+	metrics.CounterFunc("wesher_join_failures_total", "Number of attempts to join cluster nodes which failed.", func() float64 {
+		_, failures := c.JoinStats()
+		return float64(failures)
+	})
+	metrics.CounterFunc("wesher_decrypt_failures_total", "Number of gossip messages which could not be decrypted, most likely sent with another cluster key.", func() float64 {
+		return float64(c.DecryptFailures())
+	})
+	return failureCounters{
+		reconfiguration: metrics.Counter("wesher_reconfiguration_errors_total", "Number of errors applying cluster changes locally, including the ones counted separately."),
+		hostsWrite:      metrics.Counter("wesher_hosts_write_errors_total", "Number of failed writes of hosts entries."),
+		updateScript:    metrics.Counter("wesher_update_script_failures_total", "Number of failed runs of the node update script."),
+		hookScript:      metrics.Counter("wesher_hook_script_failures_total", "Number of failed runs of the per-event hook scripts."),
+		drift:           metrics.Counter("wesher_drift_repairs_total", "Number of times the wireguard state was found drifted from the desired state and repaired."),
+	}
+}
+
+// registerScriptMetrics registers the consecutive failures of the node update script and hook scripts, which stay
+// above zero while a script keeps failing
+func registerScriptMetrics(metrics *common.Metrics, failures *scriptFailures, updateScript string, hooks hookScripts) {
+	metrics.GaugeFunc("wesher_update_script_consecutive_failures", "Number of consecutive failed runs of the node update script.", func() float64 {
+		return float64(failures.Max(updateScript))
+	})
+	metrics.GaugeFunc("wesher_hook_script_consecutive_failures", "Highest number of consecutive failed runs of any hook script.", func() float64 {
+		return float64(failures.Max(hooks.paths()...))
+	})
+}
+
+// newConvergenceStatus describes the convergence for the status output
+func newConvergenceStatus(conv cluster.Convergence, now time.Time) convergenceStatus {
+	status := convergenceStatus{HealthScore: conv.HealthScore, SuspectMembers: conv.Suspects}
+	if !conv.LastPushPull.IsZero() {
+		status.LastPushPull = conv.LastPushPull.UTC().Format(time.RFC3339)
+		status.LastPushPullAge = now.Sub(conv.LastPushPull).Truncate(time.Second).String()
+	}
+	return status
+}
+
+// serveMetrics serves the metrics at /metrics on the provided address
+func serveMetrics(addr string, metrics *common.Metrics) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	logrus.WithError(http.ListenAndServe(addr, mux)).Error("could not serve metrics")
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/costela/wesher/cluster"
+)
+
+func Test_newConvergenceStatus(t *testing.T) {
+	now := time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)
+	got := newConvergenceStatus(cluster.Convergence{HealthScore: 2, Suspects: 1, LastPushPull: now.Add(-90500 * time.Millisecond)}, now)
+	want := convergenceStatus{HealthScore: 2, SuspectMembers: 1, LastPushPull: "2020-05-01T09:58:29Z", LastPushPullAge: "1m30s"}
+	if got != want {
+		t.Errorf("newConvergenceStatus() = %+v, want %+v", got, want)
+	}
+	if got := newConvergenceStatus(cluster.Convergence{}, now); got.LastPushPull != "" || got.LastPushPullAge != "" {
+		t.Errorf("newConvergenceStatus() = %+v, want no push/pull", got)
+	}
+}
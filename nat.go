@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// roamingInterval is the interval in which the endpoints peers roamed to are checked
+const roamingInterval = 30 * time.Second
+
+// NAT settings
+const (
+	natAuto = "auto"
+	natYes  = "yes"
+	natNo   = "no"
+)
+
+// behindNAT decides whether the local node is behind NAT; automatically, it is assumed to be if the advertised address
+// is not assigned to any local interface, as is the case for addresses of port forwards
+func behindNAT(setting string, advertised net.IP) (bool, error) {
+	switch setting {
+	case natYes:
+		return true, nil
+	case natNo:
+		return false, nil
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false, errors.Wrap(err, "could not get local addresses")
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(advertised) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// sameEndpoints reports whether both sets of endpoints are the same
+func sameEndpoints(a, b map[string]*net.UDPAddr) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, endpoint := range a {
+		if other, ok := b[key]; !ok || other.String() != endpoint.String() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func Test_behindNAT(t *testing.T) {
+	tests := []struct {
+		name       string
+		setting    string
+		advertised string
+		want       bool
+	}{
+		{"local address", natAuto, "127.0.0.1", false},
+		{"foreign address", natAuto, "192.0.2.1", true},
+		{"forced", natYes, "127.0.0.1", true},
+		{"disabled", natNo, "192.0.2.1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := behindNAT(tt.setting, net.ParseIP(tt.advertised))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("behindNAT() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_sameEndpoints(t *testing.T) {
+	a := map[string]*net.UDPAddr{"key": {IP: net.ParseIP("192.0.2.1"), Port: 51820}}
+	if !sameEndpoints(a, map[string]*net.UDPAddr{"key": {IP: net.ParseIP("192.0.2.1"), Port: 51820}}) {
+		t.Error("sameEndpoints() = false for equal endpoints")
+	}
+	if sameEndpoints(a, map[string]*net.UDPAddr{"key": {IP: net.ParseIP("192.0.2.1"), Port: 4000}}) {
+		t.Error("sameEndpoints() = true for different ports")
+	}
+	if sameEndpoints(a, nil) || !sameEndpoints(nil, map[string]*net.UDPAddr{}) {
+		t.Error("sameEndpoints() mismatch for empty endpoints")
+	}
+}
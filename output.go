@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// output formats supported by subcommands
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// printResult prints the result of a subcommand to stdout, either as JSON or using the provided text printer
+func printResult(format string, result interface{}, text func()) {
+	if format != outputJSON {
+		text()
+		return
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(result); err != nil {
+		fmt.Fprintf(os.Stderr, "could not encode output: %s\n", err)
+	}
+}
+
+// outputFormatFromArgs looks up the output format in the raw arguments, for when the config could not be loaded
+func outputFormatFromArgs(args []string) string {
+	for i, arg := range args {
+		switch {
+		case arg == "--output" && i+1 < len(args):
+			return args[i+1]
+		case strings.HasPrefix(arg, "--output="):
+			return strings.TrimPrefix(arg, "--output=")
+		}
+	}
+	if format := os.Getenv("WESHER_OUTPUT"); format != "" {
+		return format
+	}
+	return outputText
+}
+
+// takeFormatArg removes the --format option of a subcommand from os.Args, so it is not parsed as configuration, and
+// provides its value or the default
+func takeFormatArg(defaultFormat string) string {
+	format := defaultFormat
+	for i := 1; i < len(os.Args); i++ {
+		switch arg := os.Args[i]; {
+		case arg == "--format" && i+1 < len(os.Args):
+			format = os.Args[i+1]
+			os.Args = append(os.Args[:i], os.Args[i+2:]...)
+			i--
+		case strings.HasPrefix(arg, "--format="):
+			format = strings.TrimPrefix(arg, "--format=")
+			os.Args = append(os.Args[:i], os.Args[i+1:]...)
+			i--
+		}
+	}
+	return format
+}
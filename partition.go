@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// partitionScriptEnv provides the environment describing a partition change to the partition script
+func partitionScriptEnv(partitioned bool, visible, expected int) []string {
+	return []string{
+		fmt.Sprintf("WESHER_PARTITIONED=%t", partitioned),
+		fmt.Sprintf("WESHER_MEMBERS=%d", visible),
+		fmt.Sprintf("WESHER_EXPECTED_MEMBERS=%d", expected),
+	}
+}
+
+// runPartitionScript runs the partition script after the node became partitioned or recovered, killing it after the
+// timeout like the other scripts
+func runPartitionScript(ctx context.Context, script string, timeout time.Duration, partitioned bool, visible, expected int) error {
+	err := runScript(ctx, script, nil, timeout, scriptRun{Env: partitionScriptEnv(partitioned, visible, expected)})
+	return errors.Wrap(err, "partition-script")
+}
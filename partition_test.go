@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func Test_runPartitionScript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wesher-partition")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := path.Join(dir, "partition.sh")
+	// fail unless the node is reported partitioned with 2 of 6 members
+	content := "#!/bin/sh\n[ \"$WESHER_PARTITIONED\" = true ] && [ \"$WESHER_MEMBERS\" = 2 ] && [ \"$WESHER_EXPECTED_MEMBERS\" = 6 ]\n"
+	if err := ioutil.WriteFile(script, []byte(content), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runPartitionScript(context.Background(), script, time.Second, true, 2, 6); err != nil {
+		t.Errorf("runPartitionScript() error = %v", err)
+	}
+	if err := runPartitionScript(context.Background(), script, time.Second, false, 6, 6); err == nil {
+		t.Error("runPartitionScript() should fail when the script fails")
+	}
+
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\nsleep 10\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := runPartitionScript(context.Background(), script, 100*time.Millisecond, true, 2, 6); err == nil || time.Since(start) > 5*time.Second {
+		t.Errorf("runPartitionScript() of hanging script = %v after %s, want it killed after the timeout", err, time.Since(start))
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// checkPprofAddr ensures profiles are only served on loopback addresses, since they expose internals of the process
+func checkPprofAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.Wrapf(err, "invalid pprof address %q", addr)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return errors.Errorf("pprof address %q is not a loopback address", addr)
+	}
+	return nil
+}
+
+// servePprof serves the runtime profiles at /debug/pprof/ on the provided address
+func servePprof(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	logrus.WithError(http.ListenAndServe(addr, mux)).Error("could not serve pprof")
+}
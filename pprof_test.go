@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func Test_checkPprofAddr(t *testing.T) {
+	tests := []struct {
+		addr    string
+		wantErr bool
+	}{
+		{"127.0.0.1:6060", false},
+		{"[::1]:6060", false},
+		{"localhost:6060", false},
+		{"0.0.0.0:6060", true},
+		{":6060", true},
+		{"192.0.2.1:6060", true},
+		{"127.0.0.1", true},
+	}
+	for _, tt := range tests {
+		if err := checkPprofAddr(tt.addr); (err != nil) != tt.wantErr {
+			t.Errorf("checkPprofAddr(%q) error = %v, wantErr %v", tt.addr, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/costela/wesher/common"
+	"github.com/pkg/errors"
+)
+
+// promTargetGroup is a group of scrape targets in the Prometheus file_sd format
+type promTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// newPromTargetGroups provides one target group per node, scraping its overlay address on the port, labeled with its
+// name and labels; label names Prometheus does not accept are sanitized
+func newPromTargetGroups(nodes []common.Node, port int) []promTargetGroup {
+	groups := make([]promTargetGroup, 0, len(nodes))
+	for _, node := range nodes {
+		labels := make(map[string]string, len(node.Labels)+1)
+		for key, value := range node.Labels {
+			labels[promLabelName(key)] = value
+		}
+		labels["node"] = node.Name
+		groups = append(groups, promTargetGroup{
+			Targets: []string{net.JoinHostPort(node.OverlayAddr.IP.String(), strconv.Itoa(port))},
+			Labels:  labels,
+		})
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Labels["node"] < groups[j].Labels["node"] })
+	return groups
+}
+
+// promLabelName replaces the characters Prometheus does not accept in label names by underscores
+func promLabelName(name string) string {
+	sanitized := strings.Map(func(c rune) rune {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' {
+			return c
+		}
+		return '_'
+	}, name)
+	if sanitized == "" || sanitized[0] >= '0' && sanitized[0] <= '9' || strings.HasPrefix(sanitized, "__") {
+		sanitized = "label_" + sanitized // reserved or invalid as first character
+	}
+	return sanitized
+}
+
+// writePromTargets atomically replaces the Prometheus file_sd file with the targets of the nodes
+func writePromTargets(filePath string, nodes []common.Node, port int) error {
+	content, err := json.MarshalIndent(newPromTargetGroups(nodes, port), "", "  ")
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(common.WriteFileAtomic(filePath, content, 0644), "could not write Prometheus targets file")
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/costela/wesher/common"
+)
+
+func Test_newPromTargetGroups(t *testing.T) {
+	node1 := common.Node{Name: "node1"}
+	node1.OverlayAddr = net.IPNet{IP: net.ParseIP("10.0.0.1"), Mask: net.CIDRMask(32, 32)}
+	node1.Labels = map[string]string{"env": "prod", "k8s.io/role": "db", "1st": "yes"}
+	node2 := common.Node{Name: "node2"}
+	node2.OverlayAddr = net.IPNet{IP: net.ParseIP("2001:db8::2"), Mask: net.CIDRMask(128, 128)}
+
+	want := []promTargetGroup{
+		{Targets: []string{"10.0.0.1:9100"}, Labels: map[string]string{"node": "node1", "env": "prod", "k8s_io_role": "db", "label_1st": "yes"}},
+		{Targets: []string{"[2001:db8::2]:9100"}, Labels: map[string]string{"node": "node2"}},
+	}
+	if got := newPromTargetGroups([]common.Node{node2, node1}, 9100); !reflect.DeepEqual(got, want) {
+		t.Errorf("newPromTargetGroups() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// scriptRun is the input of a single script run
+type scriptRun struct {
+	Env   []string // added to the environment of the daemon
+	Stdin []byte
+}
+
+// scriptRunner runs a script asynchronously from a worker, so slow scripts do not block the main loop
+// Runs requested while the script is running or within the interval after its last start are coalesced into a single
+// one with the latest input; hung scripts are killed after the timeout.
+type scriptRunner struct {
+	Path     string
+	Args     []string
+	Interval time.Duration
+	Timeout  time.Duration
+	Failures *scriptFailures // optional
+
+	lock   sync.Mutex
+	next   *scriptRun
+	wake   chan struct{}
+	errors chan error
+}
+
+func newScriptRunner(path string, args []string, interval, timeout time.Duration) *scriptRunner {
+	return &scriptRunner{
+		Path:     path,
+		Args:     args,
+		Interval: interval,
+		Timeout:  timeout,
+		wake:     make(chan struct{}, 1),
+		errors:   make(chan error, 1),
+	}
+}
+
+// Submit requests a run with the provided input, replacing any pending one; it never blocks
+func (r *scriptRunner) Submit(run scriptRun) {
+	r.lock.Lock()
+	r.next = &run
+	r.lock.Unlock()
+	select {
+	case r.wake <- struct{}{}:
+	default: // already woken up
+	}
+}
+
+// Errors provides the failures of runs; failures are dropped while a previous one was not received yet
+func (r *scriptRunner) Errors() <-chan error {
+	return r.errors
+}
+
+// Run runs the submitted runs until the context is done
+func (r *scriptRunner) Run(ctx context.Context) {
+	var lastStart time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.wake:
+		}
+		if wait := time.Until(lastStart.Add(r.Interval)); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+		}
+		r.lock.Lock()
+		run := r.next
+		r.next = nil
+		r.lock.Unlock()
+		if run == nil {
+			continue // coalesced into the previous run
+		}
+		lastStart = time.Now()
+		err := r.run(ctx, *run)
+		r.Failures.record(r.Path, err)
+		if err != nil {
+			select {
+			case r.errors <- err:
+			default:
+			}
+		}
+	}
+}
+
+func (r *scriptRunner) run(ctx context.Context, run scriptRun) error {
+	return runScript(ctx, r.Path, r.Args, r.Timeout, run)
+}
+
+// hookRun is a queued run of a hook script
+type hookRun struct {
+	Path string
+	scriptRun
+}
+
+// maxQueuedHooks bounds the hook runs waiting for a worker, should hooks be much slower than the changes they describe
+const maxQueuedHooks = 1024
+
+// hookQueue runs hook scripts from a worker, in order of submission
+// Unlike the node update script, hook runs are never coalesced, since each describes a distinct change.
+type hookQueue struct {
+	Args     []string
+	Timeout  time.Duration
+	Failures *scriptFailures // optional
+
+	lock   sync.Mutex
+	queue  []hookRun
+	wake   chan struct{}
+	errors chan error
+}
+
+func newHookQueue(args []string, timeout time.Duration) *hookQueue {
+	return &hookQueue{
+		Args:    args,
+		Timeout: timeout,
+		wake:    make(chan struct{}, 1),
+		errors:  make(chan error, 1),
+	}
+}
+
+// Submit queues the runs; it never blocks, dropping runs exceeding maxQueuedHooks
+func (q *hookQueue) Submit(runs ...hookRun) {
+	q.lock.Lock()
+	if dropped := len(q.queue) + len(runs) - maxQueuedHooks; dropped > 0 {
+		runs = runs[:len(runs)-dropped]
+		q.fail(errors.Errorf("hook queue full, dropped %d runs", dropped))
+	}
+	q.queue = append(q.queue, runs...)
+	q.lock.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default: // already woken up
+	}
+}
+
+// Errors provides the failures of runs; failures are dropped while a previous one was not received yet
+func (q *hookQueue) Errors() <-chan error {
+	return q.errors
+}
+
+func (q *hookQueue) fail(err error) {
+	select {
+	case q.errors <- err:
+	default:
+	}
+}
+
+// Run runs the queued hooks until the context is done
+func (q *hookQueue) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		}
+		for {
+			q.lock.Lock()
+			if len(q.queue) == 0 {
+				q.lock.Unlock()
+				break
+			}
+			run := q.queue[0]
+			q.queue = q.queue[1:]
+			q.lock.Unlock()
+			err := runScript(ctx, run.Path, q.Args, q.Timeout, run.scriptRun)
+			q.Failures.record(run.Path, err)
+			if err != nil {
+				q.fail(err)
+			}
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}
+}
+
+// runScript runs the script with the input, killing it after the timeout
+// Scripts run in their own process group, which is killed as a whole, so processes started by scripts cannot outlive
+// them and keep a wedged run going.
+func runScript(ctx context.Context, path string, args []string, timeout time.Duration, run scriptRun) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := exec.Command(path, args...)
+	cmd.Env = append(os.Environ(), run.Env...)
+	cmd.Stdin = bytes.NewReader(run.Stdin)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return errors.Wrapf(err, "%s failed", path)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		return errors.Wrapf(err, "%s failed", path)
+	case <-ctx.Done():
+		unix.Kill(-cmd.Process.Pid, unix.SIGKILL) //nolint: errcheck // the group may have exited meanwhile
+		<-done
+		if ctx.Err() == context.DeadlineExceeded {
+			return errors.Errorf("%s killed after timeout of %s", path, timeout)
+		}
+		return errors.Wrapf(ctx.Err(), "%s killed", path)
+	}
+}
+
+// scriptFailures counts the consecutive failures of scripts, by path; a successful run resets the count
+type scriptFailures struct {
+	lock   sync.Mutex
+	counts map[string]int
+}
+
+func newScriptFailures() *scriptFailures {
+	return &scriptFailures{counts: make(map[string]int)}
+}
+
+// record counts the outcome of a run of the script; does nothing on a nil receiver
+func (f *scriptFailures) record(path string, err error) {
+	if f == nil {
+		return
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err == nil {
+		delete(f.counts, path)
+		return
+	}
+	f.counts[path]++
+}
+
+// Consecutive provides the consecutive failures of the scripts currently failing, by path
+func (f *scriptFailures) Consecutive() map[string]int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	counts := make(map[string]int, len(f.counts))
+	for path, count := range f.counts {
+		counts[path] = count
+	}
+	return counts
+}
+
+// Max provides the highest consecutive failures of any of the scripts
+func (f *scriptFailures) Max(paths ...string) int {
+	counts := f.Consecutive()
+	max := 0
+	for _, path := range paths {
+		if counts[path] > max {
+			max = counts[path]
+		}
+	}
+	return max
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeScript(t *testing.T, dir, content string) string {
+	script := path.Join(dir, "script.sh")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\n"+content), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return script
+}
+
+func Test_scriptRunner_coalesces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wesher-script")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := path.Join(dir, "out")
+	runner := newScriptRunner(writeScript(t, dir, `echo "$RUN" >> `+out+"\n"), nil, 200*time.Millisecond, time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go runner.Run(ctx)
+
+	runner.Submit(scriptRun{Env: []string{"RUN=1"}})
+	time.Sleep(50 * time.Millisecond) // first run starts immediately
+	for _, run := range []string{"RUN=2", "RUN=3", "RUN=4"} {
+		runner.Submit(scriptRun{Env: []string{run}})
+	}
+	time.Sleep(400 * time.Millisecond)
+
+	content, _ := ioutil.ReadFile(out)
+	if got := strings.Fields(string(content)); strings.Join(got, ",") != "1,4" {
+		t.Errorf("scriptRunner ran with %v, want the first and the latest run only", got)
+	}
+	select {
+	case err := <-runner.Errors():
+		t.Errorf("scriptRunner failed: %s", err)
+	default:
+	}
+}
+
+func Test_scriptRunner_timeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wesher-script")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	runner := newScriptRunner(writeScript(t, dir, "exec sleep 10\n"), nil, 0, 100*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go runner.Run(ctx)
+
+	runner.Submit(scriptRun{})
+	select {
+	case err := <-runner.Errors():
+		if !strings.Contains(err.Error(), "timeout") {
+			t.Errorf("scriptRunner failed with %s, want a timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("scriptRunner did not kill the hung script")
+	}
+}
+
+func Test_hookQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wesher-script")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := path.Join(dir, "out")
+	script := writeScript(t, dir, `echo "$RUN" >> `+out+"\n")
+	queue := newHookQueue(nil, time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go queue.Run(ctx)
+
+	for _, run := range []string{"RUN=1", "RUN=2", "RUN=3"} {
+		queue.Submit(hookRun{Path: script, scriptRun: scriptRun{Env: []string{run}}})
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	content, _ := ioutil.ReadFile(out)
+	if got := strings.Fields(string(content)); strings.Join(got, ",") != "1,2,3" {
+		t.Errorf("hookQueue ran with %v, want every run in order", got)
+	}
+}
+
+func Test_runScript_killsProcessGroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wesher-script")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pidFile := path.Join(dir, "pid")
+	script := writeScript(t, dir, "sleep 10 &\necho $! > "+pidFile+"\nwait\n")
+
+	err = runScript(context.Background(), script, nil, 200*time.Millisecond, scriptRun{})
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("runScript() = %v, want a timeout", err)
+	}
+	pid, _ := ioutil.ReadFile(pidFile)
+	time.Sleep(50 * time.Millisecond)
+	// the child is gone, or a zombie if nothing reaps orphans in the test environment
+	if stat, err := ioutil.ReadFile("/proc/" + strings.TrimSpace(string(pid)) + "/stat"); err == nil && !strings.Contains(string(stat), ") Z ") {
+		t.Errorf("runScript() left child process %s of the script running", strings.TrimSpace(string(pid)))
+	}
+}
+
+func Test_scriptFailures(t *testing.T) {
+	failures := newScriptFailures()
+	failures.record("a.sh", errors.New("failed"))
+	failures.record("a.sh", errors.New("failed"))
+	failures.record("b.sh", errors.New("failed"))
+	if got := failures.Max("a.sh", "b.sh"); got != 2 {
+		t.Errorf("scriptFailures.Max() = %d, want 2", got)
+	}
+	failures.record("a.sh", nil)
+	if got := failures.Consecutive(); len(got) != 1 || got["b.sh"] != 1 {
+		t.Errorf("scriptFailures.Consecutive() = %v, want only b.sh failing once", got)
+	}
+	var disabled *scriptFailures
+	disabled.record("a.sh", errors.New("failed")) // must not panic
+}
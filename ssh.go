@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/costela/wesher/common"
+	"github.com/pkg/errors"
+)
+
+// sshNodes provides the nodes which can safely be written to SSH files, sorted by name
+// Names are gossiped by other nodes, so anything not a valid hostname is skipped instead of ending up in a Host line.
+func sshNodes(nodes []common.Node) []common.Node {
+	valid := make([]common.Node, 0, len(nodes))
+	for _, node := range nodes {
+		if common.ValidHostname(node.Name) {
+			valid = append(valid, node)
+		}
+	}
+	sort.Slice(valid, func(i, j int) bool { return valid[i].Name < valid[j].Name })
+	return valid
+}
+
+// formatSSHConfig formats an ssh_config include file with a Host block per node, connecting to its overlay address
+// If knownHostsFile is set, it is added to the global known hosts files of these hosts.
+func formatSSHConfig(nodes []common.Node, knownHostsFile string) string {
+	b := &strings.Builder{}
+	b.WriteString("# managed by wesher; changes will be overwritten\n")
+	for _, node := range sshNodes(nodes) {
+		fmt.Fprintf(b, "\nHost %s\n", node.Name)
+		fmt.Fprintf(b, "    HostName %s\n", node.OverlayAddr.IP)
+		if knownHostsFile != "" {
+			fmt.Fprintf(b, "    GlobalKnownHostsFile %s\n", knownHostsFile)
+		}
+	}
+	return b.String()
+}
+
+// formatKnownHosts formats a known_hosts file with the announced host keys of each node, under both its name and its
+// overlay address
+func formatKnownHosts(nodes []common.Node) string {
+	b := &strings.Builder{}
+	b.WriteString("# managed by wesher; changes will be overwritten\n")
+	for _, node := range sshNodes(nodes) {
+		for _, key := range node.SSHHostKeys {
+			fmt.Fprintf(b, "%s,%s %s\n", node.Name, node.OverlayAddr.IP, key)
+		}
+	}
+	return b.String()
+}
+
+// writeSSHFiles atomically replaces the SSH config and known hosts files which are set with the nodes
+func writeSSHFiles(configFile, knownHostsFile string, nodes []common.Node) error {
+	if configFile != "" {
+		if err := common.WriteFileAtomic(configFile, []byte(formatSSHConfig(nodes, knownHostsFile)), 0644); err != nil {
+			return errors.Wrap(err, "could not write SSH config file")
+		}
+	}
+	if knownHostsFile != "" {
+		if err := common.WriteFileAtomic(knownHostsFile, []byte(formatKnownHosts(nodes)), 0644); err != nil {
+			return errors.Wrap(err, "could not write SSH known hosts file")
+		}
+	}
+	return nil
+}
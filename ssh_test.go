@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/costela/wesher/common"
+)
+
+func Test_formatSSHConfig(t *testing.T) {
+	node1 := common.Node{Name: "node1"}
+	node1.OverlayAddr = net.IPNet{IP: net.ParseIP("10.0.0.1"), Mask: net.CIDRMask(32, 32)}
+	node1.SSHHostKeys = []string{"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIA==", "ssh-rsa AAAAB3NzaC1yc2E="}
+	node2 := common.Node{Name: "node2"}
+	node2.OverlayAddr = net.IPNet{IP: net.ParseIP("10.0.0.2"), Mask: net.CIDRMask(32, 32)}
+	invalid := common.Node{Name: "evil\n  ProxyCommand sh"}
+	nodes := []common.Node{node2, invalid, node1}
+
+	wantConfig := `# managed by wesher; changes will be overwritten
+
+Host node1
+    HostName 10.0.0.1
+    GlobalKnownHostsFile /etc/ssh/wesher_known_hosts
+
+Host node2
+    HostName 10.0.0.2
+    GlobalKnownHostsFile /etc/ssh/wesher_known_hosts
+`
+	if got := formatSSHConfig(nodes, "/etc/ssh/wesher_known_hosts"); got != wantConfig {
+		t.Errorf("formatSSHConfig() = %q, want %q", got, wantConfig)
+	}
+
+	wantKnownHosts := `# managed by wesher; changes will be overwritten
+node1,10.0.0.1 ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIA==
+node1,10.0.0.1 ssh-rsa AAAAB3NzaC1yc2E=
+`
+	if got := formatKnownHosts(nodes); got != wantKnownHosts {
+		t.Errorf("formatKnownHosts() = %q, want %q", got, wantKnownHosts)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/costela/wesher/cluster"
+	"github.com/costela/wesher/common"
+	"github.com/costela/wesher/wg"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// newCluster creates the cluster, or a standalone one with the static peers of --standalone-peers
+// With a relay, gossip packets share its socket.
+func newCluster(c *config, relay *wg.Relay) (*cluster.Cluster, error) {
+	if !c.Standalone {
+		var shared cluster.SharedSocket
+		if relay != nil {
+			shared = relay
+		}
+		return cluster.New(c.Interface, c.Init, c.ClusterKey, c.BindAddr, c.ClusterPort, c.BindDevice, c.AdvertiseAddr, c.ClusterPort, c.nodeName(), c.GossipQueueDepth, !c.NoGossipCompression, time.Duration(*c.PushPullInterval), c.GossipNodes, c.GossipOverOverlay, shared)
+	}
+	var peers []common.Node
+	if c.StandalonePeers != "" {
+		var err error
+		if peers, err = loadStaticPeers(c.StandalonePeers); err != nil {
+			return nil, err
+		}
+	}
+	logrus.Infof("running standalone with %d static peers, without cluster membership gossip", len(peers))
+	advertiseAddr := c.AdvertiseAddr
+	if advertiseAddr == "" {
+		advertiseAddr = c.BindAddr // what memberlist would advertise
+	}
+	return cluster.NewStandalone(c.nodeName(), advertiseAddr, peers)
+}
+
+// loadStaticPeers reads peers from a file with one peer per line, consisting of its name, wireguard public key,
+// overlay address and endpoint address, optionally with a port (address:port), separated by whitespace; empty lines
+// and lines starting with # are ignored.
+// The peers carry encoded metadata, like cluster members.
+func loadStaticPeers(path string) ([]common.Node, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open static peers file")
+	}
+	defer f.Close()
+	peers := []common.Node{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 4 {
+			return nil, errors.Errorf("%s:%d: expected a node name, public key, overlay address and endpoint address", path, line)
+		}
+		peer, err := staticPeer(fields[0], fields[1], fields[2], fields[3])
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", path, line)
+		}
+		peers = append(peers, peer)
+	}
+	return peers, errors.Wrap(scanner.Err(), "could not read static peers file")
+}
+
+func staticPeer(name, pubKey, overlayAddr, endpoint string) (common.Node, error) {
+	peer := common.Node{Name: name}
+	if _, err := wgtypes.ParseKey(pubKey); err != nil {
+		return peer, errors.Wrapf(err, "invalid public key %q", pubKey)
+	}
+	peer.PubKey = pubKey
+	ip := net.ParseIP(overlayAddr)
+	if ip == nil {
+		return peer, errors.Errorf("invalid overlay address %q", overlayAddr)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	peer.OverlayAddr = net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+	host := endpoint
+	if h, port, err := net.SplitHostPort(endpoint); err == nil {
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil || p == 0 {
+			return peer, errors.Errorf("invalid endpoint port in %q", endpoint)
+		}
+		host, peer.EndpointPort = h, uint16(p)
+	}
+	if peer.Addr = net.ParseIP(host); peer.Addr == nil {
+		return peer, errors.Errorf("invalid endpoint address %q", endpoint)
+	}
+	meta, err := peer.FullMeta()
+	if err != nil {
+		return peer, err
+	}
+	peer.Meta = meta
+	return peer, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func Test_loadStaticPeers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wesher-peers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, _ := wgtypes.GeneratePrivateKey()
+	pubKey := key.PublicKey().String()
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"peers", "# comment\n\nnode1 " + pubKey + " 10.0.0.2 192.0.2.1\nnode2 " + pubKey + " 10.0.0.3 192.0.2.2:51821\n", false},
+		{"missing field", "node1 " + pubKey + " 10.0.0.2\n", true},
+		{"invalid key", "node1 nokey 10.0.0.2 192.0.2.1\n", true},
+		{"invalid overlay address", "node1 " + pubKey + " nowhere 192.0.2.1\n", true},
+		{"invalid port", "node1 " + pubKey + " 10.0.0.2 192.0.2.1:0\n", true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := path.Join(dir, string(rune('a'+i)))
+			if err := ioutil.WriteFile(file, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			peers, err := loadStaticPeers(file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadStaticPeers() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(peers) != 2 {
+				t.Fatalf("loadStaticPeers() = %d peers, want 2", len(peers))
+			}
+			peer := peers[1]
+			if err := peer.DecodeMeta(); err != nil {
+				t.Fatalf("DecodeMeta() error = %v", err)
+			}
+			if peer.Name != "node2" || peer.Addr.String() != "192.0.2.2" || peer.EndpointPort != 51821 || peer.PubKey != pubKey || peer.OverlayAddr.String() != "10.0.0.3/32" {
+				t.Errorf("loadStaticPeers() peer = %s %s:%d %s %s, want node2 192.0.2.2:51821 %s 10.0.0.3/32", peer.Name, peer.Addr, peer.EndpointPort, peer.PubKey, peer.OverlayAddr.String(), pubKey)
+			}
+		})
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/costela/wesher/cluster"
+	"github.com/costela/wesher/common"
+	"github.com/costela/wesher/control"
+)
+
+// subcommands maps subcommand names to their implementation
+// Each implementation receives the positional arguments following the subcommand name and provides the exit code;
+// all other arguments are left in os.Args to be parsed as configuration.
+var subcommands = map[string]func(args []string) int{
+	"validate":  func([]string) int { return runValidate() },
+	"doctor":    func([]string) int { return runDoctor() },
+	"route":     runRoute,
+	"status":    runStatus,
+	"resync":    runResync,
+	"kv":        runKV,
+	"metadata":  runMetadata,
+	"export":    runExport,
+	"inventory": runInventory,
+
+	"rotate-cluster-key": runRotateClusterKey,
+}
+
+// runSubcommand runs the subcommand named by the first argument, if any, and exits with its exit code
+func runSubcommand() {
+	if len(os.Args) < 2 {
+		return
+	}
+	run, ok := subcommands[os.Args[1]]
+	if !ok {
+		return
+	}
+	end := 2
+	for end < len(os.Args) && !strings.HasPrefix(os.Args[end], "-") {
+		end++
+	}
+	args := append([]string{}, os.Args[2:end]...)
+	os.Args = append(os.Args[:1], os.Args[end:]...)
+	os.Exit(run(args))
+}
+
+// runRoute implements the route subcommand, listing, adding or withdrawing routes announced by the running daemon
+func runRoute(args []string) int {
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	command, networks := "route-list", []string{}
+	switch {
+	case len(args) == 0:
+	case len(args) == 2 && args[0] == "add":
+		command, networks = "route-add", args[1:]
+	case len(args) == 2 && (args[0] == "del" || args[0] == "delete"):
+		command, networks = "route-del", args[1:]
+	default:
+		fmt.Fprintln(os.Stderr, "usage: wesher route [add|del NETWORK/CIDR]")
+		return 2
+	}
+
+	routes := []string{}
+	if err := control.Send(config.controlSocket(), &routes, command, networks...); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	printResult(config.Output, struct {
+		Routes []string `json:"routes"`
+	}{routes}, func() {
+		for _, route := range routes {
+			fmt.Println(route)
+		}
+	})
+	return 0
+}
+
+// statusResult is the summary of the running daemon provided by the status subcommand
+type statusResult struct {
+	Name      string   `json:"name"`
+	Version   string   `json:"version"`
+	Members   int      `json:"members"`
+	Leader    string   `json:"leader"`
+	IsLeader  bool     `json:"is_leader"`
+	Connected bool     `json:"connected"`           // false while disconnected on request, e.g. via D-Bus
+	Conflicts []string `json:"conflicts,omitempty"` // other nodes claiming the name of this node
+	// RouteConflicts lists the routed networks announced by more than one node, as resolved by the last configuration
+	RouteConflicts []string `json:"route_conflicts,omitempty"`
+	Waiting        bool     `json:"waiting,omitempty"` // waiting for --min-members before configuring the interface
+	// VIPs holds the owner of each virtual IP known to the node, by address
+	VIPs map[string]string `json:"vips,omitempty"`
+	// KeyMismatches lists the nodes gossip repeatedly could not be decrypted from, most likely using another cluster key
+	KeyMismatches []string `json:"key_mismatches,omitempty"`
+	// Partitioned is set while partition detection considers the node partitioned from the cluster
+	Partitioned bool `json:"partitioned,omitempty"`
+	// Gossip holds the configured gossip tuning and the one recommended for the current cluster size
+	Gossip      gossipStatus      `json:"gossip"`
+	Convergence convergenceStatus `json:"convergence"`
+	Nodes       []nodeFacts       `json:"nodes"` // including the local node, sorted by name
+}
+
+// nodeFacts describes the host and wesher version of a node, as gossiped in its metadata
+type nodeFacts struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	OS      string `json:"os,omitempty"`
+	Arch    string `json:"arch,omitempty"`
+	Kernel  string `json:"kernel,omitempty"`
+	// Metadata holds the free-form values announced by the node, see wesher metadata
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// newNodeFacts provides the facts of the nodes, sorted by name; nodes not gossiping facts, i.e. running older versions,
+// have them empty
+func newNodeFacts(nodes []common.Node) []nodeFacts {
+	facts := make([]nodeFacts, len(nodes))
+	for i, node := range nodes {
+		facts[i] = nodeFacts{Name: node.Name, Version: node.Version, OS: node.OS, Arch: node.Arch, Kernel: node.Kernel, Metadata: node.Metadata}
+	}
+	sort.Slice(facts, func(i, j int) bool { return facts[i].Name < facts[j].Name })
+	return facts
+}
+
+// keyMismatchNames formats the cluster key mismatches for the status output
+func keyMismatchNames(mismatches []cluster.KeyMismatch) []string {
+	names := make([]string, len(mismatches))
+	for i, mismatch := range mismatches {
+		names[i] = mismatch.Addr
+		if mismatch.Node != "" {
+			names[i] = fmt.Sprintf("%s (%s)", mismatch.Node, mismatch.Addr)
+		}
+	}
+	return names
+}
+
+// String formats the facts for human consumption, marking unknown ones
+func (f nodeFacts) String() string {
+	unknown := func(s string) string {
+		if s == "" {
+			return "?"
+		}
+		return s
+	}
+	s := fmt.Sprintf("%s: wesher %s, %s/%s, kernel %s", f.Name, unknown(f.Version), unknown(f.OS), unknown(f.Arch), unknown(f.Kernel))
+	keys := make([]string, 0, len(f.Metadata))
+	for key := range f.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s += fmt.Sprintf(", %s=%s", key, f.Metadata[key])
+	}
+	return s
+}
+
+// convergenceStatus describes the state of the gossip protocol, telling network trouble apart from a converged cluster
+type convergenceStatus struct {
+	HealthScore    int    `json:"health_score"` // 0 is healthy
+	SuspectMembers int    `json:"suspect_members"`
+	LastPushPull   string `json:"last_push_pull,omitempty"` // RFC3339, empty if none yet
+	// LastPushPullAge is the time since the last complete state exchange, for human consumption
+	LastPushPullAge string `json:"last_push_pull_age,omitempty"`
+}
+
+// gossipStatus describes the gossip tuning of the running daemon
+type gossipStatus struct {
+	PushPullInterval            string `json:"push_pull_interval"`
+	GossipNodes                 int    `json:"gossip_nodes"`
+	RecommendedPushPullInterval string `json:"recommended_push_pull_interval"`
+	RecommendedGossipNodes      int    `json:"recommended_gossip_nodes"`
+}
+
+// runStatus implements the status subcommand, summarizing the state of the running daemon
+func runStatus(args []string) int {
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "usage: wesher status")
+		return 2
+	}
+
+	status := statusResult{}
+	if err := control.Send(config.controlSocket(), &status, "status"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	printResult(config.Output, status, func() {
+		fmt.Printf("name: %s\nversion: %s\nmembers: %d\nleader: %s\nconnected: %t\n", status.Name, status.Version, status.Members, status.Leader, status.Connected)
+		if status.Waiting {
+			fmt.Println("waiting for more members before configuring the interface")
+		}
+		for _, mismatch := range status.KeyMismatches {
+			fmt.Printf("cluster key mismatch: %s\n", mismatch)
+		}
+		if status.Partitioned {
+			fmt.Println("partitioned: most expected members are not visible")
+		}
+		vips := make([]string, 0, len(status.VIPs))
+		for vip := range status.VIPs {
+			vips = append(vips, vip)
+		}
+		sort.Strings(vips)
+		for _, vip := range vips {
+			fmt.Printf("virtual IP %s: %s\n", vip, status.VIPs[vip])
+		}
+		c := status.Convergence
+		lastPushPull := "never"
+		if c.LastPushPull != "" {
+			lastPushPull = c.LastPushPullAge + " ago"
+		}
+		fmt.Printf("health score: %d\nsuspect members: %d\nlast push/pull: %s\n", c.HealthScore, c.SuspectMembers, lastPushPull)
+		g := status.Gossip
+		fmt.Printf("gossip: push/pull every %s, fan-out %d (recommended: %s, %d)\n", g.PushPullInterval, g.GossipNodes, g.RecommendedPushPullInterval, g.RecommendedGossipNodes)
+		for _, conflict := range status.Conflicts {
+			fmt.Printf("name conflict: %s\n", conflict)
+		}
+		for _, conflict := range status.RouteConflicts {
+			fmt.Printf("route conflict: %s\n", conflict)
+		}
+		fmt.Println("nodes:")
+		for _, node := range status.Nodes {
+			outdated := ""
+			if node.Version != status.Version {
+				outdated = " (version differs)"
+			}
+			fmt.Printf("  %s%s\n", node, outdated)
+		}
+	})
+	return 0
+}
+
+// runResync implements the resync subcommand, forcing the running daemon to resync like SIGUSR2
+func runResync(args []string) int {
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "usage: wesher resync")
+		return 2
+	}
+
+	if err := control.Send(config.controlSocket(), nil, "resync"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// runKV implements the kv subcommand, reading or changing the key/value store replicated to all nodes
+func runKV(args []string) int {
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	switch {
+	case len(args) == 0:
+		values := map[string]string{}
+		if err := control.Send(config.controlSocket(), &values, "kv-list"); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		printResult(config.Output, values, func() {
+			keys := make([]string, 0, len(values))
+			for key := range values {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				fmt.Printf("%s=%s\n", key, values[key])
+			}
+		})
+	case len(args) == 2 && args[0] == "get":
+		var value string
+		if err := control.Send(config.controlSocket(), &value, "kv-get", args[1]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		printResult(config.Output, struct {
+			Value string `json:"value"`
+		}{value}, func() { fmt.Println(value) })
+	case len(args) == 3 && args[0] == "set", len(args) == 2 && (args[0] == "del" || args[0] == "delete"):
+		command := "kv-set"
+		if args[0] != "set" {
+			command = "kv-del"
+		}
+		if err := control.Send(config.controlSocket(), nil, command, args[1:]...); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "usage: wesher kv [get KEY|set KEY VALUE|del KEY]")
+		return 2
+	}
+	return 0
+}
+
+// runMetadata implements the metadata subcommand, reading or changing the metadata the running daemon announces
+func runMetadata(args []string) int {
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	switch {
+	case len(args) == 0:
+		metadata := map[string]string{}
+		if err := control.Send(config.controlSocket(), &metadata, "metadata-list"); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		printResult(config.Output, metadata, func() {
+			keys := make([]string, 0, len(metadata))
+			for key := range metadata {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				fmt.Printf("%s=%s\n", key, metadata[key])
+			}
+		})
+	case len(args) == 3 && args[0] == "set", len(args) == 2 && (args[0] == "del" || args[0] == "delete"):
+		command := "metadata-set"
+		if args[0] != "set" {
+			command = "metadata-del"
+		}
+		if err := control.Send(config.controlSocket(), nil, command, args[1:]...); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "usage: wesher metadata [set KEY VALUE|del KEY]")
+		return 2
+	}
+	return 0
+}
+
+// keyRotationTimeout bounds the wait for all members to acknowledge a new cluster key, within the control timeout
+const keyRotationTimeout = 20 * time.Second
+
+// rotateKeyResult is the outcome of a cluster key rotation
+type rotateKeyResult struct {
+	Key     string   `json:"key"`     // base64 encoded
+	Members []string `json:"members"` // switched to the new key, besides the local node
+}
+
+// runRotateClusterKey implements the rotate-cluster-key subcommand, switching all members to a new cluster key
+func runRotateClusterKey(args []string) int {
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "usage: wesher rotate-cluster-key")
+		return 2
+	}
+
+	result := rotateKeyResult{}
+	if err := control.Send(config.controlSocket(), &result, "rotate-cluster-key"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	printResult(config.Output, result, func() {
+		fmt.Printf("switched %d members to the new cluster key: %s\n", len(result.Members)+1, result.Key)
+		if len(config.ClusterKey) > 0 {
+			fmt.Println("update --cluster-key on every node, or it overrides the new key on restart")
+		}
+	})
+	return 0
+}
+
+// changeMetadata sets a metadata entry from KEY VALUE arguments, or deletes one from a KEY argument
+// The metadata is copied, since the announced one may still be in use.
+func changeMetadata(metadata map[string]string, set bool, args []string) (map[string]string, error) {
+	result := make(map[string]string, len(metadata)+1)
+	for key, value := range metadata {
+		result[key] = value
+	}
+	switch {
+	case set && len(args) == 2:
+		if err := common.ValidMetadata(args[0], args[1]); err != nil {
+			return nil, err
+		}
+		result[args[0]] = args[1]
+		if len(result) > common.MaxMetadataEntries {
+			return nil, fmt.Errorf("at most %d metadata entries are allowed", common.MaxMetadataEntries)
+		}
+	case !set && len(args) == 1:
+		delete(result, args[0])
+	default:
+		return nil, fmt.Errorf("invalid metadata arguments %v", args)
+	}
+	return result, nil
+}
+
+// changeRoutes adds or removes the provided networks to or from the manually announced routes
+// Only networks inside the routed networks may be added, just like automatically discovered routes. The result is
+// not aggregated, so every added network can later be removed again.
+func changeRoutes(routes []net.IPNet, add bool, args []string, routedNets []*net.IPNet) ([]net.IPNet, error) {
+	result := append([]net.IPNet{}, routes...)
+	for _, arg := range args {
+		_, network, err := net.ParseCIDR(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %s", arg, err)
+		}
+		if !add {
+			for i := 0; i < len(result); i++ {
+				if result[i].String() == network.String() {
+					result = append(result[:i], result[i+1:]...)
+					i--
+				}
+			}
+			continue
+		}
+		routed := false
+		for _, routedNet := range routedNets {
+			routed = routed || routedNet.Contains(network.IP)
+		}
+		if !routed {
+			return nil, fmt.Errorf("network %s is not part of any routed network", network)
+		}
+		exists := false
+		for _, route := range result {
+			exists = exists || route.String() == network.String()
+		}
+		if !exists {
+			result = append(result, *network)
+		}
+	}
+	return result, nil
+}
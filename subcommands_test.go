@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/costela/wesher/common"
+)
+
+func Test_changeRoutes(t *testing.T) {
+	_, routedNet, _ := net.ParseCIDR("192.168.0.0/16")
+	routedNets := []*net.IPNet{routedNet}
+
+	routes, err := changeRoutes(nil, true, []string{"192.168.5.0/24", "192.168.6.0/24", "192.168.5.0/24"}, routedNets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := networkStrings(routes); len(got) != 2 || got[0] != "192.168.5.0/24" || got[1] != "192.168.6.0/24" {
+		t.Errorf("changeRoutes() add = %v, want [192.168.5.0/24 192.168.6.0/24]", got)
+	}
+
+	routes, err = changeRoutes(routes, false, []string{"192.168.5.0/24"}, routedNets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := networkStrings(routes); len(got) != 1 || got[0] != "192.168.6.0/24" {
+		t.Errorf("changeRoutes() del = %v, want [192.168.6.0/24]", got)
+	}
+
+	if _, err := changeRoutes(routes, true, []string{"10.0.0.0/24"}, routedNets); err == nil {
+		t.Error("changeRoutes() should refuse networks outside of the routed networks")
+	}
+	if _, err := changeRoutes(routes, true, []string{"192.168.7.0"}, routedNets); err == nil {
+		t.Error("changeRoutes() should refuse invalid networks")
+	}
+}
+
+func Test_changeMetadata(t *testing.T) {
+	announced := map[string]string{"rack": "r12"}
+	metadata, err := changeMetadata(announced, true, []string{"maintenance", "yes"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"rack": "r12", "maintenance": "yes"}; !reflect.DeepEqual(metadata, want) {
+		t.Errorf("changeMetadata() set = %v, want %v", metadata, want)
+	}
+	if len(announced) != 1 {
+		t.Errorf("changeMetadata() modified the announced metadata: %v", announced)
+	}
+
+	metadata, err = changeMetadata(metadata, false, []string{"rack"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"maintenance": "yes"}; !reflect.DeepEqual(metadata, want) {
+		t.Errorf("changeMetadata() del = %v, want %v", metadata, want)
+	}
+
+	if _, err := changeMetadata(metadata, true, []string{"Rack", "r12"}); err == nil {
+		t.Error("changeMetadata() should refuse invalid keys")
+	}
+}
+
+func Test_newNodeFacts(t *testing.T) {
+	current := common.Node{Name: "b"}
+	current.Version, current.OS, current.Arch, current.Kernel = "1.2.0", "linux", "amd64", "5.10.0"
+	old := common.Node{Name: "a"} // gossips no facts
+
+	facts := newNodeFacts([]common.Node{current, old})
+	if len(facts) != 2 || facts[0].Name != "a" || facts[1].Name != "b" {
+		t.Fatalf("newNodeFacts() = %v, want a and b sorted by name", facts)
+	}
+	if got, want := facts[0].String(), "a: wesher ?, ?/?, kernel ?"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	if got, want := facts[1].String(), "b: wesher 1.2.0, linux/amd64, kernel 5.10.0"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/costela/wesher/wg"
+	"github.com/sirupsen/logrus"
+)
+
+// capNetAdmin is the capability needed to manage network interfaces, routes and wireguard devices
+const capNetAdmin = 12
+
+// validateResult is the machine-readable result of the validate subcommand
+type validateResult struct {
+	Valid    bool     `json:"valid"`
+	Problems []string `json:"problems"`
+}
+
+// runValidate implements the validate subcommand: it checks the configuration without changing anything on the
+// system, printing every problem found, and provides the exit code
+func runValidate() int {
+	result := validateResult{Problems: []string{}}
+	var format string
+	config, err := loadConfig()
+	if err != nil {
+		result.Problems = append(result.Problems, err.Error())
+		format = outputFormatFromArgs(os.Args[1:])
+	} else {
+		format = config.Output
+		for _, problem := range config.validate() {
+			result.Problems = append(result.Problems, problem.Error())
+		}
+	}
+	result.Valid = len(result.Problems) == 0
+
+	printResult(format, result, func() {
+		for _, problem := range result.Problems {
+			fmt.Fprintf(os.Stderr, "invalid configuration: %s\n", problem)
+		}
+		if result.Valid {
+			fmt.Println("configuration is valid")
+		}
+	})
+	if !result.Valid {
+		return 1
+	}
+	return 0
+}
+
+// validate performs the checks not already done while loading the config, which depend on the state of the system
+// and are therefore not fatal before actually running
+func (c *config) validate() []error {
+	var problems []error
+
+	if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
+		problems = append(problems, fmt.Errorf("log-level: %s", err))
+	}
+
+	// overlay network sanity
+	overlayNet := (*net.IPNet)(c.OverlayNet)
+	if ones, bits := overlayNet.Mask.Size(); bits-ones < 8 {
+		problems = append(problems, fmt.Errorf("overlay-net %s is too small to allocate addresses without collisions; use at least a /%d", overlayNet, bits-8))
+	}
+	if c.MTU < 576 || c.MTU > 65535 {
+		problems = append(problems, fmt.Errorf("mtu %d is out of range 576-65535", c.MTU))
+	}
+	if _, err := c.routedHosts(); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := c.sshHostKeys(); err != nil {
+		problems = append(problems, err)
+	}
+	if c.ExternalPeersFile != "" {
+		if _, err := wg.LoadExternalPeers(c.ExternalPeersFile); err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	// port conflicts
+	inRange := map[string]bool{}
+	for name, port := range map[string]int{"cluster-port": c.ClusterPort, "wireguard-port": c.WireguardPort} {
+		if inRange[name] = port >= 1 && port <= 65535; !inRange[name] {
+			problems = append(problems, fmt.Errorf("%s %d is out of range 1-65535", name, port))
+		}
+	}
+	if c.ClusterPort == c.WireguardPort {
+		problems = append(problems, fmt.Errorf("cluster-port and wireguard-port must differ, both are %d", c.ClusterPort))
+	}
+	if inRange["wireguard-port"] {
+		problems = append(problems, checkPortFree("udp", c.BindAddr, c.WireguardPort, "wireguard-port")...)
+	}
+	if inRange["cluster-port"] {
+		problems = append(problems, checkPortFree("udp", c.BindAddr, c.ClusterPort, "cluster-port")...)
+		problems = append(problems, checkPortFree("tcp", c.BindAddr, c.ClusterPort, "cluster-port")...)
+	}
+
+	// scripts
+	if c.NodeUpdateScript != "" {
+		if _, err := exec.LookPath(c.NodeUpdateScript); err != nil {
+			problems = append(problems, fmt.Errorf("node-update-script %s cannot be executed: %s", c.NodeUpdateScript, err))
+		}
+	}
+	if c.PartitionScript != "" {
+		if _, err := exec.LookPath(c.PartitionScript); err != nil {
+			problems = append(problems, fmt.Errorf("partition-script %s cannot be executed: %s", c.PartitionScript, err))
+		}
+	}
+	if c.HealthScript != "" {
+		if _, err := exec.LookPath(c.HealthScript); err != nil {
+			problems = append(problems, fmt.Errorf("health-script %s cannot be executed: %s", c.HealthScript, err))
+		}
+	}
+
+	// permissions
+	if c.Backend == wg.BackendFake {
+		// no devices are managed
+	} else if ok, err := hasCapability(capNetAdmin); err != nil {
+		problems = append(problems, fmt.Errorf("could not check capabilities: %s", err))
+	} else if !ok {
+		problems = append(problems, fmt.Errorf("missing CAP_NET_ADMIN capability, needed to manage the wireguard interface; run as root or grant it"))
+	}
+	if !c.NoEtcHosts {
+		if err := checkWritable("/etc/hosts"); err != nil {
+			problems = append(problems, fmt.Errorf("hosts file cannot be written (disable with --no-etc-hosts): %s", err))
+		}
+	}
+	if err := checkWritable("/var/lib/wesher"); err != nil && !os.IsNotExist(err) {
+		problems = append(problems, fmt.Errorf("state directory cannot be written: %s", err))
+	}
+	if c.DumpFile != "" {
+		if err := checkWritable(path.Dir(c.DumpFile)); err != nil {
+			problems = append(problems, fmt.Errorf("dump-file directory cannot be written: %s", err))
+		}
+	}
+	if c.EventLog != "" {
+		if err := checkWritable(path.Dir(c.EventLog)); err != nil {
+			problems = append(problems, fmt.Errorf("event-log directory cannot be written: %s", err))
+		}
+	}
+
+	return problems
+}
+
+// checkPortFree checks whether the port can be listened on
+func checkPortFree(network, addr string, port int, name string) []error {
+	hostPort := net.JoinHostPort(addr, strconv.Itoa(port))
+	var err error
+	if network == "udp" {
+		var conn net.PacketConn
+		if conn, err = net.ListenPacket(network, hostPort); err == nil {
+			conn.Close()
+		}
+	} else {
+		var listener net.Listener
+		if listener, err = net.Listen(network, hostPort); err == nil {
+			listener.Close()
+		}
+	}
+	if err != nil {
+		return []error{fmt.Errorf("%s %d (%s) cannot be used, is another instance running?: %s", name, port, network, err)}
+	}
+	return nil
+}
+
+// checkWritable checks whether the provided file or directory is writable by the current process
+func checkWritable(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		f, err := ioutil.TempFile(path, ".wesher-validate")
+		if err != nil {
+			return err
+		}
+		f.Close()
+		return os.Remove(f.Name())
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// hasCapability checks whether the provided capability is in the effective set of the current process
+func hasCapability(capability uint) (bool, error) {
+	status, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+		capEff, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+		if err != nil {
+			return false, err
+		}
+		return capEff&(1<<capability) != 0, nil
+	}
+	return false, fmt.Errorf("no effective capabilities found")
+}
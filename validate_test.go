@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/base64"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// freePort provides a port currently free for both TCP and UDP on the loopback address
+func freePort(t *testing.T) int {
+	for i := 0; i < 10; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := listener.Addr().(*net.TCPAddr).Port
+		listener.Close()
+		if conn, err := net.ListenPacket("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port))); err == nil {
+			conn.Close()
+			return port
+		}
+	}
+	t.Fatal("could not find a free port")
+	return 0
+}
+
+func Test_config_validate(t *testing.T) {
+	defer func(args []string) { os.Args = args }(os.Args)
+	clusterPort, wireguardPort := strconv.Itoa(freePort(t)), strconv.Itoa(freePort(t))
+
+	tests := []struct {
+		name    string
+		args    []string
+		modify  func(c *config)
+		wantErr string // substring of the single expected problem, empty for none
+	}{
+		{"valid", nil, nil, ""},
+		{"short cluster key", []string{"--cluster-key", base64.StdEncoding.EncodeToString(make([]byte, 16))}, nil, "unsupported cluster key length"},
+		{"long cluster key", []string{"--cluster-key", base64.StdEncoding.EncodeToString(make([]byte, 64))}, nil, "unsupported cluster key length"},
+		{"overlay net too small", []string{"--overlay-net", "10.0.0.0/32"}, nil, "overlay-net 10.0.0.0/32 is too small"},
+		{"overlay net too small for IPv6", []string{"--overlay-net", "fd00::/128"}, nil, "use at least a /120"},
+		{"equal ports", nil, func(c *config) { c.WireguardPort = c.ClusterPort }, "cluster-port and wireguard-port must differ"},
+		{"port out of range", nil, func(c *config) { c.WireguardPort = 70000 }, "wireguard-port 70000 is out of range"},
+		{"missing node update script", nil, func(c *config) { c.NodeUpdateScript = "/nonexistent/update.sh" }, "node-update-script /nonexistent/update.sh cannot be executed"},
+		{"missing health script", nil, func(c *config) { c.HealthScript = "/nonexistent/health.sh" }, "health-script /nonexistent/health.sh cannot be executed"},
+		{"mtu out of range", nil, func(c *config) { c.MTU = 100 }, "mtu 100 is out of range"},
+		{"zero advertise command interval", []string{"--advertise-addr-cmd-interval", "0"}, nil, "advertise address command interval must be positive"},
+		{"single port with endpoint port", []string{"--single-port", "--wireguard-endpoint-port", "51821"}, nil, "a single port cannot be used with --wireguard-endpoint-port"},
+		{"negative health interval", []string{"--health-interval", "-1m"}, nil, "health interval must be positive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Args = append([]string{"wesher", "--backend", "fake", "--no-etc-hosts", "--bind-addr", "127.0.0.1",
+				"--cluster-port", clusterPort, "--wireguard-port", wireguardPort}, tt.args...)
+			var problems []string
+			c, err := loadConfig()
+			if err != nil {
+				problems = append(problems, err.Error())
+			} else {
+				if tt.modify != nil {
+					tt.modify(c)
+				}
+				for _, problem := range c.validate() {
+					problems = append(problems, problem.Error())
+				}
+			}
+
+			switch {
+			case tt.wantErr == "" && len(problems) != 0:
+				t.Errorf("validate() = %v, want no problems", problems)
+			case tt.wantErr != "" && (len(problems) != 1 || !strings.Contains(problems[0], tt.wantErr)):
+				t.Errorf("validate() = %v, want a single problem containing %q", problems, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package wg
+
+import (
+	"bufio"
+	"hash/fnv"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// AddressStrategy assigns the overlay address of the local node inside the overlay network
+// It is provided the name of the local node and the overlay addresses already used by other known nodes.
+// Automatic strategies never assign addresses of their reserved ranges.
+type AddressStrategy interface {
+	Assign(ipnet *net.IPNet, name string, used []net.IP) (net.IP, error)
+}
+
+// HashName assigns addresses by hashing the node name, so every node deterministically gets the same address
+// This is the default strategy; it needs no coordination, but may collide in small networks.
+type HashName struct {
+	Reserved []*net.IPNet
+}
+
+// Assign implements AddressStrategy
+func (h HashName) Assign(ipnet *net.IPNet, name string, used []net.IP) (net.IP, error) {
+	return hashUnreserved(ipnet, []byte(name), h.Reserved)
+}
+
+// HashPubKey assigns addresses by hashing the wireguard public key, so addresses follow the node identity instead of
+// its name
+type HashPubKey struct {
+	PubKey   wgtypes.Key
+	Reserved []*net.IPNet
+}
+
+// Assign implements AddressStrategy
+func (h HashPubKey) Assign(ipnet *net.IPNet, name string, used []net.IP) (net.IP, error) {
+	return hashUnreserved(ipnet, h.PubKey[:], h.Reserved)
+}
+
+// Sequential assigns the lowest address not used by any known node, packing nodes densely
+// Known nodes are the ones persisted from previous runs, so addresses are only stable as long as the state is kept;
+// nodes started at once without state may collide.
+type Sequential struct {
+	Reserved []*net.IPNet
+}
+
+// Assign implements AddressStrategy
+func (s Sequential) Assign(ipnet *net.IPNet, name string, used []net.IP) (net.IP, error) {
+	taken := make(map[string]bool, len(used))
+	for _, ip := range used {
+		taken[ip.String()] = true
+	}
+	ip := append(net.IP{}, ipnet.IP.Mask(ipnet.Mask)...)
+	for next(ip); ipnet.Contains(ip); next(ip) {
+		if r := ReservedRange(s.Reserved, ip); r != nil {
+			ip = lastAddr(r) // skip the whole range
+			continue
+		}
+		if !taken[ip.String()] && !isBroadcast(ipnet, ip) {
+			return ip, nil
+		}
+	}
+	return nil, errors.Errorf("no free address left in %s", ipnet)
+}
+
+// Static assigns the addresses listed by node name, leaving full control to the operator
+// Listed addresses may be part of reserved ranges, which are meant for static assignments.
+type Static struct {
+	Addrs map[string]net.IP
+}
+
+// Assign implements AddressStrategy
+func (s Static) Assign(ipnet *net.IPNet, name string, used []net.IP) (net.IP, error) {
+	ip, ok := s.Addrs[name]
+	if !ok {
+		return nil, errors.Errorf("no static address listed for node %s", name)
+	}
+	if !ipnet.Contains(ip) {
+		return nil, errors.Errorf("static address %s of node %s is outside of the overlay network %s", ip, name, ipnet)
+	}
+	return ip, nil
+}
+
+// LoadStaticAddrs reads the static addresses of nodes from a file with one node per line, consisting of its name and
+// address separated by whitespace; empty lines and lines starting with # are ignored.
+func LoadStaticAddrs(path string) (map[string]net.IP, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open static addresses file")
+	}
+	defer f.Close()
+	addrs := make(map[string]net.IP)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, errors.Errorf("%s:%d: expected a node name and an address", path, line)
+		}
+		ip := net.ParseIP(fields[1])
+		if ip == nil {
+			return nil, errors.Errorf("%s:%d: invalid address %q", path, line, fields[1])
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		addrs[fields[0]] = ip
+	}
+	return addrs, errors.Wrap(scanner.Err(), "could not read static addresses file")
+}
+
+// maxRehash bounds the attempts to hash into an unreserved address
+const maxRehash = 64
+
+// hashUnreserved hashes the provided data into the network, rehashing with a counter while the address is reserved,
+// so only nodes hashing into reserved ranges get a different address than without reservation
+func hashUnreserved(ipnet *net.IPNet, data []byte, reserved []*net.IPNet) (net.IP, error) {
+	ip := hashAddr(ipnet, data)
+	for i := byte(1); ReservedRange(reserved, ip) != nil; i++ {
+		if i > maxRehash {
+			return nil, errors.Errorf("could not find an unreserved address in %s", ipnet)
+		}
+		ip = hashAddr(ipnet, append(append([]byte{}, data...), i))
+	}
+	return ip, nil
+}
+
+// ReservedRange provides the reserved range containing the address, if any
+func ReservedRange(reserved []*net.IPNet, ip net.IP) *net.IPNet {
+	for _, r := range reserved {
+		if r.Contains(ip) {
+			return r
+		}
+	}
+	return nil
+}
+
+// lastAddr provides the last address of the network
+func lastAddr(ipnet *net.IPNet) net.IP {
+	ip := append(net.IP{}, ipnet.IP.Mask(ipnet.Mask)...)
+	for i := range ip {
+		ip[i] |= ^ipnet.Mask[len(ipnet.Mask)-len(ip)+i]
+	}
+	return ip
+}
+
+// hashAddr maps a hash of the provided data into the network
+func hashAddr(ipnet *net.IPNet, data []byte) net.IP {
+	// TODO: this is way too brittle and opaque
+	bits, size := ipnet.Mask.Size()
+	ip := make([]byte, len(ipnet.IP))
+	copy(ip, []byte(ipnet.IP))
+
+	h := fnv.New128a()
+	h.Write(data)
+	hb := h.Sum(nil)
+
+	for i := 1; i <= (size-bits)/8; i++ {
+		ip[len(ip)-i] = hb[len(hb)-i]
+	}
+	return net.IP(ip)
+}
+
+// AssignPrefix maps a hash of the provided data to a prefix of the given length inside the network, e.g. to assign
+// every node its own /64 of a secondary overlay network
+func AssignPrefix(ipnet *net.IPNet, ones int, data []byte) net.IPNet {
+	bits, size := ipnet.Mask.Size()
+	h := fnv.New128a()
+	h.Write(data)
+	hb := h.Sum(nil)
+
+	ip := append(net.IP{}, ipnet.IP.Mask(ipnet.Mask)...)
+	for i := bits; i < ones; i++ {
+		ip[i/8] |= hb[i/8] & (0x80 >> uint(i%8))
+	}
+	return net.IPNet{IP: ip, Mask: net.CIDRMask(ones, size)}
+}
+
+// next increments the address in place
+func next(ip net.IP) {
+	for i := len(ip) - 1; i >= 0; i-- {
+		ip[i]++
+		if ip[i] != 0 {
+			return
+		}
+	}
+}
+
+// isBroadcast reports whether the address is the broadcast address of an IPv4 network
+func isBroadcast(ipnet *net.IPNet, ip net.IP) bool {
+	if ip.To4() == nil || len(ip) != len(ipnet.Mask) {
+		return false
+	}
+	for i := range ip {
+		if ip[i]|ipnet.Mask[i] != 0xff {
+			return false
+		}
+	}
+	return true
+}
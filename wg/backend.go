@@ -0,0 +1,220 @@
+package wg
+
+import (
+	"net"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// backends
+const (
+	BackendKernel = "kernel"
+	BackendFake   = "fake"
+)
+
+// Backend manages wireguard devices
+// The kernel backend manages actual devices, while the fake one only keeps their configuration in memory, so the mesh
+// logic can run without root or kernel modules, e.g. in tests and for development.
+type Backend interface {
+	// Up creates the device if it does not exist yet, and sets its overlay address and MTU
+	Up(iface string, addr net.IPNet, mtu int) error
+	// ConfigurePeers applies the device configuration, including the changed peers
+	ConfigurePeers(iface string, cfg wgtypes.Config) error
+	// Down removes the device
+	Down(iface string) error
+	// Stats provides the current device state, including its peers and their traffic; the error satisfies
+	// os.IsNotExist if the device does not exist
+	Stats(iface string) (*wgtypes.Device, error)
+	// HostNetwork reports whether the devices are part of the host network, so routes, addresses and other host
+	// configuration must follow the devices
+	HostNetwork() bool
+}
+
+// NewBackend provides the named backend
+func NewBackend(name string) (Backend, error) {
+	switch name {
+	case BackendKernel:
+		client, err := wgctrl.New()
+		if err != nil {
+			return nil, errors.Wrap(err, "could not instantiate wireguard client")
+		}
+		return &kernelBackend{client: client}, nil
+	case BackendFake:
+		return NewFake(), nil
+	}
+	return nil, errors.Errorf("unknown wireguard backend %q", name)
+}
+
+type kernelBackend struct {
+	client *wgctrl.Client
+}
+
+func (b *kernelBackend) Up(iface string, addr net.IPNet, mtu int) error {
+	if err := netlink.LinkAdd(&wireguard{LinkAttrs: netlink.LinkAttrs{Name: iface}}); err != nil && !os.IsExist(err) {
+		return errors.Wrapf(err, "could not create interface %s", iface)
+	}
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return errors.Wrapf(err, "could not get link information for %s", iface)
+	}
+	if err := netlink.AddrReplace(link, &netlink.Addr{IPNet: &addr}); err != nil {
+		return errors.Wrapf(err, "could not set address for %s", iface)
+	}
+	if err := netlink.LinkSetMTU(link, mtu); err != nil {
+		return errors.Wrapf(err, "could not set MTU for %s", iface)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return errors.Wrapf(err, "could not enable interface %s", iface)
+	}
+	return nil
+}
+
+func (b *kernelBackend) ConfigurePeers(iface string, cfg wgtypes.Config) error {
+	return b.client.ConfigureDevice(iface, cfg)
+}
+
+func (b *kernelBackend) Down(iface string) error {
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return err
+	}
+	return netlink.LinkDel(link)
+}
+
+func (b *kernelBackend) Stats(iface string) (*wgtypes.Device, error) {
+	return b.client.Device(iface)
+}
+
+func (b *kernelBackend) HostNetwork() bool {
+	return true
+}
+
+// Fake is a Backend keeping devices in memory
+type Fake struct {
+	lock    sync.Mutex
+	devices map[string]*fakeDevice
+}
+
+type fakeDevice struct {
+	addr   net.IPNet
+	mtu    int
+	device wgtypes.Device
+}
+
+// NewFake creates a fake backend without devices
+func NewFake() *Fake {
+	return &Fake{devices: make(map[string]*fakeDevice)}
+}
+
+// Up implements Backend
+func (f *Fake) Up(iface string, addr net.IPNet, mtu int) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	dev, ok := f.devices[iface]
+	if !ok {
+		dev = &fakeDevice{device: wgtypes.Device{Name: iface, Type: wgtypes.Unknown}}
+		f.devices[iface] = dev
+	}
+	dev.addr, dev.mtu = addr, mtu
+	return nil
+}
+
+// ConfigurePeers implements Backend
+func (f *Fake) ConfigurePeers(iface string, cfg wgtypes.Config) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	dev, ok := f.devices[iface]
+	if !ok {
+		return &os.PathError{Op: "configure", Path: iface, Err: os.ErrNotExist}
+	}
+	d := &dev.device
+	if cfg.PrivateKey != nil {
+		d.PrivateKey, d.PublicKey = *cfg.PrivateKey, cfg.PrivateKey.PublicKey()
+	}
+	if cfg.ListenPort != nil {
+		d.ListenPort = *cfg.ListenPort
+	}
+	if cfg.FirewallMark != nil {
+		d.FirewallMark = *cfg.FirewallMark
+	}
+	if cfg.ReplacePeers {
+		d.Peers = nil
+	}
+	for _, peerCfg := range cfg.Peers {
+		index := -1
+		for i, peer := range d.Peers {
+			if peer.PublicKey == peerCfg.PublicKey {
+				index = i
+			}
+		}
+		switch {
+		case peerCfg.Remove:
+			if index >= 0 {
+				d.Peers = append(d.Peers[:index], d.Peers[index+1:]...)
+			}
+			continue
+		case index < 0 && peerCfg.UpdateOnly:
+			continue
+		case index < 0:
+			d.Peers = append(d.Peers, wgtypes.Peer{PublicKey: peerCfg.PublicKey})
+			index = len(d.Peers) - 1
+		}
+		peer := &d.Peers[index]
+		if peerCfg.Endpoint != nil {
+			peer.Endpoint = peerCfg.Endpoint
+		}
+		if peerCfg.PersistentKeepaliveInterval != nil {
+			peer.PersistentKeepaliveInterval = *peerCfg.PersistentKeepaliveInterval
+		}
+		if peerCfg.ReplaceAllowedIPs {
+			peer.AllowedIPs = nil
+		}
+		peer.AllowedIPs = append(peer.AllowedIPs, peerCfg.AllowedIPs...)
+	}
+	return nil
+}
+
+// Down implements Backend
+func (f *Fake) Down(iface string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, ok := f.devices[iface]; !ok {
+		return &os.PathError{Op: "remove", Path: iface, Err: os.ErrNotExist}
+	}
+	delete(f.devices, iface)
+	return nil
+}
+
+// Stats implements Backend
+func (f *Fake) Stats(iface string) (*wgtypes.Device, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	dev, ok := f.devices[iface]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: iface, Err: os.ErrNotExist}
+	}
+	device := dev.device
+	device.Peers = append([]wgtypes.Peer{}, dev.device.Peers...)
+	return &device, nil
+}
+
+// HostNetwork implements Backend; the devices only exist in memory
+func (f *Fake) HostNetwork() bool {
+	return false
+}
+
+// Addr provides the overlay address and MTU of the device, if it exists
+func (f *Fake) Addr(iface string) (net.IPNet, int, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	dev, ok := f.devices[iface]
+	if !ok {
+		return net.IPNet{}, 0, false
+	}
+	return dev.addr, dev.mtu, true
+}
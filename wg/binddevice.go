@@ -0,0 +1,151 @@
+package wg
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// The wireguard kernel socket cannot be bound to a device directly; instead, its packets are marked and routed
+// through a dedicated routing table only containing routes via the bind device. Like wg-quick, the wireguard port is
+// used as both mark and table number, which keeps them unique across multiple wesher instances.
+
+// routeViaDevice ensures packets sent by the wireguard socket leave through the bind device
+// The routes of the device are copied to the table, and copies of routes the device no longer has are removed, so
+// the table follows changes of the device routes, e.g. a new gateway from DHCP.
+func (s *State) routeViaDevice() error {
+	routes, table, err := s.deviceTableRoutes()
+	if err != nil {
+		return err
+	}
+	for _, route := range routes {
+		route.Table = s.Port
+		if err := netlink.RouteReplace(&route); err != nil {
+			return errors.Wrapf(err, "could not copy route %s to table %d", route, s.Port)
+		}
+	}
+	for _, route := range staleTableRoutes(routes, table) {
+		route := route
+		if err := netlink.RouteDel(&route); err != nil && err != unix.ESRCH {
+			return errors.Wrapf(err, "could not remove route %s from table %d", route, s.Port)
+		}
+	}
+
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		rule, err := s.findDeviceRule(family)
+		if err != nil {
+			return err
+		}
+		if rule != nil {
+			continue
+		}
+		rule = netlink.NewRule()
+		rule.Family = family
+		rule.Mark = s.Port
+		rule.Table = s.Port
+		if err := netlink.RuleAdd(rule); err != nil {
+			return errors.Wrapf(err, "could not add rule for fwmark %d", s.Port)
+		}
+	}
+	return nil
+}
+
+// deviceTableRoutes provides the routes of the bind device and the ones currently in its table
+func (s *State) deviceTableRoutes() ([]netlink.Route, []netlink.Route, error) {
+	link, err := netlink.LinkByName(s.BindDevice)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "could not get link information for %s", s.BindDevice)
+	}
+	routes, err := netlink.RouteList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "could not list routes for %s", s.BindDevice)
+	}
+	table, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: s.Port}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "could not list routes of table %d", s.Port)
+	}
+	return routes, table, nil
+}
+
+// tableRouteKey identifies a route within a table by destination and metric, like the kernel does when replacing it
+func tableRouteKey(route netlink.Route) string {
+	dst := "default"
+	if route.Dst != nil {
+		dst = route.Dst.String()
+	} else if route.Gw.To4() == nil {
+		dst = "default6"
+	}
+	return fmt.Sprintf("%s metric %d", dst, route.Priority)
+}
+
+// staleTableRoutes provides the routes of the table without a device route to copy them from
+func staleTableRoutes(device, table []netlink.Route) []netlink.Route {
+	copied := make(map[string]bool, len(device))
+	for _, route := range device {
+		copied[tableRouteKey(route)] = true
+	}
+	stale := []netlink.Route{}
+	for _, route := range table {
+		if !copied[tableRouteKey(route)] {
+			stale = append(stale, route)
+		}
+	}
+	return stale
+}
+
+// tableDrift describes how the table differs from the routes of the bind device
+func tableDrift(device, table []netlink.Route, tableID int) []string {
+	drift := []string{}
+	copies := make(map[string]netlink.Route, len(table))
+	for _, route := range table {
+		copies[tableRouteKey(route)] = route
+	}
+	for _, route := range device {
+		key := tableRouteKey(route)
+		copied, ok := copies[key]
+		switch {
+		case !ok:
+			drift = append(drift, fmt.Sprintf("route to %s is missing from table %d", key, tableID))
+		case copied.Gw.String() != route.Gw.String():
+			drift = append(drift, fmt.Sprintf("route to %s in table %d is via %s instead of %s", key, tableID, copied.Gw, route.Gw))
+		}
+	}
+	for _, route := range staleTableRoutes(device, table) {
+		drift = append(drift, fmt.Sprintf("route to %s in table %d is stale", tableRouteKey(route), tableID))
+	}
+	return drift
+}
+
+// removeDeviceRules removes the rules added by routeViaDevice; the routing table itself is left alone, since it is
+// unused without the rules
+func (s *State) removeDeviceRules() error {
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		rule, err := s.findDeviceRule(family)
+		if err != nil {
+			return err
+		}
+		if rule == nil {
+			continue
+		}
+		if err := netlink.RuleDel(rule); err != nil {
+			return errors.Wrapf(err, "could not remove rule for fwmark %d", s.Port)
+		}
+	}
+	return nil
+}
+
+func (s *State) findDeviceRule(family int) (*netlink.Rule, error) {
+	rules, err := netlink.RuleList(family)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list rules")
+	}
+	for _, rule := range rules {
+		if rule.Mark == s.Port && rule.Table == s.Port {
+			rule.Family = family
+			return &rule, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,49 @@
+package wg
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func Test_tableDrift(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+	_, old, _ := net.ParseCIDR("192.168.2.0/24")
+	gw, newGw := net.ParseIP("192.168.1.1"), net.ParseIP("192.168.1.254")
+	device := []netlink.Route{{Dst: lan}, {Gw: newGw, Priority: 100}}
+
+	tests := []struct {
+		name      string
+		table     []netlink.Route
+		wantStale []netlink.Route
+		want      []string
+	}{
+		{"in sync", []netlink.Route{{Dst: lan, Table: 51820}, {Gw: newGw, Priority: 100, Table: 51820}}, []netlink.Route{}, []string{}},
+		{"empty table", nil, []netlink.Route{}, []string{
+			"route to 192.168.1.0/24 metric 0 is missing from table 51820",
+			"route to default metric 100 is missing from table 51820",
+		}},
+		{"gateway changed", []netlink.Route{{Dst: lan, Table: 51820}, {Gw: gw, Priority: 100, Table: 51820}}, []netlink.Route{}, []string{
+			"route to default metric 100 in table 51820 is via 192.168.1.1 instead of 192.168.1.254",
+		}},
+		{"route removed from the device", []netlink.Route{{Dst: lan, Table: 51820}, {Dst: old, Table: 51820}, {Gw: newGw, Priority: 100, Table: 51820}}, []netlink.Route{{Dst: old, Table: 51820}}, []string{
+			"route to 192.168.2.0/24 metric 0 in table 51820 is stale",
+		}},
+		{"metric changed", []netlink.Route{{Dst: lan, Table: 51820}, {Gw: newGw, Priority: 50, Table: 51820}}, []netlink.Route{{Gw: newGw, Priority: 50, Table: 51820}}, []string{
+			"route to default metric 100 is missing from table 51820",
+			"route to default metric 50 in table 51820 is stale",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := staleTableRoutes(device, tt.table); !reflect.DeepEqual(got, tt.wantStale) {
+				t.Errorf("staleTableRoutes() = %v, want %v", got, tt.wantStale)
+			}
+			if got := tableDrift(device, tt.table, 51820); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tableDrift() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package wg
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/costela/wesher/common"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Drift compares the actual device configuration against the desired one for the provided nodes and describes the
+// differences, e.g. caused by manual changes with wg or ip, other daemons or missed events.
+// Peers are compared by allowed IPs and keepalive, but not by endpoint, since wireguard follows roaming peers on its
+// own; with the kernel backend, the overlay address, MTU and routes are compared too, as is the routing table of the
+// bind device. If any drift is found, the applied peers and routes are forgotten, so the next SetUpInterface reapplies
+// all of them instead of only changed ones.
+func (s *State) Drift(nodes []common.Node, routedNet []*net.IPNet) ([]string, error) {
+	device, err := s.backend.Stats(s.iface)
+	if os.IsNotExist(err) {
+		s.ForgetApplied()
+		return []string{"interface is missing"}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not get wireguard device %s", s.iface)
+	}
+	peerCfgs, err := s.nodesToPeerConfigs(nodes)
+	if err != nil {
+		return nil, errors.Wrap(err, "error converting received node information to wireguard format")
+	}
+	peerCfgs = append(peerCfgs, s.externalPeerConfigs()...)
+	drift := deviceDrift(device, s.PrivKey, s.Port, peerCfgs)
+
+	if s.hostNetwork {
+		link, err := netlink.LinkByName(s.iface)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not get link information for %s", s.iface)
+		}
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not get addresses of %s", s.iface)
+		}
+		currentRoutes, err := netlink.RouteList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not get routes of %s", s.iface)
+		}
+		drift = append(drift, linkDrift(link.Attrs(), addrs, s.OverlayAddr, s.MTU)...)
+		drift = append(drift, routeDrift(currentRoutes, s.desiredRoutes(link.Attrs().Index, nodes, routedNet))...)
+		if s.BindDevice != "" {
+			routes, table, err := s.deviceTableRoutes()
+			if err != nil {
+				return nil, err
+			}
+			drift = append(drift, tableDrift(routes, table, s.Port)...)
+		}
+	}
+
+	if len(drift) > 0 {
+		s.peers, s.routes = nil, nil
+	}
+	return drift, nil
+}
+
+// deviceDrift describes how the wireguard device differs from its desired key, port and peers
+func deviceDrift(device *wgtypes.Device, privKey wgtypes.Key, port int, peerCfgs []wgtypes.PeerConfig) []string {
+	drift := []string{}
+	if device.PrivateKey != privKey {
+		drift = append(drift, "private key differs")
+	}
+	if device.ListenPort != port {
+		drift = append(drift, fmt.Sprintf("listen port is %d instead of %d", device.ListenPort, port))
+	}
+	actual := make(map[wgtypes.Key]wgtypes.Peer, len(device.Peers))
+	for _, peer := range device.Peers {
+		actual[peer.PublicKey] = peer
+	}
+	for _, peerCfg := range peerCfgs {
+		peer, ok := actual[peerCfg.PublicKey]
+		delete(actual, peerCfg.PublicKey)
+		if !ok {
+			drift = append(drift, fmt.Sprintf("peer %s is missing", peerCfg.PublicKey))
+			continue
+		}
+		if got, want := sortedNetworks(peer.AllowedIPs), sortedNetworks(peerCfg.AllowedIPs); got != want {
+			drift = append(drift, fmt.Sprintf("peer %s allows %s instead of %s", peerCfg.PublicKey, got, want))
+		}
+		keepalive := time.Duration(0)
+		if peerCfg.PersistentKeepaliveInterval != nil {
+			keepalive = *peerCfg.PersistentKeepaliveInterval
+		}
+		if peer.PersistentKeepaliveInterval != keepalive {
+			drift = append(drift, fmt.Sprintf("peer %s has keepalive %s instead of %s", peerCfg.PublicKey, peer.PersistentKeepaliveInterval, keepalive))
+		}
+	}
+	for key := range actual {
+		drift = append(drift, fmt.Sprintf("unexpected peer %s", key))
+	}
+	sort.Strings(drift)
+	return drift
+}
+
+// linkDrift describes how the interface differs from its desired state
+func linkDrift(attrs *netlink.LinkAttrs, addrs []netlink.Addr, overlayAddr net.IPNet, mtu int) []string {
+	drift := []string{}
+	if attrs.Flags&net.FlagUp == 0 {
+		drift = append(drift, "interface is down")
+	}
+	if attrs.MTU != mtu {
+		drift = append(drift, fmt.Sprintf("MTU is %d instead of %d", attrs.MTU, mtu))
+	}
+	found := false
+	for _, addr := range addrs {
+		found = found || addr.IPNet != nil && addr.IPNet.String() == overlayAddr.String()
+	}
+	if !found {
+		drift = append(drift, fmt.Sprintf("overlay address %s is missing", overlayAddr.String()))
+	}
+	return drift
+}
+
+// routeDrift describes the desired routes which are missing or use another gateway
+func routeDrift(current, desired []netlink.Route) []string {
+	drift := []string{}
+	for _, route := range desired {
+		match := matchRoute(current, route)
+		switch {
+		case match == nil:
+			drift = append(drift, fmt.Sprintf("route %s is missing", route.Dst))
+		case match.Gw.String() != route.Gw.String():
+			drift = append(drift, fmt.Sprintf("route %s is via %s instead of %s", route.Dst, match.Gw, route.Gw))
+		}
+	}
+	return drift
+}
+
+// sortedNetworks formats the networks in a canonical order, for comparison
+func sortedNetworks(networks []net.IPNet) string {
+	formatted := make([]string, len(networks))
+	for i := range networks {
+		formatted[i] = networks[i].String()
+	}
+	sort.Strings(formatted)
+	return fmt.Sprint(formatted)
+}
@@ -0,0 +1,76 @@
+package wg
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/costela/wesher/common"
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func Test_State_Drift_fake(t *testing.T) {
+	_, overlayNet, _ := net.ParseCIDR("10.0.0.0/8")
+	backend := NewFake()
+	s, _, err := New(backend, "wgtest", 51820, 1420, overlayNet, "local", nil, "")
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	peerKey, _ := wgtypes.GeneratePrivateKey()
+	node := common.Node{Name: "peer", Addr: net.ParseIP("192.0.2.1")}
+	node.PubKey = peerKey.PublicKey().String()
+	node.OverlayAddr = net.IPNet{IP: net.ParseIP("10.0.0.2").To4(), Mask: net.CIDRMask(32, 32)}
+	nodes := []common.Node{node}
+
+	if err := s.SetUpInterface(nodes, nil); err != nil {
+		t.Fatalf("SetUpInterface() error = %v", err)
+	}
+	if drift, err := s.Drift(nodes, nil); err != nil || len(drift) != 0 {
+		t.Fatalf("Drift() = %v, %v right after setup, want none", drift, err)
+	}
+
+	// simulate manual changes, e.g. with wg set
+	foreignKey, _ := wgtypes.GeneratePrivateKey()
+	manual := wgtypes.Config{Peers: []wgtypes.PeerConfig{
+		{PublicKey: peerKey.PublicKey(), Remove: true},
+		{PublicKey: foreignKey.PublicKey()},
+	}}
+	if err := backend.ConfigurePeers("wgtest", manual); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"peer " + peerKey.PublicKey().String() + " is missing", "unexpected peer " + foreignKey.PublicKey().String()}
+	if drift, err := s.Drift(nodes, nil); err != nil || !reflect.DeepEqual(drift, want) {
+		t.Errorf("Drift() = %v, %v, want %v", drift, err, want)
+	}
+
+	if err := s.SetUpInterface(nodes, nil); err != nil {
+		t.Fatalf("SetUpInterface() error = %v", err)
+	}
+	if drift, err := s.Drift(nodes, nil); err != nil || len(drift) != 0 {
+		t.Errorf("Drift() = %v, %v after repair, want none", drift, err)
+	}
+
+	backend.Down("wgtest")
+	if drift, err := s.Drift(nodes, nil); err != nil || !reflect.DeepEqual(drift, []string{"interface is missing"}) {
+		t.Errorf("Drift() = %v, %v after removing the interface, want it missing", drift, err)
+	}
+}
+
+func Test_linkDrift_routeDrift(t *testing.T) {
+	overlayAddr := net.IPNet{IP: net.ParseIP("10.0.0.1").To4(), Mask: net.CIDRMask(8, 32)}
+	attrs := &netlink.LinkAttrs{MTU: 1280}
+	want := []string{"interface is down", "MTU is 1280 instead of 1420", "overlay address 10.0.0.1/8 is missing"}
+	if got := linkDrift(attrs, nil, overlayAddr, 1420); !reflect.DeepEqual(got, want) {
+		t.Errorf("linkDrift() = %v, want %v", got, want)
+	}
+
+	_, routed, _ := net.ParseCIDR("192.168.1.0/24")
+	_, missing, _ := net.ParseCIDR("192.168.2.0/24")
+	current := []netlink.Route{viaRoute(1, *routed, net.ParseIP("10.0.0.3"))}
+	desired := []netlink.Route{viaRoute(1, *routed, net.ParseIP("10.0.0.2")), viaRoute(1, *missing, net.ParseIP("10.0.0.2"))}
+	want = []string{"route 192.168.1.0/24 is via 10.0.0.3 instead of 10.0.0.2", "route 192.168.2.0/24 is missing"}
+	if got := routeDrift(current, desired); !reflect.DeepEqual(got, want) {
+		t.Errorf("routeDrift() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,109 @@
+package wg
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// ExternalPeer is a plain wireguard peer not running wesher, like a VPN concentrator or a phone, configured on the
+// interface alongside the nodes
+type ExternalPeer struct {
+	Name       string
+	PubKey     wgtypes.Key
+	Endpoint   *net.UDPAddr // nil for peers only connecting to this node, e.g. roaming clients
+	endpoint   string       // as configured, possibly a host name
+	AllowedIPs []net.IPNet
+}
+
+// LoadExternalPeers reads external peers from a file with one peer per line, consisting of its name, public key,
+// comma separated allowed IPs (CIDR format) and optionally its endpoint (address:port), separated by whitespace;
+// empty lines and lines starting with # are ignored.
+func LoadExternalPeers(path string) ([]ExternalPeer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open external peers file")
+	}
+	defer f.Close()
+	peers := []ExternalPeer{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 3 || len(fields) > 4 {
+			return nil, errors.Errorf("%s:%d: expected a name, public key, allowed IPs and optionally an endpoint", path, line)
+		}
+		peer := ExternalPeer{Name: fields[0]}
+		if peer.PubKey, err = wgtypes.ParseKey(fields[1]); err != nil {
+			return nil, errors.Wrapf(err, "%s:%d: invalid public key %q", path, line, fields[1])
+		}
+		for _, allowed := range strings.Split(fields[2], ",") {
+			_, network, err := net.ParseCIDR(allowed)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s:%d: invalid allowed IP %q", path, line, allowed)
+			}
+			peer.AllowedIPs = append(peer.AllowedIPs, *network)
+		}
+		if len(fields) == 4 {
+			peer.endpoint = fields[3]
+			if peer.Endpoint, err = net.ResolveUDPAddr("udp", fields[3]); err != nil {
+				return nil, errors.Wrapf(err, "%s:%d: invalid endpoint %q", path, line, fields[3])
+			}
+		}
+		peers = append(peers, peer)
+	}
+	return peers, errors.Wrap(scanner.Err(), "could not read external peers file")
+}
+
+// ResolveExternalEndpoints resolves the configured endpoints of the external peers again, e.g. after resuming from
+// suspend, in case their host names now resolve to other addresses; peers whose endpoint cannot be resolved keep the
+// previous one.
+func (s *State) ResolveExternalEndpoints() error {
+	var errs []string
+	for i, peer := range s.ExternalPeers {
+		if peer.endpoint == "" {
+			continue
+		}
+		endpoint, err := net.ResolveUDPAddr("udp", peer.endpoint)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", peer.Name, err))
+			continue
+		}
+		s.ExternalPeers[i].Endpoint = endpoint
+	}
+	if len(errs) > 0 {
+		return errors.Errorf("could not resolve external peer endpoints: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// ExternalNetworks provides the allowed IPs of all external peers
+func ExternalNetworks(peers []ExternalPeer) []net.IPNet {
+	networks := []net.IPNet{}
+	for _, peer := range peers {
+		networks = append(networks, peer.AllowedIPs...)
+	}
+	return networks
+}
+
+// externalPeerConfigs provides the configurations of the external peers
+func (s *State) externalPeerConfigs() []wgtypes.PeerConfig {
+	peerCfgs := make([]wgtypes.PeerConfig, len(s.ExternalPeers))
+	for i, peer := range s.ExternalPeers {
+		peerCfgs[i] = wgtypes.PeerConfig{
+			PublicKey:                   peer.PubKey,
+			ReplaceAllowedIPs:           true,
+			Endpoint:                    peer.Endpoint,
+			AllowedIPs:                  peer.AllowedIPs,
+			PersistentKeepaliveInterval: s.KeepaliveInterval,
+		}
+	}
+	return peerCfgs
+}
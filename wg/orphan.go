@@ -0,0 +1,79 @@
+package wg
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// policies for existing interfaces not matching the configuration
+const (
+	ExistingAdopt    = "adopt"
+	ExistingRecreate = "recreate"
+	ExistingAbort    = "abort"
+)
+
+// ExistingMismatches inspects an already existing interface, e.g. from a previous run, and describes how it does not
+// match the provided overlay network; it provides nothing if the interface does not exist or matches.
+// Other interfaces of the same name are never touched, and cause an error.
+func (s *State) ExistingMismatches(overlayNet *net.IPNet) ([]string, error) {
+	if !s.hostNetwork {
+		return nil, nil
+	}
+	link, err := netlink.LinkByName(s.iface)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not get link information for %s", s.iface)
+	}
+	if link.Type() != (&wireguard{}).Type() {
+		return nil, errors.Errorf("%s already exists as a %s interface, not a wireguard one", s.iface, link.Type())
+	}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not get addresses of %s", s.iface)
+	}
+	ipnets := make([]net.IPNet, 0, len(addrs))
+	for _, addr := range addrs {
+		if addr.IPNet != nil {
+			ipnets = append(ipnets, *addr.IPNet)
+		}
+	}
+	peers, err := s.Peers()
+	if err != nil {
+		return nil, err
+	}
+	return interfaceMismatches(ipnets, peers, overlayNet), nil
+}
+
+// interfaceMismatches describes the addresses outside of the overlay network and the foreign peers, i.e. peers without
+// an overlay address in their allowed IPs, as all wesher peers have
+func interfaceMismatches(addrs []net.IPNet, peers []wgtypes.Peer, overlayNet *net.IPNet) []string {
+	mismatches := []string{}
+	for _, addr := range addrs {
+		if addr.IP.IsLinkLocalUnicast() || overlayNet.Contains(addr.IP) {
+			continue
+		}
+		mismatches = append(mismatches, fmt.Sprintf("address %s is outside of the overlay network %s", addr.String(), overlayNet))
+	}
+	for _, peer := range peers {
+		if !hasOverlayAddr(peer.AllowedIPs, overlayNet) {
+			mismatches = append(mismatches, fmt.Sprintf("peer %s has no address in the overlay network %s", peer.PublicKey, overlayNet))
+		}
+	}
+	return mismatches
+}
+
+func hasOverlayAddr(allowedIPs []net.IPNet, overlayNet *net.IPNet) bool {
+	for _, allowed := range allowedIPs {
+		ones, bits := allowed.Mask.Size()
+		if ones == bits && overlayNet.Contains(allowed.IP) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,351 @@
+package wg
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// With a single port, wireguard traffic is multiplexed with membership gossip on the cluster port. The relay owns the
+// UDP socket of that port and tells wireguard messages apart by their header: a message type from 1 to 4, three zero
+// bytes and the size of that type. Gossip is encrypted with the cluster key, so its packets only match by chance.
+// Wireguard messages are passed to and from the device through a loopback socket per remote address, connected to the
+// listening port of the device. The device therefore sees a distinct endpoint per remote address and follows roaming
+// peers as usual, while the relay translates between the endpoints of both sides.
+
+const (
+	// relaySessionTimeout is the time without traffic after which sessions no peer is configured with are closed
+	relaySessionTimeout = 3 * time.Minute
+	// relayMaxSessions bounds the sessions opened for messages from unknown addresses, which anyone can send
+	relayMaxSessions = 1024
+	// relayQueueLen is the number of other packets buffered until read; further ones are dropped
+	relayQueueLen = 64
+	// relayBufSize is enough for any UDP packet
+	relayBufSize = 65536
+)
+
+// errRelayClosed is returned when reading from a closed relay or view
+var errRelayClosed = errors.New("relay is closed")
+
+// Relay multiplexes wireguard traffic with other UDP traffic on a single socket, see above
+type Relay struct {
+	conn     net.PacketConn
+	device   *net.UDPAddr // loopback address the device listens on
+	lock     sync.Mutex
+	sessions map[string]*relaySession // by remote address
+	byLocal  map[string]*relaySession // by local address of their socket
+	view     *relayView               // receiving the other packets, if any
+	closed   int32
+	done     chan struct{}
+}
+
+// relaySession passes the wireguard messages of a single remote address to and from the device
+type relaySession struct {
+	remote     *net.UDPAddr
+	conn       *net.UDPConn
+	configured bool  // a peer is configured with it
+	active     int64 // unix time of the last message, in nanoseconds
+	closed     int32
+}
+
+// isWireguardMessage tells whether the packet is a wireguard message, by its header and size
+func isWireguardMessage(b []byte) bool {
+	if len(b) < 4 || b[1] != 0 || b[2] != 0 || b[3] != 0 {
+		return false
+	}
+	switch b[0] {
+	case 1: // handshake initiation
+		return len(b) == 148
+	case 2: // handshake response
+		return len(b) == 92
+	case 3: // cookie reply
+		return len(b) == 64
+	case 4: // transport data, padded to 16 bytes
+		return len(b) >= 32 && len(b)%16 == 0
+	}
+	return false
+}
+
+// NewRelay listens on addr for the multiplexed traffic, passing wireguard messages to the device listening on
+// devicePort
+func NewRelay(addr string, devicePort int) (*Relay, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not listen on %s", addr)
+	}
+	r := &Relay{
+		conn:     conn,
+		device:   &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: devicePort},
+		sessions: make(map[string]*relaySession),
+		byLocal:  make(map[string]*relaySession),
+		done:     make(chan struct{}),
+	}
+	go r.receive()
+	go r.expireSessions()
+	return r, nil
+}
+
+// Local provides the local endpoint to configure a peer at the remote endpoint with
+func (r *Relay) Local(remote *net.UDPAddr) (*net.UDPAddr, error) {
+	s, err := r.session(remote, true)
+	if err != nil {
+		return nil, err
+	}
+	return s.conn.LocalAddr().(*net.UDPAddr), nil
+}
+
+// Remote provides the remote endpoint of the local one the device knows a peer by, or nil if it is not relayed
+func (r *Relay) Remote(local *net.UDPAddr) *net.UDPAddr {
+	if local == nil {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if s, ok := r.byLocal[local.String()]; ok {
+		return s.remote
+	}
+	return nil
+}
+
+// Retain marks the sessions of the local endpoints as configured; the other ones are closed once idle
+func (r *Relay) Retain(locals []*net.UDPAddr) {
+	configured := make(map[string]bool, len(locals))
+	for _, local := range locals {
+		if local != nil {
+			configured[local.String()] = true
+		}
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for local, s := range r.byLocal {
+		s.configured = configured[local]
+	}
+}
+
+// Gossip provides a view of the socket only receiving the packets which are not wireguard messages, replacing any
+// previous one; closing it leaves the socket open
+func (r *Relay) Gossip() net.PacketConn {
+	v := &relayView{relay: r, packets: make(chan relayPacket, relayQueueLen), done: make(chan struct{})}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.view = v
+	return v
+}
+
+// Close closes the socket and all sessions
+func (r *Relay) Close() error {
+	if !atomic.CompareAndSwapInt32(&r.closed, 0, 1) {
+		return nil
+	}
+	close(r.done)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, s := range r.sessions {
+		s.close()
+	}
+	r.sessions, r.byLocal = map[string]*relaySession{}, map[string]*relaySession{}
+	return r.conn.Close()
+}
+
+func (r *Relay) isClosed() bool {
+	return atomic.LoadInt32(&r.closed) == 1
+}
+
+// session provides the session of the remote endpoint, opening it if needed; sessions not to be configured are limited
+func (r *Relay) session(remote *net.UDPAddr, configured bool) (*relaySession, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if s, ok := r.sessions[remote.String()]; ok {
+		s.configured = s.configured || configured
+		return s, nil
+	}
+	if r.isClosed() {
+		return nil, errRelayClosed
+	}
+	if !configured && len(r.sessions) >= relayMaxSessions {
+		return nil, errors.Errorf("too many relayed endpoints, ignoring %s", remote)
+	}
+	conn, err := net.DialUDP("udp", &net.UDPAddr{IP: r.device.IP}, r.device)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not open relay socket for %s", remote)
+	}
+	s := &relaySession{remote: remote, conn: conn, configured: configured}
+	s.touch(time.Now())
+	r.sessions[remote.String()] = s
+	r.byLocal[conn.LocalAddr().String()] = s
+	go r.send(s)
+	return s, nil
+}
+
+// receive passes the wireguard messages received on the socket to the device, and the other packets to the view
+func (r *Relay) receive() {
+	buf := make([]byte, relayBufSize)
+	for {
+		n, addr, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			if r.isClosed() {
+				return
+			}
+			logrus.Debugf("error reading from relay socket: %s", err)
+			continue
+		}
+		from, ok := addr.(*net.UDPAddr)
+		if !ok || n < 1 {
+			continue
+		}
+		if isWireguardMessage(buf[:n]) {
+			s, err := r.session(from, false)
+			if err != nil {
+				logrus.Debugf("could not relay wireguard message from %s: %s", from, err)
+				continue
+			}
+			s.touch(time.Now())
+			if _, err := s.conn.Write(buf[:n]); err != nil {
+				logrus.Debugf("could not relay wireguard message from %s: %s", from, err)
+			}
+			continue
+		}
+		r.lock.Lock()
+		v := r.view
+		r.lock.Unlock()
+		if v == nil {
+			continue
+		}
+		select {
+		case v.packets <- relayPacket{buf: append([]byte(nil), buf[:n]...), from: from}:
+		default: // like a full socket buffer
+		}
+	}
+}
+
+// send passes the messages of the device to the remote endpoint of the session
+func (r *Relay) send(s *relaySession) {
+	buf := make([]byte, relayBufSize)
+	for {
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			if s.isClosed() {
+				return
+			}
+			// e.g. the device not listening yet, reported for a previous message
+			logrus.Debugf("error reading from relay socket for %s: %s", s.remote, err)
+			continue
+		}
+		s.touch(time.Now())
+		if _, err := r.conn.WriteTo(buf[:n], s.remote); err != nil {
+			logrus.Debugf("could not relay wireguard message to %s: %s", s.remote, err)
+		}
+	}
+}
+
+// expireSessions periodically closes the idle sessions no peer is configured with
+func (r *Relay) expireSessions() {
+	ticker := time.NewTicker(relaySessionTimeout / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case now := <-ticker.C:
+			r.expire(now)
+		}
+	}
+}
+
+func (r *Relay) expire(now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for remote, s := range r.sessions {
+		if s.configured || now.Sub(s.lastActive()) < relaySessionTimeout {
+			continue
+		}
+		s.close()
+		delete(r.sessions, remote)
+		delete(r.byLocal, s.conn.LocalAddr().String())
+	}
+}
+
+func (s *relaySession) touch(now time.Time) {
+	atomic.StoreInt64(&s.active, now.UnixNano())
+}
+
+func (s *relaySession) lastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.active))
+}
+
+func (s *relaySession) close() {
+	atomic.StoreInt32(&s.closed, 1)
+	s.conn.Close()
+}
+
+func (s *relaySession) isClosed() bool {
+	return atomic.LoadInt32(&s.closed) == 1
+}
+
+// relayPacket is a packet received by the relay which is not a wireguard message
+type relayPacket struct {
+	buf  []byte
+	from *net.UDPAddr
+}
+
+// relayView implements net.PacketConn for the packets of the relay which are not wireguard messages
+type relayView struct {
+	relay   *Relay
+	packets chan relayPacket
+	once    sync.Once
+	done    chan struct{}
+}
+
+// ReadFrom implements net.PacketConn
+func (v *relayView) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-v.packets:
+		return copy(b, p.buf), p.from, nil
+	case <-v.done:
+		return 0, nil, errRelayClosed
+	case <-v.relay.done:
+		return 0, nil, errRelayClosed
+	}
+}
+
+// WriteTo implements net.PacketConn
+func (v *relayView) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return v.relay.conn.WriteTo(b, addr)
+}
+
+// Close implements net.PacketConn, only closing the view
+func (v *relayView) Close() error {
+	v.once.Do(func() {
+		close(v.done)
+		v.relay.lock.Lock()
+		defer v.relay.lock.Unlock()
+		if v.relay.view == v {
+			v.relay.view = nil
+		}
+	})
+	return nil
+}
+
+// LocalAddr implements net.PacketConn
+func (v *relayView) LocalAddr() net.Addr {
+	return v.relay.conn.LocalAddr()
+}
+
+// SetDeadline implements net.PacketConn; deadlines are not supported
+func (v *relayView) SetDeadline(t time.Time) error {
+	return errors.New("deadlines are not supported by the relay")
+}
+
+// SetReadDeadline implements net.PacketConn; deadlines are not supported
+func (v *relayView) SetReadDeadline(t time.Time) error {
+	return v.SetDeadline(t)
+}
+
+// SetWriteDeadline implements net.PacketConn; deadlines are not supported
+func (v *relayView) SetWriteDeadline(t time.Time) error {
+	return v.SetDeadline(t)
+}
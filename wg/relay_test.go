@@ -0,0 +1,148 @@
+package wg
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/costela/wesher/common"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func Test_isWireguardMessage(t *testing.T) {
+	message := func(kind byte, size int) []byte {
+		b := make([]byte, size)
+		b[0] = kind
+		return b
+	}
+	gossip := message(1, 148)
+	gossip[2] = 0x2a // e.g. a nonce
+	tests := []struct {
+		name   string
+		packet []byte
+		want   bool
+	}{
+		{"handshake initiation", message(1, 148), true},
+		{"handshake response", message(2, 92), true},
+		{"cookie reply", message(3, 64), true},
+		{"keepalive", message(4, 32), true},
+		{"transport data", message(4, 1456), true},
+		{"unpadded transport data", message(4, 1457), false},
+		{"initiation of wrong size", message(1, 149), false},
+		{"unknown type", message(5, 64), false},
+		{"non-zero reserved bytes", gossip, false},
+		{"short", []byte{1, 0}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isWireguardMessage(tt.packet); got != tt.want {
+				t.Errorf("isWireguardMessage() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+// readPacket reads a packet from the socket, failing the test if none arrives
+func readPacket(t *testing.T, conn net.PacketConn) ([]byte, *net.UDPAddr) {
+	t.Helper()
+	buf := make([]byte, relayBufSize)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, addr, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("no packet received: %s", err)
+	}
+	return buf[:n], addr.(*net.UDPAddr)
+}
+
+func Test_Relay(t *testing.T) {
+	device, err := net.ListenPacket("udp", "127.0.0.1:0") // in place of the wireguard device
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+	relay, err := NewRelay("127.0.0.1:0", device.LocalAddr().(*net.UDPAddr).Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	relayAddr := relay.conn.LocalAddr()
+	remote, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	gossip := relay.Gossip()
+	defer gossip.Close()
+
+	initiation := make([]byte, 148)
+	initiation[0] = 1
+	remote.WriteTo(initiation, relayAddr)
+	got, local := readPacket(t, device)
+	if !bytes.Equal(got, initiation) {
+		t.Errorf("device received %x, want the initiation", got)
+	}
+	if r := relay.Remote(local); r == nil || r.String() != remote.LocalAddr().String() {
+		t.Errorf("Remote(%s) = %s, want %s", local, r, remote.LocalAddr())
+	}
+
+	response := make([]byte, 92)
+	response[0] = 2
+	device.WriteTo(response, local)
+	got, from := readPacket(t, remote)
+	if !bytes.Equal(got, response) || from.String() != relayAddr.String() {
+		t.Errorf("remote received %x from %s, want the response from %s", got, from, relayAddr)
+	}
+
+	remote.WriteTo([]byte("gossip"), relayAddr)
+	buf := make([]byte, 64)
+	n, addr, err := gossip.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "gossip" || addr.String() != remote.LocalAddr().String() {
+		t.Errorf("gossip ReadFrom() = %q, %s, %v; want the gossip packet", buf[:n], addr, err)
+	}
+
+	if configured, err := relay.Local(remote.LocalAddr().(*net.UDPAddr)); err != nil || configured.String() != local.String() {
+		t.Errorf("Local() = %s, %v; want the session of the received messages %s", configured, err, local)
+	}
+	relay.expire(time.Now().Add(relaySessionTimeout))
+	if relay.Remote(local) == nil {
+		t.Errorf("configured session expired")
+	}
+	relay.Retain(nil)
+	relay.expire(time.Now().Add(relaySessionTimeout))
+	if relay.Remote(local) != nil {
+		t.Errorf("idle session no longer configured did not expire")
+	}
+}
+
+func Test_State_SetUpInterface_relay(t *testing.T) {
+	relay, err := NewRelay("127.0.0.1:0", 51820)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	_, overlayNet, _ := net.ParseCIDR("10.0.0.0/8")
+	backend := NewFake()
+	s, _, err := New(backend, "wgtest", 51820, 1420, overlayNet, "local", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Relay = relay
+	key, _ := wgtypes.GeneratePrivateKey()
+	node := common.Node{Name: "peer", Addr: net.ParseIP("192.0.2.1")}
+	node.PubKey = key.PublicKey().String()
+	node.OverlayAddr = net.IPNet{IP: net.ParseIP("10.0.0.2").To4(), Mask: net.CIDRMask(32, 32)}
+	node.EndpointPort = 7946
+
+	if err := s.SetUpInterface([]common.Node{node}, nil); err != nil {
+		t.Fatalf("SetUpInterface() error = %v", err)
+	}
+	device, _ := backend.Stats("wgtest")
+	if len(device.Peers) != 1 || !device.Peers[0].Endpoint.IP.IsLoopback() {
+		t.Fatalf("device peers = %v, want the peer at a loopback endpoint", device.Peers)
+	}
+	peers, err := s.Peers()
+	if err != nil || len(peers) != 1 || peers[0].Endpoint.String() != "192.0.2.1:7946" {
+		t.Errorf("Peers() = %v, %v; want the peer at its announced endpoint", peers, err)
+	}
+}
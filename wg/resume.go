@@ -0,0 +1,55 @@
+package wg
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/costela/wesher/common"
+	"github.com/pkg/errors"
+)
+
+// handshakePort is the port of the datagrams sent to initiate handshakes; the discard port, since they are not meant
+// to be received by anything
+const handshakePort = 9
+
+// Resume prepares the state for reconfiguring the interface after resuming from suspend: the endpoints peers roamed
+// to are forgotten, since they likely changed while suspended, and all peers are reapplied with the announced ones on
+// the next SetUpInterface.
+func (s *State) Resume() {
+	s.roamed = nil
+	s.peers = nil
+}
+
+// InitiateHandshakes makes wireguard initiate handshakes with the nodes right away, instead of waiting for traffic or
+// keepalives, by sending an empty datagram to each of their overlay addresses.
+// Only the kernel backend carries traffic, so it does nothing for others.
+func (s *State) InitiateHandshakes(nodes []common.Node) error {
+	if !s.hostNetwork {
+		return nil
+	}
+	failed := 0
+	var err error
+	for _, node := range nodes {
+		if node.OverlayAddr.IP == nil {
+			continue
+		}
+		if sendErr := sendEmpty(net.JoinHostPort(node.OverlayAddr.IP.String(), strconv.Itoa(handshakePort))); sendErr != nil {
+			failed++
+			err = sendErr
+		}
+	}
+	if failed > 0 {
+		return errors.Wrapf(err, "could not initiate handshakes with %d nodes", failed)
+	}
+	return nil
+}
+
+func sendEmpty(addr string) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(nil)
+	return err
+}
@@ -0,0 +1,87 @@
+package wg
+
+import (
+	"net"
+	"time"
+
+	"github.com/costela/wesher/common"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// roamedHandshakeAge bounds the age of the last handshake with a peer for its current endpoint to be trusted
+const roamedHandshakeAge = 3 * time.Minute
+
+// roamed is an endpoint a peer roamed to, away from the one it announces
+type roamed struct {
+	announced string // endpoint the node announced when it roamed
+	endpoint  *net.UDPAddr
+	observed  bool // learned by the local device, instead of gossiped by other nodes
+}
+
+// UpdateRoaming records the endpoints peers roamed to, as learned by the device from their authenticated packets, so
+// they are kept when reconfiguring the peers instead of being reset to the announced ones.
+// With AdoptRoamed, the endpoints other nodes gossip are also used for peers the device has not heard from recently.
+// It provides the endpoints observed locally, by public key, for gossiping them.
+func (s *State) UpdateRoaming(nodes []common.Node, now time.Time) (map[string]*net.UDPAddr, error) {
+	peers, err := s.Peers()
+	if err != nil {
+		return nil, err
+	}
+	s.roamed = roamedEndpoints(s.roamed, nodes, peers, s.Port, s.AdoptRoamed, now)
+	observed := make(map[string]*net.UDPAddr)
+	for key, r := range s.roamed {
+		if r.observed {
+			observed[key] = r.endpoint
+		}
+	}
+	return observed, nil
+}
+
+// roamedEndpoints provides the endpoints the nodes roamed to, forgetting the ones of nodes that left or announce
+// another endpoint by now
+func roamedEndpoints(previous map[string]roamed, nodes []common.Node, peers []wgtypes.Peer, port int, adopt bool, now time.Time) map[string]roamed {
+	byKey := make(map[string]wgtypes.Peer, len(peers))
+	for _, peer := range peers {
+		byKey[peer.PublicKey.String()] = peer
+	}
+	announced := make(map[string]string, len(nodes))
+	for _, node := range nodes {
+		announced[node.PubKey] = nodeEndpoint(node, port).String()
+	}
+
+	current := make(map[string]roamed)
+	heard := make(map[string]bool)
+	for _, node := range nodes {
+		peer, ok := byKey[node.PubKey]
+		if ok && peer.Endpoint != nil && now.Sub(peer.LastHandshakeTime) < roamedHandshakeAge {
+			heard[node.PubKey] = true // the device knows best
+			if peer.Endpoint.String() != announced[node.PubKey] {
+				current[node.PubKey] = roamed{announced: announced[node.PubKey], endpoint: peer.Endpoint, observed: true}
+			}
+			continue
+		}
+		if r, ok := previous[node.PubKey]; ok && r.announced == announced[node.PubKey] {
+			current[node.PubKey] = r // kept until heard from again
+		}
+	}
+	if !adopt {
+		return current
+	}
+	for _, node := range nodes {
+		for key, endpoint := range node.Roamed {
+			if _, ok := announced[key]; !ok || heard[key] || current[key].observed {
+				continue
+			}
+			current[key] = roamed{announced: announced[key], endpoint: endpoint}
+		}
+	}
+	return current
+}
+
+// roamedEndpoint provides the endpoint the node roamed to, if it still announces the same endpoint
+func (s *State) roamedEndpoint(node common.Node, announced *net.UDPAddr) *net.UDPAddr {
+	if r, ok := s.roamed[node.PubKey]; ok && r.announced == announced.String() {
+		return r.endpoint
+	}
+	return announced
+}
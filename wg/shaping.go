@@ -0,0 +1,163 @@
+package wg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/costela/wesher/common"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Bandwidth limits are applied with an HTB qdisc on the wireguard interface: all traffic goes through a root class
+// limited to the egress limit, below which every limited peer gets its own class, selected by u32 filters matching
+// the peer's allowed IPs. Traffic to other peers goes through a default class only bound by the root class.
+
+// unlimitedRate is used for classes without limit; HTB needs some rate
+const unlimitedRate = 100 * 1000 * 1000 * 1000 // 100gbit
+
+// class minor numbers
+const (
+	rootClass      = 1
+	defaultClass   = 2
+	firstPeerClass = 16
+)
+
+// peerLimit is the limit applied to the traffic towards a peer
+type peerLimit struct {
+	rate     uint64
+	networks []net.IPNet
+}
+
+// peerLimits provides the limits for all limited peers, sorted by public key for stable class numbers
+// A peer's limit is the lowest of the local peer egress limit and the ingress limit announced by the peer.
+func (s *State) peerLimits(nodes []common.Node) []peerLimit {
+	sorted := append([]common.Node{}, nodes...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].PubKey < sorted[j].PubKey })
+	limits := make([]peerLimit, 0)
+	for _, node := range sorted {
+		rate := minRate(s.PeerEgressLimit, node.IngressLimit)
+		if rate == 0 {
+			continue
+		}
+		limits = append(limits, peerLimit{
+			rate:     rate,
+			networks: append([]net.IPNet{node.OverlayAddr}, node.Routes...),
+		})
+	}
+	return limits
+}
+
+// applyShaping sets up the qdisc, classes and filters for the configured limits, only touching them if they changed
+func (s *State) applyShaping(link netlink.Link, nodes []common.Node) error {
+	limits := s.peerLimits(nodes)
+	spec := fmt.Sprintf("%d %v", s.EgressLimit, limits)
+	if spec == s.shapingSpec {
+		return nil
+	}
+
+	root := netlink.NewHtb(netlink.QdiscAttrs{
+		LinkIndex: link.Attrs().Index,
+		Handle:    netlink.MakeHandle(1, 0),
+		Parent:    netlink.HANDLE_ROOT,
+	})
+	root.Defcls = defaultClass
+	// start from scratch, dropping any previous classes and filters
+	netlink.QdiscDel(root) // nolint: errcheck // fails if there is no previous qdisc
+	s.shapingSpec = ""
+	if s.EgressLimit == 0 && len(limits) == 0 {
+		s.shapingSpec = spec
+		return nil
+	}
+
+	if err := netlink.QdiscAdd(root); err != nil {
+		return errors.Wrapf(err, "could not add qdisc to %s", s.iface)
+	}
+	rootRate := s.EgressLimit
+	if rootRate == 0 {
+		rootRate = unlimitedRate
+	}
+	if err := s.addClass(link, netlink.MakeHandle(1, 0), rootClass, rootRate); err != nil {
+		return err
+	}
+	if err := s.addClass(link, netlink.MakeHandle(1, rootClass), defaultClass, rootRate); err != nil {
+		return err
+	}
+	for i, limit := range limits {
+		minor := uint16(firstPeerClass + i)
+		if err := s.addClass(link, netlink.MakeHandle(1, rootClass), minor, minRate(limit.rate, rootRate)); err != nil {
+			return err
+		}
+		for _, network := range limit.networks {
+			protocol, keys := u32Keys(network)
+			filter := &netlink.U32{
+				FilterAttrs: netlink.FilterAttrs{
+					LinkIndex: link.Attrs().Index,
+					Parent:    netlink.MakeHandle(1, 0),
+					Priority:  1,
+					Protocol:  protocol,
+				},
+				ClassId: netlink.MakeHandle(1, minor),
+				Sel:     &netlink.TcU32Sel{Flags: netlink.TC_U32_TERMINAL, Keys: keys},
+			}
+			if err := netlink.FilterAdd(filter); err != nil {
+				return errors.Wrapf(err, "could not add traffic filter for %s", &network)
+			}
+		}
+	}
+	s.shapingSpec = spec
+	return nil
+}
+
+func (s *State) addClass(link netlink.Link, parent uint32, minor uint16, rate uint64) error {
+	class := netlink.NewHtbClass(netlink.ClassAttrs{
+		LinkIndex: link.Attrs().Index,
+		Parent:    parent,
+		Handle:    netlink.MakeHandle(1, minor),
+	}, netlink.HtbClassAttrs{Rate: rate, Ceil: rate})
+	if err := netlink.ClassAdd(class); err != nil {
+		return errors.Wrapf(err, "could not add traffic class 1:%d to %s", minor, s.iface)
+	}
+	return nil
+}
+
+// u32Keys provides the u32 protocol and keys matching packets to the provided network
+// The wireguard interface carries bare IP packets, so the destination address is at a fixed offset of the IP header.
+func u32Keys(network net.IPNet) (uint16, []netlink.TcU32Key) {
+	protocol, offset := uint16(unix.ETH_P_IP), 16
+	ip, mask := network.IP.To4(), network.Mask
+	if ip == nil {
+		protocol, offset = unix.ETH_P_IPV6, 24
+		ip = network.IP.To16()
+	}
+	if len(mask) != len(ip) {
+		mask = mask[len(mask)-len(ip):]
+	}
+	keys := make([]netlink.TcU32Key, 0, len(ip)/4)
+	for i := 0; i < len(ip); i += 4 {
+		m := binary.BigEndian.Uint32(mask[i : i+4])
+		if m == 0 {
+			continue
+		}
+		keys = append(keys, netlink.TcU32Key{
+			Mask: m,
+			Val:  binary.BigEndian.Uint32(ip[i:i+4]) & m,
+			Off:  int32(offset + i),
+		})
+	}
+	if len(keys) == 0 {
+		keys = append(keys, netlink.TcU32Key{}) // match all
+	}
+	return protocol, keys
+}
+
+// minRate provides the lowest of the provided rates, ignoring unset (zero) rates
+func minRate(a, b uint64) uint64 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,62 @@
+package wg
+
+import (
+	"net"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// removeStale removes leftovers of a previous run which did not shut down cleanly, i.e. addresses other than the
+// overlay address and routes via the interface not part of the desired routes
+func (s *State) removeStale(link netlink.Link, currentRoutes, desiredRoutes []netlink.Route) error {
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return err
+	}
+	for _, addr := range staleAddrs(addrs, s.OverlayAddr) {
+		logrus.Infof("removing stale address %s from %s", addr.IPNet, s.iface)
+		addr := addr
+		if err := netlink.AddrDel(link, &addr); err != nil {
+			return err
+		}
+	}
+	for _, route := range staleRoutes(currentRoutes, desiredRoutes) {
+		logrus.Infof("removing stale route %s via %s", route.Dst, s.iface)
+		route := route
+		if err := netlink.RouteDel(&route); err != nil && err != unix.ESRCH {
+			return err
+		}
+	}
+	return nil
+}
+
+// staleAddrs provides the addresses other than the overlay address, ignoring link-local ones
+func staleAddrs(addrs []netlink.Addr, overlayAddr net.IPNet) []netlink.Addr {
+	stale := make([]netlink.Addr, 0)
+	for _, addr := range addrs {
+		if addr.IPNet == nil || addr.IP.IsLinkLocalUnicast() || addr.IPNet.String() == overlayAddr.String() {
+			continue
+		}
+		stale = append(stale, addr)
+	}
+	return stale
+}
+
+// staleRoutes provides the current routes without a desired route to the same destination, ignoring the routes
+// maintained by the kernel for the interface addresses
+func staleRoutes(current, desired []netlink.Route) []netlink.Route {
+	wanted := make(map[string]bool, len(desired))
+	for _, route := range desired {
+		wanted[route.Dst.String()] = true
+	}
+	stale := make([]netlink.Route, 0)
+	for _, route := range current {
+		if route.Dst == nil || route.Protocol == unix.RTPROT_KERNEL || route.Dst.IP.IsLinkLocalUnicast() || wanted[route.Dst.String()] {
+			continue
+		}
+		stale = append(stale, route)
+	}
+	return stale
+}
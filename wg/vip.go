@@ -0,0 +1,45 @@
+package wg
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// applyVIPs adds the virtual IPs owned by the local node to the interface, and removes the ones it no longer owns
+func (s *State) applyVIPs(link netlink.Link) error {
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return err
+	}
+	current := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		if addr.IPNet != nil {
+			current[addr.IPNet.String()] = true
+		}
+	}
+	owned := make(map[string]bool, len(s.VIPs))
+	for _, vip := range s.VIPs {
+		vip := vip
+		owned[vip.String()] = true
+		if current[vip.String()] {
+			continue
+		}
+		logrus.Infof("taking over virtual IP %s on %s", vip.IP, s.iface)
+		if err := netlink.AddrAdd(link, &netlink.Addr{IPNet: &vip}); err != nil {
+			return errors.Wrapf(err, "could not add virtual IP %s", vip.IP)
+		}
+	}
+	for _, addr := range addrs {
+		if addr.IPNet == nil || !s.vips[addr.IPNet.String()] || owned[addr.IPNet.String()] {
+			continue
+		}
+		logrus.Infof("releasing virtual IP %s on %s", addr.IP, s.iface)
+		addr := addr
+		if err := netlink.AddrDel(link, &addr); err != nil {
+			return errors.Wrapf(err, "could not remove virtual IP %s", addr.IP)
+		}
+	}
+	s.vips = owned
+	return nil
+}
@@ -0,0 +1,185 @@
+package wg
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// watchSettleTime is the time waited for further changes before pushing them, so bursts (e.g. the interface being
+// removed along with its addresses and routes) are pushed as a single change
+const watchSettleTime = 100 * time.Millisecond
+
+// watchResubscribeDelay is the time waited before resubscribing to netlink updates after a subscription failed
+const watchResubscribeDelay = 5 * time.Second
+
+// WatchInterface pushes external changes removing configuration from the interface to a channel: the interface
+// being removed or set down, or addresses or routes via it being removed. If a bind device is provided, changes of its
+// routes are pushed too, since they need to be copied to its routing table.
+// Changes are tracked via netlink updates and pushed as descriptions, with bursts coalesced into a single push. Since
+// changes made by wesher itself are pushed too, they only hint at drift, to be confirmed with Drift.
+func WatchInterface(iface, bindDevice string) <-chan []string {
+	changesc := make(chan []string)
+	w := &interfaceWatcher{iface: iface, bindDevice: bindDevice}
+	go w.run(changesc)
+	return changesc
+}
+
+// interfaceWatcher keeps track of the index of the watched interface and bind device, to match address and route
+// updates
+type interfaceWatcher struct {
+	iface      string
+	index      int
+	bindDevice string
+	bindIndex  int
+}
+
+func (w *interfaceWatcher) run(changesc chan<- []string) {
+	var linkc chan netlink.LinkUpdate
+	var addrc chan netlink.AddrUpdate
+	var routec chan netlink.RouteUpdate
+	var done chan struct{}
+	var settle, retry <-chan time.Time
+	var pending []string
+	var out chan<- []string // only set while changes are pending
+
+	unsubscribe := func() {
+		close(done)
+		// drain until the subscriptions are closed
+		go func(c chan netlink.LinkUpdate) {
+			for range c {
+			}
+		}(linkc)
+		go func(c chan netlink.AddrUpdate) {
+			for range c {
+			}
+		}(addrc)
+		go func(c chan netlink.RouteUpdate) {
+			for range c {
+			}
+		}(routec)
+		linkc, addrc, routec = nil, nil, nil
+		retry = time.After(watchResubscribeDelay)
+	}
+	subscribe := func() {
+		w.index, w.bindIndex = 0, 0
+		if link, err := netlink.LinkByName(w.iface); err == nil {
+			w.index = link.Attrs().Index
+		}
+		if w.bindDevice != "" {
+			if link, err := netlink.LinkByName(w.bindDevice); err == nil {
+				w.bindIndex = link.Attrs().Index
+			}
+		}
+		linkc = make(chan netlink.LinkUpdate)
+		addrc = make(chan netlink.AddrUpdate)
+		routec = make(chan netlink.RouteUpdate)
+		done = make(chan struct{})
+		// failed subscriptions are retried below
+		if err := netlink.LinkSubscribe(linkc, done); err != nil {
+			close(linkc)
+		}
+		if err := netlink.AddrSubscribe(addrc, done); err != nil {
+			close(addrc)
+		}
+		if err := netlink.RouteSubscribe(routec, done); err != nil {
+			close(routec)
+		}
+	}
+	push := func(change string) {
+		if change == "" {
+			return
+		}
+		pending = append(pending, change)
+		if settle == nil {
+			settle = time.After(watchSettleTime)
+		}
+	}
+
+	subscribe()
+	for {
+		select {
+		case update, ok := <-linkc:
+			if !ok {
+				unsubscribe()
+				continue
+			}
+			push(w.linkChange(update))
+		case update, ok := <-addrc:
+			if !ok {
+				unsubscribe()
+				continue
+			}
+			push(w.addrChange(update))
+		case update, ok := <-routec:
+			if !ok {
+				unsubscribe()
+				continue
+			}
+			push(w.routeChange(update))
+		case <-retry:
+			retry = nil
+			subscribe()
+		case <-settle:
+			settle = nil
+			out = changesc
+		case out <- pending:
+			pending, out = nil, nil
+		}
+	}
+}
+
+// linkChange describes the link update, if it removed the interface or set it down
+func (w *interfaceWatcher) linkChange(update netlink.LinkUpdate) string {
+	if w.bindDevice != "" && update.Attrs().Name == w.bindDevice {
+		w.bindIndex = update.Attrs().Index
+		if update.Header.Type == unix.RTM_DELLINK {
+			w.bindIndex = 0
+		}
+		return "" // its routes are updated along with it
+	}
+	if update.Attrs().Name != w.iface {
+		return ""
+	}
+	if update.Header.Type == unix.RTM_DELLINK {
+		w.index = 0
+		return "interface was removed"
+	}
+	w.index = update.Attrs().Index
+	if update.Flags&unix.IFF_UP == 0 {
+		return "interface is down"
+	}
+	return ""
+}
+
+// addrChange describes the address update, if it removed an address from the interface
+func (w *interfaceWatcher) addrChange(update netlink.AddrUpdate) string {
+	if update.NewAddr || w.index == 0 || update.LinkIndex != w.index {
+		return ""
+	}
+	return fmt.Sprintf("address %s was removed", update.LinkAddress.String())
+}
+
+// routeChange describes the route update, if it removed a route via the interface or changed one of the main table via
+// the bind device
+func (w *interfaceWatcher) routeChange(update netlink.RouteUpdate) string {
+	if w.bindIndex != 0 && update.LinkIndex == w.bindIndex && update.Table == unix.RT_TABLE_MAIN {
+		dst := "default"
+		if update.Dst != nil {
+			dst = update.Dst.String()
+		}
+		if update.Type == unix.RTM_DELROUTE {
+			return fmt.Sprintf("route to %s via %s was removed", dst, w.bindDevice)
+		}
+		return fmt.Sprintf("route to %s via %s was changed", dst, w.bindDevice)
+	}
+	if update.Type != unix.RTM_DELROUTE || w.index == 0 || update.LinkIndex != w.index || update.Dst == nil {
+		return ""
+	}
+	if update.Table == unix.RT_TABLE_LOCAL { // follows the removal of addresses
+		return ""
+	}
+	return fmt.Sprintf("route to %s was removed", update.Dst)
+}
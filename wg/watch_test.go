@@ -0,0 +1,94 @@
+package wg
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func Test_interfaceWatcher_changes(t *testing.T) {
+	w := &interfaceWatcher{iface: "wgtest"}
+	_, dst, _ := net.ParseCIDR("10.1.0.0/16")
+	addr := net.IPNet{IP: net.ParseIP("10.0.0.1"), Mask: net.CIDRMask(8, 32)}
+
+	if got := w.addrChange(netlink.AddrUpdate{LinkAddress: addr, LinkIndex: 7}); got != "" {
+		t.Errorf("addrChange() = %q before the interface is known, want none", got)
+	}
+
+	created := netlink.LinkUpdate{Header: unix.NlMsghdr{Type: unix.RTM_NEWLINK}, Link: &wireguard{netlink.LinkAttrs{Name: "wgtest", Index: 7}}}
+	if got := w.linkChange(created); got != "interface is down" || w.index != 7 {
+		t.Errorf("linkChange() = %q, index %d, want interface down with index 7", got, w.index)
+	}
+	created.Flags = unix.IFF_UP
+	if got := w.linkChange(created); got != "" {
+		t.Errorf("linkChange() = %q for an interface up, want none", got)
+	}
+	other := netlink.LinkUpdate{Header: unix.NlMsghdr{Type: unix.RTM_DELLINK}, Link: &wireguard{netlink.LinkAttrs{Name: "eth0", Index: 2}}}
+	if got := w.linkChange(other); got != "" {
+		t.Errorf("linkChange() = %q for another interface, want none", got)
+	}
+
+	if got := w.addrChange(netlink.AddrUpdate{LinkAddress: addr, LinkIndex: 7, NewAddr: true}); got != "" {
+		t.Errorf("addrChange() = %q for an added address, want none", got)
+	}
+	if got := w.addrChange(netlink.AddrUpdate{LinkAddress: addr, LinkIndex: 2}); got != "" {
+		t.Errorf("addrChange() = %q for another interface, want none", got)
+	}
+	if got := w.addrChange(netlink.AddrUpdate{LinkAddress: addr, LinkIndex: 7}); got != "address 10.0.0.1/8 was removed" {
+		t.Errorf("addrChange() = %q, want address removed", got)
+	}
+
+	removed := netlink.RouteUpdate{Type: unix.RTM_DELROUTE, Route: netlink.Route{LinkIndex: 7, Dst: dst, Table: unix.RT_TABLE_MAIN}}
+	if got := w.routeChange(removed); got != "route to 10.1.0.0/16 was removed" {
+		t.Errorf("routeChange() = %q, want route removed", got)
+	}
+	removed.Table = unix.RT_TABLE_LOCAL
+	if got := w.routeChange(removed); got != "" {
+		t.Errorf("routeChange() = %q for a local route, want none", got)
+	}
+	added := netlink.RouteUpdate{Type: unix.RTM_NEWROUTE, Route: netlink.Route{LinkIndex: 7, Dst: dst}}
+	if got := w.routeChange(added); got != "" {
+		t.Errorf("routeChange() = %q for an added route, want none", got)
+	}
+
+	deleted := netlink.LinkUpdate{Header: unix.NlMsghdr{Type: unix.RTM_DELLINK}, Link: &wireguard{netlink.LinkAttrs{Name: "wgtest", Index: 7}}}
+	if got := w.linkChange(deleted); got != "interface was removed" || w.index != 0 {
+		t.Errorf("linkChange() = %q, index %d, want interface removed", got, w.index)
+	}
+}
+
+func Test_interfaceWatcher_bindDeviceChanges(t *testing.T) {
+	w := &interfaceWatcher{iface: "wgtest", bindDevice: "eth1"}
+	_, dst, _ := net.ParseCIDR("192.168.1.0/24")
+
+	added := netlink.RouteUpdate{Type: unix.RTM_NEWROUTE, Route: netlink.Route{LinkIndex: 3, Table: unix.RT_TABLE_MAIN}}
+	if got := w.routeChange(added); got != "" {
+		t.Errorf("routeChange() = %q before the bind device is known, want none", got)
+	}
+
+	created := netlink.LinkUpdate{Header: unix.NlMsghdr{Type: unix.RTM_NEWLINK}, Link: &wireguard{netlink.LinkAttrs{Name: "eth1", Index: 3}}}
+	if got := w.linkChange(created); got != "" || w.bindIndex != 3 || w.index != 0 {
+		t.Errorf("linkChange() = %q, bind index %d, index %d; want bind index 3 only", got, w.bindIndex, w.index)
+	}
+	if got := w.routeChange(added); got != "route to default via eth1 was changed" {
+		t.Errorf("routeChange() = %q, want default route changed", got)
+	}
+	removed := netlink.RouteUpdate{Type: unix.RTM_DELROUTE, Route: netlink.Route{LinkIndex: 3, Dst: dst, Table: unix.RT_TABLE_MAIN}}
+	if got := w.routeChange(removed); got != "route to 192.168.1.0/24 via eth1 was removed" {
+		t.Errorf("routeChange() = %q, want route removed", got)
+	}
+	copied := netlink.RouteUpdate{Type: unix.RTM_NEWROUTE, Route: netlink.Route{LinkIndex: 3, Dst: dst, Table: 51820}}
+	if got := w.routeChange(copied); got != "" {
+		t.Errorf("routeChange() = %q for a route copied to the bind device table, want none", got)
+	}
+
+	deleted := netlink.LinkUpdate{Header: unix.NlMsghdr{Type: unix.RTM_DELLINK}, Link: &wireguard{netlink.LinkAttrs{Name: "eth1", Index: 3}}}
+	if got := w.linkChange(deleted); got != "" || w.bindIndex != 0 {
+		t.Errorf("linkChange() = %q, bind index %d, want the bind device forgotten", got, w.bindIndex)
+	}
+	if got := w.routeChange(removed); got != "" {
+		t.Errorf("routeChange() = %q after the bind device was removed, want none", got)
+	}
+}
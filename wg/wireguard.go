@@ -2,40 +2,52 @@ package wg
 
 import (
 	"fmt"
-	"hash/fnv"
 	"net"
 	"os"
 	"time"
 
 	"github.com/costela/wesher/common"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
-	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.org/x/sys/unix"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
-	"github.com/sirupsen/logrus"
 )
 
 // State holds the configured state of a Wesher Wireguard interface
 type State struct {
-	iface       string
-	client      *wgctrl.Client
-	OverlayAddr net.IPNet
-	Port        int
-	PrivKey     wgtypes.Key
-	PubKey      wgtypes.Key
-	MTU         int
+	iface             string
+	backend           Backend
+	hostNetwork       bool // routes, policy rules, shaping and stale addresses are managed, i.e. with the kernel backend
+	OverlayAddr       net.IPNet
+	Port              int
+	PrivKey           wgtypes.Key
+	PubKey            wgtypes.Key
+	MTU               int
 	KeepaliveInterval *time.Duration
+	KeepaliveNATOnly  bool // only send keepalives to peers if either side is behind NAT
+	BehindNAT         bool // whether the local node is behind NAT
+	AdoptRoamed       bool // use the endpoints other nodes observed peers roaming to
+	StrictAllowedIPs  bool // peers only get the host prefix of their overlay address as allowed IP, never their routes
+	ExternalPeers     []ExternalPeer
+	BindDevice        string
+	Relay             *Relay                   // relays the traffic of the nodes multiplexed on the cluster port, if any
+	MarkPackets       bool                     // mark encapsulated packets with the listening port even without BindDevice
+	EgressLimit       uint64                   // bits per second, 0 for unlimited
+	PeerEgressLimit   uint64                   // bits per second, 0 for unlimited
+	VIPs              []net.IPNet              // virtual IPs owned by the local node, added to the interface
+	shapingSpec       string                   // limits currently applied
+	peers             map[wgtypes.Key]string   // fingerprints of the peer configurations currently applied
+	routes            map[string]netlink.Route // routes currently applied via the interface, by destination
+	cleanedUp         bool                     // leftovers of previous runs were removed
+	roamed            map[string]roamed        // endpoints peers roamed to, by public key
+	vips              map[string]bool          // virtual IPs currently added to the interface
 }
 
 // New creates a new Wesher Wireguard state
 // The Wireguard keys are generated for every new interface
 // The interface must later be setup using SetUpInterface
-func New(iface string, port int, mtu int, ipnet *net.IPNet, name string, keepaliveInterval *time.Duration) (*State, *common.Node, error) {
-	client, err := wgctrl.New()
-	if err != nil {
-		return nil, nil, errors.Wrap(err, "could not instantiate wireguard client")
-	}
-
+func New(backend Backend, iface string, port int, mtu int, ipnet *net.IPNet, name string, keepaliveInterval *time.Duration, bindDevice string) (*State, *common.Node, error) {
 	privKey, err := wgtypes.GeneratePrivateKey()
 	if err != nil {
 		return nil, nil, err
@@ -43,14 +55,16 @@ func New(iface string, port int, mtu int, ipnet *net.IPNet, name string, keepali
 	pubKey := privKey.PublicKey()
 
 	state := State{
-		iface:   iface,
-		client:  client,
-		Port:    port,
-		PrivKey: privKey,
-		PubKey:  pubKey,
-		MTU:     mtu,
+		iface:             iface,
+		backend:           backend,
+		Port:              port,
+		PrivKey:           privKey,
+		PubKey:            pubKey,
+		MTU:               mtu,
 		KeepaliveInterval: keepaliveInterval,
+		BindDevice:        bindDevice,
 	}
+	state.hostNetwork = backend.HostNetwork()
 	state.assignOverlayAddr(ipnet, name)
 
 	node := &common.Node{}
@@ -60,118 +74,176 @@ func New(iface string, port int, mtu int, ipnet *net.IPNet, name string, keepali
 	return &state, node, nil
 }
 
+// SetPrivateKey replaces the generated private key, e.g. by one persisted from a previous run
+func (s *State) SetPrivateKey(key wgtypes.Key) {
+	s.PrivKey = key
+	s.PubKey = key.PublicKey()
+}
+
 // assignOverlayAddr assigns a new address to the interface
 // The address is assigned inside the provided network and depends on the
 // provided name deterministically
 // Currently, the address is assigned by hashing the name and mapping that
 // hash in the target network space
 func (s *State) assignOverlayAddr(ipnet *net.IPNet, name string) {
-	// TODO: this is way too brittle and opaque
-	bits, size := ipnet.Mask.Size()
-	ip := make([]byte, len(ipnet.IP))
-	copy(ip, []byte(ipnet.IP))
-
-	h := fnv.New128a()
-	h.Write([]byte(name))
-	hb := h.Sum(nil)
+	s.AssignOverlayAddr(HashName{}, ipnet, name, nil) // nolint: errcheck // cannot fail
+}
 
-	for i := 1; i <= (size-bits)/8; i++ {
-		ip[len(ip)-i] = hb[len(hb)-i]
+// AssignOverlayAddr assigns a new address to the interface using the provided strategy, avoiding the addresses used
+// by other known nodes if the strategy supports it
+func (s *State) AssignOverlayAddr(strategy AddressStrategy, ipnet *net.IPNet, name string, used []net.IP) error {
+	ip, err := strategy.Assign(ipnet, name, used)
+	if err != nil {
+		return err
 	}
-
+	if s.OverlayAddr.IP != nil && !s.OverlayAddr.IP.Equal(ip) {
+		s.cleanedUp = false // remove the previous address
+	}
+	_, size := ipnet.Mask.Size()
 	s.OverlayAddr = net.IPNet{
-		IP:   net.IP(ip),
+		IP:   ip,
 		Mask: net.CIDRMask(size, size), // either /32 or /128, depending if ipv4 or ipv6
 	}
+	return nil
+}
+
+// hostPrefix provides the single address network of the IP, either /32 or /128
+func hostPrefix(ip net.IP) net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
 }
 
 // DownInterface shuts down the associated network interface
 func (s *State) DownInterface() error {
-	if _, err := s.client.Device(s.iface); err != nil {
+	if _, err := s.backend.Stats(s.iface); err != nil {
 		if os.IsNotExist(err) {
 			return nil // device already gone; noop
 		}
 		return err
 	}
-	link, err := netlink.LinkByName(s.iface)
+	if s.hostNetwork && s.BindDevice != "" {
+		if err := s.removeDeviceRules(); err != nil {
+			return err
+		}
+	}
+	s.ForgetApplied()
+	return s.backend.Down(s.iface)
+}
+
+// ForgetApplied forgets the configuration applied to the interface, e.g. once it is gone, so the next SetUpInterface
+// reapplies all of it instead of only the changes
+func (s *State) ForgetApplied() {
+	s.shapingSpec = ""
+	s.peers = nil
+	s.routes = nil
+	s.vips = nil
+}
+
+// Peers provides the peers currently configured on the associated wireguard device
+func (s *State) Peers() ([]wgtypes.Peer, error) {
+	device, err := s.backend.Stats(s.iface)
 	if err != nil {
-		return err
+		return nil, errors.Wrapf(err, "could not get wireguard device %s", s.iface)
 	}
-	return netlink.LinkDel(link)
+	if s.Relay != nil {
+		for i, peer := range device.Peers {
+			if remote := s.Relay.Remote(peer.Endpoint); remote != nil {
+				device.Peers[i].Endpoint = remote
+			}
+		}
+	}
+	return device.Peers, nil
 }
 
 // SetUpInterface creates and sets up the associated network interface
 func (s *State) SetUpInterface(nodes []common.Node, routedNet []*net.IPNet) error {
-	if err := netlink.LinkAdd(&wireguard{LinkAttrs: netlink.LinkAttrs{Name: s.iface}}); err != nil && !os.IsExist(err) {
-		return errors.Wrapf(err, "could not create interface %s", s.iface)
+	if err := s.backend.Up(s.iface, s.OverlayAddr, s.MTU); err != nil {
+		return err
 	}
 
 	peerCfgs, err := s.nodesToPeerConfigs(nodes)
 	if err != nil {
 		return errors.Wrap(err, "error converting received node information to wireguard format")
 	}
-	
-	logrus.Infof("set wireguard configuration for %s port %s peers %s", s.iface, s.Port, peerCfgs)
+	peerCfgs = append(peerCfgs, s.externalPeerConfigs()...)
+
+	changes, replace, applied := s.peerChanges(peerCfgs)
+	logrus.Infof("set wireguard configuration for %s port %d: %d peers, %d changed", s.iface, s.Port, len(peerCfgs), len(changes))
+	logrus.Debugf("changed wireguard peers %v", changes)
 
-	if err := s.client.ConfigureDevice(s.iface, wgtypes.Config{
+	wgConfig := wgtypes.Config{
 		PrivateKey:   &s.PrivKey,
 		ListenPort:   &s.Port,
-		ReplacePeers: true,
-		Peers:        peerCfgs,
-	}); err != nil {
-		return errors.Wrapf(err, "could not set wireguard configuration for %s port %s peers %s", s.iface, s.Port, peerCfgs)
+		ReplacePeers: replace,
+		Peers:        changes,
+	}
+	if s.hostNetwork && s.BindDevice != "" {
+		if err := s.routeViaDevice(); err != nil {
+			return errors.Wrapf(err, "could not route wireguard traffic via %s", s.BindDevice)
+		}
+	}
+	if s.BindDevice != "" || s.MarkPackets {
+		wgConfig.FirewallMark = &s.Port
+	}
+
+	if err := s.backend.ConfigurePeers(s.iface, wgConfig); err != nil {
+		s.peers = nil // the device state is unknown, configure all peers next time
+		return errors.Wrapf(err, "could not set wireguard configuration for %s port %d peers %v", s.iface, s.Port, changes)
+	}
+	s.peers = applied
+	if s.Relay != nil {
+		endpoints := make([]*net.UDPAddr, 0, len(peerCfgs))
+		for _, peerCfg := range peerCfgs {
+			endpoints = append(endpoints, peerCfg.Endpoint)
+		}
+		s.Relay.Retain(endpoints)
+	}
+	if !s.hostNetwork {
+		return nil
 	}
 
 	link, err := netlink.LinkByName(s.iface)
 	if err != nil {
 		return errors.Wrapf(err, "could not get link information for %s", s.iface)
 	}
-	if err := netlink.AddrReplace(link, &netlink.Addr{
-		IPNet: &s.OverlayAddr,
-	}); err != nil {
-		return errors.Wrapf(err, "could not set address for %s", s.iface)
-	}
-	if err := netlink.LinkSetMTU(link, s.MTU); err != nil {
-		return errors.Wrapf(err, "could not set MTU for %s", s.iface)
-	}
-	if err := netlink.LinkSetUp(link); err != nil {
-		return errors.Wrapf(err, "could not enable interface %s", s.iface)
+	if err := s.applyShaping(link, nodes); err != nil {
+		return errors.Wrapf(err, "could not apply bandwidth limits to %s", s.iface)
 	}
 
 	// first compute routes
+	routes := s.desiredRoutes(link.Attrs().Index, nodes, routedNet)
+	if s.routes != nil {
+		// only apply the differences to the routes applied before, without listing the routing table
+		if err := s.applyVIPs(link); err != nil {
+			return errors.Wrapf(err, "could not update virtual IPs of %s", s.iface)
+		}
+		s.applyRouteChanges(routes)
+		return nil
+	}
 	currentRoutes, err := netlink.RouteList(link, netlink.FAMILY_ALL)
 	if err != nil {
 		return errors.Wrapf(err, "could not update the routing table for %s", s.iface)
 	}
-	routes := make([]netlink.Route, 0)
-	for index, node := range nodes {
-		// dev route
-		routes = append(routes, netlink.Route{
-			LinkIndex: link.Attrs().Index,
-			Dst:       &nodes[index].OverlayAddr,
-			Scope:     netlink.SCOPE_LINK,
-		})
-		// via routes
-		for _, route := range node.Routes {
-			for _, routedNetItem := range routedNet {
-				if !routedNetItem.Contains(route.IP) {
-					continue
-				}
-			}
-			routes = append(routes, netlink.Route{
-				LinkIndex: link.Attrs().Index,
-				Dst:       &route,
-				Gw:        node.OverlayAddr.IP,
-				Scope:     netlink.SCOPE_SITE,
-			})
+	// then remove leftovers of a previous crash, once
+	if !s.cleanedUp {
+		if err := s.removeStale(link, currentRoutes, routes); err != nil {
+			return errors.Wrapf(err, "could not remove stale configuration of %s", s.iface)
 		}
+		s.cleanedUp = true
+	}
+	if err := s.applyVIPs(link); err != nil {
+		return errors.Wrapf(err, "could not update virtual IPs of %s", s.iface)
 	}
 	// then actually update the routing table
 	for _, route := range routes {
 		match := matchRoute(currentRoutes, route)
 		if match == nil {
+			logrus.Tracef("adding route %s via %s", route.Dst, route.Gw)
 			netlink.RouteAdd(&route)
 		} else if match.Gw.String() != route.Gw.String() {
+			logrus.Tracef("replacing route %s via %s with one via %s", route.Dst, match.Gw, route.Gw)
 			netlink.RouteReplace(&route)
 		}
 	}
@@ -184,10 +256,145 @@ func (s *State) SetUpInterface(nodes []common.Node, routedNet []*net.IPNet) erro
 			}
 		}
 	}
+	s.routes = routesByDst(routes)
 
 	return nil
 }
 
+// applyRouteChanges adds or replaces the desired routes differing from the ones currently applied, and removes the
+// applied routes which are no longer desired
+// Routes which could not be added are left out of the applied routes, so they are retried on the next setup.
+func (s *State) applyRouteChanges(routes []netlink.Route) {
+	add, replace, remove := routeChanges(s.routes, routes)
+	applied := routesByDst(routes)
+	for _, route := range add {
+		route := route
+		logrus.Tracef("adding route %s via %s", route.Dst, route.Gw)
+		if err := netlink.RouteAdd(&route); err != nil && err != unix.EEXIST {
+			logrus.WithError(err).Debugf("could not add route %s", route.Dst)
+			delete(applied, route.Dst.String())
+		}
+	}
+	for _, route := range replace {
+		route := route
+		logrus.Tracef("replacing route %s with one via %s", route.Dst, route.Gw)
+		if err := netlink.RouteReplace(&route); err != nil {
+			logrus.WithError(err).Debugf("could not replace route %s", route.Dst)
+			delete(applied, route.Dst.String())
+		}
+	}
+	for _, route := range remove {
+		route := route
+		logrus.Tracef("removing route %s via %s", route.Dst, route.Gw)
+		if err := netlink.RouteDel(&route); err != nil && err != unix.ESRCH {
+			logrus.WithError(err).Debugf("could not remove route %s", route.Dst)
+		}
+	}
+	s.routes = applied
+}
+
+// routeChanges provides the desired routes missing from the applied ones, the ones whose gateway changed and the
+// applied routes no longer desired
+// Added routes keep the order of the desired ones, so routes to nodes precede the routes via them.
+func routeChanges(applied map[string]netlink.Route, desired []netlink.Route) (add, replace, remove []netlink.Route) {
+	wanted := routesByDst(desired)
+	seen := make(map[string]bool, len(desired))
+	for _, route := range desired {
+		dst := route.Dst.String()
+		if seen[dst] {
+			continue
+		}
+		seen[dst] = true
+		route = wanted[dst] // the last desired route to the destination, as applied
+		current, ok := applied[dst]
+		switch {
+		case !ok:
+			add = append(add, route)
+		case current.Gw.String() != route.Gw.String():
+			replace = append(replace, route)
+		}
+	}
+	for dst, route := range applied {
+		if _, ok := wanted[dst]; !ok {
+			remove = append(remove, route)
+		}
+	}
+	return add, replace, remove
+}
+
+// routesByDst indexes the routes by destination
+func routesByDst(routes []netlink.Route) map[string]netlink.Route {
+	result := make(map[string]netlink.Route, len(routes))
+	for _, route := range routes {
+		result[route.Dst.String()] = route
+	}
+	return result
+}
+
+// desiredRoutes provides the routes via the interface to the nodes, their prefixes, virtual IPs and announced networks,
+// and to external peers
+func (s *State) desiredRoutes(linkIndex int, nodes []common.Node, routedNet []*net.IPNet) []netlink.Route {
+	routes := make([]netlink.Route, 0)
+	for index, node := range nodes {
+		// dev route
+		dst := &nodes[index].OverlayAddr
+		if s.StrictAllowedIPs {
+			host := hostPrefix(node.OverlayAddr.IP)
+			dst = &host
+		}
+		routes = append(routes, netlink.Route{
+			LinkIndex: linkIndex,
+			Dst:       dst,
+			Scope:     netlink.SCOPE_LINK,
+		})
+		if s.StrictAllowedIPs {
+			continue
+		}
+		// prefix and virtual IP routes
+		for _, prefix := range append(append([]net.IPNet{}, node.Prefixes...), node.VIPs...) {
+			prefix := prefix
+			routes = append(routes, netlink.Route{
+				LinkIndex: linkIndex,
+				Dst:       &prefix,
+				Scope:     netlink.SCOPE_LINK,
+			})
+		}
+		// via routes
+		for _, route := range node.Routes {
+			route := route
+			for _, routedNetItem := range routedNet {
+				if !routedNetItem.Contains(route.IP) {
+					continue
+				}
+			}
+			routes = append(routes, viaRoute(linkIndex, route, node.OverlayAddr.IP))
+		}
+	}
+	for _, network := range ExternalNetworks(s.ExternalPeers) {
+		network := network
+		routes = append(routes, netlink.Route{
+			LinkIndex: linkIndex,
+			Dst:       &network,
+			Scope:     netlink.SCOPE_LINK,
+		})
+	}
+	return routes
+}
+
+// nodeEndpoint provides the underlay address wireguard traffic to the node is sent to; nodes gossiping over the
+// overlay network announce it separately from their cluster address, and nodes behind a NAT port forward announce
+// their external port
+func nodeEndpoint(node common.Node, port int) *net.UDPAddr {
+	endpoint := &net.UDPAddr{IP: node.Addr, Port: port}
+	if node.Endpoint != nil {
+		endpoint.IP = node.Endpoint
+	}
+	if node.EndpointPort != 0 {
+		endpoint.Port = int(node.EndpointPort)
+	}
+	return endpoint
+}
+
 func (s *State) nodesToPeerConfigs(nodes []common.Node) ([]wgtypes.PeerConfig, error) {
 	peerCfgs := make([]wgtypes.PeerConfig, len(nodes))
 	for i, node := range nodes {
@@ -195,24 +402,119 @@ func (s *State) nodesToPeerConfigs(nodes []common.Node) ([]wgtypes.PeerConfig, e
 		if err != nil {
 			return nil, fmt.Errorf("parsing wireguard key: %w", err)
 		}
-						
+		allowedIPs := append(append(append([]net.IPNet{node.OverlayAddr}, node.Prefixes...), node.VIPs...), node.Routes...)
+		if s.StrictAllowedIPs {
+			allowedIPs = []net.IPNet{hostPrefix(node.OverlayAddr.IP)}
+		}
+
+		endpoint := s.roamedEndpoint(node, nodeEndpoint(node, s.Port))
 		peerCfgs[i] = wgtypes.PeerConfig{
 			PublicKey:         pubKey,
 			ReplaceAllowedIPs: true,
-			Endpoint: &net.UDPAddr{
-				IP:   node.Addr,
-				Port: s.Port,
-			},
-			AllowedIPs: append([]net.IPNet{node.OverlayAddr}, node.Routes...),
+			Endpoint:          endpoint,
+			AllowedIPs:        allowedIPs,
 			//AllowedIPs: []net.IPNet{
 			//	node.OverlayAddr,
 			//},
-			PersistentKeepaliveInterval: s.KeepaliveInterval,
+			PersistentKeepaliveInterval: s.peerKeepalive(node),
+		}
+		if s.Relay != nil {
+			if peerCfgs[i].Endpoint, err = s.Relay.Local(endpoint); err != nil {
+				return nil, errors.Wrapf(err, "could not relay wireguard traffic of %s", node.Name)
+			}
+		}
+		if logrus.IsLevelEnabled(logrus.TraceLevel) {
+			choice := endpointChoice(endpoint, nodeEndpoint(node, s.Port))
+			keepalive := "unset"
+			if interval := peerCfgs[i].PersistentKeepaliveInterval; interval != nil {
+				keepalive = interval.String()
+			}
+			logrus.Tracef("peer %s (%s): endpoint %s (%s), allowed IPs %v, keepalive %s", node.Name, pubKey, endpoint, choice, peerCfgs[i].AllowedIPs, keepalive)
 		}
 	}
 	return peerCfgs, nil
 }
 
+// endpointChoice describes whether the endpoint is the announced one or one the peer roamed to, for tracing
+func endpointChoice(endpoint, announced *net.UDPAddr) string {
+	if endpoint.String() == announced.String() {
+		return "announced"
+	}
+	return "roamed, announced " + announced.String()
+}
+
+// peerKeepalive provides the keepalive interval for the node; publicly routable nodes need no keepalives among each
+// other, so they are disabled explicitly if only NATed peers shall get them
+func (s *State) peerKeepalive(node common.Node) *time.Duration {
+	if s.KeepaliveNATOnly && !s.BehindNAT && !node.BehindNAT {
+		disabled := time.Duration(0)
+		return &disabled
+	}
+	return s.KeepaliveInterval
+}
+
+// peerChanges provides the peer configurations differing from the ones currently applied, including removals of
+// peers no longer present, so large clusters only send the changed peers to the device.
+// Without known applied configurations (i.e. on first setup), all peers are provided and must replace existing ones.
+func (s *State) peerChanges(peerCfgs []wgtypes.PeerConfig) ([]wgtypes.PeerConfig, bool, map[wgtypes.Key]string) {
+	applied := make(map[wgtypes.Key]string, len(peerCfgs))
+	for _, peerCfg := range peerCfgs {
+		keepalive := time.Duration(0)
+		if peerCfg.PersistentKeepaliveInterval != nil {
+			keepalive = *peerCfg.PersistentKeepaliveInterval
+		}
+		applied[peerCfg.PublicKey] = fmt.Sprintf("%s %v %s", peerCfg.Endpoint, peerCfg.AllowedIPs, keepalive)
+	}
+	if s.peers == nil {
+		logrus.Tracef("replacing all peers, since the device state is unknown")
+		return peerCfgs, true, applied
+	}
+
+	changes := make([]wgtypes.PeerConfig, 0)
+	for _, peerCfg := range peerCfgs {
+		current, ok := s.peers[peerCfg.PublicKey]
+		switch {
+		case !ok:
+			logrus.Tracef("adding peer %s: %s", peerCfg.PublicKey, applied[peerCfg.PublicKey])
+		case current != applied[peerCfg.PublicKey]:
+			logrus.Tracef("updating peer %s: %s -> %s", peerCfg.PublicKey, current, applied[peerCfg.PublicKey])
+		default:
+			continue
+		}
+		changes = append(changes, peerCfg)
+	}
+	for key := range s.peers {
+		if _, ok := applied[key]; !ok {
+			logrus.Tracef("removing peer %s, which is no longer a member", key)
+			changes = append(changes, wgtypes.PeerConfig{PublicKey: key, Remove: true})
+		}
+	}
+	return changes, false, applied
+}
+
+// viaRoute provides the route to a network announced by a node
+// Routes of the overlay address family are routed via the node's overlay address; routes of the other family cannot
+// use it as gateway and are routed via the device instead, leaving the peer selection to wireguard's allowed IPs.
+func viaRoute(linkIndex int, dst net.IPNet, gw net.IP) netlink.Route {
+	if (dst.IP.To4() == nil) != (gw.To4() == nil) {
+		return netlink.Route{
+			LinkIndex: linkIndex,
+			Dst:       &dst,
+			Scope:     netlink.SCOPE_UNIVERSE,
+		}
+	}
+	scope := netlink.SCOPE_SITE
+	if dst.IP.To4() == nil {
+		scope = netlink.SCOPE_UNIVERSE // IPv6 routes have no scope
+	}
+	return netlink.Route{
+		LinkIndex: linkIndex,
+		Dst:       &dst,
+		Gw:        gw,
+		Scope:     scope,
+	}
+}
+
 func matchRoute(set []netlink.Route, needle netlink.Route) *netlink.Route {
 	// routes are considered equal if they overlap and have the same prefix length
 	prefixn, _ := needle.Dst.Mask.Size()
@@ -1,9 +1,18 @@
 package wg
 
 import (
+	"io/ioutil"
 	"net"
+	"os"
+	"path"
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/costela/wesher/common"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 func Test_State_AssignOverlayAddr(t *testing.T) {
@@ -79,3 +88,529 @@ func Test_State_AssignOverlayAddr_repeatable(t *testing.T) {
 		t.Errorf("assignOverlayAddr() %s != %s", gen1, gen2)
 	}
 }
+
+func Test_viaRoute(t *testing.T) {
+	tests := []struct {
+		name   string
+		dst    string
+		gw     string
+		wantGw string
+	}{
+		{"ipv4 route via ipv4 overlay", "192.168.0.0/24", "10.1.2.3", "10.1.2.3"},
+		{"ipv6 route via ipv6 overlay", "2001:db8:1::/48", "fd00::1", "fd00::1"},
+		{"ipv6 route via ipv4 overlay", "2001:db8:1::/48", "10.1.2.3", "<nil>"},
+		{"ipv4 route via ipv6 overlay", "192.168.0.0/24", "fd00::1", "<nil>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, dst, _ := net.ParseCIDR(tt.dst)
+			route := viaRoute(1, *dst, net.ParseIP(tt.gw))
+			if route.Gw.String() != tt.wantGw {
+				t.Errorf("viaRoute() gateway = %s, want %s", route.Gw, tt.wantGw)
+			}
+			if route.Dst.String() != tt.dst {
+				t.Errorf("viaRoute() destination = %s, want %s", route.Dst, tt.dst)
+			}
+		})
+	}
+}
+
+func Test_u32Keys(t *testing.T) {
+	tests := []struct {
+		network      string
+		wantProtocol uint16
+		wantKeys     []netlink.TcU32Key
+	}{
+		{"10.1.2.3/32", unix.ETH_P_IP, []netlink.TcU32Key{{Mask: 0xffffffff, Val: 0x0a010203, Off: 16}}},
+		{"192.168.0.0/16", unix.ETH_P_IP, []netlink.TcU32Key{{Mask: 0xffff0000, Val: 0xc0a80000, Off: 16}}},
+		{"2001:db8:1::/48", unix.ETH_P_IPV6, []netlink.TcU32Key{
+			{Mask: 0xffffffff, Val: 0x20010db8, Off: 24},
+			{Mask: 0xffff0000, Val: 0x00010000, Off: 28},
+		}},
+		{"0.0.0.0/0", unix.ETH_P_IP, []netlink.TcU32Key{{}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.network, func(t *testing.T) {
+			_, network, _ := net.ParseCIDR(tt.network)
+			protocol, keys := u32Keys(*network)
+			if protocol != tt.wantProtocol {
+				t.Errorf("u32Keys() protocol = %#x, want %#x", protocol, tt.wantProtocol)
+			}
+			if !reflect.DeepEqual(keys, tt.wantKeys) {
+				t.Errorf("u32Keys() keys = %+v, want %+v", keys, tt.wantKeys)
+			}
+		})
+	}
+}
+
+func Test_State_peerLimits(t *testing.T) {
+	s := &State{PeerEgressLimit: 20000000}
+	nodes := make([]common.Node, 2)
+	nodes[0].PubKey, nodes[0].IngressLimit = "b", 5000000
+	nodes[1].PubKey = "a"
+	limits := s.peerLimits(nodes)
+	if len(limits) != 2 || limits[0].rate != 20000000 || limits[1].rate != 5000000 {
+		t.Errorf("peerLimits() = %+v, want a limited to 20000000 and b to 5000000", limits)
+	}
+
+	s.PeerEgressLimit = 0
+	if limits := s.peerLimits(nodes); len(limits) != 1 || limits[0].rate != 5000000 {
+		t.Errorf("peerLimits() = %+v, want only b limited to 5000000", limits)
+	}
+}
+
+func Test_State_peerChanges(t *testing.T) {
+	keys := make([]wgtypes.Key, 3)
+	for i := range keys {
+		key, _ := wgtypes.GeneratePrivateKey()
+		keys[i] = key.PublicKey()
+	}
+	peer := func(key wgtypes.Key, ip string) wgtypes.PeerConfig {
+		return wgtypes.PeerConfig{
+			PublicKey:  key,
+			Endpoint:   &net.UDPAddr{IP: net.ParseIP(ip), Port: 51820},
+			AllowedIPs: []net.IPNet{{IP: net.ParseIP("10.0.0.1"), Mask: net.CIDRMask(32, 32)}},
+		}
+	}
+
+	s := &State{}
+	changes, replace, applied := s.peerChanges([]wgtypes.PeerConfig{peer(keys[0], "192.0.2.1"), peer(keys[1], "192.0.2.2")})
+	if !replace || len(changes) != 2 {
+		t.Fatalf("peerChanges() on first setup = %d changes, replace %v; want all peers replaced", len(changes), replace)
+	}
+	s.peers = applied
+
+	changes, replace, _ = s.peerChanges([]wgtypes.PeerConfig{peer(keys[0], "192.0.2.1"), peer(keys[1], "192.0.2.2")})
+	if replace || len(changes) != 0 {
+		t.Errorf("peerChanges() without changes = %v, replace %v; want none", changes, replace)
+	}
+
+	changes, replace, _ = s.peerChanges([]wgtypes.PeerConfig{peer(keys[0], "192.0.2.10"), peer(keys[2], "192.0.2.3")})
+	if replace || len(changes) != 3 {
+		t.Fatalf("peerChanges() = %v, replace %v; want 3 incremental changes", changes, replace)
+	}
+	got := map[wgtypes.Key]bool{}
+	for _, change := range changes {
+		got[change.PublicKey] = change.Remove
+	}
+	if want := map[wgtypes.Key]bool{keys[0]: false, keys[1]: true, keys[2]: false}; !reflect.DeepEqual(got, want) {
+		t.Errorf("peerChanges() removals = %v, want %v", got, want)
+	}
+}
+
+func Benchmark_State_peerChanges(b *testing.B) {
+	peerCfgs := make([]wgtypes.PeerConfig, 1000)
+	for i := range peerCfgs {
+		key, _ := wgtypes.GeneratePrivateKey()
+		peerCfgs[i] = wgtypes.PeerConfig{
+			PublicKey:  key.PublicKey(),
+			Endpoint:   &net.UDPAddr{IP: net.IPv4(192, 0, byte(i/256), byte(i%256)), Port: 51820},
+			AllowedIPs: []net.IPNet{{IP: net.IPv4(10, 0, byte(i/256), byte(i%256)), Mask: net.CIDRMask(32, 32)}},
+		}
+	}
+	s := &State{}
+	_, _, s.peers = s.peerChanges(peerCfgs)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.peerChanges(peerCfgs)
+	}
+}
+
+func Test_staleRoutes_staleAddrs(t *testing.T) {
+	network := func(cidr string) *net.IPNet {
+		_, n, _ := net.ParseCIDR(cidr)
+		return n
+	}
+	current := []netlink.Route{
+		{Dst: network("10.0.0.2/32")},
+		{Dst: network("10.0.0.3/32")},                               // node gone during the crash
+		{Dst: network("10.0.0.0/24"), Protocol: unix.RTPROT_KERNEL}, // maintained by the kernel
+		{Dst: network("fe80::/64")},
+	}
+	desired := []netlink.Route{{Dst: network("10.0.0.2/32")}, {Dst: network("192.168.0.0/24")}}
+	if got := staleRoutes(current, desired); len(got) != 1 || got[0].Dst.String() != "10.0.0.3/32" {
+		t.Errorf("staleRoutes() = %v, want only 10.0.0.3/32", got)
+	}
+
+	overlay := net.IPNet{IP: net.ParseIP("10.0.0.1").To4(), Mask: net.CIDRMask(32, 32)}
+	addrs := []netlink.Addr{
+		{IPNet: &overlay},
+		{IPNet: &net.IPNet{IP: net.ParseIP("10.0.0.9").To4(), Mask: net.CIDRMask(32, 32)}}, // previous overlay address
+		{IPNet: &net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)}},
+	}
+	if got := staleAddrs(addrs, overlay); len(got) != 1 || got[0].IP.String() != "10.0.0.9" {
+		t.Errorf("staleAddrs() = %v, want only 10.0.0.9", got)
+	}
+}
+
+func Test_routeChanges(t *testing.T) {
+	network := func(cidr string) *net.IPNet {
+		_, n, _ := net.ParseCIDR(cidr)
+		return n
+	}
+	dsts := func(routes []netlink.Route) []string {
+		result := []string{}
+		for _, route := range routes {
+			result = append(result, route.Dst.String())
+		}
+		return result
+	}
+	applied := routesByDst([]netlink.Route{
+		{Dst: network("10.0.0.2/32")},
+		{Dst: network("10.0.0.3/32")},
+		{Dst: network("192.168.0.0/24"), Gw: net.ParseIP("10.0.0.2")},
+	})
+	desired := []netlink.Route{
+		{Dst: network("10.0.0.2/32")},
+		{Dst: network("10.0.0.4/32")},                                 // joined
+		{Dst: network("192.168.0.0/24"), Gw: net.ParseIP("10.0.0.4")}, // moved
+		{Dst: network("192.168.1.0/24"), Gw: net.ParseIP("10.0.0.4")}, // announced
+	}
+	add, replace, remove := routeChanges(applied, desired)
+	if got, want := dsts(add), []string{"10.0.0.4/32", "192.168.1.0/24"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("routeChanges() added %v, want %v in desired order", got, want)
+	}
+	if got, want := dsts(replace), []string{"192.168.0.0/24"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("routeChanges() replaced %v, want %v", got, want)
+	}
+	if got, want := dsts(remove), []string{"10.0.0.3/32"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("routeChanges() removed %v, want %v", got, want)
+	}
+	if add, replace, remove := routeChanges(routesByDst(desired), desired); len(add)+len(replace)+len(remove) != 0 {
+		t.Errorf("routeChanges() of applied routes = %v, %v, %v; want none", add, replace, remove)
+	}
+}
+
+func Test_interfaceMismatches(t *testing.T) {
+	_, overlayNet, _ := net.ParseCIDR("10.0.0.0/8")
+	ownKey, _ := wgtypes.GeneratePrivateKey()
+	foreignKey, _ := wgtypes.GeneratePrivateKey()
+	host := func(ip string) net.IPNet {
+		return net.IPNet{IP: net.ParseIP(ip).To4(), Mask: net.CIDRMask(32, 32)}
+	}
+	_, routed, _ := net.ParseCIDR("192.168.0.0/24")
+	peers := []wgtypes.Peer{
+		{PublicKey: ownKey.PublicKey(), AllowedIPs: []net.IPNet{host("10.0.0.2"), *routed}},
+		{PublicKey: foreignKey.PublicKey(), AllowedIPs: []net.IPNet{host("172.16.0.2")}},
+	}
+
+	if got := interfaceMismatches([]net.IPNet{host("10.0.0.1")}, peers[:1], overlayNet); len(got) != 0 {
+		t.Errorf("interfaceMismatches() = %v, want none", got)
+	}
+	if got := interfaceMismatches([]net.IPNet{host("172.16.0.1")}, peers, overlayNet); len(got) != 2 {
+		t.Errorf("interfaceMismatches() = %v, want the address and the foreign peer", got)
+	}
+}
+
+func Test_AddressStrategies(t *testing.T) {
+	_, ipnet, _ := net.ParseCIDR("10.0.0.0/30")
+	used := []net.IP{net.ParseIP("10.0.0.1").To4()}
+
+	if ip, err := (Sequential{}).Assign(ipnet, "test", used); err != nil || ip.String() != "10.0.0.2" {
+		t.Errorf("Sequential.Assign() = %s, %v; want 10.0.0.2", ip, err)
+	}
+	used = append(used, net.ParseIP("10.0.0.2").To4())
+	if ip, err := (Sequential{}).Assign(ipnet, "test", used); err == nil {
+		t.Errorf("Sequential.Assign() = %s, should fail without free addresses (broadcast excluded)", ip)
+	}
+
+	key, _ := wgtypes.GeneratePrivateKey()
+	hashPubKey := HashPubKey{PubKey: key.PublicKey()}
+	ip1, _ := hashPubKey.Assign(ipnet, "test", nil)
+	ip2, _ := hashPubKey.Assign(ipnet, "other", nil)
+	if !ip1.Equal(ip2) || !ipnet.Contains(ip1) {
+		t.Errorf("HashPubKey.Assign() = %s and %s, want the same address inside %s regardless of the name", ip1, ip2, ipnet)
+	}
+
+	dir, err := ioutil.TempDir("", "wesher-addrs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "addrs")
+	if err := ioutil.WriteFile(file, []byte("# static addresses\nnode1 10.0.0.1\n\nnode2   192.168.0.1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := LoadStaticAddrs(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	static := Static{Addrs: addrs}
+	if ip, err := static.Assign(ipnet, "node1", nil); err != nil || ip.String() != "10.0.0.1" {
+		t.Errorf("Static.Assign() = %s, %v; want 10.0.0.1", ip, err)
+	}
+	if _, err := static.Assign(ipnet, "node2", nil); err == nil {
+		t.Error("Static.Assign() should refuse addresses outside of the overlay network")
+	}
+	if _, err := static.Assign(ipnet, "node3", nil); err == nil {
+		t.Error("Static.Assign() should fail for unlisted nodes")
+	}
+}
+
+func Test_AddressStrategies_reserved(t *testing.T) {
+	_, ipnet, _ := net.ParseCIDR("10.0.0.0/24")
+	_, low, _ := net.ParseCIDR("10.0.0.0/28")
+	_, all, _ := net.ParseCIDR("10.0.0.0/25")
+
+	if ip, err := (Sequential{Reserved: []*net.IPNet{low}}).Assign(ipnet, "test", nil); err != nil || ip.String() != "10.0.0.16" {
+		t.Errorf("Sequential.Assign() = %s, %v; want the first address after the reserved range", ip, err)
+	}
+
+	unreserved, _ := HashName{}.Assign(ipnet, "test", nil)
+	_, own, _ := net.ParseCIDR(unreserved.String() + "/32")
+	ip, err := HashName{Reserved: []*net.IPNet{own}}.Assign(ipnet, "test", nil)
+	if err != nil || ip.Equal(unreserved) || !ipnet.Contains(ip) {
+		t.Errorf("HashName.Assign() = %s, %v; want another address than the reserved %s", ip, err, unreserved)
+	}
+	if ip, err := (HashName{Reserved: []*net.IPNet{all}}).Assign(ipnet, "test", nil); err != nil || all.Contains(ip) {
+		t.Errorf("HashName.Assign() = %s, %v; want an address outside of %s", ip, err, all)
+	}
+
+	if last := lastAddr(low); last.String() != "10.0.0.15" {
+		t.Errorf("lastAddr() = %s, want 10.0.0.15", last)
+	}
+}
+
+func Test_AssignPrefix(t *testing.T) {
+	_, ipnet, _ := net.ParseCIDR("fd00:10::/48")
+	prefix := AssignPrefix(ipnet, 64, []byte("test"))
+	if ones, _ := prefix.Mask.Size(); ones != 64 || !ipnet.Contains(prefix.IP) {
+		t.Errorf("AssignPrefix() = %s, want a /64 inside %s", &prefix, ipnet)
+	}
+	if !prefix.IP.Equal(prefix.IP.Mask(prefix.Mask)) {
+		t.Errorf("AssignPrefix() = %s has host bits set", &prefix)
+	}
+	if again := AssignPrefix(ipnet, 64, []byte("test")); again.String() != prefix.String() {
+		t.Errorf("AssignPrefix() = %s, then %s for the same data", &prefix, &again)
+	}
+	if other := AssignPrefix(ipnet, 64, []byte("test1")); other.String() == prefix.String() {
+		t.Errorf("AssignPrefix() = %s for different data", &other)
+	}
+}
+
+func Test_nodeEndpoint(t *testing.T) {
+	node := common.Node{Addr: net.ParseIP("10.10.0.1")}
+	if got := nodeEndpoint(node, 51820).String(); got != "10.10.0.1:51820" {
+		t.Errorf("nodeEndpoint() = %s, want the cluster address and local port", got)
+	}
+	node.Endpoint = net.ParseIP("192.0.2.1")
+	if got := nodeEndpoint(node, 51820).String(); got != "192.0.2.1:51820" {
+		t.Errorf("nodeEndpoint() = %s, want the announced endpoint", got)
+	}
+	node.EndpointPort = 31820
+	if got := nodeEndpoint(node, 51820).String(); got != "192.0.2.1:31820" {
+		t.Errorf("nodeEndpoint() = %s, want the announced endpoint port", got)
+	}
+}
+
+func Test_endpointChoice(t *testing.T) {
+	node := common.Node{Addr: net.ParseIP("10.10.0.1")}
+	if got := endpointChoice(nodeEndpoint(node, 51820), nodeEndpoint(node, 51820)); got != "announced" {
+		t.Errorf("endpointChoice() = %q for the announced endpoint, want announced", got)
+	}
+	roamed := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+	if got := endpointChoice(roamed, nodeEndpoint(node, 51820)); got != "roamed, announced 10.10.0.1:51820" {
+		t.Errorf("endpointChoice() = %q for a roamed endpoint, want roamed", got)
+	}
+}
+
+func Test_State_peerKeepalive(t *testing.T) {
+	interval := 30 * time.Second
+	tests := []struct {
+		name                   string
+		natOnly, local, remote bool
+		want                   time.Duration
+	}{
+		{"always", false, false, false, interval},
+		{"nat only between public nodes", true, false, false, 0},
+		{"nat only to nated node", true, false, true, interval},
+		{"nat only from nated node", true, true, false, interval},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &State{KeepaliveInterval: &interval, KeepaliveNATOnly: tt.natOnly, BehindNAT: tt.local}
+			node := common.Node{}
+			node.BehindNAT = tt.remote
+			if got := s.peerKeepalive(node); got == nil || *got != tt.want {
+				t.Errorf("peerKeepalive() = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_roamedEndpoints(t *testing.T) {
+	now := time.Now()
+	keys := make([]wgtypes.Key, 4)
+	nodes := make([]common.Node, 4)
+	for i := range keys {
+		key, _ := wgtypes.GeneratePrivateKey()
+		keys[i] = key.PublicKey()
+		nodes[i] = common.Node{Addr: net.IPv4(192, 0, 2, byte(i+1))}
+		nodes[i].PubKey = keys[i].String()
+	}
+	roamedTo := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 4000}
+	gossiped := &net.UDPAddr{IP: net.ParseIP("203.0.113.3"), Port: 5000}
+	nodes[0].Roamed = map[string]*net.UDPAddr{keys[2].String(): gossiped}
+	peers := []wgtypes.Peer{
+		{PublicKey: keys[0], Endpoint: roamedTo, LastHandshakeTime: now.Add(-time.Minute)},
+		{PublicKey: keys[1], Endpoint: &net.UDPAddr{IP: net.ParseIP("198.51.100.2"), Port: 4000}, LastHandshakeTime: now.Add(-time.Hour)},
+		{PublicKey: keys[2]},
+		{PublicKey: keys[3]},
+	}
+	previous := map[string]roamed{
+		keys[1].String(): {announced: "192.0.2.2:51820", endpoint: peers[1].Endpoint, observed: true},
+		keys[3].String(): {announced: "192.0.2.100:51820", endpoint: roamedTo, observed: true}, // announces another one by now
+	}
+
+	got := roamedEndpoints(previous, nodes, peers, 51820, false, now)
+	want := map[string]roamed{
+		keys[0].String(): {announced: "192.0.2.1:51820", endpoint: roamedTo, observed: true},
+		keys[1].String(): previous[keys[1].String()],
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("roamedEndpoints() = %v, want %v", got, want)
+	}
+
+	got = roamedEndpoints(previous, nodes, peers, 51820, true, now)
+	want[keys[2].String()] = roamed{announced: "192.0.2.3:51820", endpoint: gossiped}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("roamedEndpoints() adopting gossip = %v, want %v", got, want)
+	}
+
+	s := &State{roamed: got}
+	if endpoint := s.roamedEndpoint(nodes[2], nodeEndpoint(nodes[2], 51820)); endpoint != gossiped {
+		t.Errorf("roamedEndpoint() = %s, want %s", endpoint, gossiped)
+	}
+	if endpoint := s.roamedEndpoint(nodes[3], nodeEndpoint(nodes[3], 51820)); endpoint.String() != "192.0.2.4:51820" {
+		t.Errorf("roamedEndpoint() = %s, want the announced endpoint", endpoint)
+	}
+}
+
+func Test_State_SetUpInterface_fake(t *testing.T) {
+	_, overlayNet, _ := net.ParseCIDR("10.0.0.0/8")
+	backend := NewFake()
+	s, _, err := New(backend, "wgtest", 51820, 1420, overlayNet, "local", nil, "")
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	peerKey, _ := wgtypes.GeneratePrivateKey()
+	node := common.Node{Name: "peer", Addr: net.ParseIP("192.0.2.1")}
+	node.PubKey = peerKey.PublicKey().String()
+	node.OverlayAddr = net.IPNet{IP: net.ParseIP("10.0.0.2").To4(), Mask: net.CIDRMask(32, 32)}
+
+	if err := s.SetUpInterface([]common.Node{node}, nil); err != nil {
+		t.Fatalf("SetUpInterface() error = %v", err)
+	}
+	if addr, mtu, ok := backend.Addr("wgtest"); !ok || addr.String() != s.OverlayAddr.String() || mtu != 1420 {
+		t.Errorf("device address = %s, MTU %d (exists: %t), want %s, MTU 1420", addr.String(), mtu, ok, s.OverlayAddr.String())
+	}
+	peers, err := s.Peers()
+	if err != nil {
+		t.Fatalf("Peers() error = %v", err)
+	}
+	if len(peers) != 1 || peers[0].PublicKey != peerKey.PublicKey() || peers[0].Endpoint.String() != "192.0.2.1:51820" {
+		t.Errorf("Peers() = %v, want %s at 192.0.2.1:51820", peers, peerKey.PublicKey())
+	}
+
+	if err := s.SetUpInterface(nil, nil); err != nil {
+		t.Fatalf("SetUpInterface() error = %v", err)
+	}
+	if peers, _ := s.Peers(); len(peers) != 0 {
+		t.Errorf("Peers() = %v after the node left, want none", peers)
+	}
+
+	if err := s.DownInterface(); err != nil {
+		t.Fatalf("DownInterface() error = %v", err)
+	}
+	if _, err := backend.Stats("wgtest"); !os.IsNotExist(err) {
+		t.Errorf("Stats() error = %v after DownInterface(), want not existing", err)
+	}
+	if err := s.DownInterface(); err != nil {
+		t.Errorf("DownInterface() error = %v on removed device, want none", err)
+	}
+}
+
+func Test_State_nodesToPeerConfigs_strict(t *testing.T) {
+	peerKey, _ := wgtypes.GeneratePrivateKey()
+	node := common.Node{Name: "peer", Addr: net.ParseIP("192.0.2.1")}
+	node.PubKey = peerKey.PublicKey().String()
+	node.OverlayAddr = net.IPNet{IP: net.ParseIP("10.0.0.2").To4(), Mask: net.CIDRMask(8, 32)} // claiming the whole overlay network
+	_, routed, _ := net.ParseCIDR("192.168.1.0/24")
+	node.Routes = []net.IPNet{*routed}
+
+	s := &State{}
+	cfgs, err := s.nodesToPeerConfigs([]common.Node{node})
+	if err != nil {
+		t.Fatalf("nodesToPeerConfigs() error = %v", err)
+	}
+	if got := cfgs[0].AllowedIPs; len(got) != 2 {
+		t.Errorf("nodesToPeerConfigs() allowed IPs = %v, want the overlay address and the route", got)
+	}
+
+	s.StrictAllowedIPs = true
+	if cfgs, err = s.nodesToPeerConfigs([]common.Node{node}); err != nil {
+		t.Fatalf("nodesToPeerConfigs() error = %v", err)
+	}
+	if got := cfgs[0].AllowedIPs; len(got) != 1 || got[0].String() != "10.0.0.2/32" {
+		t.Errorf("nodesToPeerConfigs() allowed IPs = %v in strict mode, want only 10.0.0.2/32", got)
+	}
+}
+
+func Test_LoadExternalPeers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wesher-external")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, _ := wgtypes.GeneratePrivateKey()
+	pubKey := key.PublicKey().String()
+	file := path.Join(dir, "peers")
+	content := "# concentrator and phone\nvpn " + pubKey + " 192.168.100.0/24,10.99.0.1/32 192.0.2.1:51820\n\nphone " + pubKey + " 10.99.0.2/32\n"
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	peers, err := LoadExternalPeers(file)
+	if err != nil {
+		t.Fatalf("LoadExternalPeers() error = %v", err)
+	}
+	if len(peers) != 2 || peers[0].Name != "vpn" || peers[0].Endpoint.String() != "192.0.2.1:51820" || peers[1].Endpoint != nil {
+		t.Fatalf("LoadExternalPeers() = %v, want vpn with endpoint and phone without", peers)
+	}
+	networks := ExternalNetworks(peers)
+	if len(networks) != 3 || networks[0].String() != "192.168.100.0/24" || networks[2].String() != "10.99.0.2/32" {
+		t.Errorf("ExternalNetworks() = %v, want the allowed IPs of both peers", networks)
+	}
+
+	s := &State{ExternalPeers: peers}
+	s.ExternalPeers[0].Endpoint = nil
+	if err := s.ResolveExternalEndpoints(); err != nil || s.ExternalPeers[0].Endpoint.String() != "192.0.2.1:51820" || s.ExternalPeers[1].Endpoint != nil {
+		t.Errorf("ResolveExternalEndpoints() = %v, endpoints %v and %v, want vpn resolved again", err, s.ExternalPeers[0].Endpoint, s.ExternalPeers[1].Endpoint)
+	}
+
+	if err := ioutil.WriteFile(file, []byte("vpn "+pubKey+" nonetwork\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadExternalPeers(file); err == nil {
+		t.Error("LoadExternalPeers() should fail on invalid allowed IPs")
+	}
+}
+
+func Test_State_SetUpInterface_external(t *testing.T) {
+	_, overlayNet, _ := net.ParseCIDR("10.0.0.0/8")
+	backend := NewFake()
+	s, _, err := New(backend, "wgtest", 51820, 1420, overlayNet, "local", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := wgtypes.GeneratePrivateKey()
+	_, allowed, _ := net.ParseCIDR("192.168.100.0/24")
+	s.ExternalPeers = []ExternalPeer{{Name: "vpn", PubKey: key.PublicKey(), AllowedIPs: []net.IPNet{*allowed}}}
+	if err := s.SetUpInterface(nil, nil); err != nil {
+		t.Fatalf("SetUpInterface() error = %v", err)
+	}
+	peers, _ := s.Peers()
+	if len(peers) != 1 || peers[0].PublicKey != key.PublicKey() || len(peers[0].AllowedIPs) != 1 || peers[0].AllowedIPs[0].String() != "192.168.100.0/24" {
+		t.Errorf("Peers() = %v, want the external peer", peers)
+	}
+}